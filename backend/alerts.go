@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+/* ===========================
+    Models for Environmental Alerts
+=========================== */
+
+// One point of an age-dependent band. Bounds between points are interpolated
+// linearly; before the first and after the last point the nearest one applies.
+type AlertBand struct {
+	AgeDays int      `json:"AgeDays"`
+	Min     *float64 `json:"Min"`
+	Max     *float64 `json:"Max"`
+}
+
+type AlertRule struct {
+	RuleID         int         `json:"RuleID"`
+	Name           string      `json:"Name"`
+	Metric         string      `json:"Metric"`  // temperature, humidity, gas or nh3
+	CageNum        *int        `json:"CageNum"` // nil applies to every cage
+	Severity       string      `json:"Severity"`
+	Bands          []AlertBand `json:"Bands"`
+	Hysteresis     float64     `json:"Hysteresis"`
+	MinDurationSec int         `json:"MinDurationSec"`
+	IsActive       bool        `json:"IsActive"`
+}
+
+type AlertRecord struct {
+	AlertID        int64    `json:"AlertID"`
+	RuleID         *int     `json:"RuleID"`
+	Type           string   `json:"Type"`
+	Severity       string   `json:"Severity"`
+	CageNum        *int     `json:"CageNum"`
+	BatchID        *int     `json:"BatchID"`
+	Source         *string  `json:"Source"` // gateway or sensor that raised it, for non-rule alerts
+	Metric         *string  `json:"Metric"`
+	Value          *float64 `json:"Value"`
+	Threshold      *float64 `json:"Threshold"`
+	Message        string   `json:"Message"`
+	Status         string   `json:"Status"`
+	RaisedAt       string   `json:"RaisedAt"`
+	AcknowledgedBy *string  `json:"AcknowledgedBy"`
+	AcknowledgedAt *string  `json:"AcknowledgedAt"`
+	ResolvedBy     *string  `json:"ResolvedBy"`
+	ResolvedAt     *string  `json:"ResolvedAt"`
+}
+
+const (
+	AlertOpen         = "Open"
+	AlertAcknowledged = "Acknowledged"
+	AlertResolved     = "Resolved"
+)
+
+var validAlertSeverities = map[string]bool{"info": true, "warning": true, "critical": true}
+
+// Per rule and cage: when the current breach started. Open alerts are kept in
+// the database so they survive a restart, and a rule seen for the first time
+// after a restart takes its breach start from the open alert's RaisedAt.
+type alertRuleState struct {
+	breachSince time.Time
+}
+
+var (
+	alertStateMu sync.Mutex
+	alertStates  = make(map[string]*alertRuleState) // "ruleID:cage" -> state
+)
+
+/* ===========================
+    Alert Helpers
+=========================== */
+
+// bounds returns the allowed min/max for a bird age; ageDays < 0 means no batch in the cage
+func (rule AlertRule) bounds(ageDays int) (min, max *float64) {
+	if len(rule.Bands) == 0 {
+		return nil, nil
+	}
+	if ageDays < 0 || ageDays <= rule.Bands[0].AgeDays {
+		return rule.Bands[0].Min, rule.Bands[0].Max
+	}
+	last := rule.Bands[len(rule.Bands)-1]
+	if ageDays >= last.AgeDays {
+		return last.Min, last.Max
+	}
+	for i := 1; i < len(rule.Bands); i++ {
+		a, b := rule.Bands[i-1], rule.Bands[i]
+		if ageDays > b.AgeDays {
+			continue
+		}
+		frac := float64(ageDays-a.AgeDays) / float64(b.AgeDays-a.AgeDays)
+		return interpolateBound(a.Min, b.Min, frac), interpolateBound(a.Max, b.Max, frac)
+	}
+	return last.Min, last.Max
+}
+
+func interpolateBound(a, b *float64, frac float64) *float64 {
+	if a == nil || b == nil {
+		if a != nil {
+			return a
+		}
+		return b
+	}
+	v := *a + (*b-*a)*frac
+	return &v
+}
+
+// raiseAlert persists a new open alert. Other subsystems (gateways, sensor health)
+// use it too, so it is the single place alerts are created.
+func raiseAlert(ctx context.Context, a AlertRecord) (int64, error) {
+	query := `
+		INSERT INTO cm_alerts (RuleID, Type, Severity, CageNum, BatchID, Source, Metric, Value, Threshold, Message, Status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 'Open')`
+	res, err := db.ExecContext(ctx, query, a.RuleID, a.Type, a.Severity, a.CageNum, a.BatchID, a.Source, a.Metric, a.Value, a.Threshold, a.Message)
+	if err != nil {
+		return 0, err
+	}
+	alertID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	a.AlertID, a.Status = alertID, AlertOpen
+	publishLive("alert", alertTopic(a.CageNum), a)
+	notifyAlertAsync(alertID)
+	return alertID, nil
+}
+
+func alertTopic(cageNum *int) string {
+	if cageNum == nil {
+		return "farm"
+	}
+	return cageTopic(*cageNum)
+}
+
+// publishAlertStatus tells live clients an alert was acknowledged or resolved
+func publishAlertStatus(ctx context.Context, alertID int64) {
+	var cageNum *int
+	var status string
+	if err := db.QueryRowContext(ctx, "SELECT CageNum, Status FROM cm_alerts WHERE AlertID = ?", alertID).Scan(&cageNum, &status); err != nil {
+		return
+	}
+	publishLive("alert", alertTopic(cageNum), map[string]interface{}{"AlertID": alertID, "Status": status})
+}
+
+// resolveAlert closes an alert that is still open or acknowledged; false if there was none
+func resolveAlert(ctx context.Context, alertID int64, resolvedBy string) (bool, error) {
+	query := "UPDATE cm_alerts SET Status = 'Resolved', ResolvedBy = ?, ResolvedAt = NOW() WHERE AlertID = ? AND Status <> 'Resolved'"
+	res, err := db.ExecContext(ctx, query, resolvedBy, alertID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	if n > 0 {
+		publishAlertStatus(ctx, alertID)
+	}
+	return n > 0, nil
+}
+
+// openAlertFor returns the unresolved alert raised by a rule for a cage and when it
+// was raised, if there is one
+func openAlertFor(ctx context.Context, ruleID, cageNum int) (int64, time.Time, error) {
+	var alertID int64
+	var raisedAt string
+	query := "SELECT AlertID, RaisedAt FROM cm_alerts WHERE RuleID = ? AND CageNum = ? AND Status <> 'Resolved' ORDER BY AlertID DESC LIMIT 1"
+	err := db.QueryRowContext(ctx, query, ruleID, cageNum).Scan(&alertID, &raisedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, time.Time{}, nil
+	}
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	raised, err := time.ParseInLocation(sqlDateTime, raisedAt, time.Local)
+	return alertID, raised, err
+}
+
+func loadAlertRules(ctx context.Context, cageNum *int, activeOnly bool) ([]AlertRule, error) {
+	query := "SELECT RuleID, Name, Metric, CageNum, Severity, Bands, Hysteresis, MinDurationSec, IsActive FROM cm_alert_rules WHERE 1=1"
+	var args []interface{}
+	if cageNum != nil {
+		query += " AND (CageNum IS NULL OR CageNum = ?)"
+		args = append(args, *cageNum)
+	}
+	if activeOnly {
+		query += " AND IsActive = 1"
+	}
+	query += " ORDER BY RuleID"
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []AlertRule{}
+	for rows.Next() {
+		var rule AlertRule
+		var bands string
+		if err := rows.Scan(&rule.RuleID, &rule.Name, &rule.Metric, &rule.CageNum, &rule.Severity, &bands, &rule.Hysteresis, &rule.MinDurationSec, &rule.IsActive); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(bands), &rule.Bands); err != nil {
+			return nil, fmt.Errorf("rule %d has invalid bands: %w", rule.RuleID, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// evaluateAlertRules checks a fresh reading against the rules for its cage. A
+// breach must last MinDurationSec before an alert is raised, and the value must
+// come back inside the band by Hysteresis before the alert resolves itself.
+func evaluateAlertRules(ctx context.Context, cageNum int, batchID *int, values map[string]float64) {
+	rules, err := loadAlertRules(ctx, &cageNum, true)
+	if err != nil {
+		log.Printf("[ERROR] Failed to load alert rules: %v", err)
+		return
+	}
+	if len(rules) == 0 {
+		return
+	}
+
+	ageDays := -1
+	if batchID != nil {
+		var startDate string
+		if err := db.QueryRowContext(ctx, "SELECT StartDate FROM cm_batches WHERE BatchID = ?", *batchID).Scan(&startDate); err == nil {
+			if start, err := time.Parse("2006-01-02", startDate); err == nil {
+				ageDays = int(time.Since(start).Hours() / 24)
+			}
+		}
+	}
+
+	now := time.Now()
+	for _, rule := range rules {
+		value, ok := values[rule.Metric]
+		if !ok {
+			continue
+		}
+		// age curves need a bird age; a flat rule applies to empty cages as well
+		if ageDays < 0 && len(rule.Bands) > 1 {
+			continue
+		}
+		min, max := rule.bounds(ageDays)
+
+		var threshold *float64
+		direction := ""
+		switch {
+		case max != nil && value > *max:
+			threshold, direction = max, "high"
+		case min != nil && value < *min:
+			threshold, direction = min, "low"
+		}
+		cleared := (max == nil || value <= *max-rule.Hysteresis) && (min == nil || value >= *min+rule.Hysteresis)
+
+		openID, raisedAt, err := openAlertFor(ctx, rule.RuleID, cageNum)
+		if err != nil {
+			log.Printf("[ERROR] Failed to look up open alert: %v", err)
+			continue
+		}
+
+		key := fmt.Sprintf("%d:%d", rule.RuleID, cageNum)
+		alertStateMu.Lock()
+		state, ok := alertStates[key]
+		if !ok {
+			state = &alertRuleState{}
+			if openID != 0 {
+				state.breachSince = raisedAt
+			}
+			alertStates[key] = state
+		}
+		if direction == "" {
+			state.breachSince = time.Time{}
+		} else if state.breachSince.IsZero() {
+			state.breachSince = now
+		}
+		breachFor := now.Sub(state.breachSince)
+		alertStateMu.Unlock()
+
+		switch {
+		case direction != "" && openID == 0 && breachFor >= time.Duration(rule.MinDurationSec)*time.Second:
+			ruleID, cage, metric, v := rule.RuleID, cageNum, rule.Metric, value
+			a := AlertRecord{
+				RuleID:    &ruleID,
+				Type:      rule.Metric + "_" + direction,
+				Severity:  rule.Severity,
+				CageNum:   &cage,
+				BatchID:   batchID,
+				Metric:    &metric,
+				Value:     &v,
+				Threshold: threshold,
+				Message:   fmt.Sprintf("Cage %d %s is %s: %.1f (limit %.1f) - %s", cageNum, rule.Metric, direction, value, *threshold, rule.Name),
+			}
+			if _, err := raiseAlert(ctx, a); err != nil {
+				log.Printf("[ERROR] Failed to raise alert: %v", err)
+			}
+		case direction == "" && cleared && openID != 0:
+			if _, err := resolveAlert(ctx, openID, "system"); err != nil {
+				log.Printf("[ERROR] Failed to resolve alert: %v", err)
+			}
+		}
+		if openID != 0 {
+			if _, err := db.ExecContext(ctx, "UPDATE cm_alerts SET Value = ? WHERE AlertID = ?", value, openID); err != nil {
+				log.Printf("[ERROR] Failed to update value of alert %d: %v", openID, err)
+			}
+		}
+	}
+}
+
+// openAlertsForDashboard returns unresolved alerts in the shape of the dashboard Alerts panel
+func openAlertsForDashboard(ctx context.Context) ([]Alert, error) {
+	query := `
+		SELECT Severity, Message, Status FROM cm_alerts
+		WHERE Status <> 'Resolved'
+		ORDER BY FIELD(Severity, 'critical', 'warning', 'info'), RaisedAt DESC
+		LIMIT 20`
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := []Alert{}
+	for rows.Next() {
+		var severity, message, status string
+		if err := rows.Scan(&severity, &message, &status); err != nil {
+			return nil, err
+		}
+		if status == AlertAcknowledged {
+			message += " (acknowledged)"
+		}
+		alerts = append(alerts, Alert{Type: severity, Message: message})
+	}
+	return alerts, rows.Err()
+}
+
+func validateAlertRule(w http.ResponseWriter, rule *AlertRule) bool {
+	if rule.Name == "" {
+		handleError(w, http.StatusBadRequest, "Name is required", nil)
+		return false
+	}
+	if _, ok := telemetryMetrics[rule.Metric]; !ok {
+		handleError(w, http.StatusBadRequest, "Unknown metric; use temperature, humidity, gas or nh3", nil)
+		return false
+	}
+	if rule.Severity == "" {
+		rule.Severity = "warning"
+	}
+	if !validAlertSeverities[rule.Severity] {
+		handleError(w, http.StatusBadRequest, "Severity must be info, warning or critical", nil)
+		return false
+	}
+	if len(rule.Bands) == 0 {
+		handleError(w, http.StatusBadRequest, "At least one band is required", nil)
+		return false
+	}
+	sort.Slice(rule.Bands, func(i, j int) bool { return rule.Bands[i].AgeDays < rule.Bands[j].AgeDays })
+	for i, b := range rule.Bands {
+		if b.Min == nil && b.Max == nil {
+			handleError(w, http.StatusBadRequest, "Each band needs a Min or a Max", nil)
+			return false
+		}
+		if b.Min != nil && b.Max != nil && *b.Min >= *b.Max {
+			handleError(w, http.StatusBadRequest, "Band Min must be below Max", nil)
+			return false
+		}
+		if i > 0 && b.AgeDays == rule.Bands[i-1].AgeDays {
+			handleError(w, http.StatusBadRequest, "Band ages must be distinct", nil)
+			return false
+		}
+	}
+	if rule.Hysteresis < 0 || rule.MinDurationSec < 0 {
+		handleError(w, http.StatusBadRequest, "Hysteresis and MinDurationSec cannot be negative", nil)
+		return false
+	}
+	return true
+}
+
+/* ===========================
+    Alert Rule Handlers
+=========================== */
+
+func getAlertRules(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	rules, err := loadAlertRules(ctx, nil, false)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch alert rules", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, rules)
+}
+
+func createAlertRule(w http.ResponseWriter, r *http.Request) {
+	rule := AlertRule{IsActive: true}
+	if !decodeJSONBody(w, r, &rule) {
+		return
+	}
+	if !validateAlertRule(w, &rule) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	bands, _ := json.Marshal(rule.Bands)
+	query := `
+		INSERT INTO cm_alert_rules (Name, Metric, CageNum, Severity, Bands, Hysteresis, MinDurationSec, IsActive)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	res, err := db.ExecContext(ctx, query, rule.Name, rule.Metric, rule.CageNum, rule.Severity, string(bands), rule.Hysteresis, rule.MinDurationSec, rule.IsActive)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to create alert rule", err)
+		return
+	}
+	lastID, _ := res.LastInsertId()
+	respondJSON(w, http.StatusCreated, map[string]interface{}{"success": true, "insertedId": lastID})
+}
+
+func updateAlertRule(w http.ResponseWriter, r *http.Request) {
+	ruleID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid rule ID", err)
+		return
+	}
+
+	rule := AlertRule{IsActive: true}
+	if !decodeJSONBody(w, r, &rule) {
+		return
+	}
+	if !validateAlertRule(w, &rule) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	bands, _ := json.Marshal(rule.Bands)
+	query := `
+		UPDATE cm_alert_rules
+		SET Name = ?, Metric = ?, CageNum = ?, Severity = ?, Bands = ?, Hysteresis = ?, MinDurationSec = ?, IsActive = ?
+		WHERE RuleID = ?`
+	res, err := db.ExecContext(ctx, query, rule.Name, rule.Metric, rule.CageNum, rule.Severity, string(bands), rule.Hysteresis, rule.MinDurationSec, rule.IsActive, ruleID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to update alert rule", err)
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		handleError(w, http.StatusNotFound, "Alert rule not found or no changes made", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+func deleteAlertRule(w http.ResponseWriter, r *http.Request) {
+	ruleID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid rule ID", err)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	// past alerts keep pointing at the rule, so it is only switched off
+	res, err := db.ExecContext(ctx, "UPDATE cm_alert_rules SET IsActive = 0 WHERE RuleID = ?", ruleID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to delete alert rule", err)
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		handleError(w, http.StatusNotFound, "Alert rule not found", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+/* ===========================
+    Alert Handlers
+=========================== */
+
+// GET /api/alerts?status=open|acknowledged|resolved|all&cage=1
+func getAlerts(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := `
+		SELECT AlertID, RuleID, Type, Severity, CageNum, BatchID, Source, Metric, Value, Threshold, Message, Status,
+			RaisedAt, AcknowledgedBy, AcknowledgedAt, ResolvedBy, ResolvedAt
+		FROM cm_alerts WHERE 1=1`
+	var args []interface{}
+
+	switch r.URL.Query().Get("status") {
+	case "", "open":
+		query += " AND Status <> 'Resolved'"
+	case "acknowledged":
+		query += " AND Status = 'Acknowledged'"
+	case "resolved":
+		query += " AND Status = 'Resolved'"
+	case "all":
+	default:
+		handleError(w, http.StatusBadRequest, "Invalid status filter", nil)
+		return
+	}
+	if cage := r.URL.Query().Get("cage"); cage != "" {
+		query += " AND CageNum = ?"
+		args = append(args, cage)
+	}
+	query += " ORDER BY RaisedAt DESC LIMIT 200"
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch alerts", err)
+		return
+	}
+	defer rows.Close()
+
+	alerts := []AlertRecord{}
+	for rows.Next() {
+		var a AlertRecord
+		if err := rows.Scan(&a.AlertID, &a.RuleID, &a.Type, &a.Severity, &a.CageNum, &a.BatchID, &a.Source, &a.Metric, &a.Value, &a.Threshold,
+			&a.Message, &a.Status, &a.RaisedAt, &a.AcknowledgedBy, &a.AcknowledgedAt, &a.ResolvedBy, &a.ResolvedAt); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan alert", err)
+			return
+		}
+		alerts = append(alerts, a)
+	}
+	respondJSON(w, http.StatusOK, alerts)
+}
+
+// POST /api/alerts/{id}/acknowledge
+func acknowledgeAlert(w http.ResponseWriter, r *http.Request) {
+	alertID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid alert ID", err)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := "UPDATE cm_alerts SET Status = 'Acknowledged', AcknowledgedBy = ?, AcknowledgedAt = NOW() WHERE AlertID = ? AND Status = 'Open'"
+	res, err := db.ExecContext(ctx, query, requestUsername(r), alertID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to acknowledge alert", err)
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		handleError(w, http.StatusConflict, "Alert not found or not open", nil)
+		return
+	}
+	publishAlertStatus(ctx, int64(alertID))
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// POST /api/alerts/{id}/resolve
+func resolveAlertHandler(w http.ResponseWriter, r *http.Request) {
+	alertID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid alert ID", err)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	resolved, err := resolveAlert(ctx, int64(alertID), requestUsername(r))
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to resolve alert", err)
+		return
+	}
+	if !resolved {
+		handleError(w, http.StatusConflict, "Alert not found or already resolved", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+/* ===========================
+    Automation Schedules
+=========================== */
+
+// A schedule switches one relay on a device behind a gateway: on at StartTime,
+// off at EndTime (the next day when EndTime <= StartTime). Recurrence decides
+// which days it runs on:
+//
+//	daily  - every day between StartDate and EndDate (both optional)
+//	weekly - on DaysOfWeek (0 = Sunday ... 6 = Saturday)
+//	dates  - only on Dates, e.g. the days a medication is given in the water
+//
+// The scheduler sends {"action":"set_relay","device":"...","relay":2,"state":1}
+// through the gateway command path and logs every on/off in cm_automation_runs.
+// A schedule tied to a cage in manual mode is skipped (and logged as such).
+type AutomationSchedule struct {
+	ScheduleID int      `json:"ScheduleID"`
+	Name       string   `json:"Name"`
+	Kind       string   `json:"Kind"` // light, water, medication, ventilation, other
+	CageNum    *int     `json:"CageNum"`
+	GatewayID  string   `json:"GatewayID"`
+	DeviceID   string   `json:"DeviceID"`
+	Relay      int      `json:"Relay"`
+	StartTime  string   `json:"StartTime"` // HH:MM
+	EndTime    string   `json:"EndTime"`   // HH:MM
+	Recurrence string   `json:"Recurrence"`
+	DaysOfWeek []int    `json:"DaysOfWeek"`
+	Dates      []string `json:"Dates"`
+	StartDate  *string  `json:"StartDate"`
+	EndDate    *string  `json:"EndDate"`
+	IsActive   bool     `json:"IsActive"`
+	CreatedBy  string   `json:"CreatedBy"`
+	CreatedAt  string   `json:"CreatedAt"`
+}
+
+type AutomationRun struct {
+	RunID        int64   `json:"RunID"`
+	ScheduleID   int     `json:"ScheduleID"`
+	Action       string  `json:"Action"` // on, off
+	ScheduledFor string  `json:"ScheduledFor"`
+	ExecutedAt   *string `json:"ExecutedAt"`
+	Status       string  `json:"Status"`
+	CommandID    *string `json:"CommandID"`
+	Detail       *string `json:"Detail"`
+}
+
+const (
+	RunPending = "Pending"
+	RunDone    = "Done"
+	RunFailed  = "Failed"
+	RunSkipped = "Skipped"
+	RunMissed  = "Missed"
+
+	CageModeAuto   = "auto"
+	CageModeManual = "manual"
+
+	automationTickInterval      = 30 * time.Second
+	defaultAutomationCatchupHrs = 24
+)
+
+var automationKinds = map[string]bool{"light": true, "water": true, "medication": true, "ventilation": true, "other": true}
+
+// automationEvent is one on or off switch a schedule wants at a point in time
+type automationEvent struct {
+	schedule AutomationSchedule
+	action   string
+	at       time.Time
+}
+
+func parseClock(s string) (int, int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, err
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// runsOn reports whether the schedule starts a window on the given day
+func (s AutomationSchedule) runsOn(day time.Time) bool {
+	d := day.Format("2006-01-02")
+	if s.StartDate != nil && d < *s.StartDate {
+		return false
+	}
+	if s.EndDate != nil && d > *s.EndDate {
+		return false
+	}
+	switch s.Recurrence {
+	case "daily":
+		return true
+	case "weekly":
+		for _, wd := range s.DaysOfWeek {
+			if int(day.Weekday()) == wd {
+				return true
+			}
+		}
+	case "dates":
+		for _, date := range s.Dates {
+			if date == d {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// events lists the on/off switches of a schedule in (from, to], oldest first
+func (s AutomationSchedule) events(from, to time.Time) []automationEvent {
+	sh, sm, err1 := parseClock(s.StartTime)
+	eh, em, err2 := parseClock(s.EndTime)
+	if err1 != nil || err2 != nil {
+		return nil
+	}
+	var out []automationEvent
+	// start a day early so a window that began yesterday can still end today
+	day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location()).AddDate(0, 0, -1)
+	for ; !day.After(to); day = day.AddDate(0, 0, 1) {
+		if !s.runsOn(day) {
+			continue
+		}
+		on := day.Add(time.Duration(sh)*time.Hour + time.Duration(sm)*time.Minute)
+		off := day.Add(time.Duration(eh)*time.Hour + time.Duration(em)*time.Minute)
+		if !off.After(on) {
+			off = off.AddDate(0, 0, 1)
+		}
+		if on.After(from) && !on.After(to) {
+			out = append(out, automationEvent{schedule: s, action: "on", at: on})
+		}
+		if off.After(from) && !off.After(to) {
+			out = append(out, automationEvent{schedule: s, action: "off", at: off})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].at.Before(out[j].at) })
+	return out
+}
+
+// pendingEvents lists the events since the schedule last ran, looking back no
+// further than catchup. Only the newest is still due; the rest were missed.
+func (s AutomationSchedule) pendingEvents(last, now time.Time, catchup time.Duration) []automationEvent {
+	if earliest := now.Add(-catchup); last.Before(earliest) {
+		last = earliest
+	}
+	return s.events(last, now)
+}
+
+func scanSchedule(scan func(dest ...interface{}) error) (AutomationSchedule, error) {
+	var s AutomationSchedule
+	var days, dates string
+	if err := scan(&s.ScheduleID, &s.Name, &s.Kind, &s.CageNum, &s.GatewayID, &s.DeviceID, &s.Relay, &s.StartTime, &s.EndTime,
+		&s.Recurrence, &days, &dates, &s.StartDate, &s.EndDate, &s.IsActive, &s.CreatedBy, &s.CreatedAt); err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal([]byte(days), &s.DaysOfWeek); err != nil || s.DaysOfWeek == nil {
+		s.DaysOfWeek = []int{}
+	}
+	if err := json.Unmarshal([]byte(dates), &s.Dates); err != nil || s.Dates == nil {
+		s.Dates = []string{}
+	}
+	return s, nil
+}
+
+const scheduleColumns = `
+	SELECT ScheduleID, Name, Kind, CageNum, GatewayID, DeviceID, Relay, TIME_FORMAT(StartTime, '%H:%i'), TIME_FORMAT(EndTime, '%H:%i'),
+		Recurrence, DaysOfWeek, Dates, StartDate, EndDate, IsActive, CreatedBy, CreatedAt
+	FROM cm_automation_schedules`
+
+func loadSchedules(ctx context.Context, activeOnly bool) ([]AutomationSchedule, error) {
+	query := scheduleColumns
+	if activeOnly {
+		query += " WHERE IsActive = 1"
+	}
+	query += " ORDER BY ScheduleID"
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []AutomationSchedule{}
+	for rows.Next() {
+		s, err := scanSchedule(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// cageMode returns the control mode of a cage; cages not in the registry are automatic
+func cageMode(ctx context.Context, cageNum int) (string, error) {
+	var mode string
+	err := db.QueryRowContext(ctx, "SELECT ControlMode FROM cm_cages WHERE CageNum = ? AND IsActive = 1", cageNum).Scan(&mode)
+	if errors.Is(err, sql.ErrNoRows) {
+		return CageModeAuto, nil
+	}
+	return mode, err
+}
+
+/* ===========================
+    Scheduler
+=========================== */
+
+// runAutomation executes due schedule events until ctx is cancelled. On start it
+// catches up on events missed while the server was down (up to
+// AUTOMATION_CATCHUP_HOURS back): only the latest missed event per schedule is
+// executed, since that is the state the relay should be in now; the older ones
+// are logged as Missed.
+func runAutomation(ctx context.Context) {
+	t := time.NewTicker(automationTickInterval)
+	defer t.Stop()
+	for {
+		jobCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		if err := runDueSchedules(jobCtx, time.Now()); err != nil {
+			log.Printf("[ERROR] Automation: %v", err)
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func runDueSchedules(ctx context.Context, now time.Time) error {
+	schedules, err := loadSchedules(ctx, true)
+	if err != nil {
+		return err
+	}
+	catchup := time.Duration(getEnvInt("AUTOMATION_CATCHUP_HOURS", defaultAutomationCatchupHrs)) * time.Hour
+
+	for _, s := range schedules {
+		last, err := lastScheduledRun(ctx, s)
+		if err != nil {
+			return err
+		}
+
+		events := s.pendingEvents(last, now, catchup)
+		for i, ev := range events {
+			if i < len(events)-1 {
+				recordRun(ctx, ev, RunMissed, "missed while the scheduler was not running")
+				continue
+			}
+			runID, ok := recordRun(ctx, ev, RunPending, "")
+			if ok {
+				go executeScheduleEvent(ev, runID)
+			}
+		}
+	}
+	return nil
+}
+
+// lastScheduledRun is where event generation resumes for a schedule: its last
+// logged event, or its creation time for a schedule that has never run
+func lastScheduledRun(ctx context.Context, s AutomationSchedule) (time.Time, error) {
+	var last *string
+	err := db.QueryRowContext(ctx, "SELECT MAX(ScheduledFor) FROM cm_automation_runs WHERE ScheduleID = ?", s.ScheduleID).Scan(&last)
+	if err != nil {
+		return time.Time{}, err
+	}
+	ref := s.CreatedAt
+	if last != nil {
+		ref = *last
+	}
+	t, err := time.ParseInLocation(sqlDateTime, ref, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("schedule %d: %w", s.ScheduleID, err)
+	}
+	return t, nil
+}
+
+// recordRun logs an event; false when it was already logged (another tick got it)
+func recordRun(ctx context.Context, ev automationEvent, status, detail string) (int64, bool) {
+	query := `
+		INSERT IGNORE INTO cm_automation_runs (ScheduleID, Action, ScheduledFor, Status, Detail)
+		VALUES (?, ?, ?, ?, NULLIF(?, ''))`
+	res, err := db.ExecContext(ctx, query, ev.schedule.ScheduleID, ev.action, ev.at.Format(sqlDateTime), status, detail)
+	if err != nil {
+		log.Printf("[ERROR] Failed to log automation run for schedule %d: %v", ev.schedule.ScheduleID, err)
+		return 0, false
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, false
+	}
+	id, err := res.LastInsertId()
+	return id, err == nil
+}
+
+func finishRun(runID int64, status string, commandID *string, detail string) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel()
+	query := "UPDATE cm_automation_runs SET Status = ?, CommandID = ?, Detail = NULLIF(?, ''), ExecutedAt = NOW() WHERE RunID = ?"
+	if _, err := db.ExecContext(ctx, query, status, commandID, detail, runID); err != nil {
+		log.Printf("[ERROR] Failed to update automation run %d: %v", runID, err)
+	}
+}
+
+// executeScheduleEvent sends the relay command and waits for the gateway's answer
+func executeScheduleEvent(ev automationEvent, runID int64) {
+	s := ev.schedule
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel()
+
+	if s.CageNum != nil {
+		mode, err := cageMode(ctx, *s.CageNum)
+		if err != nil {
+			finishRun(runID, RunFailed, nil, "could not read cage mode: "+err.Error())
+			return
+		}
+		if mode == CageModeManual {
+			finishRun(runID, RunSkipped, nil, "cage is in manual mode")
+			return
+		}
+	}
+
+	state := 0
+	if ev.action == "on" {
+		state = 1
+	}
+	cmd := map[string]interface{}{"action": "set_relay", "device": s.DeviceID, "relay": s.Relay, "state": state}
+	issuedBy := "automation:" + strconv.Itoa(s.ScheduleID)
+	cmdID, done, err := issueGatewayCommand(ctx, s.GatewayID, cmd, issuedBy, CommandOptions{AckTimeout: defaultAckTimeout, Retries: defaultCommandRetries})
+	if err != nil {
+		finishRun(runID, RunFailed, nil, "could not issue command: "+err.Error())
+		return
+	}
+	<-done
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel2()
+	c, err := loadGatewayCommand(ctx2, cmdID)
+	if err != nil {
+		finishRun(runID, RunFailed, &cmdID, "could not load command result: "+err.Error())
+		return
+	}
+	if c.Status != CommandAcked {
+		detail := "command " + strings.ToLower(c.Status)
+		if c.Error != nil {
+			detail += ": " + *c.Error
+		}
+		finishRun(runID, RunFailed, &cmdID, detail)
+		return
+	}
+	finishRun(runID, RunDone, &cmdID, "")
+	publishLive("automation", gatewayTopic(s.GatewayID), map[string]interface{}{
+		"scheduleId": s.ScheduleID, "action": ev.action, "device": s.DeviceID, "relay": s.Relay,
+	})
+}
+
+/* ===========================
+    Automation Handlers
+=========================== */
+
+func validateSchedule(w http.ResponseWriter, s *AutomationSchedule) bool {
+	s.Name = strings.TrimSpace(s.Name)
+	s.Kind = strings.ToLower(strings.TrimSpace(s.Kind))
+	s.Recurrence = strings.ToLower(strings.TrimSpace(s.Recurrence))
+	if s.Name == "" || s.GatewayID == "" || s.DeviceID == "" {
+		handleError(w, http.StatusBadRequest, "Name, GatewayID and DeviceID are required", nil)
+		return false
+	}
+	if !automationKinds[s.Kind] {
+		handleError(w, http.StatusBadRequest, "Kind must be light, water, medication, ventilation or other", nil)
+		return false
+	}
+	if s.Relay < 1 || s.Relay > 3 {
+		handleError(w, http.StatusBadRequest, "Relay must be 1, 2 or 3", nil)
+		return false
+	}
+	if _, _, err := parseClock(s.StartTime); err != nil {
+		handleError(w, http.StatusBadRequest, "StartTime must be HH:MM", err)
+		return false
+	}
+	if _, _, err := parseClock(s.EndTime); err != nil {
+		handleError(w, http.StatusBadRequest, "EndTime must be HH:MM", err)
+		return false
+	}
+	if s.DaysOfWeek == nil {
+		s.DaysOfWeek = []int{}
+	}
+	if s.Dates == nil {
+		s.Dates = []string{}
+	}
+	switch s.Recurrence {
+	case "daily":
+	case "weekly":
+		if len(s.DaysOfWeek) == 0 {
+			handleError(w, http.StatusBadRequest, "Weekly schedules need DaysOfWeek", nil)
+			return false
+		}
+		for _, d := range s.DaysOfWeek {
+			if d < 0 || d > 6 {
+				handleError(w, http.StatusBadRequest, "DaysOfWeek must be 0 (Sunday) to 6 (Saturday)", nil)
+				return false
+			}
+		}
+	case "dates":
+		if len(s.Dates) == 0 {
+			handleError(w, http.StatusBadRequest, "Date schedules need Dates", nil)
+			return false
+		}
+		for _, d := range s.Dates {
+			if _, err := time.Parse("2006-01-02", d); err != nil {
+				handleError(w, http.StatusBadRequest, "Dates must be YYYY-MM-DD", err)
+				return false
+			}
+		}
+	default:
+		handleError(w, http.StatusBadRequest, "Recurrence must be daily, weekly or dates", nil)
+		return false
+	}
+	for _, d := range []*string{s.StartDate, s.EndDate} {
+		if d != nil {
+			if _, err := time.Parse("2006-01-02", *d); err != nil {
+				handleError(w, http.StatusBadRequest, "StartDate and EndDate must be YYYY-MM-DD", err)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// GET /api/automation/schedules
+func getSchedules(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	list, err := loadSchedules(ctx, r.URL.Query().Get("active") == "1")
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch schedules", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, list)
+}
+
+// POST /api/automation/schedules
+func createSchedule(w http.ResponseWriter, r *http.Request) {
+	var s AutomationSchedule
+	if !decodeJSONBody(w, r, &s) {
+		return
+	}
+	if !validateSchedule(w, &s) {
+		return
+	}
+	days, _ := json.Marshal(s.DaysOfWeek)
+	dates, _ := json.Marshal(s.Dates)
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := `
+		INSERT INTO cm_automation_schedules
+			(Name, Kind, CageNum, GatewayID, DeviceID, Relay, StartTime, EndTime, Recurrence, DaysOfWeek, Dates, StartDate, EndDate, CreatedBy)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	res, err := db.ExecContext(ctx, query, s.Name, s.Kind, s.CageNum, s.GatewayID, s.DeviceID, s.Relay, s.StartTime, s.EndTime,
+		s.Recurrence, string(days), string(dates), s.StartDate, s.EndDate, requestUsername(r))
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to create schedule", err)
+		return
+	}
+	id, _ := res.LastInsertId()
+	respondJSON(w, http.StatusCreated, map[string]interface{}{"success": true, "insertedId": id})
+}
+
+// PUT /api/automation/schedules/{id}
+func updateSchedule(w http.ResponseWriter, r *http.Request) {
+	scheduleID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid schedule ID", err)
+		return
+	}
+	// A body without IsActive keeps the schedule running
+	s := AutomationSchedule{IsActive: true}
+	if !decodeJSONBody(w, r, &s) {
+		return
+	}
+	if !validateSchedule(w, &s) {
+		return
+	}
+	days, _ := json.Marshal(s.DaysOfWeek)
+	dates, _ := json.Marshal(s.Dates)
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := `
+		UPDATE cm_automation_schedules
+		SET Name = ?, Kind = ?, CageNum = ?, GatewayID = ?, DeviceID = ?, Relay = ?, StartTime = ?, EndTime = ?,
+			Recurrence = ?, DaysOfWeek = ?, Dates = ?, StartDate = ?, EndDate = ?, IsActive = ?
+		WHERE ScheduleID = ?`
+	res, err := db.ExecContext(ctx, query, s.Name, s.Kind, s.CageNum, s.GatewayID, s.DeviceID, s.Relay, s.StartTime, s.EndTime,
+		s.Recurrence, string(days), string(dates), s.StartDate, s.EndDate, s.IsActive, scheduleID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to update schedule", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		handleError(w, http.StatusNotFound, "Schedule not found or no changes made", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// DELETE /api/automation/schedules/{id} deactivates the schedule; its run log is kept
+func deleteSchedule(w http.ResponseWriter, r *http.Request) {
+	scheduleID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid schedule ID", err)
+		return
+	}
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, "UPDATE cm_automation_schedules SET IsActive = 0 WHERE ScheduleID = ? AND IsActive = 1", scheduleID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to delete schedule", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		handleError(w, http.StatusNotFound, "Schedule not found", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// GET /api/automation/runs?schedule=1&limit=100
+func getAutomationRuns(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+	query := "SELECT RunID, ScheduleID, Action, ScheduledFor, ExecutedAt, Status, CommandID, Detail FROM cm_automation_runs"
+	var args []interface{}
+	if s := r.URL.Query().Get("schedule"); s != "" {
+		query += " WHERE ScheduleID = ?"
+		args = append(args, s)
+	}
+	query += " ORDER BY ScheduledFor DESC, RunID DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch automation runs", err)
+		return
+	}
+	defer rows.Close()
+
+	runs := []AutomationRun{}
+	for rows.Next() {
+		var run AutomationRun
+		if err := rows.Scan(&run.RunID, &run.ScheduleID, &run.Action, &run.ScheduledFor, &run.ExecutedAt, &run.Status, &run.CommandID, &run.Detail); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan automation run", err)
+			return
+		}
+		runs = append(runs, run)
+	}
+	respondJSON(w, http.StatusOK, runs)
+}
+
+// PUT /api/cages/{id}/mode with {"mode":"manual"|"auto"}
+func setCageMode(w http.ResponseWriter, r *http.Request) {
+	cageID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid cage ID", err)
+		return
+	}
+	var payload struct {
+		Mode string `json:"mode"`
+	}
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	mode := strings.ToLower(payload.Mode)
+	if mode != CageModeAuto && mode != CageModeManual {
+		handleError(w, http.StatusBadRequest, "mode must be auto or manual", nil)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	var cageNum int
+	err = db.QueryRowContext(ctx, "SELECT CageNum FROM cm_cages WHERE CageID = ? AND IsActive = 1", cageID).Scan(&cageNum)
+	if errors.Is(err, sql.ErrNoRows) {
+		handleError(w, http.StatusNotFound, "Cage not found", nil)
+		return
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch cage", err)
+		return
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE cm_cages SET ControlMode = ? WHERE CageID = ?", mode, cageID); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to update cage mode", err)
+		return
+	}
+	publishLive("cage", cageTopic(cageNum), map[string]interface{}{"cageNum": cageNum, "mode": mode, "by": requestUsername(r)})
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true, "mode": mode})
+}
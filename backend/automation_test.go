@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func eventList(evs []automationEvent) string {
+	parts := make([]string, len(evs))
+	for i, ev := range evs {
+		parts[i] = ev.action + "@" + ev.at.Format("01-02 15:04")
+	}
+	return strings.Join(parts, " ")
+}
+
+func march(day, hour, min int) time.Time {
+	// March 2026 starts on a Sunday
+	return time.Date(2026, 3, day, hour, min, 0, 0, time.Local)
+}
+
+func TestScheduleEvents(t *testing.T) {
+	str := func(s string) *string { return &s }
+	cases := []struct {
+		name     string
+		schedule AutomationSchedule
+		from, to time.Time
+		want     string
+	}{
+		{
+			name:     "daily window",
+			schedule: AutomationSchedule{StartTime: "06:00", EndTime: "18:00", Recurrence: "daily"},
+			from:     march(2, 0, 0), to: march(3, 12, 0),
+			want: "on@03-02 06:00 off@03-02 18:00 on@03-03 06:00",
+		},
+		{
+			name:     "from is exclusive, to inclusive",
+			schedule: AutomationSchedule{StartTime: "06:00", EndTime: "18:00", Recurrence: "daily"},
+			from:     march(2, 6, 0), to: march(2, 18, 0),
+			want: "off@03-02 18:00",
+		},
+		{
+			name:     "overnight window ends the next day",
+			schedule: AutomationSchedule{StartTime: "22:00", EndTime: "04:00", Recurrence: "daily"},
+			from:     march(2, 1, 0), to: march(2, 23, 0),
+			want: "off@03-02 04:00 on@03-02 22:00",
+		},
+		{
+			name:     "weekly on Monday and Wednesday",
+			schedule: AutomationSchedule{StartTime: "08:00", EndTime: "09:00", Recurrence: "weekly", DaysOfWeek: []int{1, 3}},
+			from:     march(1, 0, 0), to: march(7, 23, 59),
+			want: "on@03-02 08:00 off@03-02 09:00 on@03-04 08:00 off@03-04 09:00",
+		},
+		{
+			name:     "listed dates",
+			schedule: AutomationSchedule{StartTime: "10:00", EndTime: "10:30", Recurrence: "dates", Dates: []string{"2026-03-03", "2026-03-09"}},
+			from:     march(1, 0, 0), to: march(5, 0, 0),
+			want: "on@03-03 10:00 off@03-03 10:30",
+		},
+		{
+			name:     "start and end dates bound a daily schedule",
+			schedule: AutomationSchedule{StartTime: "06:00", EndTime: "07:00", Recurrence: "daily", StartDate: str("2026-03-03"), EndDate: str("2026-03-04")},
+			from:     march(1, 0, 0), to: march(6, 0, 0),
+			want: "on@03-03 06:00 off@03-03 07:00 on@03-04 06:00 off@03-04 07:00",
+		},
+		{
+			name:     "bad clock yields nothing",
+			schedule: AutomationSchedule{StartTime: "6am", EndTime: "18:00", Recurrence: "daily"},
+			from:     march(1, 0, 0), to: march(3, 0, 0),
+			want: "",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := eventList(tc.schedule.events(tc.from, tc.to)); got != tc.want {
+				t.Fatalf("got  %q\nwant %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSchedulePendingEvents(t *testing.T) {
+	daily := AutomationSchedule{StartTime: "06:00", EndTime: "18:00", Recurrence: "daily"}
+	cases := []struct {
+		name      string
+		last, now time.Time
+		catchup   time.Duration
+		want      string
+	}{
+		{"nothing due yet", march(2, 6, 0), march(2, 12, 0), 24 * time.Hour, ""},
+		{"one due", march(2, 6, 0), march(2, 18, 0), 24 * time.Hour, "off@03-02 18:00"},
+		{"short outage replays missed events", march(2, 6, 0), march(3, 7, 0), 24 * time.Hour, "off@03-02 18:00 on@03-03 06:00"},
+		{"long outage is capped at the catch-up window", march(1, 0, 0), march(5, 7, 0), 24 * time.Hour, "off@03-04 18:00 on@03-05 06:00"},
+		{"a smaller window drops older events", march(1, 0, 0), march(5, 7, 0), 2 * time.Hour, "on@03-05 06:00"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := daily.pendingEvents(tc.last, tc.now, tc.catchup)
+			if s := eventList(got); s != tc.want {
+				t.Fatalf("got  %q\nwant %q", s, tc.want)
+			}
+			for _, ev := range got {
+				if ev.at.Before(tc.now.Add(-tc.catchup)) || ev.at.After(tc.now) {
+					t.Fatalf("event %v outside the catch-up window", ev.at)
+				}
+			}
+		})
+	}
+}
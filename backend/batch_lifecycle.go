@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+/* ===========================
+    Batch Lifecycle
+=========================== */
+
+const (
+	BatchPlanned    = "Planned"
+	BatchActive     = "Active"
+	BatchHarvesting = "Harvesting"
+	BatchSold       = "Sold"
+	BatchClosed     = "Closed"
+	BatchCancelled  = "Cancelled"
+)
+
+// Allowed status changes. Sold can still be closed to freeze the report;
+// Closed and Cancelled are final.
+var batchTransitions = map[string][]string{
+	BatchPlanned:    {BatchActive, BatchCancelled},
+	BatchActive:     {BatchHarvesting, BatchSold, BatchClosed, BatchCancelled},
+	BatchHarvesting: {BatchSold, BatchClosed},
+	BatchSold:       {BatchClosed},
+	BatchClosed:     {},
+	BatchCancelled:  {},
+}
+
+// Statuses in which each kind of batch record may be added, edited or removed
+var batchActionStates = map[string][]string{
+	"mortality": {BatchActive, BatchHarvesting},
+	"usage":     {BatchActive, BatchHarvesting},
+	"harvest":   {BatchActive, BatchHarvesting},
+	"cost":      {BatchPlanned, BatchActive, BatchHarvesting, BatchSold},
+}
+
+type BatchStatusPayload struct {
+	Status string `json:"Status"`
+	Reason string `json:"Reason"`
+}
+
+type BatchStatusChange struct {
+	HistoryID  int     `json:"HistoryID"`
+	FromStatus *string `json:"FromStatus"`
+	ToStatus   string  `json:"ToStatus"`
+	ChangedBy  string  `json:"ChangedBy"`
+	ChangedAt  string  `json:"ChangedAt"`
+	Reason     string  `json:"Reason"`
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx so reports can be built inside a transaction
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func containsStatus(list []string, status string) bool {
+	for _, s := range list {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func canTransitionBatch(from, to string) bool {
+	return containsStatus(batchTransitions[from], to)
+}
+
+func batchActionAllowed(status, action string) bool {
+	return containsStatus(batchActionStates[action], status)
+}
+
+// requireBatchAction looks up the batch status and writes a 404/409 response when
+// the action is not allowed. Returns false if the handler should stop.
+func requireBatchAction(ctx context.Context, w http.ResponseWriter, q queryer, batchID interface{}, action string) bool {
+	var status string
+	err := q.QueryRowContext(ctx, "SELECT Status FROM cm_batches WHERE BatchID = ?", batchID).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		handleError(w, http.StatusNotFound, "Batch not found", nil)
+		return false
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch batch status", err)
+		return false
+	}
+	if !batchActionAllowed(status, action) {
+		handleError(w, http.StatusConflict, fmt.Sprintf("Cannot change %s records of a batch that is %s.", action, status), nil)
+		return false
+	}
+	return true
+}
+
+// transitionBatchStatus validates and applies a status change inside tx and records who made it.
+// Closing a batch also stores a snapshot of its report so the numbers no longer move.
+func transitionBatchStatus(ctx context.Context, tx *sql.Tx, batchID int, from, to, changedBy, reason string) error {
+	if from != "" && !canTransitionBatch(from, to) {
+		return fmt.Errorf("cannot change batch status from %s to %s", from, to)
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE cm_batches SET Status = ? WHERE BatchID = ?", to, batchID); err != nil {
+		return err
+	}
+
+	var fromStatus interface{}
+	if from != "" {
+		fromStatus = from
+	}
+	historyQuery := "INSERT INTO cm_batch_status_history (BatchID, FromStatus, ToStatus, ChangedBy, Reason) VALUES (?, ?, ?, ?, ?)"
+	if _, err := tx.ExecContext(ctx, historyQuery, batchID, fromStatus, to, changedBy, reason); err != nil {
+		return err
+	}
+
+	switch to {
+	case BatchActive:
+		if err := linkPlannedCage(ctx, tx, batchID); err != nil {
+			return err
+		}
+	case BatchSold, BatchClosed, BatchCancelled:
+		if err := releaseBatchCages(ctx, tx, batchID); err != nil {
+			return err
+		}
+	}
+
+	if to == BatchClosed {
+		report, err := buildBatchReport(ctx, tx, strconv.Itoa(batchID))
+		if err != nil {
+			return err
+		}
+		reportJSON, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		snapshotQuery := "INSERT INTO cm_batch_report_snapshots (BatchID, ReportJSON, ClosedBy) VALUES (?, ?, ?)"
+		if _, err := tx.ExecContext(ctx, snapshotQuery, batchID, string(reportJSON), changedBy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadBatchReport returns the frozen report of a closed batch, or computes it live
+func loadBatchReport(ctx context.Context, batchID string) (BatchReportData, error) {
+	var reportJSON string
+	err := db.QueryRowContext(ctx, "SELECT ReportJSON FROM cm_batch_report_snapshots WHERE BatchID = ?", batchID).Scan(&reportJSON)
+	if err == nil {
+		var report BatchReportData
+		if err := json.Unmarshal([]byte(reportJSON), &report); err != nil {
+			return report, err
+		}
+		return report, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return BatchReportData{}, err
+	}
+	return buildBatchReport(ctx, db, batchID)
+}
+
+/* ===========================
+    Batch Status Handlers
+=========================== */
+
+// POST /api/batches/{id}/status
+func changeBatchStatus(w http.ResponseWriter, r *http.Request) {
+	batchID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid batch ID", err)
+		return
+	}
+
+	var payload BatchStatusPayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if _, ok := batchTransitions[payload.Status]; !ok {
+		handleError(w, http.StatusBadRequest, "Invalid status", nil)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRowContext(ctx, "SELECT Status FROM cm_batches WHERE BatchID = ? FOR UPDATE", batchID).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		handleError(w, http.StatusNotFound, "Batch not found", nil)
+		return
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch batch status", err)
+		return
+	}
+	if !canTransitionBatch(current, payload.Status) {
+		handleError(w, http.StatusConflict, fmt.Sprintf("Cannot change batch status from %s to %s.", current, payload.Status), nil)
+		return
+	}
+
+	if err := transitionBatchStatus(ctx, tx, batchID, current, payload.Status, requestUsername(r), payload.Reason); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to change batch status", err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to commit transaction", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true, "status": payload.Status})
+}
+
+// GET /api/batches/{id}/status-history
+func getBatchStatusHistory(w http.ResponseWriter, r *http.Request) {
+	batchID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid batch ID", err)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := `
+		SELECT HistoryID, FromStatus, ToStatus, ChangedBy, ChangedAt, Reason
+		FROM cm_batch_status_history
+		WHERE BatchID = ?
+		ORDER BY ChangedAt ASC, HistoryID ASC`
+	rows, err := db.QueryContext(ctx, query, batchID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch status history", err)
+		return
+	}
+	defer rows.Close()
+
+	history := []BatchStatusChange{}
+	for rows.Next() {
+		var c BatchStatusChange
+		if err := rows.Scan(&c.HistoryID, &c.FromStatus, &c.ToStatus, &c.ChangedBy, &c.ChangedAt, &c.Reason); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan status change", err)
+			return
+		}
+		history = append(history, c)
+	}
+	respondJSON(w, http.StatusOK, history)
+}
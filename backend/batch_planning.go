@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+/* ===========================
+    Models for Batch Planning
+=========================== */
+
+// Placement details kept for planned batches; one row per batch in cm_batch_plans
+type BatchPlanPayload struct {
+	StartDate    string `json:"StartDate"`
+	TotalChicken int    `json:"TotalChicken"`
+	CageNum      *int   `json:"CageNum"`
+	GrowOutDays  int    `json:"GrowOutDays"`
+	DowntimeDays *int   `json:"DowntimeDays"`
+}
+
+type CalendarPlacement struct {
+	BatchID       int    `json:"BatchID"`
+	BatchName     string `json:"BatchName"`
+	Status        string `json:"Status"`
+	CageNum       *int   `json:"CageNum"`
+	Birds         int    `json:"Birds"`
+	PlacementDate string `json:"PlacementDate"`
+	HarvestDate   string `json:"HarvestDate"`
+	ReadyDate     string `json:"ReadyDate"` // harvest date plus cleaning/downtime
+	DowntimeDays  int    `json:"DowntimeDays"`
+}
+
+type CageOccupancy struct {
+	CageNum    *int                `json:"CageNum"` // nil groups batches without a cage
+	Placements []CalendarPlacement `json:"Placements"`
+}
+
+type PlacementConflict struct {
+	CageNum     int    `json:"CageNum"`
+	Type        string `json:"Type"` // "overlap" or "downtime"
+	BatchID     int    `json:"BatchID"`
+	NextBatchID int    `json:"NextBatchID"`
+	Message     string `json:"Message"`
+}
+
+type CalendarWeek struct {
+	WeekStart     string  `json:"WeekStart"`
+	CagesOccupied int     `json:"CagesOccupied"`
+	BirdsOnFarm   int     `json:"BirdsOnFarm"`
+	ChicksNeeded  int     `json:"ChicksNeeded"`
+	FeedKg        float64 `json:"FeedKg"`
+}
+
+type CapacityCalendar struct {
+	From      string              `json:"From"`
+	To        string              `json:"To"`
+	Cages     []CageOccupancy     `json:"Cages"`
+	Conflicts []PlacementConflict `json:"Conflicts"`
+	Weeks     []CalendarWeek      `json:"Weeks"`
+	TotalFeed float64             `json:"TotalFeedKg"`
+	Chicks    int                 `json:"TotalChicksNeeded"`
+}
+
+const (
+	defaultGrowOutDays  = 42
+	defaultDowntimeDays = 14
+	maxCalendarDays     = 366
+)
+
+// Broiler feed intake in grams per bird per day by week of age; the last value
+// is used for every week after
+var feedIntakeByWeek = []float64{25, 60, 100, 140, 170, 190, 200}
+
+func feedIntakeGrams(ageDays int) float64 {
+	week := ageDays / 7
+	if week >= len(feedIntakeByWeek) {
+		week = len(feedIntakeByWeek) - 1
+	}
+	return feedIntakeByWeek[week]
+}
+
+// saveBatchPlan inserts or replaces the planning details of a batch
+func saveBatchPlan(ctx context.Context, tx *sql.Tx, batchID int64, cageNum *int, growOutDays, downtimeDays int, plannedBy string) error {
+	query := `
+		INSERT INTO cm_batch_plans (BatchID, CageNum, GrowOutDays, DowntimeDays, PlannedBy)
+		VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE CageNum = VALUES(CageNum), GrowOutDays = VALUES(GrowOutDays), DowntimeDays = VALUES(DowntimeDays)`
+	_, err := tx.ExecContext(ctx, query, batchID, cageNum, growOutDays, downtimeDays, plannedBy)
+	return err
+}
+
+/* ===========================
+    Batch Planning Handlers
+=========================== */
+
+// PUT /api/batches/{id}/plan - reschedule a batch that has not been placed yet
+func updateBatchPlan(w http.ResponseWriter, r *http.Request) {
+	batchID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid batch ID", err)
+		return
+	}
+
+	var payload BatchPlanPayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	start, err := time.Parse("2006-01-02", payload.StartDate)
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid StartDate, expected YYYY-MM-DD", err)
+		return
+	}
+	if payload.TotalChicken <= 0 {
+		handleError(w, http.StatusBadRequest, "Total chicken must be greater than zero.", nil)
+		return
+	}
+	if payload.GrowOutDays <= 0 {
+		payload.GrowOutDays = defaultGrowOutDays
+	}
+	downtime := defaultDowntimeDays
+	if payload.DowntimeDays != nil && *payload.DowntimeDays >= 0 {
+		downtime = *payload.DowntimeDays
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRowContext(ctx, "SELECT Status FROM cm_batches WHERE BatchID = ? FOR UPDATE", batchID).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		handleError(w, http.StatusNotFound, "Batch not found", nil)
+		return
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch batch status", err)
+		return
+	}
+	if status != BatchPlanned {
+		handleError(w, http.StatusConflict, "Only planned batches can be rescheduled.", nil)
+		return
+	}
+
+	harvest := start.AddDate(0, 0, payload.GrowOutDays).Format("2006-01-02")
+	updateQuery := `
+		UPDATE cm_batches
+		SET StartDate = ?, ExpectedHarvestDate = ?, TotalChicken = ?, CurrentChicken = ?
+		WHERE BatchID = ?`
+	if _, err := tx.ExecContext(ctx, updateQuery, payload.StartDate, harvest, payload.TotalChicken, payload.TotalChicken, batchID); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to update batch", err)
+		return
+	}
+	if err := saveBatchPlan(ctx, tx, int64(batchID), payload.CageNum, payload.GrowOutDays, downtime, requestUsername(r)); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to save batch plan", err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to commit transaction", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true, "expectedHarvestDate": harvest})
+}
+
+// GET /api/planning/calendar?from=2025-01-01&to=2025-06-30
+// Shows cage occupancy of planned and running batches, placement conflicts and
+// the weekly chick and feed requirements of the schedule.
+func getCapacityCalendar(w http.ResponseWriter, r *http.Request) {
+	today := time.Now().Truncate(24 * time.Hour)
+	from, to := today, today.AddDate(0, 6, 0)
+	if s := r.URL.Query().Get("from"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			handleError(w, http.StatusBadRequest, "Invalid from date, expected YYYY-MM-DD", err)
+			return
+		}
+		from = t
+	}
+	if s := r.URL.Query().Get("to"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			handleError(w, http.StatusBadRequest, "Invalid to date, expected YYYY-MM-DD", err)
+			return
+		}
+		to = t
+	}
+	if to.Before(from) {
+		handleError(w, http.StatusBadRequest, "to must not be before from", nil)
+		return
+	}
+	if int(to.Sub(from).Hours()/24) > maxCalendarDays {
+		handleError(w, http.StatusBadRequest, fmt.Sprintf("Range cannot exceed %d days", maxCalendarDays), nil)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	// batches still holding or about to hold a cage, including the downtime after them
+	query := `
+		SELECT b.BatchID, b.BatchName, b.Status,
+			COALESCE(p.CageNum, (
+				SELECT c.CageNum FROM cm_batch_cages bc JOIN cm_cages c ON c.CageID = bc.CageID
+				WHERE bc.BatchID = b.BatchID AND bc.ToDate IS NULL
+				ORDER BY bc.FromDate DESC LIMIT 1
+			)),
+			CASE WHEN b.Status = 'Planned' THEN b.TotalChicken ELSE b.CurrentChicken END,
+			b.StartDate, b.ExpectedHarvestDate, COALESCE(p.DowntimeDays, ?)
+		FROM cm_batches b
+		LEFT JOIN cm_batch_plans p ON p.BatchID = b.BatchID
+		WHERE b.Status IN ('Planned', 'Active', 'Harvesting')
+		AND b.StartDate <= ?
+		ORDER BY b.StartDate ASC, b.BatchID ASC`
+	rows, err := db.QueryContext(ctx, query, defaultDowntimeDays, to.Format("2006-01-02"))
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch planned batches", err)
+		return
+	}
+	defer rows.Close()
+
+	var placements []CalendarPlacement
+	for rows.Next() {
+		var p CalendarPlacement
+		if err := rows.Scan(&p.BatchID, &p.BatchName, &p.Status, &p.CageNum, &p.Birds, &p.PlacementDate, &p.HarvestDate, &p.DowntimeDays); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan planned batch", err)
+			return
+		}
+		start, _ := time.Parse("2006-01-02", p.PlacementDate)
+		harvest, err := time.Parse("2006-01-02", p.HarvestDate)
+		if err != nil || harvest.Before(start) {
+			harvest = start.AddDate(0, 0, defaultGrowOutDays)
+			p.HarvestDate = harvest.Format("2006-01-02")
+		}
+		ready := harvest.AddDate(0, 0, p.DowntimeDays)
+		if ready.Before(from) {
+			continue
+		}
+		p.ReadyDate = ready.Format("2006-01-02")
+		placements = append(placements, p)
+	}
+	if err := rows.Err(); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to read planned batches", err)
+		return
+	}
+
+	calendar := CapacityCalendar{
+		From:      from.Format("2006-01-02"),
+		To:        to.Format("2006-01-02"),
+		Cages:     groupPlacementsByCage(placements),
+		Conflicts: findPlacementConflicts(placements),
+		Weeks:     projectWeeklyNeeds(placements, from, to, today),
+	}
+	for _, wk := range calendar.Weeks {
+		calendar.TotalFeed += wk.FeedKg
+		calendar.Chicks += wk.ChicksNeeded
+	}
+	calendar.TotalFeed = math.Round(calendar.TotalFeed*100) / 100
+
+	respondJSON(w, http.StatusOK, calendar)
+}
+
+func groupPlacementsByCage(placements []CalendarPlacement) []CageOccupancy {
+	byCage := map[int]*CageOccupancy{}
+	var unassigned *CageOccupancy
+	for _, p := range placements {
+		if p.CageNum == nil {
+			if unassigned == nil {
+				unassigned = &CageOccupancy{}
+			}
+			unassigned.Placements = append(unassigned.Placements, p)
+			continue
+		}
+		occ, ok := byCage[*p.CageNum]
+		if !ok {
+			cage := *p.CageNum
+			occ = &CageOccupancy{CageNum: &cage}
+			byCage[cage] = occ
+		}
+		occ.Placements = append(occ.Placements, p)
+	}
+
+	cages := make([]int, 0, len(byCage))
+	for c := range byCage {
+		cages = append(cages, c)
+	}
+	sort.Ints(cages)
+
+	result := []CageOccupancy{}
+	for _, c := range cages {
+		result = append(result, *byCage[c])
+	}
+	if unassigned != nil {
+		result = append(result, *unassigned)
+	}
+	return result
+}
+
+// findPlacementConflicts flags batches in the same cage that overlap, or that are
+// placed before the previous batch's cleaning/downtime period is over
+func findPlacementConflicts(placements []CalendarPlacement) []PlacementConflict {
+	conflicts := []PlacementConflict{}
+	lastInCage := map[int]CalendarPlacement{}
+	for _, p := range placements {
+		if p.CageNum == nil {
+			continue
+		}
+		prev, ok := lastInCage[*p.CageNum]
+		if ok {
+			switch {
+			case p.PlacementDate < prev.HarvestDate:
+				conflicts = append(conflicts, PlacementConflict{
+					CageNum: *p.CageNum, Type: "overlap", BatchID: prev.BatchID, NextBatchID: p.BatchID,
+					Message: p.BatchName + " is placed on " + p.PlacementDate + " before " + prev.BatchName + " is harvested on " + prev.HarvestDate,
+				})
+			case p.PlacementDate < prev.ReadyDate:
+				conflicts = append(conflicts, PlacementConflict{
+					CageNum: *p.CageNum, Type: "downtime", BatchID: prev.BatchID, NextBatchID: p.BatchID,
+					Message: p.BatchName + " is placed on " + p.PlacementDate + " before cleaning after " + prev.BatchName + " ends on " + prev.ReadyDate,
+				})
+			}
+		}
+		// keep the batch that frees the cage last as the one to compare against
+		if !ok || p.ReadyDate > prev.ReadyDate {
+			lastInCage[*p.CageNum] = p
+		}
+	}
+	return conflicts
+}
+
+// projectWeeklyNeeds walks the calendar a week at a time. Feed is only projected
+// from today onwards since earlier consumption is already recorded as usage.
+func projectWeeklyNeeds(placements []CalendarPlacement, from, to, today time.Time) []CalendarWeek {
+	weeks := []CalendarWeek{}
+	for weekStart := from; !weekStart.After(to); weekStart = weekStart.AddDate(0, 0, 7) {
+		weekEnd := weekStart.AddDate(0, 0, 7)
+		if weekEnd.After(to.AddDate(0, 0, 1)) {
+			weekEnd = to.AddDate(0, 0, 1)
+		}
+		wk := CalendarWeek{WeekStart: weekStart.Format("2006-01-02")}
+		cages := map[int]bool{}
+		var grams float64
+
+		for _, p := range placements {
+			start, _ := time.Parse("2006-01-02", p.PlacementDate)
+			harvest, _ := time.Parse("2006-01-02", p.HarvestDate)
+			if !start.Before(weekEnd) || harvest.Before(weekStart) {
+				continue
+			}
+			if p.Status == BatchPlanned && !start.Before(weekStart) {
+				wk.ChicksNeeded += p.Birds
+			}
+			wk.BirdsOnFarm += p.Birds
+			if p.CageNum != nil {
+				cages[*p.CageNum] = true
+			}
+			for d := weekStart; d.Before(weekEnd); d = d.AddDate(0, 0, 1) {
+				if d.Before(start) || !d.Before(harvest) || d.Before(today) {
+					continue
+				}
+				grams += feedIntakeGrams(int(d.Sub(start).Hours()/24)) * float64(p.Birds)
+			}
+		}
+		wk.CagesOccupied = len(cages)
+		wk.FeedKg = math.Round(grams/1000*100) / 100
+		weeks = append(weeks, wk)
+	}
+	return weeks
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+/* ===========================
+    Models for Houses & Cages
+=========================== */
+
+// CageNum is the number the sensors report as cage_num / temp_cage_num
+type Cage struct {
+	CageID       int            `json:"CageID"`
+	CageNum      int            `json:"CageNum"`
+	Name         string         `json:"Name"`
+	House        string         `json:"House"`
+	Capacity     int            `json:"Capacity"`
+	AreaM2       float64        `json:"AreaM2"`
+	Equipment    []string       `json:"Equipment"`
+	ControlMode  string         `json:"ControlMode"` // auto or manual, see automation.go
+	Devices      []CageDevice   `json:"Devices"`
+	CurrentBatch *CageBatchLink `json:"CurrentBatch"`
+	Notes        *string        `json:"Notes"`
+}
+
+type CagePayload struct {
+	CageNum   int      `json:"CageNum"`
+	Name      string   `json:"Name"`
+	House     string   `json:"House"`
+	Capacity  int      `json:"Capacity"`
+	AreaM2    float64  `json:"AreaM2"`
+	Equipment []string `json:"Equipment"`
+	Notes     string   `json:"Notes"`
+}
+
+// A sensor or gateway assigned to a cage. DeviceRef is the gateway ID or the
+// sensor's identifier as reported by the device.
+type CageDevice struct {
+	AssignmentID int    `json:"AssignmentID"`
+	CageID       int    `json:"CageID"`
+	DeviceType   string `json:"DeviceType"` // "sensor" or "gateway"
+	DeviceRef    string `json:"DeviceRef"`
+	Label        string `json:"Label"`
+}
+
+type CageBatchLink struct {
+	BatchID   int     `json:"BatchID"`
+	BatchName string  `json:"BatchName"`
+	CageID    int     `json:"CageID"`
+	CageNum   int     `json:"CageNum"`
+	CageName  string  `json:"CageName"`
+	FromDate  string  `json:"FromDate"`
+	ToDate    *string `json:"ToDate"`
+	Birds     *int    `json:"Birds"`
+}
+
+type CageBatchPayload struct {
+	CageID   int     `json:"CageID"`
+	FromDate string  `json:"FromDate"`
+	ToDate   *string `json:"ToDate"`
+	Birds    *int    `json:"Birds"`
+}
+
+type CageReading struct {
+	ID          int     `json:"temp_id"`
+	Temperature float64 `json:"temp_temperature"`
+	Humidity    float64 `json:"temp_humidity"`
+	GasSensor   float64 `json:"gas_sensor"`
+	CageNum     int     `json:"temp_cage_num"`
+	CreatedAt   string  `json:"created_at"`
+}
+
+/* ===========================
+    Cage Helpers
+=========================== */
+
+// batchInCage finds the running batch placed in the cage (by sensor cage number) on the given day
+func batchInCage(ctx context.Context, q queryer, cageNum int, day time.Time) (*int, error) {
+	query := `
+		SELECT bc.BatchID
+		FROM cm_batch_cages bc
+		JOIN cm_cages c ON c.CageID = bc.CageID
+		JOIN cm_batches b ON b.BatchID = bc.BatchID
+		WHERE c.CageNum = ? AND bc.FromDate <= ? AND (bc.ToDate IS NULL OR bc.ToDate >= ?)
+		AND b.Status IN ('Active', 'Harvesting')
+		ORDER BY bc.FromDate DESC
+		LIMIT 1`
+	d := day.Format("2006-01-02")
+	var batchID int
+	err := q.QueryRowContext(ctx, query, cageNum, d, d).Scan(&batchID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &batchID, nil
+}
+
+// linkPlannedCage places a batch in the cage chosen while planning it, if that cage is registered
+func linkPlannedCage(ctx context.Context, tx *sql.Tx, batchID int) error {
+	query := `
+		INSERT IGNORE INTO cm_batch_cages (BatchID, CageID, FromDate, Birds)
+		SELECT b.BatchID, c.CageID, b.StartDate, b.TotalChicken
+		FROM cm_batches b
+		JOIN cm_batch_plans p ON p.BatchID = b.BatchID
+		JOIN cm_cages c ON c.CageNum = p.CageNum AND c.IsActive = 1
+		WHERE b.BatchID = ?`
+	_, err := tx.ExecContext(ctx, query, batchID)
+	return err
+}
+
+// releaseBatchCages ends the open cage links of a batch that no longer holds birds
+func releaseBatchCages(ctx context.Context, tx *sql.Tx, batchID int) error {
+	_, err := tx.ExecContext(ctx, "UPDATE cm_batch_cages SET ToDate = CURDATE() WHERE BatchID = ? AND ToDate IS NULL", batchID)
+	return err
+}
+
+func loadCageDevices(ctx context.Context, cageID int) ([]CageDevice, error) {
+	rows, err := db.QueryContext(ctx, "SELECT AssignmentID, CageID, DeviceType, DeviceRef, Label FROM cm_cage_devices WHERE CageID = ? ORDER BY DeviceType, DeviceRef", cageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []CageDevice{}
+	for rows.Next() {
+		var d CageDevice
+		if err := rows.Scan(&d.AssignmentID, &d.CageID, &d.DeviceType, &d.DeviceRef, &d.Label); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+func validateCagePayload(w http.ResponseWriter, p *CagePayload) bool {
+	if p.CageNum <= 0 {
+		handleError(w, http.StatusBadRequest, "CageNum must be greater than zero", nil)
+		return false
+	}
+	if p.Name == "" {
+		p.Name = "Cage " + strconv.Itoa(p.CageNum)
+	}
+	if p.Capacity < 0 || p.AreaM2 < 0 {
+		handleError(w, http.StatusBadRequest, "Capacity and area cannot be negative", nil)
+		return false
+	}
+	if p.Equipment == nil {
+		p.Equipment = []string{}
+	}
+	return true
+}
+
+/* ===========================
+    Cage Handlers
+=========================== */
+
+const cageColumns = `
+	SELECT c.CageID, c.CageNum, c.Name, c.House, c.Capacity, c.AreaM2, c.Equipment, c.ControlMode, c.Notes,
+		bc.BatchID, b.BatchName, bc.FromDate, bc.ToDate, bc.Birds
+	FROM cm_cages c
+	LEFT JOIN cm_batch_cages bc ON bc.CageID = c.CageID AND bc.ToDate IS NULL
+		AND bc.BatchID IN (SELECT BatchID FROM cm_batches WHERE Status IN ('Active', 'Harvesting'))
+	LEFT JOIN cm_batches b ON b.BatchID = bc.BatchID
+	WHERE c.IsActive = 1`
+
+func scanCage(rows *sql.Rows) (Cage, error) {
+	var c Cage
+	var equipment string
+	var batchID, birds *int
+	var batchName, fromDate, toDate *string
+	if err := rows.Scan(&c.CageID, &c.CageNum, &c.Name, &c.House, &c.Capacity, &c.AreaM2, &equipment, &c.ControlMode, &c.Notes,
+		&batchID, &batchName, &fromDate, &toDate, &birds); err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal([]byte(equipment), &c.Equipment); err != nil || c.Equipment == nil {
+		c.Equipment = []string{}
+	}
+	if batchID != nil {
+		c.CurrentBatch = &CageBatchLink{
+			BatchID: *batchID, BatchName: *batchName, CageID: c.CageID, CageNum: c.CageNum, CageName: c.Name,
+			FromDate: *fromDate, ToDate: toDate, Birds: birds,
+		}
+	}
+	return c, nil
+}
+
+// GET /api/cages
+func getCages(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := cageColumns
+	var args []interface{}
+	if house := r.URL.Query().Get("house"); house != "" {
+		query += " AND c.House = ?"
+		args = append(args, house)
+	}
+	query += " ORDER BY c.House, c.CageNum"
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch cages", err)
+		return
+	}
+	defer rows.Close()
+
+	cages := []Cage{}
+	for rows.Next() {
+		c, err := scanCage(rows)
+		if err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan cage", err)
+			return
+		}
+		cages = append(cages, c)
+	}
+	rows.Close()
+
+	for i := range cages {
+		devices, err := loadCageDevices(ctx, cages[i].CageID)
+		if err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to fetch cage devices", err)
+			return
+		}
+		cages[i].Devices = devices
+	}
+	respondJSON(w, http.StatusOK, cages)
+}
+
+// GET /api/cages/{id}
+func getCage(w http.ResponseWriter, r *http.Request) {
+	cageID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid cage ID", err)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, cageColumns+" AND c.CageID = ?", cageID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch cage", err)
+		return
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		handleError(w, http.StatusNotFound, "Cage not found", nil)
+		return
+	}
+	cage, err := scanCage(rows)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to scan cage", err)
+		return
+	}
+	rows.Close()
+
+	if cage.Devices, err = loadCageDevices(ctx, cageID); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch cage devices", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, cage)
+}
+
+func createCage(w http.ResponseWriter, r *http.Request) {
+	var payload CagePayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if !validateCagePayload(w, &payload) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	equipment, _ := json.Marshal(payload.Equipment)
+	query := `
+		INSERT INTO cm_cages (CageNum, Name, House, Capacity, AreaM2, Equipment, Notes)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+	res, err := db.ExecContext(ctx, query, payload.CageNum, payload.Name, payload.House, payload.Capacity, payload.AreaM2, string(equipment), payload.Notes)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to create cage; the cage number may already be registered", err)
+		return
+	}
+	lastID, _ := res.LastInsertId()
+	respondJSON(w, http.StatusCreated, map[string]interface{}{"success": true, "insertedId": lastID})
+}
+
+func updateCage(w http.ResponseWriter, r *http.Request) {
+	cageID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid cage ID", err)
+		return
+	}
+
+	var payload CagePayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if !validateCagePayload(w, &payload) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	equipment, _ := json.Marshal(payload.Equipment)
+	query := `
+		UPDATE cm_cages
+		SET CageNum = ?, Name = ?, House = ?, Capacity = ?, AreaM2 = ?, Equipment = ?, Notes = ?
+		WHERE CageID = ? AND IsActive = 1`
+	res, err := db.ExecContext(ctx, query, payload.CageNum, payload.Name, payload.House, payload.Capacity, payload.AreaM2, string(equipment), payload.Notes, cageID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to update cage", err)
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		handleError(w, http.StatusNotFound, "Cage not found or no changes made", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+func deleteCage(w http.ResponseWriter, r *http.Request) {
+	cageID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid cage ID", err)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	var occupied int
+	occupiedQuery := `
+		SELECT COUNT(*) FROM cm_batch_cages bc
+		JOIN cm_batches b ON b.BatchID = bc.BatchID
+		WHERE bc.CageID = ? AND bc.ToDate IS NULL AND b.Status IN ('Active', 'Harvesting')`
+	if err := db.QueryRowContext(ctx, occupiedQuery, cageID).Scan(&occupied); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to check cage occupancy", err)
+		return
+	}
+	if occupied > 0 {
+		handleError(w, http.StatusConflict, "Cage still holds a running batch.", nil)
+		return
+	}
+
+	res, err := db.ExecContext(ctx, "UPDATE cm_cages SET IsActive = 0 WHERE CageID = ?", cageID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to delete cage", err)
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		handleError(w, http.StatusNotFound, "Cage not found", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// POST /api/cages/{id}/devices - a device can only be assigned to one cage at a time
+func assignCageDevice(w http.ResponseWriter, r *http.Request) {
+	cageID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid cage ID", err)
+		return
+	}
+
+	var payload CageDevice
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if payload.DeviceType != "sensor" && payload.DeviceType != "gateway" {
+		handleError(w, http.StatusBadRequest, "DeviceType must be sensor or gateway", nil)
+		return
+	}
+	if payload.DeviceRef == "" {
+		handleError(w, http.StatusBadRequest, "DeviceRef is required", nil)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	var active int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM cm_cages WHERE CageID = ? AND IsActive = 1", cageID).Scan(&active); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch cage", err)
+		return
+	}
+	if active == 0 {
+		handleError(w, http.StatusNotFound, "Cage not found", nil)
+		return
+	}
+
+	query := `
+		INSERT INTO cm_cage_devices (CageID, DeviceType, DeviceRef, Label)
+		VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE CageID = VALUES(CageID), Label = VALUES(Label)`
+	res, err := db.ExecContext(ctx, query, cageID, payload.DeviceType, payload.DeviceRef, payload.Label)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to assign device", err)
+		return
+	}
+	lastID, _ := res.LastInsertId()
+	respondJSON(w, http.StatusCreated, map[string]interface{}{"success": true, "insertedId": lastID})
+}
+
+// DELETE /api/cages/{id}/devices/{assignmentId}
+func unassignCageDevice(w http.ResponseWriter, r *http.Request) {
+	cageID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid cage ID", err)
+		return
+	}
+	assignmentID, err := strconv.Atoi(chi.URLParam(r, "assignmentId"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid assignment ID", err)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, "DELETE FROM cm_cage_devices WHERE AssignmentID = ? AND CageID = ?", assignmentID, cageID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to remove device", err)
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		handleError(w, http.StatusNotFound, "Device assignment not found", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+/* ===========================
+    Batch Placement Handlers
+=========================== */
+
+// GET /api/batches/{id}/cages
+func getBatchCages(w http.ResponseWriter, r *http.Request) {
+	batchID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid batch ID", err)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := `
+		SELECT bc.BatchID, b.BatchName, c.CageID, c.CageNum, c.Name, bc.FromDate, bc.ToDate, bc.Birds
+		FROM cm_batch_cages bc
+		JOIN cm_cages c ON c.CageID = bc.CageID
+		JOIN cm_batches b ON b.BatchID = bc.BatchID
+		WHERE bc.BatchID = ?
+		ORDER BY bc.FromDate, c.CageNum`
+	rows, err := db.QueryContext(ctx, query, batchID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch batch cages", err)
+		return
+	}
+	defer rows.Close()
+
+	links := []CageBatchLink{}
+	for rows.Next() {
+		var l CageBatchLink
+		if err := rows.Scan(&l.BatchID, &l.BatchName, &l.CageID, &l.CageNum, &l.CageName, &l.FromDate, &l.ToDate, &l.Birds); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan batch cage", err)
+			return
+		}
+		links = append(links, l)
+	}
+	respondJSON(w, http.StatusOK, links)
+}
+
+// POST /api/batches/{id}/cages - place (part of) a batch in a cage from a date
+func assignBatchCage(w http.ResponseWriter, r *http.Request) {
+	batchID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid batch ID", err)
+		return
+	}
+
+	var payload CageBatchPayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if _, err := time.Parse("2006-01-02", payload.FromDate); err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid FromDate, expected YYYY-MM-DD", err)
+		return
+	}
+	if payload.ToDate != nil {
+		if _, err := time.Parse("2006-01-02", *payload.ToDate); err != nil || *payload.ToDate < payload.FromDate {
+			handleError(w, http.StatusBadRequest, "Invalid ToDate", err)
+			return
+		}
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if !requireBatchAction(ctx, w, tx, batchID, "usage") {
+		return
+	}
+
+	var capacity int
+	if err := tx.QueryRowContext(ctx, "SELECT Capacity FROM cm_cages WHERE CageID = ? AND IsActive = 1 FOR UPDATE", payload.CageID).Scan(&capacity); err != nil {
+		handleError(w, http.StatusNotFound, "Cage not found", err)
+		return
+	}
+
+	// another running batch in the cage over the same dates cannot share it
+	var otherBatches int
+	overlapQuery := `
+		SELECT COUNT(*) FROM cm_batch_cages bc
+		JOIN cm_batches b ON b.BatchID = bc.BatchID
+		WHERE bc.CageID = ? AND bc.BatchID <> ? AND b.Status IN ('Active', 'Harvesting')
+		AND (bc.ToDate IS NULL OR bc.ToDate >= ?)
+		AND (? IS NULL OR bc.FromDate <= ?)`
+	if err := tx.QueryRowContext(ctx, overlapQuery, payload.CageID, batchID, payload.FromDate, payload.ToDate, payload.ToDate).Scan(&otherBatches); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to check cage occupancy", err)
+		return
+	}
+	if otherBatches > 0 {
+		handleError(w, http.StatusConflict, "Another batch occupies this cage in that period.", nil)
+		return
+	}
+	if payload.Birds != nil && capacity > 0 && *payload.Birds > capacity {
+		handleError(w, http.StatusBadRequest, "Birds exceed the cage capacity of "+strconv.Itoa(capacity), nil)
+		return
+	}
+
+	query := `
+		INSERT INTO cm_batch_cages (BatchID, CageID, FromDate, ToDate, Birds)
+		VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE ToDate = VALUES(ToDate), Birds = VALUES(Birds)`
+	if _, err := tx.ExecContext(ctx, query, batchID, payload.CageID, payload.FromDate, payload.ToDate, payload.Birds); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to place batch in cage", err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to commit transaction", err)
+		return
+	}
+	respondJSON(w, http.StatusCreated, map[string]interface{}{"success": true})
+}
+
+// DELETE /api/batches/{id}/cages/{cageId} - removes every placement of the batch in that cage
+func removeBatchCage(w http.ResponseWriter, r *http.Request) {
+	batchID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid batch ID", err)
+		return
+	}
+	cageID, err := strconv.Atoi(chi.URLParam(r, "cageId"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid cage ID", err)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	if !requireBatchAction(ctx, w, db, batchID, "usage") {
+		return
+	}
+
+	res, err := db.ExecContext(ctx, "DELETE FROM cm_batch_cages WHERE BatchID = ? AND CageID = ?", batchID, cageID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to remove batch from cage", err)
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		handleError(w, http.StatusNotFound, "Batch is not placed in this cage", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// GET /api/batches/{id}/readings?limit=100 - sensor readings attributed to the batch
+func getBatchReadings(w http.ResponseWriter, r *http.Request) {
+	batchID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid batch ID", err)
+		return
+	}
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := `
+		SELECT temp_id, temp_temperature, temp_humidity, gas_sensor, temp_cage_num, created_at
+		FROM cm_temperature
+		WHERE BatchID = ?
+		ORDER BY created_at DESC
+		LIMIT ?`
+	rows, err := db.QueryContext(ctx, query, batchID, limit)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch batch readings", err)
+		return
+	}
+	defer rows.Close()
+
+	readings := []CageReading{}
+	for rows.Next() {
+		var rd CageReading
+		if err := rows.Scan(&rd.ID, &rd.Temperature, &rd.Humidity, &rd.GasSensor, &rd.CageNum, &rd.CreatedAt); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan reading", err)
+			return
+		}
+		readings = append(readings, rd)
+	}
+	respondJSON(w, http.StatusOK, readings)
+}
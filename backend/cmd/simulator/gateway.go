@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/* ===========================
+    Virtual Gateway
+=========================== */
+
+// Each virtual gateway reports three devices per cage: an environment board
+// (DHT22 + gas sensor, relays heater/fan/light), a watering board (three level
+// sensors, three valve relays) and a feeder. It speaks the same protocol as the
+// real gateways (see gateway_protocol.go): hello, telemetry, heartbeat, event and ack.
+const (
+	simFirmware       = "sim-1.0.0"
+	heartbeatInterval = 30 * time.Second
+	maxBackoff        = 30 * time.Second
+)
+
+type simGateway struct {
+	cfg         config
+	api         *apiClient
+	id          string
+	hw          string
+	secret      string
+	reprovision func(ctx context.Context) (string, error)
+	faultOn     func(time.Time) bool
+	cages       []*cageModel
+	started     time.Time
+
+	writeMu sync.Mutex
+	conn    *websocket.Conn
+
+	mu      sync.Mutex
+	claimed bool
+	acks    map[string]map[string]interface{} // commandId -> ack already sent, for retried commands
+}
+
+func newSimGateway(cfg config, api *apiClient, id, secret string, faultOn func(time.Time) bool) *simGateway {
+	sum := sha256.Sum256([]byte(id))
+	return &simGateway{
+		cfg:     cfg,
+		api:     api,
+		id:      id,
+		hw:      fmt.Sprintf("02:%02x:%02x:%02x:%02x:%02x", sum[0], sum[1], sum[2], sum[3], sum[4]),
+		secret:  secret,
+		faultOn: faultOn,
+		started: time.Now(),
+		claimed: true, // until the server sends a pairing code
+		acks:    make(map[string]map[string]interface{}),
+	}
+}
+
+func (g *simGateway) addCage(c *cageModel) { g.cages = append(g.cages, c) }
+
+func (g *simGateway) envDevice(c *cageModel) string   { return fmt.Sprintf("%s-env-%d", g.id, c.num) }
+func (g *simGateway) waterDevice(c *cageModel) string { return fmt.Sprintf("%s-water-%d", g.id, c.num) }
+func (g *simGateway) feedDevice(c *cageModel) string  { return fmt.Sprintf("%s-feed-%d", g.id, c.num) }
+
+// run keeps the gateway connected until ctx ends, reconnecting with backoff
+func (g *simGateway) run(ctx context.Context) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		err := g.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errCredentialsRefused) {
+			log.Printf("%s stopped: %v", g.id, err)
+			return
+		}
+		log.Printf("%s disconnected: %v (reconnecting in %s)", g.id, err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		if errors.Is(err, errConnected) {
+			backoff = time.Second
+		}
+	}
+}
+
+var (
+	// errConnected wraps errors of sessions that got past the handshake, so the backoff resets
+	errConnected = errors.New("connection lost")
+	// errCredentialsRefused stops a gateway the server no longer accepts
+	errCredentialsRefused = errors.New("server refused our credentials")
+)
+
+func (g *simGateway) dial(ctx context.Context) (*websocket.Conn, error) {
+	u, err := url.Parse(g.cfg.server)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	u.Path = strings.TrimRight(u.Path, "/") + "/ws/gateway"
+
+	q := url.Values{"id": {g.id}, "hw": {g.hw}}
+	header := http.Header{}
+	if g.cfg.auth == "token" {
+		header.Set("Authorization", "Bearer "+g.secret)
+	} else {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		nonce := make([]byte, 12)
+		rand.Read(nonce)
+		mac := hmac.New(sha256.New, []byte(g.secret))
+		mac.Write([]byte(g.id + "\n" + g.hw + "\n" + ts + "\n" + hex.EncodeToString(nonce)))
+		q.Set("ts", ts)
+		q.Set("nonce", hex.EncodeToString(nonce))
+		q.Set("sig", hex.EncodeToString(mac.Sum(nil)))
+	}
+	u.RawQuery = q.Encode()
+
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), header)
+	if err != nil && resp != nil && resp.StatusCode == http.StatusUnauthorized && g.reprovision == nil {
+		return nil, fmt.Errorf("%w (run with -rotate to provision it again)", errCredentialsRefused)
+	}
+	if err != nil && resp != nil && resp.StatusCode == http.StatusUnauthorized {
+		log.Printf("%s: server refused our credentials, provisioning again", g.id)
+		secret, perr := g.reprovision(ctx)
+		if perr != nil {
+			return nil, fmt.Errorf("%w (re-provisioning failed: %v)", err, perr)
+		}
+		g.secret = secret
+		return nil, err
+	}
+	if err != nil && resp != nil {
+		return nil, fmt.Errorf("%w (HTTP %d)", err, resp.StatusCode)
+	}
+	return conn, err
+}
+
+// session runs one connection: hello, then telemetry on every tick until the link drops
+func (g *simGateway) session(ctx context.Context) error {
+	conn, err := g.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	g.writeMu.Lock()
+	g.conn = conn
+	g.writeMu.Unlock()
+	log.Printf("%s connected", g.id)
+
+	if err := g.send(g.hello()); err != nil {
+		return err
+	}
+
+	readErr := make(chan error, 1)
+	go func() { readErr <- g.readLoop(ctx, conn) }()
+
+	tick := time.NewTicker(g.cfg.interval)
+	defer tick.Stop()
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	var feed <-chan time.Time
+	if g.cfg.feedEvery > 0 {
+		t := time.NewTicker(g.cfg.feedEvery)
+		defer t.Stop()
+		feed = t.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "simulator stopped"), time.Now().Add(time.Second))
+			return ctx.Err()
+		case err := <-readErr:
+			return fmt.Errorf("%w: %v", errConnected, err)
+		case now := <-tick.C:
+			for _, c := range g.cages {
+				c.step(now)
+			}
+			if g.cages[0].scenario.linkFlap && g.faultOn(now) && mrand.Intn(12) == 0 {
+				return fmt.Errorf("%w: simulated link drop", errConnected)
+			}
+			if err := g.sendTelemetry(now); err != nil {
+				return fmt.Errorf("%w: %v", errConnected, err)
+			}
+		case <-heartbeat.C:
+			err := g.send(map[string]interface{}{"type": "heartbeat", "uptime": int(time.Since(g.started).Seconds()), "rssi": -50 - mrand.Intn(30)})
+			if err != nil {
+				return fmt.Errorf("%w: %v", errConnected, err)
+			}
+		case <-feed:
+			for _, c := range g.cages {
+				if err := g.dispense(c); err != nil {
+					return fmt.Errorf("%w: %v", errConnected, err)
+				}
+			}
+		}
+	}
+}
+
+func (g *simGateway) hello() map[string]interface{} {
+	devices := []map[string]interface{}{}
+	for _, c := range g.cages {
+		devices = append(devices,
+			map[string]interface{}{"id": g.envDevice(c), "kind": "environment", "cage": c.num},
+			map[string]interface{}{"id": g.waterDevice(c), "kind": "watering", "cage": c.num},
+			map[string]interface{}{"id": g.feedDevice(c), "kind": "feeder", "cage": c.num},
+		)
+	}
+	return map[string]interface{}{"type": "hello", "firmware": simFirmware, "devices": devices}
+}
+
+func (g *simGateway) isClaimed() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.claimed
+}
+
+func (g *simGateway) setClaimed(v bool) {
+	g.mu.Lock()
+	g.claimed = v
+	g.mu.Unlock()
+}
+
+func (g *simGateway) sendTelemetry(now time.Time) error {
+	if !g.isClaimed() {
+		return nil // the server refuses telemetry until we are claimed
+	}
+	for _, c := range g.cages {
+		relays := c.relays()
+		frame := map[string]interface{}{
+			"type": "telemetry", "device": g.envDevice(c), "cage": c.num, "ts": now.Unix(),
+			"relay1": relays[0], "relay2": relays[1], "relay3": relays[2],
+		}
+		if r, ok := c.environment(now); ok {
+			frame["temperature"] = r.temperature
+			frame["humidity"] = r.humidity
+			frame["gas"] = r.gas
+		}
+		if err := g.send(frame); err != nil {
+			return err
+		}
+
+		water, valves := c.waterState()
+		err := g.send(map[string]interface{}{
+			"type": "telemetry", "device": g.waterDevice(c), "cage": c.num, "ts": now.Unix(),
+			"water1": water[0], "water2": water[1], "water3": water[2],
+			"relay1": valves[0], "relay2": valves[1], "relay3": valves[2],
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *simGateway) dispense(c *cageModel) error {
+	if !g.isClaimed() {
+		return nil
+	}
+	return g.send(map[string]interface{}{
+		"type": "event", "device": g.feedDevice(c), "event": "feeder_dispensed",
+		"detail": map[string]interface{}{"grams": g.cfg.feedGrams, "cage": c.num},
+	})
+}
+
+func (g *simGateway) send(v interface{}) error {
+	g.writeMu.Lock()
+	defer g.writeMu.Unlock()
+	if g.cfg.verbose {
+		b, _ := json.Marshal(v)
+		log.Printf("%s -> %s", g.id, b)
+	}
+	g.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return g.conn.WriteJSON(v)
+}
+
+/* ===========================
+    Server Frames
+=========================== */
+
+type serverFrame struct {
+	Type      string          `json:"type"`
+	Error     string          `json:"error"`
+	Code      string          `json:"code"`
+	CommandID string          `json:"commandId"`
+	Action    string          `json:"action"`
+	Device    string          `json:"device"`
+	Relay     int             `json:"relay"`
+	State     json.RawMessage `json:"state"`
+}
+
+func (g *simGateway) readLoop(ctx context.Context, conn *websocket.Conn) error {
+	for {
+		_, raw, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if g.cfg.verbose {
+			log.Printf("%s <- %s", g.id, raw)
+		}
+		var f serverFrame
+		if err := json.Unmarshal(raw, &f); err != nil {
+			log.Printf("%s: unreadable frame from server: %s", g.id, raw)
+			continue
+		}
+		switch f.Type {
+		case "pairing":
+			g.setClaimed(false)
+			log.Printf("%s is not claimed, pairing code %s", g.id, f.Code)
+			if g.cfg.claim {
+				go g.claim(ctx, f.Code)
+			}
+		case "claimed":
+			g.setClaimed(true)
+			log.Printf("%s claimed", g.id)
+			// the server ignores the devices in a hello sent before the claim
+			if err := g.send(g.hello()); err != nil {
+				return err
+			}
+		case "command":
+			go g.handleCommand(f)
+		case "error":
+			log.Printf("%s: server error: %s", g.id, f.Error)
+		}
+	}
+}
+
+func (g *simGateway) claim(ctx context.Context, code string) {
+	name := "Simulated " + g.id
+	err := g.api.post(ctx, "/api/iot/gateways/"+g.id+"/claim", map[string]interface{}{"code": code, "name": name}, nil)
+	if err != nil {
+		log.Printf("%s: claim failed: %v", g.id, err)
+	}
+}
+
+// handleCommand applies a command and acks it. Retries of a command arrive with
+// the same commandId and get the original answer again without acting twice.
+func (g *simGateway) handleCommand(f serverFrame) {
+	g.mu.Lock()
+	ack, seen := g.acks[f.CommandID]
+	g.mu.Unlock()
+	if !seen {
+		ack = g.apply(f)
+		g.mu.Lock()
+		g.acks[f.CommandID] = ack
+		g.mu.Unlock()
+	}
+	log.Printf("%s command %s %s %s relay %d -> ok=%v", g.id, f.CommandID, f.Action, f.Device, f.Relay, ack["ok"])
+	if err := g.send(ack); err != nil {
+		log.Printf("%s: ack %s not sent: %v", g.id, f.CommandID, err)
+	}
+}
+
+func (g *simGateway) apply(f serverFrame) map[string]interface{} {
+	fail := func(msg string) map[string]interface{} {
+		return map[string]interface{}{"type": "ack", "commandId": f.CommandID, "ok": false, "error": msg}
+	}
+	now := time.Now()
+
+	for _, c := range g.cages {
+		switch {
+		case f.Action == "set_relay" && (f.Device == g.envDevice(c) || f.Device == g.waterDevice(c)):
+			state, err := relayState(f.State)
+			if err != nil {
+				return fail(err.Error())
+			}
+			if f.Relay < 1 || f.Relay > 3 {
+				return fail("relay must be 1..3")
+			}
+			if c.scenario.relayFault && g.faultOn(now) {
+				return fail("relay not responding")
+			}
+			c.setRelay(f.Device == g.waterDevice(c), f.Relay, state)
+			return map[string]interface{}{
+				"type": "ack", "commandId": f.CommandID, "ok": true,
+				"result": map[string]interface{}{"relay" + strconv.Itoa(f.Relay): state},
+			}
+		case (f.Action == "dispense" || f.Action == "rotate_servo") && f.Device == g.feedDevice(c):
+			if err := g.dispense(c); err != nil {
+				return fail(err.Error())
+			}
+			return map[string]interface{}{"type": "ack", "commandId": f.CommandID, "ok": true, "result": map[string]interface{}{"grams": g.cfg.feedGrams}}
+		}
+	}
+	if f.Action != "set_relay" && f.Action != "dispense" && f.Action != "rotate_servo" {
+		return fail("unknown action " + f.Action)
+	}
+	return fail("unknown device " + f.Device)
+}
+
+// relayState accepts 0/1, true/false and "on"/"off"
+func relayState(raw json.RawMessage) (int, error) {
+	switch strings.Trim(strings.ToLower(string(raw)), `"`) {
+	case "1", "true", "on":
+		return 1, nil
+	case "0", "false", "off":
+		return 0, nil
+	}
+	return 0, fmt.Errorf("invalid relay state %s", raw)
+}
+
+/* ===========================
+    Standalone DHT22
+=========================== */
+
+// dhtSensor posts like the ESP32 DHT22 sketch does, straight to /api/dht22-data
+type dhtSensor struct {
+	cfg  config
+	api  *apiClient
+	cage *cageModel
+}
+
+func (s *dhtSensor) run(ctx context.Context) {
+	t := time.NewTicker(s.cfg.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			s.cage.step(now)
+			r, ok := s.cage.environment(now)
+			if !ok {
+				continue
+			}
+			body := map[string]interface{}{"temperature": r.temperature, "humidity": r.humidity, "gas_value": r.gas, "cage_num": s.cage.num}
+			if err := s.api.post(ctx, "/api/dht22-data", body, nil); err != nil && ctx.Err() == nil {
+				log.Printf("DHT22 cage %d: %v", s.cage.num, err)
+			} else if s.cfg.verbose {
+				log.Printf("DHT22 cage %d: %.1f°C %.1f%%", s.cage.num, r.temperature, r.humidity)
+			}
+		}
+	}
+}
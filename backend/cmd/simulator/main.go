@@ -0,0 +1,296 @@
+// Command simulator stands in for the farm hardware so the IoT features can be
+// tested end to end without a bench. It runs N virtual gateways against
+// /ws/gateway (provisioning, authenticating and claiming them on the way),
+// posts DHT22 readings to /api/dht22-data like the standalone sensors do, and
+// emulates relays that acknowledge commands. Cage climate follows a scripted
+// scenario so alerts, control rules, automation and telemetry storage all get
+// exercised. Provisioning gateways needs the server's ADMIN_API_TOKEN, taken from
+// the same environment variable or -admin-token. Gateways that already exist on
+// the server without a secret in the -state file are left alone unless -rotate
+// is given:
+//
+//	go run ./cmd/simulator -server http://localhost:8080 -gateways 2 -scenario heater-failure -fault-after 2m
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type config struct {
+	server      string
+	gateways    int
+	prefix      string
+	firstCage   int
+	cagesPerGW  int
+	dhtCages    []int
+	interval    time.Duration
+	scenario    string
+	faultAfter  time.Duration
+	faultFor    time.Duration
+	auth        string
+	stateFile   string
+	claim       bool
+	rotate      bool
+	username    string
+	adminToken  string
+	duration    time.Duration
+	feedEvery   time.Duration
+	feedGrams   int
+	verbose     bool
+	httpTimeout time.Duration
+}
+
+func parseFlags() config {
+	var c config
+	var dht string
+	flag.StringVar(&c.server, "server", "http://localhost:8080", "backend base URL")
+	flag.IntVar(&c.gateways, "gateways", 1, "number of virtual gateways")
+	flag.StringVar(&c.prefix, "prefix", "sim-gw", "gateway ID prefix; gateways are <prefix>-1 .. <prefix>-N")
+	flag.IntVar(&c.firstCage, "first-cage", 1, "cage number of the first simulated cage")
+	flag.IntVar(&c.cagesPerGW, "cages", 1, "cages per gateway")
+	flag.StringVar(&dht, "dht-cages", "", "comma separated cage numbers that also get standalone DHT22 posts to /api/dht22-data")
+	flag.DurationVar(&c.interval, "interval", 10*time.Second, "telemetry interval")
+	flag.StringVar(&c.scenario, "scenario", scenarioNormal, "scenario: "+strings.Join(scenarioNames(), ", "))
+	flag.DurationVar(&c.faultAfter, "fault-after", 2*time.Minute, "when the scenario's fault starts")
+	flag.DurationVar(&c.faultFor, "fault-for", 10*time.Minute, "how long the fault lasts (0 = until exit)")
+	flag.StringVar(&c.auth, "auth", "hmac", "gateway authentication: token or hmac")
+	flag.StringVar(&c.stateFile, "state", "simulator-secrets.json", "file keeping the provisioned gateway secrets between runs")
+	flag.BoolVar(&c.claim, "claim", true, "claim unclaimed gateways with the pairing code the server issues")
+	flag.BoolVar(&c.rotate, "rotate", false, "take over gateways the state file has no working secret for by rotating their secret; this cuts off whatever device is using it")
+	flag.StringVar(&c.username, "user", "simulator", "X-Username sent with API calls")
+	flag.StringVar(&c.adminToken, "admin-token", os.Getenv("ADMIN_API_TOKEN"), "admin token for provisioning gateways (default $ADMIN_API_TOKEN)")
+	flag.DurationVar(&c.duration, "duration", 0, "stop after this long (0 = until interrupted)")
+	flag.DurationVar(&c.feedEvery, "feed-every", 30*time.Minute, "how often each feeder dispenses (0 = only on command)")
+	flag.IntVar(&c.feedGrams, "feed-grams", 500, "grams per feeder dispense")
+	flag.BoolVar(&c.verbose, "v", false, "log every frame")
+	flag.Parse()
+
+	c.server = strings.TrimRight(c.server, "/")
+	c.httpTimeout = 10 * time.Second
+	for _, s := range strings.Split(dht, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			log.Fatalf("invalid -dht-cages entry %q", s)
+		}
+		c.dhtCages = append(c.dhtCages, n)
+	}
+	if _, ok := scenarios[c.scenario]; !ok {
+		log.Fatalf("unknown scenario %q (have %s)", c.scenario, strings.Join(scenarioNames(), ", "))
+	}
+	if c.auth != "token" && c.auth != "hmac" {
+		log.Fatalf("-auth must be token or hmac")
+	}
+	if c.gateways > 0 && c.adminToken == "" {
+		log.Fatalf("gateways are provisioned with the admin token: pass -admin-token or set ADMIN_API_TOKEN")
+	}
+	if c.gateways < 0 || c.cagesPerGW < 1 || c.interval < time.Second {
+		log.Fatalf("need -gateways >= 0, -cages >= 1 and -interval >= 1s")
+	}
+	return c
+}
+
+func main() {
+	cfg := parseFlags()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if cfg.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.duration)
+		defer cancel()
+	}
+
+	api := &apiClient{base: cfg.server, username: cfg.username, adminToken: cfg.adminToken, http: &http.Client{Timeout: cfg.httpTimeout}}
+	secrets, err := loadSecrets(cfg.stateFile)
+	if err != nil {
+		log.Fatalf("read %s: %v", cfg.stateFile, err)
+	}
+
+	scenario := scenarios[cfg.scenario]
+	faultOn := faultWindow(time.Now(), cfg.faultAfter, cfg.faultFor)
+	log.Printf("Simulating %d gateway(s) x %d cage(s) against %s, scenario %q: %s (fault after %s)",
+		cfg.gateways, cfg.cagesPerGW, cfg.server, cfg.scenario, scenario.description, cfg.faultAfter)
+
+	var wg sync.WaitGroup
+	cage := cfg.firstCage
+	for i := 1; i <= cfg.gateways; i++ {
+		id := fmt.Sprintf("%s-%d", cfg.prefix, i)
+		secret, err := ensureProvisioned(ctx, api, secrets, cfg.stateFile, id, cfg.rotate)
+		if err != nil {
+			log.Fatalf("provision %s: %v", id, err)
+		}
+
+		gw := newSimGateway(cfg, api, id, secret, faultOn)
+		// with -rotate, a secret the server no longer accepts (database reset, rotated
+		// by hand) is replaced; without it the gateway stops
+		if cfg.rotate {
+			gw.reprovision = func(ctx context.Context) (string, error) {
+				secretsMu.Lock()
+				delete(secrets, id)
+				secretsMu.Unlock()
+				return ensureProvisioned(ctx, api, secrets, cfg.stateFile, id, true)
+			}
+		}
+		for j := 0; j < cfg.cagesPerGW; j++ {
+			gw.addCage(newCageModel(cage, scenario, faultOn))
+			cage++
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			gw.run(ctx)
+		}()
+	}
+
+	for _, n := range cfg.dhtCages {
+		sensor := &dhtSensor{cfg: cfg, api: api, cage: newCageModel(n, scenario, faultOn)}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sensor.run(ctx)
+		}()
+	}
+
+	if cfg.gateways == 0 && len(cfg.dhtCages) == 0 {
+		log.Fatalf("nothing to simulate: use -gateways and/or -dht-cages")
+	}
+	wg.Wait()
+	log.Printf("Simulator stopped")
+}
+
+/* ===========================
+    Backend API
+=========================== */
+
+type apiClient struct {
+	base       string
+	username   string
+	adminToken string
+	http       *http.Client
+}
+
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string { return fmt.Sprintf("HTTP %d: %s", e.Status, e.Message) }
+
+// post sends a JSON body and decodes the JSON answer into out (if not nil)
+func (a *apiClient) post(ctx context.Context, path string, body, out interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.base+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Username", a.username)
+	if a.adminToken != "" {
+		req.Header.Set("X-Admin-Token", a.adminToken)
+	}
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) != nil || e.Error == "" {
+			e.Error = strings.TrimSpace(string(data))
+		}
+		return &apiError{Status: resp.StatusCode, Message: e.Error}
+	}
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+/* ===========================
+    Provisioning
+=========================== */
+
+// secrets survive restarts in the state file: the server only hands a secret
+// out once, when the gateway is provisioned or its secret rotated
+func loadSecrets(path string) (map[string]string, error) {
+	secrets := make(map[string]string)
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return secrets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return secrets, json.Unmarshal(b, &secrets)
+}
+
+var secretsMu sync.Mutex
+
+func saveSecret(path string, secrets map[string]string, id, secret string) error {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secrets[id] = secret
+	b, err := json.MarshalIndent(secrets, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o600)
+}
+
+// ensureProvisioned returns the gateway's secret, provisioning it when needed. A
+// gateway that already exists on the server but not in this state file may be a
+// real one, so its secret is only rotated when rotate is set. A gateway revoked
+// on the server cannot be rotated back and is reported as an error.
+func ensureProvisioned(ctx context.Context, api *apiClient, secrets map[string]string, stateFile, id string, rotate bool) (string, error) {
+	secretsMu.Lock()
+	s, ok := secrets[id]
+	secretsMu.Unlock()
+	if ok {
+		return s, nil
+	}
+	var out struct {
+		Secret string `json:"secret"`
+	}
+	name := "Simulated " + id
+	err := api.post(ctx, "/api/iot/gateways", map[string]interface{}{"id": id, "name": name}, &out)
+	var ae *apiError
+	if errors.As(err, &ae) && ae.Status == http.StatusConflict {
+		if !rotate {
+			return "", fmt.Errorf("%s already exists on the server and %s has no secret for it; pick another -prefix or run with -rotate to take it over", id, stateFile)
+		}
+		log.Printf("%s already exists on the server, rotating its secret", id)
+		err = api.post(ctx, "/api/iot/gateways/"+id+"/rotate-secret", map[string]interface{}{}, &out)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := saveSecret(stateFile, secrets, id, out.Secret); err != nil {
+		return "", err
+	}
+	log.Printf("%s provisioned", id)
+	return out.Secret, nil
+}
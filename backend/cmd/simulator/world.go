@@ -0,0 +1,218 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* ===========================
+    Scenarios
+=========================== */
+
+// A scenario changes how a cage behaves while its fault is active
+// (between -fault-after and -fault-after + -fault-for).
+const (
+	scenarioNormal        = "normal"
+	scenarioHeaterFailure = "heater-failure"
+	scenarioHeatWave      = "heat-wave"
+	scenarioSensorDropout = "sensor-dropout"
+	scenarioStuckSensor   = "stuck-sensor"
+	scenarioSpikes        = "sensor-spikes"
+	scenarioRelayFault    = "relay-fault"
+	scenarioLinkFlap      = "link-flap"
+	scenarioWaterLeak     = "water-leak"
+)
+
+type scenario struct {
+	description string
+
+	heaterBroken bool    // the heater relay switches but gives no heat
+	ambientShift float64 // °C added to the outside temperature
+	dropout      bool    // the environment sensor stops reporting
+	stuck        bool    // the environment sensor repeats its last value
+	spikes       bool    // occasional absurd readings
+	relayFault   bool    // relay commands are refused
+	linkFlap     bool    // the gateway drops its connection now and then
+	leakRate     float64 // extra water level lost per tick
+}
+
+var scenarios = map[string]scenario{
+	scenarioNormal:        {description: "healthy farm, no fault"},
+	scenarioHeaterFailure: {description: "cold night and the heater gives no heat", heaterBroken: true, ambientShift: -8},
+	scenarioHeatWave:      {description: "outside temperature climbs 10°C; only the fan helps", ambientShift: 10},
+	scenarioSensorDropout: {description: "the DHT22 stops reporting", dropout: true},
+	scenarioStuckSensor:   {description: "the DHT22 keeps sending the same value", stuck: true},
+	scenarioSpikes:        {description: "the DHT22 sends occasional absurd readings", spikes: true},
+	scenarioRelayFault:    {description: "relays refuse every command", relayFault: true},
+	scenarioLinkFlap:      {description: "gateways lose their connection every few minutes", linkFlap: true},
+	scenarioWaterLeak:     {description: "drinker lines leak, water levels fall fast", leakRate: 3},
+}
+
+func scenarioNames() []string {
+	names := make([]string, 0, len(scenarios))
+	for n := range scenarios {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/* ===========================
+    Cage Model
+=========================== */
+
+// Relays on the simulated devices
+const (
+	relayHeater = 1 // environment device
+	relayFan    = 2
+	relayLight  = 3
+)
+
+// cageModel is a crude thermal model of one cage: temperature relaxes towards
+// the outside temperature plus the heater minus the fan, humidity and ammonia
+// follow ventilation, the birds drink from three lines that refill while their
+// valve relay is on
+type cageModel struct {
+	mu sync.Mutex
+
+	num      int
+	scenario scenario
+	faultOn  func(time.Time) bool
+
+	temperature float64
+	humidity    float64
+	gas         float64
+	envRelays   [3]int // heater, fan, light
+	water       [3]int // level 0..100 per drinker line
+	valves      [3]int
+	lastEnv     envReading
+}
+
+type envReading struct {
+	temperature float64
+	humidity    float64
+	gas         float64
+}
+
+func newCageModel(num int, sc scenario, faultOn func(time.Time) bool) *cageModel {
+	return &cageModel{
+		num:         num,
+		scenario:    sc,
+		faultOn:     faultOn,
+		temperature: 28 + rand.Float64(),
+		humidity:    60 + rand.Float64()*5,
+		gas:         10 + rand.Float64()*5,
+		water:       [3]int{90, 85, 95},
+	}
+}
+
+// outside is the ambient temperature: a daily swing around 27°C
+func (c *cageModel) outside(at time.Time) float64 {
+	h := float64(at.Hour()) + float64(at.Minute())/60
+	t := 27 + 4*math.Sin((h-9)/24*2*math.Pi)
+	if c.faultOn(at) {
+		t += c.scenario.ambientShift
+	}
+	return t
+}
+
+// step advances the model by one telemetry interval
+func (c *cageModel) step(at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fault := c.faultOn(at)
+	target := c.outside(at)
+	if c.envRelays[relayHeater-1] == 1 && !(fault && c.scenario.heaterBroken) {
+		target += 7
+	}
+	fanOn := c.envRelays[relayFan-1] == 1
+	if fanOn {
+		target -= 4
+	}
+	c.temperature += (target-c.temperature)*0.15 + rand.NormFloat64()*0.1
+
+	humTarget := 62.0
+	gasTarget := 18.0
+	if fanOn {
+		humTarget, gasTarget = 52, 6
+	}
+	c.humidity = clamp(c.humidity+(humTarget-c.humidity)*0.1+rand.NormFloat64()*0.5, 5, 99)
+	c.gas = clamp(c.gas+(gasTarget-c.gas)*0.05+rand.NormFloat64()*0.3, 0, 500)
+
+	for i := range c.water {
+		if c.valves[i] == 1 {
+			c.water[i] += 10
+		} else {
+			c.water[i] -= rand.Intn(2)
+			if fault {
+				c.water[i] -= int(c.scenario.leakRate)
+			}
+		}
+		c.water[i] = int(clamp(float64(c.water[i]), 0, 100))
+	}
+}
+
+// environment returns the reading the sensor would report, and false when it reports nothing
+func (c *cageModel) environment(at time.Time) (envReading, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fault := c.faultOn(at)
+	if fault && c.scenario.dropout {
+		return envReading{}, false
+	}
+	if fault && c.scenario.stuck && c.lastEnv.temperature != 0 {
+		return c.lastEnv, true
+	}
+	r := envReading{
+		temperature: math.Round(c.temperature*10) / 10,
+		humidity:    math.Round(c.humidity*10) / 10,
+		gas:         math.Round(c.gas*10) / 10,
+	}
+	if fault && c.scenario.spikes && rand.Intn(5) == 0 {
+		r.temperature = math.Round((r.temperature+15+rand.Float64()*20)*10) / 10
+		if r.temperature > 79 {
+			r.temperature = 79
+		}
+	}
+	c.lastEnv = r
+	return r, true
+}
+
+func (c *cageModel) relays() [3]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.envRelays
+}
+
+func (c *cageModel) waterState() ([3]int, [3]int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.water, c.valves
+}
+
+func (c *cageModel) setRelay(water bool, relay, state int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if water {
+		c.valves[relay-1] = state
+	} else {
+		c.envRelays[relay-1] = state
+	}
+}
+
+func clamp(v, lo, hi float64) float64 {
+	return math.Max(lo, math.Min(hi, v))
+}
+
+// faultWindow reports whether the scenario's fault is active at a given time
+func faultWindow(started time.Time, after, length time.Duration) func(time.Time) bool {
+	return func(at time.Time) bool {
+		d := at.Sub(started)
+		return d >= after && (length == 0 || d < after+length)
+	}
+}
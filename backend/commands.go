@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+/* ===========================
+    Gateway Commands
+=========================== */
+
+// Commands go down as {"type":"command","commandId":"...", ...command fields}.
+// The gateway answers with {"type":"ack","commandId":"...","ok":true,"result":{...}}
+// or "ok":false with an "error". A retried command keeps its commandId, so
+// gateways must ignore a commandId they have already executed (and ack it again).
+type GatewayCommand struct {
+	CommandID   string          `json:"CommandID"`
+	GatewayID   string          `json:"GatewayID"`
+	Payload     json.RawMessage `json:"Payload"`
+	IssuedBy    string          `json:"IssuedBy"`
+	Status      string          `json:"Status"`
+	Attempts    int             `json:"Attempts"`
+	MaxAttempts int             `json:"MaxAttempts"`
+	Result      json.RawMessage `json:"Result"`
+	Error       *string         `json:"Error"`
+	CreatedAt   string          `json:"CreatedAt"`
+	CompletedAt *string         `json:"CompletedAt"`
+}
+
+const (
+	CommandPending  = "Pending"
+	CommandSent     = "Sent"
+	CommandAcked    = "Acked"
+	CommandFailed   = "Failed"
+	CommandTimedOut = "TimedOut"
+
+	defaultAckTimeout     = 5 * time.Second
+	defaultCommandRetries = 2
+	maxAckTimeout         = 60 * time.Second
+	maxCommandRetries     = 5
+
+	// A sync request gives up waiting in time to answer before the server's write
+	// timeout; the command itself carries on and can be polled
+	maxSyncCommandWait = serverWriteTimeout - 2*time.Second
+)
+
+type CommandOptions struct {
+	AckTimeout time.Duration
+	Retries    int
+}
+
+type commandAck struct {
+	OK     bool
+	Error  string
+	Result json.RawMessage
+}
+
+// A command waiting for its ack. done is closed once the command has a final status.
+type pendingCommand struct {
+	gatewayID string
+	via       *Gateway // connection the last attempt was queued on; guarded by pendingMu
+	ack       chan commandAck
+	done      chan struct{}
+}
+
+var (
+	pendingMu       sync.Mutex
+	pendingCommands = make(map[string]*pendingCommand)
+)
+
+func newCommandID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// issueGatewayCommand records the command and delivers it in the background with
+// retries. The returned channel is closed when the command is acked, failed or timed out.
+func issueGatewayCommand(ctx context.Context, gatewayID string, command map[string]interface{}, issuedBy string, opts CommandOptions) (string, <-chan struct{}, error) {
+	if opts.AckTimeout <= 0 {
+		opts.AckTimeout = defaultAckTimeout
+	}
+	if opts.Retries < 0 {
+		opts.Retries = defaultCommandRetries
+	}
+
+	cmdID := newCommandID()
+	frame := make(map[string]interface{}, len(command)+2)
+	for k, v := range command {
+		frame[k] = v
+	}
+	frame["type"] = "command"
+	frame["commandId"] = cmdID
+
+	payload, err := json.Marshal(command)
+	if err != nil {
+		return "", nil, err
+	}
+	query := `
+		INSERT INTO cm_gateway_commands (CommandID, GatewayID, Payload, IssuedBy, Status, MaxAttempts)
+		VALUES (?, ?, ?, ?, 'Pending', ?)`
+	if _, err := db.ExecContext(ctx, query, cmdID, gatewayID, string(payload), issuedBy, opts.Retries+1); err != nil {
+		return "", nil, err
+	}
+
+	p := &pendingCommand{gatewayID: gatewayID, ack: make(chan commandAck, 1), done: make(chan struct{})}
+	pendingMu.Lock()
+	pendingCommands[cmdID] = p
+	pendingMu.Unlock()
+
+	go deliverCommand(cmdID, p, frame, opts)
+	return cmdID, p.done, nil
+}
+
+// deliverCommand sends the frame and waits for the ack, retrying on timeout or
+// when the gateway is not connected. A negative ack is final and not retried.
+func deliverCommand(cmdID string, p *pendingCommand, frame map[string]interface{}, opts CommandOptions) {
+	defer func() {
+		pendingMu.Lock()
+		delete(pendingCommands, cmdID)
+		pendingMu.Unlock()
+		close(p.done)
+	}()
+
+	lastErr := "no ack from gateway"
+	for attempt := 1; attempt <= opts.Retries+1; attempt++ {
+		gatewayMu.RLock()
+		gw, ok := gateways[p.gatewayID]
+		gatewayMu.RUnlock()
+
+		if !ok {
+			lastErr = "gateway not connected"
+		} else if err := gw.writeJSON(frame); err != nil {
+			lastErr = "send failed: " + err.Error()
+		} else {
+			pendingMu.Lock()
+			p.via = gw
+			pendingMu.Unlock()
+			updateCommandStatus(cmdID, CommandSent, attempt, nil, "")
+			publishLive("command", gatewayTopic(p.gatewayID), map[string]interface{}{"commandId": cmdID, "gatewayId": p.gatewayID, "status": CommandSent, "attempt": attempt})
+
+			select {
+			case ack := <-p.ack:
+				if ack.OK {
+					finishCommand(cmdID, p.gatewayID, CommandAcked, attempt, ack.Result, "")
+				} else {
+					finishCommand(cmdID, p.gatewayID, CommandFailed, attempt, ack.Result, ack.Error)
+				}
+				return
+			case <-time.After(opts.AckTimeout):
+				lastErr = "no ack from gateway"
+			}
+			continue
+		}
+		// not connected or write failed: wait before the next attempt instead of spinning
+		select {
+		case ack := <-p.ack:
+			status := CommandAcked
+			if !ack.OK {
+				status = CommandFailed
+			}
+			finishCommand(cmdID, p.gatewayID, status, attempt, ack.Result, ack.Error)
+			return
+		case <-time.After(opts.AckTimeout):
+		}
+	}
+	finishCommand(cmdID, p.gatewayID, CommandTimedOut, opts.Retries+1, nil, lastErr)
+}
+
+func updateCommandStatus(cmdID, status string, attempts int, result json.RawMessage, errText string) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel()
+
+	var resultArg, errArg interface{}
+	if len(result) > 0 {
+		resultArg = string(result)
+	}
+	if errText != "" {
+		errArg = errText
+	}
+	query := `
+		UPDATE cm_gateway_commands
+		SET Status = ?, Attempts = ?, Result = COALESCE(?, Result), Error = ?,
+			CompletedAt = IF(? IN ('Acked', 'Failed', 'TimedOut'), NOW(), NULL)
+		WHERE CommandID = ?`
+	if _, err := db.ExecContext(ctx, query, status, attempts, resultArg, errArg, status, cmdID); err != nil {
+		log.Printf("[ERROR] Failed to update command %s: %v", cmdID, err)
+	}
+}
+
+func finishCommand(cmdID, gatewayID, status string, attempts int, result json.RawMessage, errText string) {
+	updateCommandStatus(cmdID, status, attempts, result, errText)
+	publishLive("command", gatewayTopic(gatewayID), map[string]interface{}{
+		"commandId": cmdID, "gatewayId": gatewayID, "status": status, "result": result, "error": errText,
+	})
+}
+
+// timeOutStaleCommands closes the commands a previous run of the server was
+// still delivering; nothing is waiting for their acks any more
+func timeOutStaleCommands(ctx context.Context) error {
+	query := `
+		UPDATE cm_gateway_commands SET Status = 'TimedOut', Error = 'server restarted', CompletedAt = NOW()
+		WHERE Status IN ('Pending', 'Sent')`
+	_, err := db.ExecContext(ctx, query)
+	return err
+}
+
+// deliverCommandAck hands an ack frame to the command waiting for it
+func deliverCommandAck(gatewayID, cmdID string, ack commandAck) bool {
+	pendingMu.Lock()
+	p, ok := pendingCommands[cmdID]
+	pendingMu.Unlock()
+	if !ok || p.gatewayID != gatewayID {
+		return false
+	}
+	select {
+	case p.ack <- ack:
+	default: // a duplicate ack for a retried command
+	}
+	return true
+}
+
+// failPendingCommands fails the commands that were sent on a connection that has
+// gone away; a gateway that reconnects does not get them replayed
+func failPendingCommands(gw *Gateway, reason string) {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	for _, p := range pendingCommands {
+		if p.via != gw {
+			continue
+		}
+		select {
+		case p.ack <- commandAck{OK: false, Error: "gateway disconnected: " + reason}:
+		default:
+		}
+	}
+}
+
+const gatewayCommandColumns = `CommandID, GatewayID, Payload, IssuedBy, Status, Attempts, MaxAttempts, Result, Error,
+	CreatedAt, CompletedAt`
+
+// scanGatewayCommand reads one row selected with gatewayCommandColumns
+func scanGatewayCommand(row interface{ Scan(...interface{}) error }) (GatewayCommand, error) {
+	var c GatewayCommand
+	var payload string
+	var result *string
+	err := row.Scan(&c.CommandID, &c.GatewayID, &payload, &c.IssuedBy, &c.Status,
+		&c.Attempts, &c.MaxAttempts, &result, &c.Error, &c.CreatedAt, &c.CompletedAt)
+	if err != nil {
+		return c, err
+	}
+	c.Payload = json.RawMessage(payload)
+	if result != nil {
+		c.Result = json.RawMessage(*result)
+	}
+	return c, nil
+}
+
+func loadGatewayCommand(ctx context.Context, cmdID string) (GatewayCommand, error) {
+	query := "SELECT " + gatewayCommandColumns + " FROM cm_gateway_commands WHERE CommandID = ?"
+	return scanGatewayCommand(db.QueryRowContext(ctx, query, cmdID))
+}
+
+/* ===========================
+    Command Handlers
+=========================== */
+
+// POST /api/iot/gateways/{id}/command?mode=sync|async&timeout=5&retries=2
+// sync (the default) waits for the gateway's ack; async returns 202 and the
+// command can be polled at /api/iot/commands/{commandId}. A sync request whose
+// command is still retrying after maxSyncCommandWait also gets the 202.
+func sendCommand(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	var cmd map[string]interface{}
+	if !decodeJSONBody(w, r, &cmd) {
+		return
+	}
+
+	opts := CommandOptions{AckTimeout: defaultAckTimeout, Retries: defaultCommandRetries}
+	if s := r.URL.Query().Get("timeout"); s != "" {
+		secs, err := strconv.Atoi(s)
+		if err != nil || secs <= 0 || time.Duration(secs)*time.Second > maxAckTimeout {
+			handleError(w, http.StatusBadRequest, "timeout must be 1-60 seconds", err)
+			return
+		}
+		opts.AckTimeout = time.Duration(secs) * time.Second
+	}
+	if s := r.URL.Query().Get("retries"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > maxCommandRetries {
+			handleError(w, http.StatusBadRequest, "retries must be 0-5", err)
+			return
+		}
+		opts.Retries = n
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "sync"
+	}
+	if mode != "sync" && mode != "async" {
+		handleError(w, http.StatusBadRequest, "mode must be sync or async", nil)
+		return
+	}
+
+	gatewayMu.RLock()
+	gw, ok := gateways[id]
+	gatewayMu.RUnlock()
+	if !ok {
+		handleError(w, http.StatusNotFound, "gateway not connected", nil)
+		return
+	}
+	if !gw.isClaimed() {
+		handleError(w, http.StatusConflict, "gateway not claimed", nil)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	cmdID, done, err := issueGatewayCommand(ctx, id, cmd, requestUsername(r), opts)
+	cancel()
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to issue command", err)
+		return
+	}
+
+	if mode == "async" {
+		respondJSON(w, http.StatusAccepted, map[string]interface{}{"success": true, "commandId": cmdID, "status": CommandPending})
+		return
+	}
+
+	wait := time.NewTimer(maxSyncCommandWait)
+	defer wait.Stop()
+	select {
+	case <-done:
+	case <-wait.C:
+		respondJSON(w, http.StatusAccepted, map[string]interface{}{"success": true, "commandId": cmdID, "status": CommandSent})
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	ctx, cancel = withTimeout(context.Background())
+	defer cancel()
+	result, err := loadGatewayCommand(ctx, cmdID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to load command result", err)
+		return
+	}
+	status := http.StatusOK
+	switch result.Status {
+	case CommandFailed:
+		status = http.StatusBadGateway
+	case CommandTimedOut:
+		status = http.StatusGatewayTimeout
+	}
+	respondJSON(w, status, map[string]interface{}{"success": result.Status == CommandAcked, "command": result})
+}
+
+// GET /api/iot/commands/{id}
+func getGatewayCommand(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	c, err := loadGatewayCommand(ctx, chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		handleError(w, http.StatusNotFound, "Command not found", nil)
+		return
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch command", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, c)
+}
+
+// GET /api/iot/commands?gateway=gw-1&limit=50
+func getGatewayCommands(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	limit := 50
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+	query := "SELECT " + gatewayCommandColumns + " FROM cm_gateway_commands"
+	var args []interface{}
+	if gw := r.URL.Query().Get("gateway"); gw != "" {
+		query += " WHERE GatewayID = ?"
+		args = append(args, gw)
+	}
+	query += " ORDER BY CreatedAt DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch commands", err)
+		return
+	}
+	defer rows.Close()
+
+	commands := []GatewayCommand{}
+	for rows.Next() {
+		c, err := scanGatewayCommand(rows)
+		if err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan command", err)
+			return
+		}
+		commands = append(commands, c)
+	}
+	respondJSON(w, http.StatusOK, commands)
+}
@@ -0,0 +1,737 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+/* ===========================
+    Water & Feed Metering
+=========================== */
+
+// Water intake is derived from the level sensors (Water1..3) of gateway and
+// direct devices: a drop in a channel's level counts as drinking, a rise is a
+// refill. Changes smaller than the meter's MinDropUnits are sensor noise and are
+// ignored. A water meter maps one channel to a cage and says how many litres one
+// unit of level is worth (for float switches that is the volume between two
+// switches). Each meter's daily litres are kept in cm_water_meter_days, so
+// removing a meter does not erase the water it already measured. Feed comes from "feeder_dispensed"
+// events ({"grams":500}), sent by gateway feeders or recorded when a direct
+// feeder with GramsPerDispense is triggered through the proxy. Both are summed
+// per cage and day, attributed to the batch living in the cage that day, and
+// stored in cm_batch_consumption by the telemetry job. With FEED_USAGE_DRAFTS=1
+// each finished day's feed also becomes a draft inventory usage for a user to confirm.
+type WaterMeter struct {
+	ID            int     `json:"id"`
+	GatewayID     string  `json:"gatewayId"`
+	DeviceID      string  `json:"deviceId"`
+	Channel       int     `json:"channel"`
+	CageNum       *int    `json:"cageNum"`
+	LitersPerUnit float64 `json:"litersPerUnit"`
+	MinDropUnits  int     `json:"minDropUnits"`
+	CreatedAt     string  `json:"createdAt"`
+}
+
+type WaterMeterPayload struct {
+	GatewayID     string  `json:"gatewayId"`
+	DeviceID      string  `json:"deviceId"`
+	Channel       int     `json:"channel"`
+	CageNum       *int    `json:"cageNum"`
+	LitersPerUnit float64 `json:"litersPerUnit"`
+	MinDropUnits  int     `json:"minDropUnits"` // defaults to defaultWaterMinDrop
+}
+
+type ConsumptionDay struct {
+	Date        string  `json:"date"`
+	CageNum     int     `json:"cageNum"`
+	WaterLiters float64 `json:"waterLiters"`
+	FeedKg      float64 `json:"feedKg"`
+	Dispenses   int     `json:"dispenses"`
+}
+
+type BatchConsumption struct {
+	BatchID          int              `json:"batchId"`
+	WaterLiters      float64          `json:"waterLiters"`
+	FeedKg           float64          `json:"feedKg"`
+	WaterToFeedRatio *float64         `json:"waterToFeedRatio"` // litres of water per kg of feed
+	Days             []ConsumptionDay `json:"days"`
+}
+
+type FeedUsageDraft struct {
+	ID         int     `json:"id"`
+	BatchID    int     `json:"batchId"`
+	BatchName  string  `json:"batchName"`
+	Date       string  `json:"date"`
+	QuantityKg float64 `json:"quantityKg"`
+	Status     string  `json:"status"`
+	UsageID    *int    `json:"usageId"`
+	ReviewedBy *string `json:"reviewedBy"`
+	ReviewedAt *string `json:"reviewedAt"`
+	CreatedAt  string  `json:"createdAt"`
+}
+
+type ConfirmFeedDraftPayload struct {
+	ItemID       int      `json:"itemId"`
+	QuantityUsed *float64 `json:"quantityUsed"` // in the item's unit; defaults to the metered kg
+}
+
+const (
+	FeedDraftPending   = "pending"
+	FeedDraftConfirmed = "confirmed"
+	FeedDraftDismissed = "dismissed"
+
+	feederDispensedEvent = "feeder_dispensed"
+
+	defaultWaterMinDrop = 2
+)
+
+type consumptionKey struct {
+	cageNum int
+	day     string
+}
+
+type consumptionTotals struct {
+	waterLiters float64
+	feedKg      float64
+	dispenses   int
+}
+
+/* ===========================
+    Rollup
+=========================== */
+
+// rollupConsumption recomputes water and feed per batch, cage and day for every
+// day from the one containing since. Active meters rewrite their own rows in
+// cm_water_meter_days; the batch totals are then rebuilt from all meter days and
+// the feeder events, both of which are kept, so late readings are picked up,
+// running twice is harmless and removed meters keep their history.
+func rollupConsumption(ctx context.Context, since time.Time) error {
+	dayStart := time.Date(since.Year(), since.Month(), since.Day(), 0, 0, 0, 0, time.Local)
+	day := dayStart.Format("2006-01-02")
+	totals := make(map[consumptionKey]*consumptionTotals)
+	add := func(cageNum int, at time.Time) *consumptionTotals {
+		k := consumptionKey{cageNum, at.Format("2006-01-02")}
+		if totals[k] == nil {
+			totals[k] = &consumptionTotals{}
+		}
+		return totals[k]
+	}
+
+	meterDays, err := meterWater(ctx, dayStart)
+	if err != nil {
+		return fmt.Errorf("water metering: %w", err)
+	}
+	if err := meterFeed(ctx, dayStart, add); err != nil {
+		return fmt.Errorf("feed metering: %w", err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for meterID, days := range meterDays {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM cm_water_meter_days WHERE MeterID = ? AND Date >= ?", meterID, day); err != nil {
+			return err
+		}
+		for k, liters := range days {
+			query := "INSERT INTO cm_water_meter_days (MeterID, CageNum, Date, WaterLiters) VALUES (?, ?, ?, ?)"
+			if _, err := tx.ExecContext(ctx, query, meterID, k.cageNum, k.day, math.Round(liters*1000)/1000); err != nil {
+				return err
+			}
+		}
+	}
+	if err := sumMeterDays(ctx, tx, day, totals); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM cm_batch_consumption WHERE Date >= ?", day); err != nil {
+		return err
+	}
+	query := `
+		INSERT INTO cm_batch_consumption (BatchID, CageNum, Date, WaterLiters, FeedKg, Dispenses)
+		VALUES (?, ?, ?, ?, ?, ?)`
+	for k, t := range totals {
+		date, _ := time.ParseInLocation("2006-01-02", k.day, time.Local)
+		batchID, err := batchInCage(ctx, tx, k.cageNum, date)
+		if err != nil {
+			return err
+		}
+		if batchID == nil {
+			continue // nothing living in the cage that day
+		}
+		if _, err := tx.ExecContext(ctx, query, *batchID, k.cageNum, k.day,
+			math.Round(t.waterLiters*1000)/1000, math.Round(t.feedKg*1000)/1000, t.dispenses); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if getEnvInt("FEED_USAGE_DRAFTS", 0) == 1 {
+		return draftFeedUsage(ctx, dayStart)
+	}
+	return nil
+}
+
+// sumMeterDays adds the stored litres of every meter, active or not, to totals
+func sumMeterDays(ctx context.Context, tx *sql.Tx, day string, totals map[consumptionKey]*consumptionTotals) error {
+	query := `
+		SELECT CageNum, DATE_FORMAT(Date, '%Y-%m-%d'), SUM(WaterLiters)
+		FROM cm_water_meter_days
+		WHERE Date >= ?
+		GROUP BY CageNum, Date`
+	rows, err := tx.QueryContext(ctx, query, day)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k consumptionKey
+		var liters float64
+		if err := rows.Scan(&k.cageNum, &k.day, &liters); err != nil {
+			return err
+		}
+		if totals[k] == nil {
+			totals[k] = &consumptionTotals{}
+		}
+		totals[k].waterLiters += liters
+	}
+	return rows.Err()
+}
+
+// waterLevelDrop compares a level with the last accepted one (nil before the first
+// reading). It reports how far the level dropped and whether the level becomes the
+// new reference: the first reading, refills and drops of at least minDrop do, and
+// smaller moves either way are sensor noise.
+func waterLevelDrop(ref *int, level, minDrop int) (int, bool) {
+	switch {
+	case ref == nil, level-*ref >= minDrop:
+		return 0, true
+	case *ref-level >= minDrop:
+		return *ref - level, true
+	}
+	return 0, false
+}
+
+// meterWater sums the level drops of every active water meter per cage and day.
+// A drop only counts once the level has fallen MinDropUnits below the last
+// accepted level, and only a rise of as much is taken as a refill.
+func meterWater(ctx context.Context, dayStart time.Time) (map[int]map[consumptionKey]float64, error) {
+	meters, err := loadWaterMeters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// one reading before the window gives the first drop of the day a baseline
+	from := dayStart.Add(-time.Hour).Format(sqlDateTime)
+
+	result := make(map[int]map[consumptionKey]float64, len(meters))
+	for _, m := range meters {
+		days := make(map[consumptionKey]float64)
+		result[m.ID] = days
+		minDrop := m.MinDropUnits
+		if minDrop < 1 {
+			minDrop = 1
+		}
+		query := fmt.Sprintf(`
+			SELECT CageNum, Water%d, ReceivedAt
+			FROM cm_gateway_telemetry
+			WHERE GatewayID = ? AND DeviceID = ? AND ReceivedAt >= ? AND Water%[1]d IS NOT NULL
+			ORDER BY ReceivedAt, ID`, m.Channel)
+		rows, err := db.QueryContext(ctx, query, m.GatewayID, m.DeviceID, from)
+		if err != nil {
+			return nil, err
+		}
+		var ref *int
+		for rows.Next() {
+			var cageNum *int
+			var level int
+			var at string
+			if err := rows.Scan(&cageNum, &level, &at); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			t, err := time.ParseInLocation(sqlDateTime, at, time.Local)
+			if err != nil {
+				continue
+			}
+			if m.CageNum != nil {
+				cageNum = m.CageNum
+			}
+			drop, accept := waterLevelDrop(ref, level, minDrop)
+			if !accept {
+				continue
+			}
+			if drop > 0 && !t.Before(dayStart) && cageNum != nil {
+				days[consumptionKey{*cageNum, t.Format("2006-01-02")}] += float64(drop) * m.LitersPerUnit
+			}
+			l := level
+			ref = &l
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// meterFeed sums feeder_dispensed events; the cage comes from the device registry
+func meterFeed(ctx context.Context, dayStart time.Time, add func(int, time.Time) *consumptionTotals) error {
+	query := `
+		SELECT e.Detail, e.ReceivedAt, COALESCE(gd.CageNum, d.CageNum)
+		FROM cm_gateway_events e
+		LEFT JOIN cm_gateway_devices gd ON gd.GatewayID = e.GatewayID AND gd.DeviceID = e.DeviceID
+		LEFT JOIN cm_devices d ON e.GatewayID = ? AND CAST(d.DeviceID AS CHAR) = e.DeviceID
+		WHERE e.Event = ? AND e.ReceivedAt >= ?`
+	rows, err := db.QueryContext(ctx, query, directDeviceGateway, feederDispensedEvent, dayStart.Format(sqlDateTime))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var detail, at string
+		var cageNum *int
+		if err := rows.Scan(&detail, &at, &cageNum); err != nil {
+			return err
+		}
+		var d struct {
+			Grams float64 `json:"grams"`
+			Cage  *int    `json:"cage"`
+		}
+		if json.Unmarshal([]byte(detail), &d) != nil || d.Grams <= 0 {
+			continue
+		}
+		if d.Cage != nil {
+			cageNum = d.Cage
+		}
+		t, err := time.ParseInLocation(sqlDateTime, at, time.Local)
+		if err != nil || cageNum == nil {
+			continue
+		}
+		c := add(*cageNum, t)
+		c.feedKg += d.Grams / 1000
+		c.dispenses++
+	}
+	return rows.Err()
+}
+
+// draftFeedUsage turns each finished day's metered feed into a pending usage
+// draft; drafts nobody has reviewed yet follow late corrections
+func draftFeedUsage(ctx context.Context, dayStart time.Time) error {
+	query := `
+		INSERT INTO cm_feed_usage_drafts (BatchID, Date, QuantityKg)
+		SELECT BatchID, Date, SUM(FeedKg)
+		FROM cm_batch_consumption
+		WHERE Date >= ? AND Date < CURDATE()
+		GROUP BY BatchID, Date
+		HAVING SUM(FeedKg) > 0
+		ON DUPLICATE KEY UPDATE QuantityKg = IF(Status = 'pending', VALUES(QuantityKg), QuantityKg)`
+	_, err := db.ExecContext(ctx, query, dayStart.Format("2006-01-02"))
+	return err
+}
+
+// recordFeederDispense logs a dispense by a direct feeder triggered through the proxy
+func recordFeederDispense(ctx context.Context, d Device) {
+	if d.GramsPerDispense == nil || *d.GramsPerDispense <= 0 {
+		return
+	}
+	detail := fmt.Sprintf(`{"grams":%g,"source":"proxy"}`, *d.GramsPerDispense)
+	query := "INSERT INTO cm_gateway_events (GatewayID, DeviceID, Event, Detail, ReceivedAt) VALUES (?, ?, ?, ?, NOW())"
+	if _, err := db.ExecContext(ctx, query, directDeviceGateway, d.historyID(), feederDispensedEvent, detail); err != nil {
+		log.Printf("[ERROR] Failed to record feeder dispense for device %d: %v", d.ID, err)
+	}
+}
+
+// batchConsumptionTotals returns the metered water (L) and feed (kg) of a batch and their ratio
+func batchConsumptionTotals(ctx context.Context, batchID int) (float64, float64, *float64, error) {
+	var water, feed float64
+	query := "SELECT COALESCE(SUM(WaterLiters), 0), COALESCE(SUM(FeedKg), 0) FROM cm_batch_consumption WHERE BatchID = ?"
+	if err := db.QueryRowContext(ctx, query, batchID).Scan(&water, &feed); err != nil {
+		return 0, 0, nil, err
+	}
+	return math.Round(water*100) / 100, math.Round(feed*100) / 100, waterToFeedRatio(water, feed), nil
+}
+
+func waterToFeedRatio(waterLiters, feedKg float64) *float64 {
+	if feedKg <= 0 {
+		return nil
+	}
+	ratio := math.Round(waterLiters/feedKg*100) / 100
+	return &ratio
+}
+
+/* ===========================
+    Water Meter Handlers
+=========================== */
+
+func loadWaterMeters(ctx context.Context) ([]WaterMeter, error) {
+	query := `
+		SELECT MeterID, GatewayID, DeviceID, Channel, CageNum, LitersPerUnit, MinDropUnits, CreatedAt
+		FROM cm_water_meters
+		WHERE IsActive = 1
+		ORDER BY GatewayID, DeviceID, Channel`
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []WaterMeter{}
+	for rows.Next() {
+		var m WaterMeter
+		if err := rows.Scan(&m.ID, &m.GatewayID, &m.DeviceID, &m.Channel, &m.CageNum, &m.LitersPerUnit, &m.MinDropUnits, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	return list, rows.Err()
+}
+
+func validateWaterMeter(w http.ResponseWriter, p *WaterMeterPayload) bool {
+	p.GatewayID = strings.TrimSpace(p.GatewayID)
+	p.DeviceID = strings.TrimSpace(p.DeviceID)
+	if p.GatewayID == "" || p.DeviceID == "" {
+		handleError(w, http.StatusBadRequest, "gatewayId and deviceId are required (gatewayId \"direct\" and the registry id for direct-IP devices)", nil)
+		return false
+	}
+	if p.Channel < 1 || p.Channel > 3 {
+		handleError(w, http.StatusBadRequest, "channel must be 1, 2 or 3", nil)
+		return false
+	}
+	if p.LitersPerUnit <= 0 {
+		handleError(w, http.StatusBadRequest, "litersPerUnit must be greater than 0", nil)
+		return false
+	}
+	if p.MinDropUnits < 0 {
+		handleError(w, http.StatusBadRequest, "minDropUnits cannot be negative", nil)
+		return false
+	}
+	if p.MinDropUnits == 0 {
+		p.MinDropUnits = defaultWaterMinDrop
+	}
+	return true
+}
+
+// GET /api/consumption/water-meters
+func getWaterMeters(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	list, err := loadWaterMeters(ctx)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch water meters", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, list)
+}
+
+// POST /api/consumption/water-meters
+func createWaterMeter(w http.ResponseWriter, r *http.Request) {
+	var payload WaterMeterPayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if !validateWaterMeter(w, &payload) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := `
+		INSERT INTO cm_water_meters (GatewayID, DeviceID, Channel, CageNum, LitersPerUnit, MinDropUnits) VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE MeterID = LAST_INSERT_ID(MeterID), CageNum = VALUES(CageNum),
+			LitersPerUnit = VALUES(LitersPerUnit), MinDropUnits = VALUES(MinDropUnits), IsActive = 1`
+	res, err := db.ExecContext(ctx, query, payload.GatewayID, payload.DeviceID, payload.Channel, payload.CageNum,
+		payload.LitersPerUnit, payload.MinDropUnits)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to create water meter", err)
+		return
+	}
+	id, _ := res.LastInsertId()
+	respondJSON(w, http.StatusCreated, map[string]interface{}{"success": true, "insertedId": id})
+}
+
+// PUT /api/consumption/water-meters/{id}
+func updateWaterMeter(w http.ResponseWriter, r *http.Request) {
+	meterID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid water meter ID", err)
+		return
+	}
+	var payload WaterMeterPayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if !validateWaterMeter(w, &payload) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := `
+		UPDATE cm_water_meters SET GatewayID = ?, DeviceID = ?, Channel = ?, CageNum = ?, LitersPerUnit = ?, MinDropUnits = ?
+		WHERE MeterID = ? AND IsActive = 1`
+	res, err := db.ExecContext(ctx, query, payload.GatewayID, payload.DeviceID, payload.Channel, payload.CageNum,
+		payload.LitersPerUnit, payload.MinDropUnits, meterID)
+	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			handleError(w, http.StatusConflict, "That device channel already has a water meter", nil)
+			return
+		}
+		handleError(w, http.StatusInternalServerError, "Failed to update water meter", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		handleError(w, http.StatusNotFound, "Water meter not found or no changes made", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// DELETE /api/consumption/water-meters/{id}
+func deleteWaterMeter(w http.ResponseWriter, r *http.Request) {
+	meterID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid water meter ID", err)
+		return
+	}
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, "UPDATE cm_water_meters SET IsActive = 0 WHERE MeterID = ? AND IsActive = 1", meterID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to delete water meter", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		handleError(w, http.StatusNotFound, "Water meter not found", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+/* ===========================
+    Consumption Handlers
+=========================== */
+
+// GET /api/batches/{id}/consumption returns the metered days of a batch, newest first
+func getBatchConsumption(w http.ResponseWriter, r *http.Request) {
+	batchID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid batch ID", err)
+		return
+	}
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := `
+		SELECT Date, CageNum, WaterLiters, FeedKg, Dispenses
+		FROM cm_batch_consumption
+		WHERE BatchID = ?
+		ORDER BY Date DESC, CageNum`
+	rows, err := db.QueryContext(ctx, query, batchID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch consumption", err)
+		return
+	}
+	defer rows.Close()
+
+	out := BatchConsumption{BatchID: batchID, Days: []ConsumptionDay{}}
+	for rows.Next() {
+		var d ConsumptionDay
+		if err := rows.Scan(&d.Date, &d.CageNum, &d.WaterLiters, &d.FeedKg, &d.Dispenses); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan consumption", err)
+			return
+		}
+		out.WaterLiters += d.WaterLiters
+		out.FeedKg += d.FeedKg
+		out.Days = append(out.Days, d)
+	}
+	out.WaterLiters = math.Round(out.WaterLiters*100) / 100
+	out.FeedKg = math.Round(out.FeedKg*100) / 100
+	out.WaterToFeedRatio = waterToFeedRatio(out.WaterLiters, out.FeedKg)
+	respondJSON(w, http.StatusOK, out)
+}
+
+// GET /api/consumption/feed-drafts?status=pending&batch=3
+func getFeedUsageDrafts(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := `
+		SELECT d.DraftID, d.BatchID, b.BatchName, d.Date, d.QuantityKg, d.Status, d.UsageID, d.ReviewedBy, d.ReviewedAt, d.CreatedAt
+		FROM cm_feed_usage_drafts d
+		JOIN cm_batches b ON b.BatchID = d.BatchID
+		WHERE 1=1`
+	var args []interface{}
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = FeedDraftPending
+	}
+	if status != "all" {
+		query += " AND d.Status = ?"
+		args = append(args, status)
+	}
+	if b := r.URL.Query().Get("batch"); b != "" {
+		batchID, err := strconv.Atoi(b)
+		if err != nil {
+			handleError(w, http.StatusBadRequest, "Invalid batch ID", err)
+			return
+		}
+		query += " AND d.BatchID = ?"
+		args = append(args, batchID)
+	}
+	query += " ORDER BY d.Date DESC, d.BatchID"
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch feed usage drafts", err)
+		return
+	}
+	defer rows.Close()
+
+	list := []FeedUsageDraft{}
+	for rows.Next() {
+		var d FeedUsageDraft
+		if err := rows.Scan(&d.ID, &d.BatchID, &d.BatchName, &d.Date, &d.QuantityKg, &d.Status, &d.UsageID,
+			&d.ReviewedBy, &d.ReviewedAt, &d.CreatedAt); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan feed usage draft", err)
+			return
+		}
+		list = append(list, d)
+	}
+	respondJSON(w, http.StatusOK, list)
+}
+
+// lockPendingDraft loads a draft inside tx and checks nobody reviewed it yet
+func lockPendingDraft(ctx context.Context, w http.ResponseWriter, tx *sql.Tx, draftID int) (FeedUsageDraft, bool) {
+	var d FeedUsageDraft
+	query := "SELECT DraftID, BatchID, Date, QuantityKg, Status FROM cm_feed_usage_drafts WHERE DraftID = ? FOR UPDATE"
+	err := tx.QueryRowContext(ctx, query, draftID).Scan(&d.ID, &d.BatchID, &d.Date, &d.QuantityKg, &d.Status)
+	if errors.Is(err, sql.ErrNoRows) {
+		handleError(w, http.StatusNotFound, "Feed usage draft not found", nil)
+		return d, false
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch feed usage draft", err)
+		return d, false
+	}
+	if d.Status != FeedDraftPending {
+		handleError(w, http.StatusConflict, "Feed usage draft was already "+d.Status, nil)
+		return d, false
+	}
+	return d, true
+}
+
+// POST /api/consumption/feed-drafts/{id}/confirm books the draft as inventory usage
+func confirmFeedUsageDraft(w http.ResponseWriter, r *http.Request) {
+	draftID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid draft ID", err)
+		return
+	}
+	var payload ConfirmFeedDraftPayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if payload.ItemID <= 0 {
+		handleError(w, http.StatusBadRequest, "itemId is required", nil)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+
+	draft, ok := lockPendingDraft(ctx, w, tx, draftID)
+	if !ok {
+		return
+	}
+	if !requireBatchAction(ctx, w, tx, draft.BatchID, "usage") {
+		return
+	}
+	quantity := draft.QuantityKg
+	if payload.QuantityUsed != nil {
+		quantity = *payload.QuantityUsed
+	}
+	if quantity <= 0 {
+		handleError(w, http.StatusBadRequest, "quantityUsed must be greater than 0", nil)
+		return
+	}
+
+	usageID, err := drawInventoryUsage(ctx, tx, draft.BatchID, payload.ItemID, draft.Date, quantity)
+	if errors.Is(err, errInsufficientStock) {
+		handleError(w, http.StatusBadRequest, "Not enough total stock available to complete this action.", nil)
+		return
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to create usage record", err)
+		return
+	}
+
+	query := "UPDATE cm_feed_usage_drafts SET Status = ?, UsageID = ?, ReviewedBy = ?, ReviewedAt = NOW() WHERE DraftID = ?"
+	if _, err := tx.ExecContext(ctx, query, FeedDraftConfirmed, usageID, requestUsername(r), draftID); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to update feed usage draft", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to commit transaction", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true, "usageId": usageID})
+}
+
+// POST /api/consumption/feed-drafts/{id}/dismiss
+func dismissFeedUsageDraft(w http.ResponseWriter, r *http.Request) {
+	draftID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid draft ID", err)
+		return
+	}
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, ok := lockPendingDraft(ctx, w, tx, draftID); !ok {
+		return
+	}
+	query := "UPDATE cm_feed_usage_drafts SET Status = ?, ReviewedBy = ?, ReviewedAt = NOW() WHERE DraftID = ?"
+	if _, err := tx.ExecContext(ctx, query, FeedDraftDismissed, requestUsername(r), draftID); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to update feed usage draft", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to commit transaction", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestWaterLevelDrop(t *testing.T) {
+	// levels from a meter with a 3 unit deadband: jitter, a slow fall, a refill
+	levels := []int{100, 101, 99, 97, 96, 95, 93, 110, 108, 107}
+	wantDrops := []int{0, 0, 0, 3, 0, 0, 4, 0, 0, 3}
+	var ref *int
+	total := 0
+	for i, level := range levels {
+		drop, accept := waterLevelDrop(ref, level, 3)
+		if drop != wantDrops[i] {
+			t.Fatalf("reading %d (level %d): drop %d, want %d", i, level, drop, wantDrops[i])
+		}
+		if accept {
+			l := level
+			ref = &l
+		}
+		total += drop
+	}
+	if total != 10 {
+		t.Fatalf("total drop %d, want 10", total)
+	}
+	if *ref != 107 {
+		t.Fatalf("reference level %d, want 107", *ref)
+	}
+}
@@ -0,0 +1,680 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+/* ===========================
+    Closed-Loop Control Rules
+=========================== */
+
+// A control rule drives one relay from one cage metric, e.g. "cage 2 temperature
+// above 32 for 5 minutes: fan relay on; back off below 29":
+//
+//	{"CageNum":2,"Metric":"temperature","Operator":">","OnThreshold":32,"OffThreshold":29,
+//	 "ForSeconds":300,"MinOnSeconds":120,"MinOffSeconds":120,"GatewayID":"gw-1","DeviceID":"esp-fan-2","Relay":1}
+//
+// The gap between OnThreshold and OffThreshold is the hysteresis. MinOnSeconds and
+// MinOffSeconds stop the relay from chattering. Rules are evaluated on every reading
+// ingested for the cage from a gateway or registered device, except readings from
+// unhealthy sensors; cages in manual mode are left alone. A switch the gateway does
+// not carry out is retried with backoff rather than on the next reading. The same
+// state machine replays stored telemetry for the simulate endpoints.
+type ControlRule struct {
+	RuleID        int     `json:"RuleID"`
+	Name          string  `json:"Name"`
+	CageNum       int     `json:"CageNum"`
+	Metric        string  `json:"Metric"`
+	Operator      string  `json:"Operator"` // ">" turns on when above, "<" when below
+	OnThreshold   float64 `json:"OnThreshold"`
+	OffThreshold  float64 `json:"OffThreshold"`
+	ForSeconds    int     `json:"ForSeconds"`
+	MinOnSeconds  int     `json:"MinOnSeconds"`
+	MinOffSeconds int     `json:"MinOffSeconds"`
+	GatewayID     string  `json:"GatewayID"`
+	DeviceID      string  `json:"DeviceID"`
+	Relay         int     `json:"Relay"`
+	IsActive      bool    `json:"IsActive"`
+}
+
+type ControlAction struct {
+	ActionID  int64   `json:"ActionID"`
+	RuleID    int     `json:"RuleID"`
+	Action    string  `json:"Action"` // on, off
+	Value     float64 `json:"Value"`
+	At        string  `json:"At"`
+	Status    string  `json:"Status"`
+	CommandID *string `json:"CommandID"`
+	Detail    *string `json:"Detail"`
+}
+
+// SimulatedAction is what a rule would have done at a point in the replayed telemetry
+type SimulatedAction struct {
+	At     string  `json:"At"`
+	Action string  `json:"Action"`
+	Value  float64 `json:"Value"`
+}
+
+type SimulationResult struct {
+	Rule        ControlRule       `json:"Rule"`
+	From        string            `json:"From"`
+	To          string            `json:"To"`
+	Samples     int               `json:"Samples"`
+	Actions     []SimulatedAction `json:"Actions"`
+	Switches    int               `json:"Switches"`
+	OnMinutes   float64           `json:"OnMinutes"`
+	EndsInState string            `json:"EndsInState"`
+}
+
+// controlState is the relay state a rule believes it has set
+type controlState struct {
+	on         bool
+	lastChange time.Time // zero when the rule has never switched
+	condSince  time.Time // when the on-condition started holding; zero if it is not
+	failures   int       // consecutive switches the gateway did not carry out
+	retryAfter time.Time // set after a failed switch; the rule stays quiet until then
+}
+
+const (
+	maxSimulationSamples = 100000
+	controlRetryBase     = 30 * time.Second
+	controlRetryMax      = 10 * time.Minute
+)
+
+// controlRetryDelay is how long a rule waits after its nth consecutive failed switch
+func controlRetryDelay(failures int) time.Duration {
+	delay := controlRetryBase
+	for i := 1; i < failures && delay < controlRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > controlRetryMax {
+		delay = controlRetryMax
+	}
+	return delay
+}
+
+var (
+	controlMu     sync.Mutex
+	controlStates = make(map[int]*controlState)
+)
+
+// step feeds one reading to the rule and returns "on", "off" or "" when nothing changes
+func (rule ControlRule) step(st *controlState, value float64, at time.Time) string {
+	triggered := value > rule.OnThreshold
+	released := value < rule.OffThreshold
+	if rule.Operator == "<" {
+		triggered = value < rule.OnThreshold
+		released = value > rule.OffThreshold
+	}
+
+	if !st.retryAfter.IsZero() {
+		if at.Before(st.retryAfter) {
+			return ""
+		}
+		// The last switch never reached the relay, so its timers do not apply;
+		// send whichever state the reading calls for now
+		st.retryAfter = time.Time{}
+		if st.on && released {
+			st.on = false
+		} else if !st.on && triggered {
+			st.on = true
+		}
+		st.lastChange, st.condSince = at, time.Time{}
+		if st.on {
+			return "on"
+		}
+		return "off"
+	}
+
+	if !st.on {
+		if !triggered {
+			st.condSince = time.Time{}
+			return ""
+		}
+		if st.condSince.IsZero() {
+			st.condSince = at
+		}
+		if at.Sub(st.condSince) < time.Duration(rule.ForSeconds)*time.Second {
+			return ""
+		}
+		if !st.lastChange.IsZero() && at.Sub(st.lastChange) < time.Duration(rule.MinOffSeconds)*time.Second {
+			return ""
+		}
+		st.on, st.lastChange, st.condSince = true, at, time.Time{}
+		return "on"
+	}
+
+	if !released || at.Sub(st.lastChange) < time.Duration(rule.MinOnSeconds)*time.Second {
+		return ""
+	}
+	st.on, st.lastChange = false, at
+	return "off"
+}
+
+const controlRuleColumns = `
+	SELECT RuleID, Name, CageNum, Metric, Operator, OnThreshold, OffThreshold, ForSeconds, MinOnSeconds, MinOffSeconds,
+		GatewayID, DeviceID, Relay, IsActive
+	FROM cm_control_rules`
+
+func scanControlRule(scan func(dest ...interface{}) error) (ControlRule, error) {
+	var rule ControlRule
+	err := scan(&rule.RuleID, &rule.Name, &rule.CageNum, &rule.Metric, &rule.Operator, &rule.OnThreshold, &rule.OffThreshold,
+		&rule.ForSeconds, &rule.MinOnSeconds, &rule.MinOffSeconds, &rule.GatewayID, &rule.DeviceID, &rule.Relay, &rule.IsActive)
+	return rule, err
+}
+
+func loadControlRules(ctx context.Context, cageNum *int, activeOnly bool) ([]ControlRule, error) {
+	query := controlRuleColumns + " WHERE 1=1"
+	var args []interface{}
+	if cageNum != nil {
+		query += " AND CageNum = ?"
+		args = append(args, *cageNum)
+	}
+	if activeOnly {
+		query += " AND IsActive = 1"
+	}
+	query += " ORDER BY RuleID"
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []ControlRule{}
+	for rows.Next() {
+		rule, err := scanControlRule(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// loadControlState restores a rule's state from its last acknowledged action, so a
+// restart does not forget that a fan was switched on
+func loadControlState(ctx context.Context, ruleID int) (*controlState, error) {
+	st := &controlState{}
+	var action, at string
+	query := "SELECT Action, At FROM cm_control_rule_actions WHERE RuleID = ? AND Status = ? ORDER BY ActionID DESC LIMIT 1"
+	err := db.QueryRowContext(ctx, query, ruleID, RunDone).Scan(&action, &at)
+	if errors.Is(err, sql.ErrNoRows) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	st.on = action == "on"
+	if t, err := time.ParseInLocation(sqlDateTime, at, time.Local); err == nil {
+		st.lastChange = t
+	}
+	return st, nil
+}
+
+// evaluateControlRules runs the cage's rules against a new reading. Commands are
+// issued asynchronously so ingest is never held up by a slow gateway.
+func evaluateControlRules(ctx context.Context, cageNum int, values map[string]float64, at time.Time) {
+	rules, err := loadControlRules(ctx, &cageNum, true)
+	if err != nil {
+		log.Printf("[ERROR] Failed to load control rules for cage %d: %v", cageNum, err)
+		return
+	}
+	if len(rules) == 0 {
+		return
+	}
+	mode, err := cageMode(ctx, cageNum)
+	if err != nil {
+		log.Printf("[ERROR] Failed to read mode of cage %d: %v", cageNum, err)
+		return
+	}
+	if mode == CageModeManual {
+		return
+	}
+
+	// States of rules not seen since startup come from the database, read without
+	// holding controlMu
+	loaded := make(map[int]*controlState)
+	for _, rule := range rules {
+		if _, ok := values[rule.Metric]; !ok {
+			continue
+		}
+		controlMu.Lock()
+		_, known := controlStates[rule.RuleID]
+		controlMu.Unlock()
+		if known {
+			continue
+		}
+		st, err := loadControlState(ctx, rule.RuleID)
+		if err != nil {
+			log.Printf("[ERROR] Failed to load state of control rule %d: %v", rule.RuleID, err)
+			continue
+		}
+		loaded[rule.RuleID] = st
+	}
+
+	type pendingAction struct {
+		rule   ControlRule
+		action string
+		value  float64
+	}
+	var pending []pendingAction
+	controlMu.Lock()
+	for _, rule := range rules {
+		value, ok := values[rule.Metric]
+		if !ok {
+			continue
+		}
+		st, ok := controlStates[rule.RuleID]
+		if !ok {
+			if st, ok = loaded[rule.RuleID]; !ok {
+				continue
+			}
+			controlStates[rule.RuleID] = st
+		}
+		if action := rule.step(st, value, at); action != "" {
+			pending = append(pending, pendingAction{rule, action, value})
+		}
+	}
+	controlMu.Unlock()
+
+	for _, p := range pending {
+		applyControlAction(ctx, p.rule, p.action, p.value, at)
+	}
+}
+
+// recordControlResult tracks whether the gateway carried out the switch made at
+// `at`. A failure keeps the intended state and holds the rule back with a growing
+// delay, so an offline gateway is not sent a command on every reading. Results
+// for a switch the rule has since replaced are ignored.
+func recordControlResult(ruleID int, action string, at time.Time, ok bool) {
+	controlMu.Lock()
+	defer controlMu.Unlock()
+	st, known := controlStates[ruleID]
+	if !known || st.on != (action == "on") || !st.lastChange.Equal(at) {
+		return
+	}
+	if ok {
+		st.failures, st.retryAfter = 0, time.Time{}
+		return
+	}
+	st.failures++
+	st.retryAfter = time.Now().Add(controlRetryDelay(st.failures))
+}
+
+// applyControlAction logs the switch and sends it to the gateway, then records
+// the outcome against the rule's state
+func applyControlAction(ctx context.Context, rule ControlRule, action string, value float64, at time.Time) {
+	query := "INSERT INTO cm_control_rule_actions (RuleID, Action, Value, At, Status) VALUES (?, ?, ?, ?, 'Pending')"
+	res, err := db.ExecContext(ctx, query, rule.RuleID, action, value, at.Format(sqlDateTime))
+	if err != nil {
+		log.Printf("[ERROR] Failed to log control action for rule %d: %v", rule.RuleID, err)
+		recordControlResult(rule.RuleID, action, at, false)
+		return
+	}
+	actionID, _ := res.LastInsertId()
+
+	state := 0
+	if action == "on" {
+		state = 1
+	}
+	cmd := map[string]interface{}{"action": "set_relay", "device": rule.DeviceID, "relay": rule.Relay, "state": state}
+	cmdID, done, err := issueGatewayCommand(ctx, rule.GatewayID, cmd, "control-rule:"+strconv.Itoa(rule.RuleID), CommandOptions{AckTimeout: defaultAckTimeout, Retries: defaultCommandRetries})
+	if err != nil {
+		recordControlResult(rule.RuleID, action, at, false)
+		finishControlAction(actionID, RunFailed, nil, "could not issue command: "+err.Error())
+		return
+	}
+	publishLive("control", cageTopic(rule.CageNum), map[string]interface{}{
+		"ruleId": rule.RuleID, "action": action, "value": value, "device": rule.DeviceID, "relay": rule.Relay, "commandId": cmdID,
+	})
+
+	go func() {
+		<-done
+		ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+		defer cancel()
+		c, err := loadGatewayCommand(ctx, cmdID)
+		switch {
+		case err != nil:
+			recordControlResult(rule.RuleID, action, at, false)
+			finishControlAction(actionID, RunFailed, &cmdID, "could not load command result: "+err.Error())
+		case c.Status != CommandAcked:
+			recordControlResult(rule.RuleID, action, at, false)
+			detail := "command " + strings.ToLower(c.Status)
+			if c.Error != nil {
+				detail += ": " + *c.Error
+			}
+			finishControlAction(actionID, RunFailed, &cmdID, detail)
+		default:
+			recordControlResult(rule.RuleID, action, at, true)
+			finishControlAction(actionID, RunDone, &cmdID, "")
+		}
+	}()
+}
+
+func finishControlAction(actionID int64, status string, commandID *string, detail string) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel()
+	query := "UPDATE cm_control_rule_actions SET Status = ?, CommandID = ?, Detail = NULLIF(?, '') WHERE ActionID = ?"
+	if _, err := db.ExecContext(ctx, query, status, commandID, detail, actionID); err != nil {
+		log.Printf("[ERROR] Failed to update control action %d: %v", actionID, err)
+	}
+}
+
+// simulateControlRule replays the cage's stored readings in [from, to) through the rule
+func simulateControlRule(ctx context.Context, rule ControlRule, from, to time.Time) (SimulationResult, error) {
+	result := SimulationResult{Rule: rule, From: from.Format(sqlDateTime), To: to.Format(sqlDateTime), Actions: []SimulatedAction{}, EndsInState: "off"}
+
+	query := `
+		SELECT ` + telemetryMetrics[rule.Metric] + `, created_at
+		FROM cm_temperature
+		WHERE temp_cage_num = ? AND created_at >= ? AND created_at < ?
+			AND ` + telemetryMetrics[rule.Metric] + ` IS NOT NULL AND SensorFault IS NULL
+		ORDER BY created_at, temp_id
+		LIMIT ?`
+	rows, err := db.QueryContext(ctx, query, rule.CageNum, from.Format(sqlDateTime), to.Format(sqlDateTime), maxSimulationSamples)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	st := &controlState{}
+	var onSince time.Time
+	var last time.Time
+	for rows.Next() {
+		var value float64
+		var at string
+		if err := rows.Scan(&value, &at); err != nil {
+			return result, err
+		}
+		t, err := time.ParseInLocation(sqlDateTime, at, time.Local)
+		if err != nil {
+			return result, err
+		}
+		result.Samples++
+		last = t
+		switch rule.step(st, value, t) {
+		case "on":
+			onSince = t
+			result.Actions = append(result.Actions, SimulatedAction{At: at, Action: "on", Value: value})
+		case "off":
+			result.OnMinutes += t.Sub(onSince).Minutes()
+			result.Actions = append(result.Actions, SimulatedAction{At: at, Action: "off", Value: value})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+	if st.on {
+		result.OnMinutes += last.Sub(onSince).Minutes()
+		result.EndsInState = "on"
+	}
+	result.Switches = len(result.Actions)
+	result.OnMinutes = math.Round(result.OnMinutes*100) / 100
+	return result, nil
+}
+
+/* ===========================
+    Control Rule Handlers
+=========================== */
+
+func validateControlRule(w http.ResponseWriter, rule *ControlRule) bool {
+	rule.Name = strings.TrimSpace(rule.Name)
+	if rule.Name == "" || rule.GatewayID == "" || rule.DeviceID == "" {
+		handleError(w, http.StatusBadRequest, "Name, GatewayID and DeviceID are required", nil)
+		return false
+	}
+	if _, ok := telemetryMetrics[rule.Metric]; !ok {
+		handleError(w, http.StatusBadRequest, "Metric must be temperature, humidity, gas or nh3", nil)
+		return false
+	}
+	switch rule.Operator {
+	case ">":
+		if rule.OffThreshold > rule.OnThreshold {
+			handleError(w, http.StatusBadRequest, "OffThreshold must not be above OnThreshold for '>' rules", nil)
+			return false
+		}
+	case "<":
+		if rule.OffThreshold < rule.OnThreshold {
+			handleError(w, http.StatusBadRequest, "OffThreshold must not be below OnThreshold for '<' rules", nil)
+			return false
+		}
+	default:
+		handleError(w, http.StatusBadRequest, "Operator must be '>' or '<'", nil)
+		return false
+	}
+	if rule.Relay < 1 || rule.Relay > 3 {
+		handleError(w, http.StatusBadRequest, "Relay must be 1, 2 or 3", nil)
+		return false
+	}
+	if rule.ForSeconds < 0 || rule.MinOnSeconds < 0 || rule.MinOffSeconds < 0 {
+		handleError(w, http.StatusBadRequest, "Durations cannot be negative", nil)
+		return false
+	}
+	return true
+}
+
+// forgetControlState drops the cached state so an edited rule starts from its log
+func forgetControlState(ruleID int) {
+	controlMu.Lock()
+	delete(controlStates, ruleID)
+	controlMu.Unlock()
+}
+
+// GET /api/control-rules?cage=2
+func getControlRules(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	var cageNum *int
+	if c := r.URL.Query().Get("cage"); c != "" {
+		n, err := strconv.Atoi(c)
+		if err != nil {
+			handleError(w, http.StatusBadRequest, "Invalid cage", err)
+			return
+		}
+		cageNum = &n
+	}
+	rules, err := loadControlRules(ctx, cageNum, false)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch control rules", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, rules)
+}
+
+// POST /api/control-rules
+func createControlRule(w http.ResponseWriter, r *http.Request) {
+	var rule ControlRule
+	if !decodeJSONBody(w, r, &rule) {
+		return
+	}
+	if !validateControlRule(w, &rule) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := `
+		INSERT INTO cm_control_rules (Name, CageNum, Metric, Operator, OnThreshold, OffThreshold, ForSeconds, MinOnSeconds, MinOffSeconds,
+			GatewayID, DeviceID, Relay, IsActive)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1)`
+	res, err := db.ExecContext(ctx, query, rule.Name, rule.CageNum, rule.Metric, rule.Operator, rule.OnThreshold, rule.OffThreshold,
+		rule.ForSeconds, rule.MinOnSeconds, rule.MinOffSeconds, rule.GatewayID, rule.DeviceID, rule.Relay)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to create control rule", err)
+		return
+	}
+	id, _ := res.LastInsertId()
+	respondJSON(w, http.StatusCreated, map[string]interface{}{"success": true, "insertedId": id})
+}
+
+// PUT /api/control-rules/{id}
+func updateControlRule(w http.ResponseWriter, r *http.Request) {
+	ruleID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid rule ID", err)
+		return
+	}
+	// A body without IsActive keeps the rule running
+	rule := ControlRule{IsActive: true}
+	if !decodeJSONBody(w, r, &rule) {
+		return
+	}
+	if !validateControlRule(w, &rule) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := `
+		UPDATE cm_control_rules
+		SET Name = ?, CageNum = ?, Metric = ?, Operator = ?, OnThreshold = ?, OffThreshold = ?, ForSeconds = ?,
+			MinOnSeconds = ?, MinOffSeconds = ?, GatewayID = ?, DeviceID = ?, Relay = ?, IsActive = ?
+		WHERE RuleID = ?`
+	res, err := db.ExecContext(ctx, query, rule.Name, rule.CageNum, rule.Metric, rule.Operator, rule.OnThreshold, rule.OffThreshold,
+		rule.ForSeconds, rule.MinOnSeconds, rule.MinOffSeconds, rule.GatewayID, rule.DeviceID, rule.Relay, rule.IsActive, ruleID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to update control rule", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		handleError(w, http.StatusNotFound, "Control rule not found or no changes made", nil)
+		return
+	}
+	forgetControlState(ruleID)
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// DELETE /api/control-rules/{id} deactivates the rule; its action log is kept
+func deleteControlRule(w http.ResponseWriter, r *http.Request) {
+	ruleID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid rule ID", err)
+		return
+	}
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, "UPDATE cm_control_rules SET IsActive = 0 WHERE RuleID = ? AND IsActive = 1", ruleID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to delete control rule", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		handleError(w, http.StatusNotFound, "Control rule not found", nil)
+		return
+	}
+	forgetControlState(ruleID)
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// GET /api/control-rules/{id}/actions?limit=100
+func getControlActions(w http.ResponseWriter, r *http.Request) {
+	ruleID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid rule ID", err)
+		return
+	}
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := `
+		SELECT ActionID, RuleID, Action, Value, At, Status, CommandID, Detail
+		FROM cm_control_rule_actions WHERE RuleID = ?
+		ORDER BY ActionID DESC LIMIT ?`
+	rows, err := db.QueryContext(ctx, query, ruleID, limit)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch control actions", err)
+		return
+	}
+	defer rows.Close()
+
+	actions := []ControlAction{}
+	for rows.Next() {
+		var a ControlAction
+		if err := rows.Scan(&a.ActionID, &a.RuleID, &a.Action, &a.Value, &a.At, &a.Status, &a.CommandID, &a.Detail); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan control action", err)
+			return
+		}
+		actions = append(actions, a)
+	}
+	respondJSON(w, http.StatusOK, actions)
+}
+
+// GET /api/control-rules/{id}/simulate?range=7d (or from/to) replays a saved rule
+func simulateSavedControlRule(w http.ResponseWriter, r *http.Request) {
+	ruleID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid rule ID", err)
+		return
+	}
+	from, to, err := parseTelemetryRange(r, time.Now())
+	if err != nil || !to.After(from) {
+		handleError(w, http.StatusBadRequest, "Invalid time range", err)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	rule, err := scanControlRule(db.QueryRowContext(ctx, controlRuleColumns+" WHERE RuleID = ?", ruleID).Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		handleError(w, http.StatusNotFound, "Control rule not found", nil)
+		return
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch control rule", err)
+		return
+	}
+	result, err := simulateControlRule(ctx, rule, from, to)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to simulate control rule", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, result)
+}
+
+// POST /api/control-rules/simulate?range=7d tries out a rule before saving it
+func simulateDraftControlRule(w http.ResponseWriter, r *http.Request) {
+	var rule ControlRule
+	if !decodeJSONBody(w, r, &rule) {
+		return
+	}
+	if !validateControlRule(w, &rule) {
+		return
+	}
+	from, to, err := parseTelemetryRange(r, time.Now())
+	if err != nil || !to.After(from) {
+		handleError(w, http.StatusBadRequest, "Invalid time range", err)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	result, err := simulateControlRule(ctx, rule, from, to)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to simulate control rule", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestControlRuleStep(t *testing.T) {
+	fan := ControlRule{Operator: ">", OnThreshold: 32, OffThreshold: 29, ForSeconds: 60, MinOnSeconds: 120, MinOffSeconds: 120}
+	heater := ControlRule{Operator: "<", OnThreshold: 20, OffThreshold: 23}
+	t0 := time.Date(2026, 3, 1, 12, 0, 0, 0, time.Local)
+
+	type reading struct {
+		after time.Duration // since t0
+		value float64
+		want  string
+	}
+	cases := []struct {
+		name     string
+		rule     ControlRule
+		start    controlState
+		readings []reading
+		wantOn   bool
+	}{
+		{
+			name: "on only after the condition held ForSeconds",
+			rule: fan,
+			readings: []reading{
+				{0, 33, ""},
+				{30 * time.Second, 34, ""},
+				{60 * time.Second, 33, "on"},
+			},
+			wantOn: true,
+		},
+		{
+			name: "a dip restarts the ForSeconds wait",
+			rule: fan,
+			readings: []reading{
+				{0, 33, ""},
+				{40 * time.Second, 31, ""},
+				{70 * time.Second, 33, ""},
+				{110 * time.Second, 33, ""},
+				{130 * time.Second, 33, "on"},
+			},
+			wantOn: true,
+		},
+		{
+			name:  "hysteresis band keeps the relay on",
+			rule:  fan,
+			start: controlState{on: true, lastChange: t0.Add(-time.Hour)},
+			readings: []reading{
+				{0, 30, ""},
+				{time.Minute, 29.5, ""},
+				{2 * time.Minute, 28.9, "off"},
+			},
+		},
+		{
+			name:  "MinOnSeconds holds a fresh switch",
+			rule:  fan,
+			start: controlState{on: true, lastChange: t0},
+			readings: []reading{
+				{time.Minute, 25, ""},
+				{2 * time.Minute, 25, "off"},
+			},
+		},
+		{
+			name:  "MinOffSeconds holds a fresh release",
+			rule:  fan,
+			start: controlState{lastChange: t0},
+			readings: []reading{
+				{0, 35, ""},
+				{90 * time.Second, 35, ""},
+				{2 * time.Minute, 35, "on"},
+			},
+			wantOn: true,
+		},
+		{
+			name: "below operator",
+			rule: heater,
+			readings: []reading{
+				{0, 21, ""},
+				{time.Second, 19, "on"},
+				{2 * time.Second, 22, ""},
+				{3 * time.Second, 24, "off"},
+			},
+		},
+		{
+			name:  "failed switch waits for retryAfter",
+			rule:  fan,
+			start: controlState{on: true, lastChange: t0.Add(-time.Minute), failures: 1, retryAfter: t0.Add(30 * time.Second)},
+			readings: []reading{
+				{0, 33, ""},
+				{20 * time.Second, 33, ""},
+				{30 * time.Second, 33, "on"},
+				{40 * time.Second, 33, ""},
+			},
+			wantOn: true,
+		},
+		{
+			name:  "retry sends the state the reading calls for",
+			rule:  fan,
+			start: controlState{on: true, lastChange: t0.Add(-time.Minute), failures: 2, retryAfter: t0},
+			readings: []reading{
+				{0, 25, "off"},
+				{time.Second, 25, ""},
+			},
+		},
+		{
+			name:  "retry of a failed release inside the band",
+			rule:  fan,
+			start: controlState{lastChange: t0.Add(-time.Minute), failures: 1, retryAfter: t0},
+			readings: []reading{
+				{0, 30, "off"},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			st := tc.start
+			for i, rd := range tc.readings {
+				if got := tc.rule.step(&st, rd.value, t0.Add(rd.after)); got != rd.want {
+					t.Fatalf("reading %d (%v at +%v): got %q, want %q", i, rd.value, rd.after, got, rd.want)
+				}
+			}
+			if st.on != tc.wantOn {
+				t.Fatalf("ends on=%v, want %v", st.on, tc.wantOn)
+			}
+		})
+	}
+}
+
+func TestControlRetryDelay(t *testing.T) {
+	cases := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{5, 8 * time.Minute},
+		{6, controlRetryMax},
+		{40, controlRetryMax},
+	}
+	for _, tc := range cases {
+		if got := controlRetryDelay(tc.failures); got != tc.want {
+			t.Errorf("controlRetryDelay(%d) = %v, want %v", tc.failures, got, tc.want)
+		}
+	}
+}
+
+func TestRecordControlResult(t *testing.T) {
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.Local)
+	const ruleID = -1
+	controlMu.Lock()
+	controlStates[ruleID] = &controlState{on: true, lastChange: at}
+	controlMu.Unlock()
+	defer forgetControlState(ruleID)
+
+	recordControlResult(ruleID, "on", at, false)
+	recordControlResult(ruleID, "on", at, false)
+	controlMu.Lock()
+	st := *controlStates[ruleID]
+	controlMu.Unlock()
+	if !st.on || st.failures != 2 || st.retryAfter.IsZero() {
+		t.Fatalf("after two failures: %+v", st)
+	}
+
+	// a result for an older switch leaves the state alone
+	recordControlResult(ruleID, "on", at.Add(-time.Minute), true)
+	controlMu.Lock()
+	if controlStates[ruleID].failures != 2 {
+		t.Fatal("stale result cleared the failures")
+	}
+	controlMu.Unlock()
+
+	recordControlResult(ruleID, "on", at, true)
+	controlMu.Lock()
+	st = *controlStates[ruleID]
+	controlMu.Unlock()
+	if st.failures != 0 || !st.retryAfter.IsZero() {
+		t.Fatalf("after success: %+v", st)
+	}
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+/* ===========================
+    Direct-IP Devices
+=========================== */
+
+// ESP boards on the farm LAN that are not behind a gateway. They are registered
+// with their IP, type and cage; the backend polls their /telemetry and proxies
+// relay, mode and feeder calls so browsers never need to reach the LAN directly.
+// Polled water/relay history shares cm_gateway_telemetry with gateway devices,
+// filed under the pseudo gateway "direct" with the registry ID as DeviceID, since
+// the IP can change with DHCP. Writes through the proxy are logged in
+// cm_gateway_commands like gateway commands, and switching a relay on needs the
+// cage to be in manual mode.
+const (
+	directDeviceGateway    = "direct"
+	defaultDevicePollSecs  = 10
+	maxDeviceResponseBytes = 16 * 1024
+	deviceProxyTimeout     = 5 * time.Second
+)
+
+var deviceTypes = map[string]bool{"Watering": true, "Feeding": true, "Medicine": true, "Environment": true}
+
+// device types that serve GET /telemetry
+var polledDeviceTypes = map[string]bool{"Watering": true, "Medicine": true, "Environment": true}
+
+// deviceTelemetry is what the ESP firmware returns from /telemetry; the
+// environment fields are only sent by boards with a DHT22/gas sensor
+type deviceTelemetry struct {
+	Water1      *int     `json:"water1"`
+	Water2      *int     `json:"water2"`
+	Water3      *int     `json:"water3"`
+	Relay1      *int     `json:"relay1"`
+	Relay2      *int     `json:"relay2"`
+	Relay3      *int     `json:"relay3"`
+	Temperature *float64 `json:"temperature"`
+	Humidity    *float64 `json:"humidity"`
+	Gas         *float64 `json:"gas"`
+}
+
+// validDeviceIP only accepts private LAN addresses, so the poller and the relay
+// proxy cannot be pointed at the server itself or at hosts outside the farm
+func validDeviceIP(s string) bool {
+	host := s
+	if h, _, err := net.SplitHostPort(s); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return false
+	}
+	return ip.IsPrivate()
+}
+
+// historyID is the DeviceID a direct device's readings and events are filed under
+func (d Device) historyID() string {
+	return strconv.Itoa(d.ID)
+}
+
+const deviceColumns = `
+	SELECT DeviceID, IPAddress, DeviceType, Name, CageNum, GramsPerDispense, LastPolledAt, LastError
+	FROM cm_devices`
+
+func scanDevice(scan func(dest ...interface{}) error) (Device, error) {
+	var d Device
+	err := scan(&d.ID, &d.IPAddress, &d.DeviceType, &d.Name, &d.CageNum, &d.GramsPerDispense, &d.LastPolledAt, &d.LastError)
+	return d, err
+}
+
+func loadDevices(ctx context.Context) ([]Device, error) {
+	rows, err := db.QueryContext(ctx, deviceColumns+" WHERE IsActive = 1 ORDER BY DeviceType, DeviceID")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Device{}
+	for rows.Next() {
+		d, err := scanDevice(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, d)
+	}
+	return list, rows.Err()
+}
+
+func loadDevice(ctx context.Context, id int) (Device, error) {
+	return scanDevice(db.QueryRowContext(ctx, deviceColumns+" WHERE DeviceID = ? AND IsActive = 1", id).Scan)
+}
+
+// refreshDeviceCache mirrors the registry into the in-memory devices map
+func refreshDeviceCache(list []Device) {
+	devMu.Lock()
+	defer devMu.Unlock()
+	devices = make(map[string]Device, len(list))
+	for _, d := range list {
+		devices[d.IPAddress] = d
+	}
+}
+
+/* ===========================
+    Poller
+=========================== */
+
+func runDevicePoller(ctx context.Context) {
+	interval := time.Duration(getEnvInt("DEVICE_POLL_SECONDS", defaultDevicePollSecs)) * time.Second
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			pollCtx, cancel := context.WithTimeout(ctx, interval)
+			pollDevices(pollCtx)
+			cancel()
+		}
+	}
+}
+
+func pollDevices(ctx context.Context) {
+	list, err := loadDevices(ctx)
+	if err != nil {
+		log.Printf("[ERROR] Failed to load devices: %v", err)
+		return
+	}
+	refreshDeviceCache(list)
+
+	var wg sync.WaitGroup
+	for _, d := range list {
+		if !polledDeviceTypes[d.DeviceType] {
+			continue
+		}
+		wg.Add(1)
+		go func(d Device) {
+			defer wg.Done()
+			err := pollDevice(ctx, d)
+			errText := ""
+			if err != nil {
+				errText = err.Error()
+				if len(errText) > 255 {
+					errText = errText[:255]
+				}
+			}
+			// LastPolledAt is the last successful poll, LastError the latest failure
+			query := "UPDATE cm_devices SET LastPolledAt = IF(? = '', NOW(), LastPolledAt), LastError = NULLIF(?, '') WHERE DeviceID = ?"
+			if _, err := db.ExecContext(ctx, query, errText, errText, d.ID); err != nil {
+				log.Printf("[ERROR] Failed to update device %d: %v", d.ID, err)
+			}
+		}(d)
+	}
+	wg.Wait()
+}
+
+// pollDevice fetches one reading and stores it like gateway telemetry
+func pollDevice(ctx context.Context, d Device) error {
+	body, status, err := deviceRequest(ctx, d, http.MethodGet, "/telemetry", nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("telemetry returned HTTP %d", status)
+	}
+	var t deviceTelemetry
+	if err := json.Unmarshal(body, &t); err != nil {
+		return fmt.Errorf("invalid telemetry: %w", err)
+	}
+	now := time.Now()
+
+	if t.Temperature != nil && t.Humidity != nil && d.CageNum != nil {
+		gas := 0.0
+		if t.Gas != nil {
+			gas = *t.Gas
+		}
+		if _, err := ingestEnvironmentReading(ctx, directDeviceGateway, d.historyID(), *d.CageNum, *t.Temperature, *t.Humidity, gas, now); err != nil {
+			return err
+		}
+	}
+	if t.Water1 == nil && t.Water2 == nil && t.Water3 == nil && t.Relay1 == nil && t.Relay2 == nil && t.Relay3 == nil {
+		return nil
+	}
+
+	query := `
+		INSERT INTO cm_gateway_telemetry (GatewayID, DeviceID, CageNum, Water1, Water2, Water3, Relay1, Relay2, Relay3, ReceivedAt)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if _, err := db.ExecContext(ctx, query, directDeviceGateway, d.historyID(), d.CageNum, t.Water1, t.Water2, t.Water3,
+		t.Relay1, t.Relay2, t.Relay3, now.Format(sqlDateTime)); err != nil {
+		return err
+	}
+
+	devMu.Lock()
+	r := readings[d.IPAddress]
+	setIfPresent(&r.Water1, t.Water1)
+	setIfPresent(&r.Water2, t.Water2)
+	setIfPresent(&r.Water3, t.Water3)
+	setIfPresent(&r.Relay1, t.Relay1)
+	setIfPresent(&r.Relay2, t.Relay2)
+	setIfPresent(&r.Relay3, t.Relay3)
+	r.At = now
+	readings[d.IPAddress] = r
+	devMu.Unlock()
+
+	topic := "farm"
+	if d.CageNum != nil {
+		topic = cageTopic(*d.CageNum)
+	}
+	publishLive("reading", topic, map[string]interface{}{"deviceId": d.ID, "device": d.IPAddress, "cageNum": d.CageNum, "telemetry": r})
+	return nil
+}
+
+// deviceRequest calls the device's HTTP API and returns the (size-limited) body
+func deviceRequest(ctx context.Context, d Device, method, path string, payload interface{}) ([]byte, int, error) {
+	var reqBody io.Reader
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return nil, 0, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+d.IPAddress+path, reqBody)
+	if err != nil {
+		return nil, 0, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := httpc.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDeviceResponseBytes))
+	return body, resp.StatusCode, err
+}
+
+/* ===========================
+    Device Handlers
+=========================== */
+
+func validateDeviceRequest(w http.ResponseWriter, p *DeviceRequest) bool {
+	p.IPAddress = strings.TrimSpace(p.IPAddress)
+	p.Name = strings.TrimSpace(p.Name)
+	if !validDeviceIP(p.IPAddress) {
+		handleError(w, http.StatusBadRequest, "ipAddress must be an IP address (optionally with :port)", nil)
+		return false
+	}
+	if !deviceTypes[p.DeviceType] {
+		handleError(w, http.StatusBadRequest, "deviceType must be Watering, Feeding, Medicine or Environment", nil)
+		return false
+	}
+	if p.GramsPerDispense != nil && *p.GramsPerDispense < 0 {
+		handleError(w, http.StatusBadRequest, "gramsPerDispense cannot be negative", nil)
+		return false
+	}
+	return true
+}
+
+// GET /api/iot/manageDevices lists registered devices with their latest reading
+func getManagedDevices(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	list, err := loadDevices(ctx)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch devices", err)
+		return
+	}
+	devMu.RLock()
+	for i := range list {
+		if t, ok := readings[list[i].IPAddress]; ok {
+			t := t
+			list[i].Telemetry = &t
+		}
+	}
+	devMu.RUnlock()
+	respondJSON(w, http.StatusOK, list)
+}
+
+// POST /api/iot/manageDevices
+func registerDevice(w http.ResponseWriter, r *http.Request) {
+	var payload DeviceRequest
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if !validateDeviceRequest(w, &payload) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	// re-registering a removed device brings it back
+	query := `
+		INSERT INTO cm_devices (IPAddress, DeviceType, Name, CageNum, GramsPerDispense) VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE DeviceID = LAST_INSERT_ID(DeviceID), DeviceType = VALUES(DeviceType),
+			Name = VALUES(Name), CageNum = VALUES(CageNum), GramsPerDispense = VALUES(GramsPerDispense), IsActive = 1`
+	res, err := db.ExecContext(ctx, query, payload.IPAddress, payload.DeviceType, payload.Name, payload.CageNum, payload.GramsPerDispense)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to register device", err)
+		return
+	}
+	id, _ := res.LastInsertId()
+	respondJSON(w, http.StatusCreated, DeviceResponse{Message: "Device registered", ID: id, Device: payload})
+}
+
+// PUT /api/iot/manageDevices/{id}
+func updateDevice(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid device ID", err)
+		return
+	}
+	var payload DeviceRequest
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if !validateDeviceRequest(w, &payload) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := "UPDATE cm_devices SET IPAddress = ?, DeviceType = ?, Name = ?, CageNum = ?, GramsPerDispense = ? WHERE DeviceID = ? AND IsActive = 1"
+	res, err := db.ExecContext(ctx, query, payload.IPAddress, payload.DeviceType, payload.Name, payload.CageNum, payload.GramsPerDispense, deviceID)
+	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			handleError(w, http.StatusConflict, "Another device already uses that IP address", nil)
+			return
+		}
+		handleError(w, http.StatusInternalServerError, "Failed to update device", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		handleError(w, http.StatusNotFound, "Device not found or no changes made", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// DELETE /api/iot/manageDevices/{id}
+func deleteDevice(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid device ID", err)
+		return
+	}
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, "UPDATE cm_devices SET IsActive = 0 WHERE DeviceID = ? AND IsActive = 1", deviceID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to remove device", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		handleError(w, http.StatusNotFound, "Device not found", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// deviceFromRequest loads the {id} device or writes the error response
+func deviceFromRequest(w http.ResponseWriter, r *http.Request, ctx context.Context) (Device, bool) {
+	deviceID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid device ID", err)
+		return Device{}, false
+	}
+	d, err := loadDevice(ctx, deviceID)
+	if errors.Is(err, sql.ErrNoRows) {
+		handleError(w, http.StatusNotFound, "Device not found", nil)
+		return d, false
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch device", err)
+		return d, false
+	}
+	return d, true
+}
+
+// GET /api/iot/devices/{id}/telemetry returns the last polled reading; ?live=1 asks the device now
+func getDeviceTelemetry(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), deviceProxyTimeout)
+	defer cancel()
+
+	d, ok := deviceFromRequest(w, r, ctx)
+	if !ok {
+		return
+	}
+	if r.URL.Query().Get("live") == "1" {
+		if err := pollDevice(ctx, d); err != nil {
+			handleError(w, http.StatusBadGateway, "Device did not answer", err)
+			return
+		}
+	}
+	devMu.RLock()
+	t, ok := readings[d.IPAddress]
+	devMu.RUnlock()
+	if !ok {
+		handleError(w, http.StatusNotFound, "No telemetry from this device yet", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, t)
+}
+
+// relaysSwitchedOn reports whether a /set-relays payload turns any relay on
+func relaysSwitchedOn(payload map[string]interface{}) bool {
+	for k, v := range payload {
+		if !strings.HasPrefix(k, "relay") {
+			continue
+		}
+		switch v := v.(type) {
+		case float64:
+			if v != 0 {
+				return true
+			}
+		case bool:
+			if v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// logDeviceCommand records a proxied write in cm_gateway_commands so it shows in
+// the command history next to gateway commands
+func logDeviceCommand(ctx context.Context, d Device, path string, payload map[string]interface{}, issuedBy string) (string, error) {
+	command := make(map[string]interface{}, len(payload)+2)
+	for k, v := range payload {
+		command[k] = v
+	}
+	command["device"] = d.historyID()
+	command["path"] = path
+	body, err := json.Marshal(command)
+	if err != nil {
+		return "", err
+	}
+	cmdID := newCommandID()
+	query := `
+		INSERT INTO cm_gateway_commands (CommandID, GatewayID, Payload, IssuedBy, Status, Attempts, MaxAttempts)
+		VALUES (?, ?, ?, ?, 'Sent', 1, 1)`
+	if _, err := db.ExecContext(ctx, query, cmdID, directDeviceGateway, string(body), issuedBy); err != nil {
+		return "", err
+	}
+	return cmdID, nil
+}
+
+// proxyDevice forwards the JSON body to a device endpoint and relays its answer.
+// It returns the device and its HTTP status, or status 0 if the call never reached it.
+func proxyDevice(w http.ResponseWriter, r *http.Request, path string) (Device, int) {
+	var payload map[string]interface{}
+	if !decodeJSONBody(w, r, &payload) {
+		return Device{}, 0
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), deviceProxyTimeout)
+	defer cancel()
+
+	d, ok := deviceFromRequest(w, r, ctx)
+	if !ok {
+		return d, 0
+	}
+	// Automation and control rules own the relays of a cage in auto mode; turning
+	// everything off is always allowed
+	if path == "/set-relays" && d.CageNum != nil && relaysSwitchedOn(payload) {
+		mode, err := cageMode(ctx, *d.CageNum)
+		if err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to read cage mode", err)
+			return d, 0
+		}
+		if mode != CageModeManual {
+			handleError(w, http.StatusConflict, fmt.Sprintf("Cage %d is in auto mode, switch it to manual to set relays by hand", *d.CageNum), nil)
+			return d, 0
+		}
+	}
+
+	cmdID, err := logDeviceCommand(ctx, d, path, payload, requestUsername(r))
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to record device command", err)
+		return d, 0
+	}
+	body, status, err := deviceRequest(ctx, d, http.MethodPost, path, payload)
+	if err != nil {
+		errText := err.Error()
+		if len(errText) > 255 {
+			errText = errText[:255]
+		}
+		finishCommand(cmdID, directDeviceGateway, CommandFailed, 1, nil, errText)
+		handleError(w, http.StatusBadGateway, "Device did not answer", err)
+		return d, 0
+	}
+	log.Printf("Device %d (%s) %s by %s: HTTP %d", d.ID, d.IPAddress, path, requestUsername(r), status)
+	result := json.RawMessage(body)
+	if !json.Valid(body) {
+		result, _ = json.Marshal(map[string]interface{}{"response": string(body)})
+	}
+	if status < 300 {
+		finishCommand(cmdID, directDeviceGateway, CommandAcked, 1, result, "")
+	} else {
+		finishCommand(cmdID, directDeviceGateway, CommandFailed, 1, result, fmt.Sprintf("device returned HTTP %d", status))
+	}
+	if d.CageNum != nil {
+		publishLive("command", cageTopic(*d.CageNum), map[string]interface{}{"deviceId": d.ID, "commandId": cmdID, "path": path, "payload": payload, "status": status})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if json.Valid(body) {
+		w.Write(body)
+	} else {
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": status < 300, "response": string(body)})
+	}
+	return d, status
+}
+
+// POST /api/iot/devices/{id}/relays with {"relay1":1,...} (and optionally "mode")
+func setDeviceRelays(w http.ResponseWriter, r *http.Request) { proxyDevice(w, r, "/set-relays") }
+
+// POST /api/iot/devices/{id}/mode with {"mode":"manual"|"automatic"}
+func setDeviceMode(w http.ResponseWriter, r *http.Request) { proxyDevice(w, r, "/mode") }
+
+// POST /api/iot/devices/{id}/rotate-servo with {"relay":n} or {"angle":60} (feeders)
+func rotateDeviceServo(w http.ResponseWriter, r *http.Request) {
+	d, status := proxyDevice(w, r, "/rotate-servo")
+	if status >= 200 && status < 300 {
+		recordFeederDispense(r.Context(), d)
+	}
+}
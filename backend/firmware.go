@@ -0,0 +1,902 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+/* ===========================
+    Firmware OTA
+=========================== */
+
+// Firmware images are uploaded once (POST /api/iot/firmware, multipart "file",
+// "version", "signature", optional "sha256" that must match, "notes") and kept
+// under uploads/firmware. Images are signed offline with the release ed25519
+// key: "signature" (hex or base64) signs "{version}\n{sha256 hex}" and is checked
+// against the public key in FIRMWARE_SIGNING_PUBKEY, so the server never holds
+// the private key and cannot mint images itself. A version is used once, even
+// after its image is retired. Uploading, retiring and setting targets need the
+// admin token (requireAdmin).
+//
+// Each gateway has a target version; setting it, for one gateway or as a
+// rollout over many, queues a Pending rollout row. The rollout job sends
+// Pending rows to connected gateways, at most FIRMWARE_MAX_PARALLEL in flight, as
+//
+//	{"type":"command","commandId":"...","action":"firmware_update","version":"1.3.0",
+//	 "url":"/api/iot/firmware/4/download","sha256":"...","signature":"...","size":912384}
+//
+// and the gateway checks the signature with the same public key before installing.
+// The gateway acks once it accepts the update, then downloads the image from
+// url with its gateway credentials (the same token or signed query as
+// /ws/gateway; every signed request needs a fresh nonce) using Range requests
+// to resume, and reports progress as events:
+//
+//	{"type":"event","device":"gateway","event":"firmware_status",
+//	 "detail":{"version":"1.3.0","status":"installing","progress":100}}
+//
+// with status downloading, installing, succeeded, failed or rolled_back (plus
+// "error"). A hello with the target version also completes the rollout, and a
+// hello with another version while installing counts as a rollback. Rollouts
+// without news for FIRMWARE_TIMEOUT_MINUTES fail. Failures and rollbacks raise
+// a warning alert and are not retried until the target is set again.
+type Firmware struct {
+	FirmwareID int     `json:"FirmwareID"`
+	Version    string  `json:"Version"`
+	Sha256     string  `json:"Sha256"`
+	Signature  *string `json:"Signature"` // nil for images uploaded before signing was required
+	SizeBytes  int64   `json:"SizeBytes"`
+	Notes      *string `json:"Notes"`
+	UploadedBy string  `json:"UploadedBy"`
+	UploadedAt string  `json:"UploadedAt"`
+	Gateways   int     `json:"Gateways"` // gateways targeting this version
+	filePath   string
+}
+
+type FirmwareRollout struct {
+	RolloutID   int64   `json:"RolloutID"`
+	GatewayID   string  `json:"GatewayID"`
+	FirmwareID  int     `json:"FirmwareID"`
+	Version     string  `json:"Version"`
+	FromVersion *string `json:"FromVersion"`
+	Status      string  `json:"Status"`
+	Progress    *int    `json:"Progress"`
+	CommandID   *string `json:"CommandID"`
+	Detail      *string `json:"Detail"`
+	CreatedBy   string  `json:"CreatedBy"`
+	CreatedAt   string  `json:"CreatedAt"`
+	UpdatedAt   string  `json:"UpdatedAt"`
+	FinishedAt  *string `json:"FinishedAt"`
+}
+
+type FirmwareTargetPayload struct {
+	Version *string `json:"Version"` // nil clears the target
+}
+
+type FirmwareRolloutPayload struct {
+	Version  string   `json:"Version"`
+	Gateways []string `json:"Gateways"` // empty means every claimed gateway
+}
+
+// firmwareStatusEvent is the gateway's progress report
+type firmwareStatusEvent struct {
+	Version  string `json:"version"`
+	Status   string `json:"status"`
+	Progress *int   `json:"progress"`
+	Error    string `json:"error"`
+}
+
+const (
+	RolloutPending     = "Pending"
+	RolloutSent        = "Sent"
+	RolloutDownloading = "Downloading"
+	RolloutInstalling  = "Installing"
+	RolloutSucceeded   = "Succeeded"
+	RolloutFailed      = "Failed"
+	RolloutRolledBack  = "RolledBack"
+	RolloutSuperseded  = "Superseded"
+
+	firmwareDir               = "uploads/firmware"
+	firmwareStatusEventName   = "firmware_status"
+	firmwareFailedAlert       = "firmware_failed"
+	firmwareJobInterval       = 30 * time.Second
+	firmwareAckTimeout        = 15 * time.Second
+	defaultFirmwareMaxMB      = 16
+	defaultFirmwareParallel   = 5
+	defaultFirmwareTimeoutMin = 30
+)
+
+var firmwareVersionPattern = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z.+_-]{0,31}$`)
+
+// firmwareDispatchMu serializes dispatch runs so the ticker and an API-triggered
+// run cannot both count free slots and exceed FIRMWARE_MAX_PARALLEL
+var firmwareDispatchMu sync.Mutex
+
+// gateway-reported statuses and the rollout status they move to
+var firmwareEventStatuses = map[string]string{
+	"downloading": RolloutDownloading,
+	"installing":  RolloutInstalling,
+	"succeeded":   RolloutSucceeded,
+	"failed":      RolloutFailed,
+	"rolled_back": RolloutRolledBack,
+}
+
+// in-flight statuses: the gateway has the command and has not finished
+const inFlightRollouts = "'Sent', 'Downloading', 'Installing'"
+
+func firmwareURL(firmwareID int) string {
+	return fmt.Sprintf("/api/iot/firmware/%d/download", firmwareID)
+}
+
+const firmwareColumns = `
+	SELECT f.FirmwareID, f.Version, f.Sha256, f.Signature, f.SizeBytes, f.Notes, f.UploadedBy, f.UploadedAt, f.FilePath,
+		(SELECT COUNT(*) FROM cm_gateways g WHERE g.TargetFirmware = f.Version)
+	FROM cm_firmware f`
+
+func scanFirmware(scan func(dest ...interface{}) error) (Firmware, error) {
+	var f Firmware
+	err := scan(&f.FirmwareID, &f.Version, &f.Sha256, &f.Signature, &f.SizeBytes, &f.Notes, &f.UploadedBy, &f.UploadedAt, &f.filePath, &f.Gateways)
+	return f, err
+}
+
+func loadFirmwareByVersion(ctx context.Context, version string) (Firmware, error) {
+	return scanFirmware(db.QueryRowContext(ctx, firmwareColumns+" WHERE f.Version = ? AND f.IsActive = 1", version).Scan)
+}
+
+// firmwareSigningKey reads the release public key from FIRMWARE_SIGNING_PUBKEY
+func firmwareSigningKey() (ed25519.PublicKey, error) {
+	raw := strings.TrimSpace(os.Getenv("FIRMWARE_SIGNING_PUBKEY"))
+	if raw == "" {
+		return nil, errors.New("FIRMWARE_SIGNING_PUBKEY is not set")
+	}
+	key, ok := decodeHexOrBase64(raw, ed25519.PublicKeySize)
+	if !ok {
+		return nil, errors.New("FIRMWARE_SIGNING_PUBKEY is not a hex or base64 ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+func decodeHexOrBase64(s string, size int) ([]byte, bool) {
+	if b, err := hex.DecodeString(s); err == nil && len(b) == size {
+		return b, true
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == size {
+		return b, true
+	}
+	return nil, false
+}
+
+// firmwareSignedMessage is what the release key signs for an image
+func firmwareSignedMessage(version, sha256Hex string) []byte {
+	return []byte(version + "\n" + sha256Hex)
+}
+
+const rolloutColumns = `
+	SELECT RolloutID, GatewayID, FirmwareID, Version, FromVersion, Status, Progress, CommandID, Detail,
+		CreatedBy, CreatedAt, UpdatedAt, FinishedAt
+	FROM cm_firmware_rollouts`
+
+func scanRollout(scan func(dest ...interface{}) error) (FirmwareRollout, error) {
+	var ro FirmwareRollout
+	err := scan(&ro.RolloutID, &ro.GatewayID, &ro.FirmwareID, &ro.Version, &ro.FromVersion, &ro.Status, &ro.Progress,
+		&ro.CommandID, &ro.Detail, &ro.CreatedBy, &ro.CreatedAt, &ro.UpdatedAt, &ro.FinishedAt)
+	return ro, err
+}
+
+// activeRollout returns the gateway's unfinished rollout, if any
+func activeRollout(ctx context.Context, gatewayID string) (*FirmwareRollout, error) {
+	query := rolloutColumns + " WHERE GatewayID = ? AND Status IN ('Pending', " + inFlightRollouts + ") ORDER BY RolloutID DESC LIMIT 1"
+	ro, err := scanRollout(db.QueryRowContext(ctx, query, gatewayID).Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ro, nil
+}
+
+// setFirmwareTarget stores the gateway's target version and queues a rollout,
+// superseding any unfinished one. fw nil clears the target.
+func setFirmwareTarget(ctx context.Context, tx *sql.Tx, gatewayID string, fw *Firmware, by string) (bool, error) {
+	var current *string
+	err := tx.QueryRowContext(ctx, "SELECT Firmware FROM cm_gateways WHERE GatewayID = ? AND RevokedAt IS NULL FOR UPDATE", gatewayID).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var target interface{}
+	if fw != nil {
+		target = fw.Version
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE cm_gateways SET TargetFirmware = ? WHERE GatewayID = ?", target, gatewayID); err != nil {
+		return false, err
+	}
+	query := `
+		UPDATE cm_firmware_rollouts SET Status = 'Superseded', Detail = 'target changed', FinishedAt = NOW()
+		WHERE GatewayID = ? AND Status IN ('Pending', ` + inFlightRollouts + `)`
+	if _, err := tx.ExecContext(ctx, query, gatewayID); err != nil {
+		return false, err
+	}
+	if fw == nil || (current != nil && *current == fw.Version) {
+		return true, nil
+	}
+	query = `
+		INSERT INTO cm_firmware_rollouts (GatewayID, FirmwareID, Version, FromVersion, Status, CreatedBy)
+		VALUES (?, ?, ?, ?, 'Pending', ?)`
+	_, err = tx.ExecContext(ctx, query, gatewayID, fw.FirmwareID, fw.Version, current, by)
+	return true, err
+}
+
+// setRolloutStatus moves an unfinished rollout to a new status; finished ones are
+// left alone so a late report cannot reopen them. Failures and rollbacks raise an alert.
+func setRolloutStatus(ctx context.Context, ro FirmwareRollout, status string, progress *int, detail string) error {
+	if len(detail) > 255 {
+		detail = detail[:255]
+	}
+	query := `
+		UPDATE cm_firmware_rollouts
+		SET Status = ?, Progress = COALESCE(?, Progress), Detail = COALESCE(NULLIF(?, ''), Detail),
+			FinishedAt = IF(? IN ('Succeeded', 'Failed', 'RolledBack'), NOW(), NULL)
+		WHERE RolloutID = ? AND Status IN ('Pending', ` + inFlightRollouts + `)`
+	res, err := db.ExecContext(ctx, query, status, progress, detail, status, ro.RolloutID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	publishLive("firmware", gatewayTopic(ro.GatewayID), map[string]interface{}{
+		"rolloutId": ro.RolloutID, "gatewayId": ro.GatewayID, "version": ro.Version, "status": status, "progress": progress, "detail": detail,
+	})
+
+	if status != RolloutFailed && status != RolloutRolledBack {
+		return nil
+	}
+	id := ro.GatewayID
+	msg := fmt.Sprintf("Firmware %s on gateway %s failed", ro.Version, ro.GatewayID)
+	if status == RolloutRolledBack {
+		msg = fmt.Sprintf("Gateway %s rolled back from firmware %s", ro.GatewayID, ro.Version)
+	}
+	if detail != "" {
+		msg += ": " + detail
+	}
+	_, err = raiseAlert(ctx, AlertRecord{Type: firmwareFailedAlert, Severity: "warning", Source: &id, Message: msg})
+	return err
+}
+
+// handleFirmwareEvent applies a firmware_status event to the gateway's rollout
+func handleFirmwareEvent(ctx context.Context, gatewayID string, detail json.RawMessage) error {
+	var ev firmwareStatusEvent
+	if err := json.Unmarshal(detail, &ev); err != nil {
+		return fmt.Errorf("invalid firmware status: %w", err)
+	}
+	status, ok := firmwareEventStatuses[strings.ToLower(ev.Status)]
+	if !ok {
+		return fmt.Errorf("unknown firmware status %q", ev.Status)
+	}
+	ro, err := activeRollout(ctx, gatewayID)
+	if err != nil || ro == nil {
+		return err
+	}
+	if ev.Version != "" && ev.Version != ro.Version {
+		log.Printf("[WARN] Gateway %s reported firmware %s status for %s while rolling out %s", gatewayID, ev.Status, ev.Version, ro.Version)
+		return nil
+	}
+	return setRolloutStatus(ctx, *ro, status, ev.Progress, ev.Error)
+}
+
+// checkFirmwareAfterHello completes or rolls back the rollout of a gateway that
+// has just announced its firmware version
+func checkFirmwareAfterHello(ctx context.Context, gatewayID, firmware string) error {
+	if firmware == "" {
+		return nil
+	}
+	ro, err := activeRollout(ctx, gatewayID)
+	if err != nil || ro == nil {
+		return err
+	}
+	switch {
+	case firmware == ro.Version:
+		full := 100
+		return setRolloutStatus(ctx, *ro, RolloutSucceeded, &full, "")
+	case ro.Status == RolloutInstalling:
+		return setRolloutStatus(ctx, *ro, RolloutRolledBack, nil, "gateway restarted on "+firmware)
+	}
+	return nil
+}
+
+// dispatchFirmwareRollouts fails rollouts that went quiet and sends pending ones
+// to connected gateways, keeping at most FIRMWARE_MAX_PARALLEL in flight
+func dispatchFirmwareRollouts(ctx context.Context) error {
+	firmwareDispatchMu.Lock()
+	defer firmwareDispatchMu.Unlock()
+
+	timeout := getEnvInt("FIRMWARE_TIMEOUT_MINUTES", defaultFirmwareTimeoutMin)
+	rows, err := db.QueryContext(ctx, rolloutColumns+" WHERE Status IN ("+inFlightRollouts+") AND UpdatedAt < NOW() - INTERVAL ? MINUTE", timeout)
+	if err != nil {
+		return err
+	}
+	var stale []FirmwareRollout
+	for rows.Next() {
+		ro, err := scanRollout(rows.Scan)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		stale = append(stale, ro)
+	}
+	rows.Close()
+	for _, ro := range stale {
+		if err := setRolloutStatus(ctx, ro, RolloutFailed, nil, fmt.Sprintf("no progress for %d minutes while %s", timeout, strings.ToLower(ro.Status))); err != nil {
+			return err
+		}
+	}
+
+	var inFlight int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM cm_firmware_rollouts WHERE Status IN ("+inFlightRollouts+")").Scan(&inFlight); err != nil {
+		return err
+	}
+	slots := getEnvInt("FIRMWARE_MAX_PARALLEL", defaultFirmwareParallel) - inFlight
+	if slots <= 0 {
+		return nil
+	}
+
+	rows, err = db.QueryContext(ctx, rolloutColumns+" WHERE Status = 'Pending' ORDER BY RolloutID")
+	if err != nil {
+		return err
+	}
+	var pending []FirmwareRollout
+	for rows.Next() {
+		ro, err := scanRollout(rows.Scan)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, ro)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, ro := range pending {
+		if slots == 0 {
+			break
+		}
+		gatewayMu.RLock()
+		gw, ok := gateways[ro.GatewayID]
+		gatewayMu.RUnlock()
+		if !ok || !gw.isClaimed() {
+			continue
+		}
+		if err := sendFirmwareUpdate(ctx, ro); err != nil {
+			log.Printf("[ERROR] Firmware rollout %d to %s: %v", ro.RolloutID, ro.GatewayID, err)
+			continue
+		}
+		slots--
+	}
+	return nil
+}
+
+func sendFirmwareUpdate(ctx context.Context, ro FirmwareRollout) error {
+	fw, err := scanFirmware(db.QueryRowContext(ctx, firmwareColumns+" WHERE f.FirmwareID = ?", ro.FirmwareID).Scan)
+	if err != nil {
+		return err
+	}
+	cmd := map[string]interface{}{
+		"action":    "firmware_update",
+		"version":   fw.Version,
+		"url":       firmwareURL(fw.FirmwareID),
+		"sha256":    fw.Sha256,
+		"signature": fw.Signature,
+		"size":      fw.SizeBytes,
+	}
+
+	// claim the row first so the ticker and an API-triggered dispatch cannot both send it
+	res, err := db.ExecContext(ctx, "UPDATE cm_firmware_rollouts SET Status = 'Sent' WHERE RolloutID = ? AND Status = 'Pending'", ro.RolloutID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	cmdID, done, err := issueGatewayCommand(ctx, ro.GatewayID, cmd, "firmware-rollout:"+strconv.FormatInt(ro.RolloutID, 10),
+		CommandOptions{AckTimeout: firmwareAckTimeout, Retries: defaultCommandRetries})
+	if err != nil {
+		db.ExecContext(ctx, "UPDATE cm_firmware_rollouts SET Status = 'Pending' WHERE RolloutID = ? AND Status = 'Sent'", ro.RolloutID)
+		return err
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE cm_firmware_rollouts SET CommandID = ? WHERE RolloutID = ?", cmdID, ro.RolloutID); err != nil {
+		return err
+	}
+	publishLive("firmware", gatewayTopic(ro.GatewayID), map[string]interface{}{
+		"rolloutId": ro.RolloutID, "gatewayId": ro.GatewayID, "version": ro.Version, "status": RolloutSent, "commandId": cmdID,
+	})
+
+	go func() {
+		<-done
+		ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+		defer cancel()
+		c, err := loadGatewayCommand(ctx, cmdID)
+		if err != nil {
+			log.Printf("[ERROR] Failed to load firmware command %s: %v", cmdID, err)
+			return
+		}
+		if c.Status == CommandAcked {
+			return
+		}
+		detail := "update command " + strings.ToLower(c.Status)
+		if c.Error != nil {
+			detail += ": " + *c.Error
+		}
+		if err := setRolloutStatus(ctx, ro, RolloutFailed, nil, detail); err != nil {
+			log.Printf("[ERROR] Failed to update firmware rollout %d: %v", ro.RolloutID, err)
+		}
+	}()
+	return nil
+}
+
+func runFirmwareRollouts(ctx context.Context) {
+	t := time.NewTicker(firmwareJobInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			jobCtx, cancel := context.WithTimeout(ctx, time.Minute)
+			if err := dispatchFirmwareRollouts(jobCtx); err != nil {
+				log.Printf("[ERROR] Firmware rollouts: %v", err)
+			}
+			cancel()
+		}
+	}
+}
+
+/* ===========================
+    Firmware Handlers
+=========================== */
+
+// POST /api/iot/firmware (multipart)
+func uploadFirmware(w http.ResponseWriter, r *http.Request) {
+	pub, err := firmwareSigningKey()
+	if err != nil {
+		handleError(w, http.StatusServiceUnavailable, "Firmware uploads are disabled: "+err.Error(), nil)
+		return
+	}
+	maxBytes := int64(getEnvInt("FIRMWARE_MAX_MB", defaultFirmwareMaxMB)) << 20
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid upload or file too large", err)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	version := strings.TrimSpace(r.FormValue("version"))
+	if !firmwareVersionPattern.MatchString(version) {
+		handleError(w, http.StatusBadRequest, "version is required (letters, digits, . + _ -, max 32 characters)", nil)
+		return
+	}
+	expected := strings.ToLower(strings.TrimSpace(r.FormValue("sha256")))
+	signature, ok := decodeHexOrBase64(strings.TrimSpace(r.FormValue("signature")), ed25519.SignatureSize)
+	if !ok {
+		handleError(w, http.StatusBadRequest, "signature is required (hex or base64 ed25519 signature)", nil)
+		return
+	}
+	notes := strings.TrimSpace(r.FormValue("notes"))
+	if len(notes) > 255 {
+		handleError(w, http.StatusBadRequest, "notes must be at most 255 characters", nil)
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "file is required", err)
+		return
+	}
+	defer file.Close()
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	// versions are never reused, so a gateway's reported version always means one image
+	var active bool
+	err = db.QueryRowContext(ctx, "SELECT IsActive FROM cm_firmware WHERE Version = ?", version).Scan(&active)
+	switch {
+	case err == nil && active:
+		handleError(w, http.StatusConflict, "Firmware version already exists", nil)
+		return
+	case err == nil:
+		handleError(w, http.StatusConflict, "Firmware version "+version+" was retired and cannot be reused, upload it under a new version", nil)
+		return
+	case !errors.Is(err, sql.ErrNoRows):
+		handleError(w, http.StatusInternalServerError, "Failed to check firmware version", err)
+		return
+	}
+
+	if err := os.MkdirAll(firmwareDir, 0755); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to create firmware directory", err)
+		return
+	}
+	tmp, err := os.CreateTemp(firmwareDir, "upload-*")
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to store firmware", err)
+		return
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed; the only file a failed upload removes
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(file, maxBytes+1))
+	tmp.Close()
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to store firmware", err)
+		return
+	}
+	if size == 0 || size > maxBytes {
+		handleError(w, http.StatusBadRequest, fmt.Sprintf("Firmware must be between 1 byte and %d MB", maxBytes>>20), nil)
+		return
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if expected != "" && expected != sum {
+		handleError(w, http.StatusBadRequest, "Checksum mismatch: file has sha256 "+sum, nil)
+		return
+	}
+	if !ed25519.Verify(pub, firmwareSignedMessage(version, sum), signature) {
+		handleError(w, http.StatusBadRequest, "Signature does not match this version and image", nil)
+		return
+	}
+
+	// the row claims the version before the file is moved into place, so an upload
+	// that loses a race for the version never touches the winner's image
+	path := filepath.Join(firmwareDir, fmt.Sprintf("%s-%s.bin", version, sum[:12]))
+	query := `
+		INSERT INTO cm_firmware (Version, Sha256, Signature, SizeBytes, FilePath, Notes, UploadedBy)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?)`
+	res, err := db.ExecContext(ctx, query, version, sum, hex.EncodeToString(signature), size, path, notes, requestUsername(r))
+	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			handleError(w, http.StatusConflict, "Firmware version already exists", nil)
+			return
+		}
+		handleError(w, http.StatusInternalServerError, "Failed to save firmware", err)
+		return
+	}
+	id, _ := res.LastInsertId()
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		if _, derr := db.ExecContext(ctx, "DELETE FROM cm_firmware WHERE FirmwareID = ?", id); derr != nil {
+			log.Printf("[ERROR] Failed to remove firmware %d after a failed store: %v", id, derr)
+		}
+		handleError(w, http.StatusInternalServerError, "Failed to store firmware", err)
+		return
+	}
+	respondJSON(w, http.StatusCreated, map[string]interface{}{"success": true, "insertedId": id, "sha256": sum, "size": size})
+}
+
+// GET /api/iot/firmware
+func getFirmware(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, firmwareColumns+" WHERE f.IsActive = 1 ORDER BY f.UploadedAt DESC")
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch firmware", err)
+		return
+	}
+	defer rows.Close()
+
+	list := []Firmware{}
+	for rows.Next() {
+		fw, err := scanFirmware(rows.Scan)
+		if err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan firmware", err)
+			return
+		}
+		list = append(list, fw)
+	}
+	respondJSON(w, http.StatusOK, list)
+}
+
+// DELETE /api/iot/firmware/{id} retires an image that no gateway targets. The
+// version stays taken so it can never name a different image.
+func deleteFirmware(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid firmware ID", err)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	fw, err := scanFirmware(db.QueryRowContext(ctx, firmwareColumns+" WHERE f.FirmwareID = ? AND f.IsActive = 1", id).Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		handleError(w, http.StatusNotFound, "Firmware not found or no changes made", nil)
+		return
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch firmware", err)
+		return
+	}
+	if fw.Gateways > 0 {
+		handleError(w, http.StatusConflict, fmt.Sprintf("Firmware %s is the target of %d gateway(s)", fw.Version, fw.Gateways), nil)
+		return
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE cm_firmware SET IsActive = 0 WHERE FirmwareID = ?", id); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to delete firmware", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Firmware " + fw.Version + " retired; the version cannot be uploaded again"})
+}
+
+// GET /api/iot/firmware/{id}/download, authenticated like /ws/gateway (?id=gw-1
+// plus token or signature); only the gateway being updated to the image may fetch
+// it. Range and If-Range are handled by ServeContent.
+func downloadFirmware(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid firmware id", http.StatusBadRequest)
+		return
+	}
+	gatewayID := r.URL.Query().Get("id")
+	if gatewayID == "" {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+	if _, err := authenticateGateway(ctx, r, gatewayID); err != nil {
+		log.Printf("Firmware download by %s rejected: %v", gatewayID, err)
+		http.Error(w, err.Error(), gatewayAuthStatus(err))
+		return
+	}
+	fw, err := scanFirmware(db.QueryRowContext(ctx, firmwareColumns+" WHERE f.FirmwareID = ? AND f.IsActive = 1", id).Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "firmware not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load firmware", http.StatusInternalServerError)
+		return
+	}
+
+	// a gateway may only fetch the image it is being updated to
+	ro, err := activeRollout(ctx, gatewayID)
+	if err != nil {
+		http.Error(w, "failed to load rollout", http.StatusInternalServerError)
+		return
+	}
+	if ro == nil || ro.FirmwareID != fw.FirmwareID {
+		var target sql.NullString
+		if err := db.QueryRowContext(ctx, "SELECT TargetFirmware FROM cm_gateways WHERE GatewayID = ?", gatewayID).Scan(&target); err != nil {
+			http.Error(w, "failed to load gateway", http.StatusInternalServerError)
+			return
+		}
+		if !target.Valid || target.String != fw.Version {
+			log.Printf("Firmware download of %s by %s rejected: not its target", fw.Version, gatewayID)
+			http.Error(w, "firmware not assigned to this gateway", http.StatusForbidden)
+			return
+		}
+		ro = nil
+	}
+
+	// the first request of a download moves the rollout on
+	if r.Header.Get("Range") == "" || strings.HasPrefix(r.Header.Get("Range"), "bytes=0-") {
+		if ro != nil && ro.Status == RolloutSent {
+			zero := 0
+			setRolloutStatus(ctx, *ro, RolloutDownloading, &zero, "")
+		}
+	}
+
+	f, err := os.Open(fw.filePath)
+	if err != nil {
+		log.Printf("[ERROR] Firmware %s file: %v", fw.Version, err)
+		http.Error(w, "firmware file missing", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	uploaded, _ := time.ParseInLocation(sqlDateTime, fw.UploadedAt, time.Local)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", `"`+fw.Sha256+`"`)
+	w.Header().Set("X-Firmware-Version", fw.Version)
+	w.Header().Set("X-Firmware-Sha256", fw.Sha256)
+	http.ServeContent(w, r, filepath.Base(fw.filePath), uploaded, f)
+}
+
+// PUT /api/iot/gateways/{id}/firmware-target {"Version":"1.3.0"} or {"Version":null}
+func setGatewayFirmwareTarget(w http.ResponseWriter, r *http.Request) {
+	gatewayID := chi.URLParam(r, "id")
+	var payload FirmwareTargetPayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	var fw *Firmware
+	if payload.Version != nil {
+		f, err := loadFirmwareByVersion(ctx, strings.TrimSpace(*payload.Version))
+		if errors.Is(err, sql.ErrNoRows) {
+			handleError(w, http.StatusBadRequest, "Unknown firmware version", nil)
+			return
+		}
+		if err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to fetch firmware", err)
+			return
+		}
+		if f.Signature == nil {
+			handleError(w, http.StatusConflict, unsignedFirmwareMessage(f.Version), nil)
+			return
+		}
+		fw = &f
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+
+	ok, err := setFirmwareTarget(ctx, tx, gatewayID, fw, requestUsername(r))
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to set firmware target", err)
+		return
+	}
+	if !ok {
+		handleError(w, http.StatusNotFound, "Gateway not found or revoked", nil)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to commit transaction", err)
+		return
+	}
+	go dispatchFirmwareRolloutsNow()
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// POST /api/iot/firmware/rollout sets the target of many gateways at once
+func createFirmwareRollout(w http.ResponseWriter, r *http.Request) {
+	var payload FirmwareRolloutPayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	fw, err := loadFirmwareByVersion(ctx, strings.TrimSpace(payload.Version))
+	if errors.Is(err, sql.ErrNoRows) {
+		handleError(w, http.StatusBadRequest, "Unknown firmware version", nil)
+		return
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch firmware", err)
+		return
+	}
+	if fw.Signature == nil {
+		handleError(w, http.StatusConflict, unsignedFirmwareMessage(fw.Version), nil)
+		return
+	}
+
+	targets := payload.Gateways
+	if len(targets) == 0 {
+		rows, err := db.QueryContext(ctx, "SELECT GatewayID FROM cm_gateways WHERE ClaimedAt IS NOT NULL AND RevokedAt IS NULL")
+		if err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to fetch gateways", err)
+			return
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				handleError(w, http.StatusInternalServerError, "Failed to scan gateway", err)
+				return
+			}
+			targets = append(targets, id)
+		}
+		rows.Close()
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+
+	updated, missing := []string{}, []string{}
+	for _, id := range targets {
+		ok, err := setFirmwareTarget(ctx, tx, id, &fw, requestUsername(r))
+		if err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to set firmware target", err)
+			return
+		}
+		if ok {
+			updated = append(updated, id)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to commit transaction", err)
+		return
+	}
+	go dispatchFirmwareRolloutsNow()
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true, "version": fw.Version, "gateways": updated, "notFound": missing})
+}
+
+func unsignedFirmwareMessage(version string) string {
+	return "Firmware " + version + " was uploaded without a signature, retire it and upload a signed image under a new version"
+}
+
+func dispatchFirmwareRolloutsNow() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := dispatchFirmwareRollouts(ctx); err != nil {
+		log.Printf("[ERROR] Firmware rollouts: %v", err)
+	}
+}
+
+// GET /api/iot/firmware/rollouts?gateway=gw-1&version=1.3.0&status=Failed&limit=100
+func getFirmwareRollouts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := rolloutColumns + " WHERE 1=1"
+	var args []interface{}
+	for param, column := range map[string]string{"gateway": "GatewayID", "version": "Version", "status": "Status"} {
+		if v := q.Get(param); v != "" {
+			query += " AND " + column + " = ?"
+			args = append(args, v)
+		}
+	}
+	limit := 100
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+	query += " ORDER BY RolloutID DESC LIMIT ?"
+	args = append(args, limit)
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch firmware rollouts", err)
+		return
+	}
+	defer rows.Close()
+
+	list := []FirmwareRollout{}
+	for rows.Next() {
+		ro, err := scanRollout(rows.Scan)
+		if err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan firmware rollout", err)
+			return
+		}
+		list = append(list, ro)
+	}
+	respondJSON(w, http.StatusOK, list)
+}
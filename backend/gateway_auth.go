@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+/* ===========================
+    Gateway Authentication
+=========================== */
+
+// Every gateway is provisioned with an ID and a secret (POST /api/iot/gateways)
+// which is flashed into its firmware. It proves itself on /ws/gateway in one of two ways:
+//
+//	token: Authorization: Bearer <secret>   (or ?token=<secret> for clients that cannot set headers)
+//	hmac:  ?id=gw-1&hw=<mac>&ts=<unix>&nonce=<random>&sig=<hex hmac-sha256(secret, id\nhw\nts\nnonce)>
+//
+// Signed requests older than gatewayAuthWindow or with a nonce already seen are
+// refused so a captured URL cannot be replayed. "hw" is the hardware ID (MAC) and
+// is required in both modes: the first successful connect binds the credentials to
+// it, and later connects from other hardware are refused until the secret is
+// rotated. Provisioning, rotating and revoking need the admin token (requireAdmin).
+type GatewayProvisionPayload struct {
+	ID   string  `json:"id"`
+	Name *string `json:"name"`
+}
+
+const (
+	gatewayAuthWindow = 5 * time.Minute
+	gatewaySecretLen  = 32
+)
+
+var (
+	errGatewayUnknown   = errors.New("unknown gateway")
+	errGatewayRevoked   = errors.New("gateway revoked")
+	errGatewayBadAuth   = errors.New("invalid gateway credentials")
+	errGatewayReplay    = errors.New("stale or replayed signature")
+	errGatewayDuplicate = errors.New("gateway already connected from another device")
+	errGatewayHardware  = errors.New("gateway credentials are bound to other hardware")
+)
+
+// gatewayUpgrader only accepts connections without an Origin header: gateways
+// are not browsers, and this stops a web page from opening a gateway socket
+var gatewayUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return r.Header.Get("Origin") == "" },
+}
+
+var (
+	nonceMu    sync.Mutex
+	seenNonces = make(map[string]time.Time) // gatewayID + nonce -> expiry
+)
+
+func newGatewaySecret() string {
+	b := make([]byte, gatewaySecretLen)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func gatewaySignature(secret, id, hw, ts, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id + "\n" + hw + "\n" + ts + "\n" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// rememberNonce returns false if the nonce was already used inside the auth window
+func rememberNonce(gatewayID, nonce string, now time.Time) bool {
+	nonceMu.Lock()
+	defer nonceMu.Unlock()
+	for k, exp := range seenNonces {
+		if now.After(exp) {
+			delete(seenNonces, k)
+		}
+	}
+	key := gatewayID + "|" + nonce
+	if _, ok := seenNonces[key]; ok {
+		return false
+	}
+	seenNonces[key] = now.Add(2 * gatewayAuthWindow)
+	return true
+}
+
+// authenticateGateway checks the connect request against the registry and
+// returns the hardware ID the gateway presented
+func authenticateGateway(ctx context.Context, r *http.Request, id string) (string, error) {
+	var secret, revokedAt, boundHW *string
+	err := db.QueryRowContext(ctx, "SELECT Secret, RevokedAt, HardwareID FROM cm_gateways WHERE GatewayID = ?", id).Scan(&secret, &revokedAt, &boundHW)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errGatewayUnknown
+	}
+	if err != nil {
+		return "", err
+	}
+	if revokedAt != nil {
+		return "", errGatewayRevoked
+	}
+	if secret == nil || *secret == "" {
+		return "", errGatewayUnknown
+	}
+
+	q := r.URL.Query()
+	hw := q.Get("hw")
+	if hw == "" || len(hw) > 64 {
+		return "", errGatewayBadAuth
+	}
+	if sig := q.Get("sig"); sig != "" {
+		ts, nonce := q.Get("ts"), q.Get("nonce")
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil || nonce == "" {
+			return "", errGatewayBadAuth
+		}
+		now := time.Now()
+		if d := now.Sub(time.Unix(sec, 0)); d > gatewayAuthWindow || d < -gatewayAuthWindow {
+			return "", errGatewayReplay
+		}
+		if !hmac.Equal([]byte(strings.ToLower(sig)), []byte(gatewaySignature(*secret, id, hw, ts, nonce))) {
+			return "", errGatewayBadAuth
+		}
+		if !rememberNonce(id, nonce, now) {
+			return "", errGatewayReplay
+		}
+		return hw, bindGatewayHardware(ctx, id, hw, boundHW)
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		token = q.Get("token")
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(*secret)) != 1 {
+		return "", errGatewayBadAuth
+	}
+	return hw, bindGatewayHardware(ctx, id, hw, boundHW)
+}
+
+// bindGatewayHardware ties the gateway's credentials to the first hardware that
+// authenticates with them, and refuses any other hardware afterwards
+func bindGatewayHardware(ctx context.Context, id, hw string, bound *string) error {
+	if bound != nil {
+		if *bound != hw {
+			return errGatewayHardware
+		}
+		return nil
+	}
+	res, err := db.ExecContext(ctx, "UPDATE cm_gateways SET HardwareID = ? WHERE GatewayID = ? AND HardwareID IS NULL", hw, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	// another connect bound it first
+	var current string
+	if err := db.QueryRowContext(ctx, "SELECT COALESCE(HardwareID, '') FROM cm_gateways WHERE GatewayID = ?", id).Scan(&current); err != nil {
+		return err
+	}
+	if current != hw {
+		return errGatewayHardware
+	}
+	return nil
+}
+
+func gatewayAuthStatus(err error) int {
+	switch err {
+	case errGatewayUnknown, errGatewayBadAuth, errGatewayReplay:
+		return http.StatusUnauthorized
+	case errGatewayRevoked, errGatewayHardware:
+		return http.StatusForbidden
+	case errGatewayDuplicate:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// provisionGateway handles POST /api/iot/gateways. The secret is only ever returned here.
+func provisionGateway(w http.ResponseWriter, r *http.Request) {
+	var payload GatewayProvisionPayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	payload.ID = strings.TrimSpace(payload.ID)
+	if payload.ID == "" || len(payload.ID) > 64 {
+		handleError(w, http.StatusBadRequest, "Gateway ID is required (max 64 characters)", nil)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	secret := newGatewaySecret()
+	query := "INSERT INTO cm_gateways (GatewayID, Name, Secret) VALUES (?, ?, ?)"
+	if _, err := db.ExecContext(ctx, query, payload.ID, payload.Name, secret); err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			handleError(w, http.StatusConflict, "Gateway already exists", nil)
+			return
+		}
+		handleError(w, http.StatusInternalServerError, "Failed to provision gateway", err)
+		return
+	}
+	respondJSON(w, http.StatusCreated, map[string]interface{}{"success": true, "id": payload.ID, "secret": secret})
+}
+
+// rotateGatewaySecret handles POST /api/iot/gateways/{id}/rotate-secret; the live
+// connection is dropped so the gateway has to come back with the new secret. The
+// hardware binding is cleared as well, so rotating is how a gateway moves to a
+// replacement board. Revoked gateways stay revoked.
+func rotateGatewaySecret(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	secret := newGatewaySecret()
+	res, err := db.ExecContext(ctx, "UPDATE cm_gateways SET Secret = ?, HardwareID = NULL WHERE GatewayID = ? AND RevokedAt IS NULL", secret, id)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to rotate gateway secret", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var revokedAt *string
+		err := db.QueryRowContext(ctx, "SELECT RevokedAt FROM cm_gateways WHERE GatewayID = ?", id).Scan(&revokedAt)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			handleError(w, http.StatusNotFound, "Gateway not found", nil)
+		case err != nil:
+			handleError(w, http.StatusInternalServerError, "Failed to rotate gateway secret", err)
+		default:
+			handleError(w, http.StatusConflict, "Gateway is revoked, provision the hardware under a new ID", nil)
+		}
+		return
+	}
+	disconnectGateway(id, "credentials rotated")
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true, "id": id, "secret": secret})
+}
+
+// revokeGateway handles POST /api/iot/gateways/{id}/revoke
+func revokeGateway(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, "UPDATE cm_gateways SET RevokedAt = NOW() WHERE GatewayID = ? AND RevokedAt IS NULL", id)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to revoke gateway", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		handleError(w, http.StatusNotFound, "Gateway not found or already revoked", nil)
+		return
+	}
+	disconnectGateway(id, "revoked")
+	publishLive("gateway", gatewayTopic(id), map[string]interface{}{"id": id, "status": "revoked"})
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Gateway revoked"})
+}
+
+// disconnectGateway closes a live gateway connection; its read loop cleans up
+func disconnectGateway(id, reason string) {
+	gatewayMu.RLock()
+	gw, ok := gateways[id]
+	gatewayMu.RUnlock()
+	if !ok {
+		return
+	}
+	gw.closeWithReason(reason)
+}
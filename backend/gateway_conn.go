@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/* ===========================
+    Gateway Write Path
+=========================== */
+
+// gorilla/websocket allows one concurrent writer, so every frame for a gateway
+// goes through its outbound queue and is written by a single writer goroutine,
+// which also sends the pings. A full queue means the gateway (or its link) cannot
+// keep up: writeJSON waits up to gatewayEnqueueTimeout and then fails instead of
+// blocking the HTTP handler or the read loop. Closing a gateway stops the writer,
+// closes the socket and fails the commands that were waiting on this connection.
+const (
+	gatewaySendBuffer     = 32
+	gatewayEnqueueTimeout = 2 * time.Second
+	gatewayWriteTimeout   = 10 * time.Second
+)
+
+var (
+	errGatewayClosed = errors.New("gateway connection closed")
+	errGatewayBusy   = errors.New("gateway send queue full")
+)
+
+func newGateway(id, hw string, conn *websocket.Conn) *Gateway {
+	now := time.Now().Unix()
+	return &Gateway{
+		ID:          id,
+		Conn:        conn,
+		HardwareID:  hw,
+		LastSeen:    now,
+		ConnectedAt: now,
+		send:        make(chan []byte, gatewaySendBuffer),
+		closed:      make(chan struct{}),
+	}
+}
+
+// writeJSON queues v for the writer goroutine
+func (gw *Gateway) writeJSON(v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-gw.closed:
+		return errGatewayClosed
+	default:
+	}
+
+	t := time.NewTimer(gatewayEnqueueTimeout)
+	defer t.Stop()
+	select {
+	case gw.send <- msg:
+		return nil
+	case <-gw.closed:
+		return errGatewayClosed
+	case <-t.C:
+		log.Printf("[WARN] Gateway %s send queue full, dropping frame", gw.ID)
+		return errGatewayBusy
+	}
+}
+
+// attachGateway makes gw the live connection for its ID and records it. It
+// re-checks for a duplicate under the write lock, since another connection for
+// the ID may have been accepted meanwhile; a connection from the same hardware
+// replaces the old one. Returns false (and closes gw) if it was refused.
+func attachGateway(gw *Gateway, remoteAddr string) bool {
+	gatewayMu.Lock()
+	if cur, ok := gateways[gw.ID]; ok {
+		if cur.HardwareID != gw.HardwareID {
+			gatewayMu.Unlock()
+			gw.closeWithReason(errGatewayDuplicate.Error())
+			return false
+		}
+		// the same device reconnected before its old connection timed out; the old
+		// connection's cleanup sees it is no longer current and only cleans up itself
+		cur.closeWithReason("replaced by new connection")
+	}
+	gateways[gw.ID] = gw
+	gatewayMu.Unlock()
+	log.Printf("Gateway connected: %s", gw.ID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel()
+	if err := registerGatewayConnection(ctx, gw); err != nil {
+		log.Printf("[ERROR] Failed to register gateway %s: %v", gw.ID, err)
+	}
+	if err := recordGatewayConnect(ctx, gw, remoteAddr); err != nil {
+		log.Printf("[ERROR] Failed to record connection of gateway %s: %v", gw.ID, err)
+	}
+	resolveGatewayOfflineAlert(ctx, gw.ID)
+	publishLive("gateway", gatewayTopic(gw.ID), map[string]interface{}{"id": gw.ID, "status": "connected", "claimed": gw.isClaimed()})
+	setGatewayState(gw.ID, GatewayOnline)
+	return true
+}
+
+// detachGateway runs once a connection has ended: it fails the commands waiting
+// on it, closes its history row and, unless a newer connection took over, marks
+// the gateway offline
+func detachGateway(gw *Gateway, readErr error) {
+	gw.closeWithReason(disconnectReason(gw, readErr))
+	reason := gw.closeReason()
+	failPendingCommands(gw, reason)
+	recordGatewayDisconnect(gw, reason)
+	gatewayMu.Lock()
+	current := gateways[gw.ID] == gw
+	if current {
+		delete(gateways, gw.ID)
+	}
+	gatewayMu.Unlock()
+	if !current {
+		log.Printf("Gateway %s connection replaced", gw.ID)
+		return
+	}
+	persistGatewayLastSeen(gw, time.Unix(atomic.LoadInt64(&gw.LastSeen), 0))
+	log.Printf("Gateway disconnected: %s", gw.ID)
+	publishLive("gateway", gatewayTopic(gw.ID), map[string]interface{}{"id": gw.ID, "status": "disconnected"})
+	setGatewayState(gw.ID, GatewayOffline)
+}
+
+// closeWithReason shuts the connection down from the server side; the first
+// reason given is what the connection history records
+func (gw *Gateway) closeWithReason(reason string) {
+	gw.closeOnce.Do(func() {
+		gw.mu.Lock()
+		gw.reason = reason
+		gw.mu.Unlock()
+		close(gw.closed)
+	})
+}
+
+func (gw *Gateway) closeReason() string {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return gw.reason
+}
+
+// writePump is the only goroutine that writes to the gateway's socket. It exits
+// when the gateway is closed or a write fails, closing the socket either way so
+// the read loop ends too.
+func (gw *Gateway) writePump() {
+	ping := time.NewTicker(gatewayPingInterval)
+	defer func() {
+		ping.Stop()
+		gw.Conn.Close()
+	}()
+
+	for {
+		select {
+		case msg := <-gw.send:
+			gw.Conn.SetWriteDeadline(time.Now().Add(gatewayWriteTimeout))
+			if err := gw.Conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				log.Printf("Write error to %s: %v", gw.ID, err)
+				gw.closeWithReason("write failed: " + err.Error())
+				return
+			}
+		case <-ping.C:
+			gw.Conn.SetWriteDeadline(time.Now().Add(gatewayWriteTimeout))
+			if err := gw.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				gw.closeWithReason("ping failed: " + err.Error())
+				return
+			}
+		case <-gw.closed:
+			// best effort: when the gateway hung up first this write just fails
+			gw.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+			gw.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, gw.closeReason()))
+			return
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+/* ===========================
+    Gateway Liveness
+=========================== */
+
+// A gateway is "online" while connected and sending telemetry, "stale" when it is
+// connected but has sent no telemetry for GATEWAY_STALE_MINUTES, and "offline"
+// when it is not connected. A claimed gateway that stays offline for
+// GATEWAY_OFFLINE_MINUTES raises a critical alert, resolved when it reconnects.
+// Every connection is recorded in cm_gateway_connections with why it ended.
+const (
+	GatewayOnline  = "online"
+	GatewayStale   = "stale"
+	GatewayOffline = "offline"
+
+	gatewayPingInterval          = 20 * time.Second
+	gatewayPongTimeout           = 60 * time.Second
+	gatewayReadLimit             = 64 * 1024
+	gatewayMonitorInterval       = time.Minute
+	defaultGatewayStaleMinutes   = 10
+	defaultGatewayOfflineMinutes = 5
+	gatewayOfflineAlert          = "gateway_offline"
+)
+
+type GatewayConnection struct {
+	ID             int64   `json:"ID"`
+	GatewayID      string  `json:"GatewayID"`
+	HardwareID     *string `json:"HardwareID"`
+	RemoteAddr     string  `json:"RemoteAddr"`
+	ConnectedAt    string  `json:"ConnectedAt"`
+	DisconnectedAt *string `json:"DisconnectedAt"`
+	Reason         *string `json:"Reason"`
+}
+
+var (
+	gatewayStateMu sync.Mutex
+	gatewayStates  = make(map[string]string) // last state published per gateway
+)
+
+// gatewayState derives the state of a gateway; gw is nil when it is not connected.
+// Until its first telemetry frame a gateway gets the stale period from when it connected.
+func gatewayState(gw *Gateway, now time.Time) string {
+	if gw == nil {
+		return GatewayOffline
+	}
+	stale := time.Duration(getEnvInt("GATEWAY_STALE_MINUTES", defaultGatewayStaleMinutes)) * time.Minute
+	last := atomic.LoadInt64(&gw.LastTelemetry)
+	if last == 0 {
+		last = gw.ConnectedAt
+	}
+	if now.Sub(time.Unix(last, 0)) > stale {
+		return GatewayStale
+	}
+	return GatewayOnline
+}
+
+// setGatewayState publishes a state change to live clients
+func setGatewayState(id, state string) {
+	gatewayStateMu.Lock()
+	changed := gatewayStates[id] != state
+	gatewayStates[id] = state
+	gatewayStateMu.Unlock()
+	if changed {
+		publishLive("gateway", gatewayTopic(id), map[string]interface{}{"id": id, "state": state})
+	}
+}
+
+// configureGatewayConn sets the read limit and deadline; every pong or frame
+// pushes the deadline out, so a silent gateway times out its own read loop
+func configureGatewayConn(gw *Gateway) {
+	gw.Conn.SetReadLimit(gatewayReadLimit)
+	gw.Conn.SetReadDeadline(time.Now().Add(gatewayPongTimeout))
+	gw.Conn.SetPongHandler(func(string) error {
+		atomic.StoreInt64(&gw.LastSeen, time.Now().Unix())
+		return gw.Conn.SetReadDeadline(time.Now().Add(gatewayPongTimeout))
+	})
+}
+
+// disconnectReason turns the error that ended the read loop into something readable
+func disconnectReason(gw *Gateway, err error) string {
+	if reason := gw.closeReason(); reason != "" {
+		return reason
+	}
+	var ne net.Error
+	switch {
+	case websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway):
+		return "closed by gateway"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "ping timeout"
+	case websocket.IsUnexpectedCloseError(err):
+		return "connection lost: " + err.Error()
+	case err != nil:
+		return err.Error()
+	}
+	return "unknown"
+}
+
+func recordGatewayConnect(ctx context.Context, gw *Gateway, remoteAddr string) error {
+	query := "INSERT INTO cm_gateway_connections (GatewayID, HardwareID, RemoteAddr, ConnectedAt) VALUES (?, NULLIF(?, ''), ?, NOW())"
+	res, err := db.ExecContext(ctx, query, gw.ID, gw.HardwareID, remoteAddr)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&gw.connectionID, id)
+	return nil
+}
+
+func recordGatewayDisconnect(gw *Gateway, reason string) {
+	connID := atomic.LoadInt64(&gw.connectionID)
+	if connID == 0 {
+		return
+	}
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel()
+	query := "UPDATE cm_gateway_connections SET DisconnectedAt = NOW(), Reason = ? WHERE ID = ?"
+	if _, err := db.ExecContext(ctx, query, reason, connID); err != nil {
+		log.Printf("[ERROR] Failed to record disconnect of gateway %s: %v", gw.ID, err)
+	}
+}
+
+// closeOpenConnections marks connections left open by a previous run of the server
+func closeOpenConnections(ctx context.Context) error {
+	_, err := db.ExecContext(ctx, "UPDATE cm_gateway_connections SET DisconnectedAt = NOW(), Reason = 'server restarted' WHERE DisconnectedAt IS NULL")
+	return err
+}
+
+func openGatewayAlert(ctx context.Context, gatewayID string) (int64, error) {
+	var alertID int64
+	query := "SELECT AlertID FROM cm_alerts WHERE Type = ? AND Source = ? AND Status <> 'Resolved' ORDER BY AlertID DESC LIMIT 1"
+	err := db.QueryRowContext(ctx, query, gatewayOfflineAlert, gatewayID).Scan(&alertID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return alertID, err
+}
+
+// resolveGatewayOfflineAlert is called when a gateway reconnects
+func resolveGatewayOfflineAlert(ctx context.Context, gatewayID string) {
+	alertID, err := openGatewayAlert(ctx, gatewayID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to look up offline alert for %s: %v", gatewayID, err)
+		return
+	}
+	if alertID != 0 {
+		if _, err := resolveAlert(ctx, alertID, "system"); err != nil {
+			log.Printf("[ERROR] Failed to resolve offline alert for %s: %v", gatewayID, err)
+		}
+	}
+}
+
+// checkGateways publishes state changes and raises alerts for claimed gateways
+// that have been offline longer than the grace period
+func checkGateways(ctx context.Context, now time.Time) error {
+	offlineAfter := getEnvInt("GATEWAY_OFFLINE_MINUTES", defaultGatewayOfflineMinutes)
+	query := `
+		SELECT GatewayID, COALESCE(Name, GatewayID), LastSeen, COALESCE(UNIX_TIMESTAMP(LastSeen), 0)
+		FROM cm_gateways
+		WHERE ClaimedAt IS NOT NULL AND RevokedAt IS NULL AND LastSeen IS NOT NULL`
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	type offlineGateway struct {
+		id, name, lastSeen string
+		since              int64
+	}
+	var offline []offlineGateway
+	for rows.Next() {
+		var g offlineGateway
+		if err := rows.Scan(&g.id, &g.name, &g.lastSeen, &g.since); err != nil {
+			rows.Close()
+			return err
+		}
+		gatewayMu.RLock()
+		gw := gateways[g.id]
+		gatewayMu.RUnlock()
+
+		state := gatewayState(gw, now)
+		setGatewayState(g.id, state)
+		if state == GatewayOffline && now.Unix()-g.since >= int64(offlineAfter*60) {
+			offline = append(offline, g)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, g := range offline {
+		alertID, err := openGatewayAlert(ctx, g.id)
+		if err != nil {
+			return err
+		}
+		if alertID != 0 {
+			continue
+		}
+		id := g.id
+		threshold := float64(offlineAfter)
+		_, err = raiseAlert(ctx, AlertRecord{
+			Type:      gatewayOfflineAlert,
+			Severity:  "critical",
+			Source:    &id,
+			Threshold: &threshold,
+			Message:   fmt.Sprintf("Gateway %s has been offline since %s", g.name, g.lastSeen),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runGatewayMonitor(ctx context.Context) {
+	startCtx, cancel := context.WithTimeout(ctx, defaultQueryTimeout)
+	if err := closeOpenConnections(startCtx); err != nil {
+		log.Printf("[ERROR] Failed to close stale gateway connections: %v", err)
+	}
+	cancel()
+
+	t := time.NewTicker(gatewayMonitorInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			jobCtx, cancel := context.WithTimeout(ctx, time.Minute)
+			if err := checkGateways(jobCtx, now); err != nil {
+				log.Printf("[ERROR] Gateway monitor: %v", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// GET /api/iot/gateways/{id}/connections?limit=50
+func getGatewayConnections(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	limit := 50
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+	query := `
+		SELECT ID, GatewayID, HardwareID, RemoteAddr, ConnectedAt, DisconnectedAt, Reason
+		FROM cm_gateway_connections
+		WHERE GatewayID = ?
+		ORDER BY ConnectedAt DESC
+		LIMIT ?`
+	rows, err := db.QueryContext(ctx, query, chi.URLParam(r, "id"), limit)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch gateway connections", err)
+		return
+	}
+	defer rows.Close()
+
+	list := []GatewayConnection{}
+	for rows.Next() {
+		var c GatewayConnection
+		if err := rows.Scan(&c.ID, &c.GatewayID, &c.HardwareID, &c.RemoteAddr, &c.ConnectedAt, &c.DisconnectedAt, &c.Reason); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan gateway connection", err)
+			return
+		}
+		list = append(list, c)
+	}
+	respondJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/* ===========================
+    Gateway WebSocket Protocol
+=========================== */
+
+// Every frame from a gateway is a JSON object with a "type":
+//
+//	{"type":"hello","firmware":"1.2.0","pairingCode":"482913","devices":[{"id":"esp-water-1","kind":"watering","cage":1}]}
+//	{"type":"telemetry","device":"esp-water-1","cage":1,"temperature":29.5,"humidity":61,
+//	 "gas":120,"water1":540,"water2":530,"water3":0,"relay1":1,"relay2":0,"relay3":0,"ts":1718000000}
+//	{"type":"heartbeat","uptime":3600,"rssi":-61}
+//	{"type":"event","device":"esp-feed-1","event":"feeder_dispensed","detail":{"grams":500}}
+//	{"type":"event","device":"gateway","event":"firmware_status","detail":{"version":"1.3.0","status":"installing"}}
+//	{"type":"ack","commandId":"9f2c...","ok":true,"result":{"relay1":1}}
+//
+// The server answers invalid frames with {"type":"error","error":"..."}. Telemetry
+// and events from a gateway that has not been claimed are refused the same way.
+type GatewayFrame struct {
+	Type string `json:"type"`
+
+	// hello
+	Firmware    string               `json:"firmware,omitempty"`
+	PairingCode string               `json:"pairingCode,omitempty"`
+	Devices     []GatewayDeviceHello `json:"devices,omitempty"`
+
+	// telemetry and event
+	Device      string   `json:"device,omitempty"`
+	Cage        *int     `json:"cage,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	Humidity    *float64 `json:"humidity,omitempty"`
+	Gas         *float64 `json:"gas,omitempty"`
+	Water1      *int     `json:"water1,omitempty"`
+	Water2      *int     `json:"water2,omitempty"`
+	Water3      *int     `json:"water3,omitempty"`
+	Relay1      *int     `json:"relay1,omitempty"`
+	Relay2      *int     `json:"relay2,omitempty"`
+	Relay3      *int     `json:"relay3,omitempty"`
+	Timestamp   int64    `json:"ts,omitempty"`
+
+	// event
+	Event  string          `json:"event,omitempty"`
+	Detail json.RawMessage `json:"detail,omitempty"`
+
+	// heartbeat
+	Uptime int64 `json:"uptime,omitempty"`
+	RSSI   int   `json:"rssi,omitempty"`
+
+	// ack
+	CommandID string          `json:"commandId,omitempty"`
+	OK        *bool           `json:"ok,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+}
+
+type GatewayDeviceHello struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	Cage *int   `json:"cage"`
+}
+
+type gatewayReply struct {
+	Type  string `json:"type"`
+	Error string `json:"error,omitempty"`
+}
+
+const maxGatewayClockSkew = 24 * time.Hour
+
+// frameTime uses the gateway timestamp when it is plausible, otherwise the receive time
+func (f GatewayFrame) frameTime(received time.Time) time.Time {
+	if f.Timestamp <= 0 {
+		return received
+	}
+	t := time.Unix(f.Timestamp, 0)
+	if t.After(received.Add(time.Minute)) || t.Before(received.Add(-maxGatewayClockSkew)) {
+		return received
+	}
+	return t
+}
+
+func validRelayState(v *int) bool {
+	return v == nil || *v == 0 || *v == 1
+}
+
+func (f GatewayFrame) validate() error {
+	switch f.Type {
+	case "hello":
+		for _, d := range f.Devices {
+			if d.ID == "" {
+				return errors.New("hello devices need an id")
+			}
+		}
+	case "telemetry":
+		if f.Device == "" {
+			return errors.New("telemetry needs a device")
+		}
+		if (f.Temperature == nil) != (f.Humidity == nil) {
+			return errors.New("temperature and humidity must be sent together")
+		}
+		if f.Temperature != nil && f.Cage == nil {
+			return errors.New("environment readings need a cage")
+		}
+		// implausible values are not refused here: sensor health judges them after
+		// calibration and they are stored flagged in SensorFault
+		if !validRelayState(f.Relay1) || !validRelayState(f.Relay2) || !validRelayState(f.Relay3) {
+			return errors.New("relay states must be 0 or 1")
+		}
+	case "heartbeat":
+	case "event":
+		if f.Device == "" || f.Event == "" {
+			return errors.New("event needs a device and an event name")
+		}
+	case "ack":
+		if f.CommandID == "" || f.OK == nil {
+			return errors.New("ack needs a commandId and ok")
+		}
+	default:
+		return fmt.Errorf("unknown frame type %q", f.Type)
+	}
+	return nil
+}
+
+// handleGatewayFrame validates and persists one message read from a gateway
+func handleGatewayFrame(gw *Gateway, raw []byte) {
+	received := time.Now()
+	atomic.StoreInt64(&gw.LastSeen, received.Unix())
+
+	var f GatewayFrame
+	if err := json.Unmarshal(raw, &f); err != nil {
+		gw.writeJSON(gatewayReply{Type: "error", Error: "invalid JSON"})
+		return
+	}
+	f.Type = strings.ToLower(f.Type)
+	if err := f.validate(); err != nil {
+		gw.writeJSON(gatewayReply{Type: "error", Error: err.Error()})
+		return
+	}
+
+	if (f.Type == "telemetry" || f.Type == "event") && !gw.isClaimed() {
+		gw.writeJSON(gatewayReply{Type: "error", Error: "gateway not claimed"})
+		return
+	}
+	touchGateway(gw, received)
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel()
+
+	var err error
+	switch f.Type {
+	case "hello":
+		err = handleGatewayHello(ctx, gw, f)
+	case "telemetry":
+		err = handleGatewayTelemetry(ctx, gw, f, f.frameTime(received))
+	case "heartbeat":
+		// LastSeen above is all a heartbeat needs
+	case "event":
+		err = handleGatewayEvent(ctx, gw, f, f.frameTime(received))
+	case "ack":
+		if !deliverCommandAck(gw.ID, f.CommandID, commandAck{OK: *f.OK, Error: f.Error, Result: f.Result}) {
+			log.Printf("[WARN] Gateway %s acked unknown command %s", gw.ID, f.CommandID)
+		}
+	}
+	if err != nil {
+		log.Printf("[ERROR] Gateway %s %s frame: %v", gw.ID, f.Type, err)
+		gw.writeJSON(gatewayReply{Type: "error", Error: "failed to store " + f.Type})
+	}
+}
+
+// handleGatewayHello records what a gateway reports about itself. An unclaimed
+// gateway only gets to register its pairing code; its firmware and devices are
+// taken from the hello it sends again once it has been claimed.
+func handleGatewayHello(ctx context.Context, gw *Gateway, f GatewayFrame) error {
+	if !gw.isClaimed() {
+		if f.PairingCode == "" {
+			return nil
+		}
+		return setPairingCode(ctx, gw.ID, f.PairingCode)
+	}
+	gw.setFirmware(f.Firmware)
+	if err := persistGatewayHello(ctx, gw, f); err != nil {
+		return err
+	}
+	for _, d := range f.Devices {
+		if err := upsertGatewayDevice(ctx, gw.ID, d.ID, d.Kind, d.Cage); err != nil {
+			return err
+		}
+	}
+	if err := checkFirmwareAfterHello(ctx, gw.ID, f.Firmware); err != nil {
+		return err
+	}
+	publishLive("gateway", gatewayTopic(gw.ID), map[string]interface{}{"id": gw.ID, "status": "identified", "firmware": f.Firmware, "devices": f.Devices})
+	return nil
+}
+
+func upsertGatewayDevice(ctx context.Context, gatewayID, deviceID, kind string, cage *int) error {
+	query := `
+		INSERT INTO cm_gateway_devices (GatewayID, DeviceID, Kind, CageNum, LastSeen)
+		VALUES (?, ?, ?, ?, NOW())
+		ON DUPLICATE KEY UPDATE
+			Kind = IF(VALUES(Kind) = '', Kind, VALUES(Kind)),
+			CageNum = COALESCE(VALUES(CageNum), CageNum),
+			LastSeen = NOW()`
+	_, err := db.ExecContext(ctx, query, gatewayID, deviceID, kind, cage)
+	return err
+}
+
+func handleGatewayTelemetry(ctx context.Context, gw *Gateway, f GatewayFrame, at time.Time) error {
+	if err := upsertGatewayDevice(ctx, gw.ID, f.Device, "", f.Cage); err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&gw.LastTelemetry, at.Unix())
+	if f.Temperature != nil {
+		gas := 0.0
+		if f.Gas != nil {
+			gas = *f.Gas
+		}
+		if _, err := ingestEnvironmentReading(ctx, gw.ID, f.Device, *f.Cage, *f.Temperature, *f.Humidity, gas, at); err != nil {
+			return err
+		}
+	}
+
+	if f.Water1 == nil && f.Water2 == nil && f.Water3 == nil && f.Relay1 == nil && f.Relay2 == nil && f.Relay3 == nil {
+		return nil
+	}
+
+	query := `
+		INSERT INTO cm_gateway_telemetry (GatewayID, DeviceID, CageNum, Water1, Water2, Water3, Relay1, Relay2, Relay3, ReceivedAt)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if _, err := db.ExecContext(ctx, query, gw.ID, f.Device, f.Cage, f.Water1, f.Water2, f.Water3,
+		f.Relay1, f.Relay2, f.Relay3, at.Format(sqlDateTime)); err != nil {
+		return err
+	}
+
+	// keep the latest state per device alongside the direct-IP devices
+	devMu.Lock()
+	t := readings[f.Device]
+	setIfPresent(&t.Water1, f.Water1)
+	setIfPresent(&t.Water2, f.Water2)
+	setIfPresent(&t.Water3, f.Water3)
+	setIfPresent(&t.Relay1, f.Relay1)
+	setIfPresent(&t.Relay2, f.Relay2)
+	setIfPresent(&t.Relay3, f.Relay3)
+	t.At = at
+	readings[f.Device] = t
+	devMu.Unlock()
+
+	topic := gatewayTopic(gw.ID)
+	if f.Cage != nil {
+		topic = cageTopic(*f.Cage)
+	}
+	publishLive("reading", topic, map[string]interface{}{"gatewayId": gw.ID, "device": f.Device, "cageNum": f.Cage, "telemetry": t})
+	return nil
+}
+
+func setIfPresent(dst *int, v *int) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+func handleGatewayEvent(ctx context.Context, gw *Gateway, f GatewayFrame, at time.Time) error {
+	detail := "{}"
+	if len(f.Detail) > 0 {
+		detail = string(f.Detail)
+	}
+	query := "INSERT INTO cm_gateway_events (GatewayID, DeviceID, Event, Detail, ReceivedAt) VALUES (?, ?, ?, ?, ?)"
+	if _, err := db.ExecContext(ctx, query, gw.ID, f.Device, f.Event, detail, at.Format(sqlDateTime)); err != nil {
+		return err
+	}
+	publishLive("gateway", gatewayTopic(gw.ID), map[string]interface{}{"id": gw.ID, "device": f.Device, "event": f.Event, "detail": f.Detail})
+	if f.Event == firmwareStatusEventName {
+		return handleFirmwareEvent(ctx, gw.ID, f.Detail)
+	}
+	return nil
+}
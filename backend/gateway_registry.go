@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+/* ===========================
+    Gateway Registry / Claiming
+=========================== */
+
+// A gateway row is created when the gateway is provisioned. Until somebody claims it
+// with its pairing code it may say hello and heartbeat, but its telemetry and
+// events are refused and its hello only registers the pairing code; it is sent
+// {"type":"claimed"} when claimed and says hello again. The pairing code either comes from the gateway itself
+// ("pairingCode" in its hello, e.g. printed on a label or shown on its display)
+// or is issued by the server on connect as {"type":"pairing","code":"482913"}
+// for the gateway to display. Codes are single use and stored hashed.
+type GatewayRecord struct {
+	ID        string  `json:"id"`
+	Name      *string `json:"name"`
+	OwnerFarm *string `json:"farm"`
+	Claimed   bool    `json:"claimed"`
+	ClaimedAt *string `json:"claimedAt"`
+	ClaimedBy *string `json:"claimedBy"`
+	Firmware  *string `json:"firmware"`
+	Revoked   bool    `json:"revoked"`
+	Status    string  `json:"status"` // online, stale, offline
+	LastSeen  int64   `json:"lastSeen"`
+	// LastSeenAt is what the device picker shows
+	LastSeenAt *string `json:"lastSeenAt"`
+	// TargetFirmware is the version an OTA rollout is moving the gateway to
+	TargetFirmware *string `json:"targetFirmware"`
+}
+
+type ClaimGatewayPayload struct {
+	Code string  `json:"code"`
+	Name *string `json:"name"`
+	Farm *string `json:"farm"`
+}
+
+const (
+	pairingCodeTTL         = 30 * time.Minute
+	maxPairingAttempts     = 5
+	defaultGatewayFarm     = "Main Farm"
+	gatewayLastSeenPersist = 60 // seconds between LastSeen writes while connected
+)
+
+func hashPairingCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+func newPairingCode() string {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return fmt.Sprintf("%06d", time.Now().UnixNano()%1000000)
+	}
+	return fmt.Sprintf("%06d", n.Int64())
+}
+
+// registerGatewayConnection records the connection on the gateway's registry row
+// (created when it was provisioned) and loads whether it is claimed. Unclaimed
+// gateways are issued a fresh pairing code.
+func registerGatewayConnection(ctx context.Context, gw *Gateway) error {
+	if _, err := db.ExecContext(ctx, "UPDATE cm_gateways SET LastSeen = NOW() WHERE GatewayID = ?", gw.ID); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&gw.lastPersisted, time.Now().Unix())
+
+	var claimedAt *string
+	if err := db.QueryRowContext(ctx, "SELECT ClaimedAt FROM cm_gateways WHERE GatewayID = ?", gw.ID).Scan(&claimedAt); err != nil {
+		return err
+	}
+	gw.setClaimed(claimedAt != nil)
+	if claimedAt != nil {
+		return nil
+	}
+
+	code := newPairingCode()
+	if err := setPairingCode(ctx, gw.ID, code); err != nil {
+		return err
+	}
+	return gw.writeJSON(map[string]interface{}{"type": "pairing", "code": code, "expiresIn": int(pairingCodeTTL.Seconds())})
+}
+
+func setPairingCode(ctx context.Context, gatewayID, code string) error {
+	query := `
+		UPDATE cm_gateways
+		SET PairingCodeHash = ?, PairingExpiresAt = NOW() + INTERVAL ? SECOND, PairingAttempts = 0
+		WHERE GatewayID = ? AND ClaimedAt IS NULL`
+	_, err := db.ExecContext(ctx, query, hashPairingCode(code), int(pairingCodeTTL.Seconds()), gatewayID)
+	return err
+}
+
+// persistGatewayHello records the firmware version a claimed gateway reports
+func persistGatewayHello(ctx context.Context, gw *Gateway, f GatewayFrame) error {
+	if f.Firmware == "" {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "UPDATE cm_gateways SET Firmware = ? WHERE GatewayID = ?", f.Firmware, gw.ID)
+	return err
+}
+
+// touchGateway persists LastSeen at most once a minute per connected gateway
+func touchGateway(gw *Gateway, now time.Time) {
+	last := atomic.LoadInt64(&gw.lastPersisted)
+	if now.Unix()-last < gatewayLastSeenPersist || !atomic.CompareAndSwapInt64(&gw.lastPersisted, last, now.Unix()) {
+		return
+	}
+	persistGatewayLastSeen(gw, now)
+}
+
+func persistGatewayLastSeen(gw *Gateway, now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "UPDATE cm_gateways SET LastSeen = ? WHERE GatewayID = ?", now.Format(sqlDateTime), gw.ID); err != nil {
+		log.Printf("[ERROR] Failed to update last seen for gateway %s: %v", gw.ID, err)
+	}
+}
+
+// getGateways lists every known gateway, connected or not (the device picker polls this)
+func getGateways(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := `
+		SELECT GatewayID, Name, OwnerFarm, ClaimedAt, ClaimedBy, Firmware, TargetFirmware, LastSeen, COALESCE(UNIX_TIMESTAMP(LastSeen), 0), RevokedAt IS NOT NULL
+		FROM cm_gateways
+		ORDER BY GatewayID`
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch gateways", err)
+		return
+	}
+	defer rows.Close()
+
+	gatewayMu.RLock()
+	defer gatewayMu.RUnlock()
+
+	list := []GatewayRecord{}
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var g GatewayRecord
+		if err := rows.Scan(&g.ID, &g.Name, &g.OwnerFarm, &g.ClaimedAt, &g.ClaimedBy, &g.Firmware, &g.TargetFirmware, &g.LastSeenAt, &g.LastSeen, &g.Revoked); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan gateway", err)
+			return
+		}
+		g.Claimed = g.ClaimedAt != nil
+		g.Status = GatewayOffline
+		if gw, ok := gateways[g.ID]; ok {
+			g.Status = gatewayState(gw, time.Now())
+			g.LastSeen = atomic.LoadInt64(&gw.LastSeen)
+			if fw := gw.firmware(); fw != "" {
+				g.Firmware = &fw
+			}
+		}
+		seen[g.ID] = true
+		list = append(list, g)
+	}
+
+	// connected gateways whose registry row could not be written still show up
+	for id, gw := range gateways {
+		if seen[id] {
+			continue
+		}
+		fw := gw.firmware()
+		list = append(list, GatewayRecord{ID: id, Claimed: gw.isClaimed(), Firmware: &fw, Status: gatewayState(gw, time.Now()), LastSeen: atomic.LoadInt64(&gw.LastSeen)})
+	}
+	respondJSON(w, http.StatusOK, list)
+}
+
+// claimGateway handles POST /api/iot/gateways/{id}/claim with the pairing code
+func claimGateway(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	var payload ClaimGatewayPayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if strings.TrimSpace(payload.Code) == "" {
+		handleError(w, http.StatusBadRequest, "Pairing code is required", nil)
+		return
+	}
+	farm := defaultGatewayFarm
+	if payload.Farm != nil && strings.TrimSpace(*payload.Farm) != "" {
+		farm = strings.TrimSpace(*payload.Farm)
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var claimedAt, codeHash *string
+	var attempts int
+	var codeValid bool
+	query := `
+		SELECT ClaimedAt, PairingCodeHash, COALESCE(PairingExpiresAt > NOW(), 0), PairingAttempts
+		FROM cm_gateways WHERE GatewayID = ? FOR UPDATE`
+	err = tx.QueryRowContext(ctx, query, id).Scan(&claimedAt, &codeHash, &codeValid, &attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		handleError(w, http.StatusNotFound, "Gateway not found", nil)
+		return
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch gateway", err)
+		return
+	}
+	if claimedAt != nil {
+		handleError(w, http.StatusConflict, "Gateway is already claimed", nil)
+		return
+	}
+	if codeHash == nil || !codeValid || attempts >= maxPairingAttempts {
+		handleError(w, http.StatusGone, "Pairing code expired; reconnect the gateway for a new one", nil)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashPairingCode(payload.Code)), []byte(*codeHash)) != 1 {
+		if _, err := tx.ExecContext(ctx, "UPDATE cm_gateways SET PairingAttempts = PairingAttempts + 1 WHERE GatewayID = ?", id); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to record pairing attempt", err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to commit transaction", err)
+			return
+		}
+		handleError(w, http.StatusForbidden, "Invalid pairing code", nil)
+		return
+	}
+
+	update := `
+		UPDATE cm_gateways
+		SET ClaimedAt = NOW(), ClaimedBy = ?, OwnerFarm = ?, Name = COALESCE(?, Name),
+			PairingCodeHash = NULL, PairingExpiresAt = NULL, PairingAttempts = 0
+		WHERE GatewayID = ?`
+	if _, err := tx.ExecContext(ctx, update, requestUsername(r), farm, payload.Name, id); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to claim gateway", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to commit transaction", err)
+		return
+	}
+
+	gatewayMu.RLock()
+	gw, ok := gateways[id]
+	gatewayMu.RUnlock()
+	if ok {
+		gw.setClaimed(true)
+		gw.writeJSON(map[string]interface{}{"type": "claimed", "farm": farm})
+	}
+	publishLive("gateway", gatewayTopic(id), map[string]interface{}{"id": id, "status": "claimed", "farm": farm})
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": "Gateway claimed",
+	})
+}
@@ -4,11 +4,11 @@ go 1.24.1
 
 require github.com/go-sql-driver/mysql v1.9.2
 
-require github.com/gorilla/websocket v1.5.3 // indirect
+require github.com/gorilla/websocket v1.5.3
 
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
 	github.com/go-chi/chi/v5 v5.2.3
-	github.com/joho/godotenv v1.5.1 // indirect
-	golang.org/x/crypto v0.41.0 // indirect
+	github.com/joho/godotenv v1.5.1
+	golang.org/x/crypto v0.41.0
 )
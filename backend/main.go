@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -279,6 +280,11 @@ type BatchVitals struct {
 	AgeInDays         int     `json:"ageInDays"`
 	CurrentPopulation int     `json:"currentPopulation"`
 	TotalMortality    int     `json:"totalMortality"`
+
+	// metered by the IoT devices, see consumption.go
+	WaterLiters      float64  `json:"waterLiters"`
+	FeedKg           float64  `json:"feedKg"`
+	WaterToFeedRatio *float64 `json:"waterToFeedRatio"`
 }
 
 // for adding new batch
@@ -289,6 +295,10 @@ type NewBatchPayload struct {
 	TotalChicken        int     `json:"TotalChicken"`
 	Notes               string  `json:"Notes"`
 	ChickCost           float64 `json:"ChickCost"`
+	Status              string  `json:"Status"` // "Active" (default) or "Planned"
+	CageNum             *int    `json:"CageNum"`
+	GrowOutDays         int     `json:"GrowOutDays"`
+	DowntimeDays        *int    `json:"DowntimeDays"`
 }
 
 // for adding mortality event
@@ -505,24 +515,32 @@ type DhtData struct {
 	CreatedAt   string  `json:"created_at"`
 }
 
-// In-memory registry and state - resets on server restart
+// Direct-IP devices, registered in cm_devices (see devices.go)
 type Device struct {
-	IPAddress  string `json:"ipAddress"`
-	DeviceType string `json:"deviceType"`
-}
+	ID           int        `json:"id"`
+	IPAddress    string     `json:"ipAddress"`
+	DeviceType   string     `json:"deviceType"`
+	Name         string     `json:"name"`
+	CageNum      *int       `json:"cageNum"`
+	LastPolledAt *string    `json:"lastPolledAt"`
+	LastError    *string    `json:"lastError"`
+	Telemetry    *Telemetry `json:"telemetry,omitempty"`
 
-var (
-	idevicesMu sync.RWMutex
-	idevices   = make(map[string]Device) // key is IP
-)
+	GramsPerDispense *float64 `json:"gramsPerDispense"` // feeders: counted as feed on every proxied rotation
+}
 
 type DeviceRequest struct {
 	IPAddress  string `json:"ipAddress"`
 	DeviceType string `json:"deviceType"`
+	Name       string `json:"name"`
+	CageNum    *int   `json:"cageNum"`
+
+	GramsPerDispense *float64 `json:"gramsPerDispense"`
 }
 
 type DeviceResponse struct {
 	Message string        `json:"message"`
+	ID      int64         `json:"insertedId"`
 	Device  DeviceRequest `json:"device"`
 }
 
@@ -538,22 +556,67 @@ type Telemetry struct {
 
 var (
 	devMu    sync.RWMutex
-	devices  = make(map[string]Device)    // id -> device
-	readings = make(map[string]Telemetry) // id -> last telemetry
+	devices  = make(map[string]Device)    // IP -> registered direct device
+	readings = make(map[string]Telemetry) // device ID (or IP for direct devices) -> last telemetry
 	httpc    = &http.Client{Timeout: 3 * time.Second}
 )
 
 type Gateway struct {
-	ID       string
-	Conn     *websocket.Conn
-	LastSeen int64
+	ID         string
+	Conn       *websocket.Conn
+	HardwareID string // the "hw" the gateway authenticated with
+	LastSeen   int64  // unix seconds, accessed atomically
+
+	// MQTT gateways are bridged from the broker (mqtt_bridge.go) and have no Conn;
+	// mqttSecret checks the signature on each of their messages and signs ours
+	MQTT       bool
+	mqttSecret string
+
+	ConnectedAt   int64 // unix seconds the connection was accepted
+	LastTelemetry int64 // unix seconds of the last telemetry frame (0 until the first), accessed atomically
+	lastPersisted int64 // unix seconds LastSeen was last written to cm_gateways
+	connectionID  int64 // row in cm_gateway_connections
+
+	// outbound queue drained by writePump (gateway_conn.go), the only writer to Conn
+	send      chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex // guards Firmware, claimed and reason
+	Firmware string
+	claimed  bool
+	reason   string // why the connection was closed
+}
+
+func (gw *Gateway) setFirmware(v string) {
+	gw.mu.Lock()
+	gw.Firmware = v
+	gw.mu.Unlock()
+}
+
+func (gw *Gateway) firmware() string {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return gw.Firmware
+}
+
+func (gw *Gateway) setClaimed(v bool) {
+	gw.mu.Lock()
+	gw.claimed = v
+	gw.mu.Unlock()
+}
+
+func (gw *Gateway) isClaimed() bool {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return gw.claimed
 }
 
 var (
 	gatewayMu sync.RWMutex
 	gateways  = make(map[string]*Gateway)
 	upgrader  = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true },
+		CheckOrigin: checkLiveOrigin,
 	}
 )
 
@@ -562,7 +625,9 @@ var (
 =========================== */
 
 var db *sql.DB
-var claimed = map[string]bool{}
+
+// Longest a handler may take to write its response; long waits must stay under it
+const serverWriteTimeout = 10 * time.Second
 
 /* ===========================
     Bootstrapping / DB
@@ -611,6 +676,15 @@ func mustGetEnv(key string) string {
 	return v
 }
 
+// getEnvInt reads an optional integer setting, falling back to def when unset or invalid
+func getEnvInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
 func handleError(w http.ResponseWriter, status int, clientMsg string, err error) {
 	if err != nil {
 		log.Printf("[ERROR] %s: %v", clientMsg, err)
@@ -645,13 +719,41 @@ func decodeJSONBody[T any](w http.ResponseWriter, r *http.Request, dst *T) bool
 	return true
 }
 
+// requestUsername identifies who is acting; the frontend sends the logged-in
+// username in the X-Username header
+func requestUsername(r *http.Request) string {
+	if u := strings.TrimSpace(r.Header.Get("X-Username")); u != "" {
+		return u
+	}
+	return "unknown"
+}
+
+// requireAdmin guards endpoints that hand out device credentials, change what
+// firmware gateways run or where alert notifications go. The caller sends
+// the value of ADMIN_API_TOKEN in the X-Admin-Token header; while the variable is
+// not set these endpoints stay disabled.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		want := os.Getenv("ADMIN_API_TOKEN")
+		if want == "" {
+			handleError(w, http.StatusServiceUnavailable, "Admin endpoints are disabled, set ADMIN_API_TOKEN", nil)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(want)) != 1 {
+			handleError(w, http.StatusUnauthorized, "Admin token required", nil)
+			return
+		}
+		next(w, r)
+	}
+}
+
 // Simple CORS middleware (open by default; restrict origins if needed)
 func cors(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		h := w.Header()
 		h.Set("Access-Control-Allow-Origin", "*")
 		h.Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		h.Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		h.Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Username, X-Admin-Token")
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
@@ -1003,32 +1105,28 @@ func handleDhtData(w http.ResponseWriter, r *http.Request) {
 		Humidity    float64 `json:"humidity"`
 		GasSensor   float64 `json:"gas_value"`
 		CageNum     int     `json:"cage_num"`
+		SensorID    string  `json:"sensor_id"`
 	}
 	if !decodeJSONBody(w, r, &data) {
 		return
 	}
+	if data.SensorID == "" {
+		data.SensorID = fmt.Sprintf("cage-%d", data.CageNum)
+	}
+	if len(data.SensorID) > 64 {
+		handleError(w, http.StatusBadRequest, "sensor_id is too long", nil)
+		return
+	}
 
 	ctx, cancel := withTimeout(r.Context())
 	defer cancel()
 
-	// Limit database entries to 10 per cage
-	const limitPerCage = 10
-	cleanupStmt := `DELETE FROM cm_temperature WHERE temp_id NOT IN (SELECT temp_id FROM (SELECT temp_id FROM cm_temperature WHERE temp_cage_num = ? ORDER BY created_at DESC LIMIT ?) AS keep);`
-
-	_, err := db.ExecContext(ctx, cleanupStmt, data.CageNum, limitPerCage)
-	if err != nil {
-		handleError(w, http.StatusInternalServerError, "Failed to cleanup old temperature data", err)
-		return
-	}
-
-	stmt := `INSERT INTO cm_temperature (temp_temperature, temp_humidity, gas_sensor, temp_cage_num) VALUES (?, ?, ?, ?)`
-	res, err := db.ExecContext(ctx, stmt, data.Temperature, data.Humidity, data.GasSensor, data.CageNum)
+	id, err := ingestEnvironmentReading(ctx, dhtSensorGateway, data.SensorID, data.CageNum, data.Temperature, data.Humidity, data.GasSensor, time.Now())
 	if err != nil {
 		handleError(w, http.StatusInternalServerError, "Failed to insert temperature data", err)
 		return
 	}
 
-	id, _ := res.LastInsertId()
 	respondJSON(w, http.StatusOK, map[string]interface{}{
 		"success": true,
 		"id":      id,
@@ -1166,6 +1264,10 @@ func updateBatchEvent(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := withTimeout(r.Context())
 	defer cancel()
 
+	if !requireBatchAction(ctx, w, db, batchId, "usage") {
+		return
+	}
+
 	// Try update cm_inventory_usage
 	var usageID int
 	usageQuery := `SELECT UsageID FROM cm_inventory_usage WHERE BatchID = ? AND Date = ? LIMIT 1`
@@ -1219,6 +1321,14 @@ func insertBatchEvent(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := withTimeout(r.Context())
 	defer cancel()
 
+	action := "usage"
+	if payload.Event == "Mortality" {
+		action = "mortality"
+	}
+	if !requireBatchAction(ctx, w, db, batchId, action) {
+		return
+	}
+
 	switch payload.Event {
 	case "Consumption", "Medication":
 		if payload.Details == "" {
@@ -1310,6 +1420,10 @@ func deleteBatchEvent(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := withTimeout(r.Context())
 	defer cancel()
 
+	if !requireBatchAction(ctx, w, db, batchId, "usage") {
+		return
+	}
+
 	usageDel := `DELETE FROM cm_inventory_usage WHERE BatchID = ? AND Date = ?`
 	res, err := db.ExecContext(ctx, usageDel, batchId, payload.DATE)
 	if err == nil {
@@ -2293,32 +2407,19 @@ func createSaleHandler(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusCreated, map[string]interface{}{"success": true, "saleID": saleID})
 }
 
-func createInventoryUsage(w http.ResponseWriter, r *http.Request) {
-	var payload InventoryUsagePayload
-	if !decodeJSONBody(w, r, &payload) {
-		return
-	}
-
-	ctx, cancel := withTimeout(r.Context())
-	defer cancel()
-
-	tx, err := db.BeginTx(ctx, nil)
-	if err != nil {
-		handleError(w, http.StatusInternalServerError, "Failed to start transaction", err)
-		return
-	}
-	defer tx.Rollback()
+var errInsufficientStock = errors.New("not enough stock available")
 
+// drawInventoryUsage records a usage and draws it from the oldest purchases first (FIFO)
+func drawInventoryUsage(ctx context.Context, tx *sql.Tx, batchID, itemID int, date string, quantityUsed float64) (int64, error) {
 	stockQuery := `
 		SELECT PurchaseID, QuantityRemaining 
 		FROM cm_inventory_purchases 
 		WHERE ItemID = ? AND IsActive = 1 AND QuantityRemaining > 0 
 		ORDER BY PurchaseDate ASC`
 
-	rows, err := tx.QueryContext(ctx, stockQuery, payload.ItemID)
+	rows, err := tx.QueryContext(ctx, stockQuery, itemID)
 	if err != nil {
-		handleError(w, http.StatusInternalServerError, "Failed to query available stock", err)
-		return
+		return 0, fmt.Errorf("query available stock: %w", err)
 	}
 
 	type purchaseStock struct {
@@ -2330,58 +2431,80 @@ func createInventoryUsage(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var ps purchaseStock
 		if err := rows.Scan(&ps.ID, &ps.QtyRemaining); err != nil {
-			handleError(w, http.StatusInternalServerError, "Failed to scan stock", err)
-			return
+			rows.Close()
+			return 0, fmt.Errorf("scan stock: %w", err)
 		}
 		totalStockAvailable += ps.QtyRemaining
 		availablePurchases = append(availablePurchases, ps)
 	}
 	rows.Close()
 
-	if payload.QuantityUsed > totalStockAvailable {
-		handleError(w, http.StatusBadRequest, "Not enough total stock available to complete this action.", nil)
-		return
+	if quantityUsed > totalStockAvailable {
+		return 0, errInsufficientStock
 	}
 
 	usageQuery := "INSERT INTO cm_inventory_usage (BatchID, ItemID, Date, QuantityUsed) VALUES (?, ?, ?, ?)"
-	res, err := tx.ExecContext(ctx, usageQuery, payload.BatchID, payload.ItemID, payload.Date, payload.QuantityUsed)
+	res, err := tx.ExecContext(ctx, usageQuery, batchID, itemID, date, quantityUsed)
 	if err != nil {
-		handleError(w, http.StatusInternalServerError, "Failed to create usage record", err)
-		return
+		return 0, err
 	}
 	usageID, _ := res.LastInsertId()
 
-	quantityToDeduct := payload.QuantityUsed
+	quantityToDeduct := quantityUsed
 	for _, purchase := range availablePurchases {
 		if quantityToDeduct <= 0 {
 			break
 		}
 
-		quantityDrawn := 0.0
-		if quantityToDeduct >= purchase.QtyRemaining {
-
-			quantityDrawn = purchase.QtyRemaining
-		} else {
-
+		quantityDrawn := purchase.QtyRemaining
+		if quantityToDeduct < purchase.QtyRemaining {
 			quantityDrawn = quantityToDeduct
 		}
 
 		updateQuery := "UPDATE cm_inventory_purchases SET QuantityRemaining = QuantityRemaining - ? WHERE PurchaseID = ?"
-		_, err := tx.ExecContext(ctx, updateQuery, quantityDrawn, purchase.ID)
-		if err != nil {
-			handleError(w, http.StatusInternalServerError, "Failed to update purchase stock", err)
-			return
+		if _, err := tx.ExecContext(ctx, updateQuery, quantityDrawn, purchase.ID); err != nil {
+			return 0, fmt.Errorf("update purchase stock: %w", err)
 		}
 
 		detailQuery := "INSERT INTO cm_inventory_usage_details (UsageID, PurchaseID, QuantityDrawn) VALUES (?, ?, ?)"
-		_, err = tx.ExecContext(ctx, detailQuery, usageID, purchase.ID, quantityDrawn)
-		if err != nil {
-			handleError(w, http.StatusInternalServerError, "Failed to create usage detail record", err)
-			return
+		if _, err := tx.ExecContext(ctx, detailQuery, usageID, purchase.ID, quantityDrawn); err != nil {
+			return 0, fmt.Errorf("create usage detail: %w", err)
 		}
 
 		quantityToDeduct -= quantityDrawn
 	}
+	return usageID, nil
+}
+
+func createInventoryUsage(w http.ResponseWriter, r *http.Request) {
+	var payload InventoryUsagePayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if !requireBatchAction(ctx, w, tx, payload.BatchID, "usage") {
+		return
+	}
+
+	usageID, err := drawInventoryUsage(ctx, tx, payload.BatchID, payload.ItemID, payload.Date, payload.QuantityUsed)
+	if errors.Is(err, errInsufficientStock) {
+		handleError(w, http.StatusBadRequest, "Not enough total stock available to complete this action.", nil)
+		return
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to create usage record", err)
+		return
+	}
 
 	if err := tx.Commit(); err != nil {
 		handleError(w, http.StatusInternalServerError, "Failed to commit transaction", err)
@@ -2487,6 +2610,12 @@ func getBatchVitals(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	vitals.WaterLiters, vitals.FeedKg, vitals.WaterToFeedRatio, err = batchConsumptionTotals(ctx, batchID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch consumption data", err)
+		return
+	}
+
 	respondJSON(w, http.StatusOK, vitals)
 }
 
@@ -2533,11 +2662,16 @@ func createMortalityRecord(w http.ResponseWriter, r *http.Request) {
 	defer tx.Rollback()
 
 	var currentChicken int
-	checkQuery := "SELECT CurrentChicken FROM cm_batches WHERE BatchID = ? FOR UPDATE"
-	if err := tx.QueryRowContext(ctx, checkQuery, payload.BatchID).Scan(&currentChicken); err != nil {
+	var status string
+	checkQuery := "SELECT CurrentChicken, Status FROM cm_batches WHERE BatchID = ? FOR UPDATE"
+	if err := tx.QueryRowContext(ctx, checkQuery, payload.BatchID).Scan(&currentChicken, &status); err != nil {
 		handleError(w, http.StatusNotFound, "Batch not found", err)
 		return
 	}
+	if !batchActionAllowed(status, "mortality") {
+		handleError(w, http.StatusConflict, "Cannot record mortality on a batch that is "+status+".", nil)
+		return
+	}
 	if payload.BirdsLoss > currentChicken {
 		handleError(w, http.StatusBadRequest, "Birds loss cannot be greater than current population.", nil)
 		return
@@ -2559,8 +2693,8 @@ func createMortalityRecord(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if newPopulation <= 0 {
-		if _, err := tx.ExecContext(ctx, "UPDATE cm_batches SET Status = 'Sold' WHERE BatchID = ?", payload.BatchID); err != nil {
-			handleError(w, http.StatusInternalServerError, "Failed to update batch status to sold", err)
+		if err := transitionBatchStatus(ctx, tx, payload.BatchID, status, BatchClosed, requestUsername(r), "Population reached zero through mortality"); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to close batch", err)
 			return
 		}
 	}
@@ -2614,6 +2748,14 @@ func deleteEvent(w http.ResponseWriter, r *http.Request) {
 
 	switch eventType {
 	case "consumption":
+		var batchID int
+		if err := tx.QueryRowContext(ctx, "SELECT BatchID FROM cm_inventory_usage WHERE UsageID = ?", eventID).Scan(&batchID); err != nil {
+			handleError(w, http.StatusNotFound, "Usage record not found", err)
+			return
+		}
+		if !requireBatchAction(ctx, w, tx, batchID, "usage") {
+			return
+		}
 
 		type reversalDetail struct {
 			PurchaseID    int
@@ -2667,6 +2809,9 @@ func deleteEvent(w http.ResponseWriter, r *http.Request) {
 			handleError(w, http.StatusInternalServerError, "Failed to find mortality record", err)
 			return
 		}
+		if !requireBatchAction(ctx, w, tx, batchID, "mortality") {
+			return
+		}
 		_, err = tx.ExecContext(ctx, "UPDATE cm_batches SET CurrentChicken = CurrentChicken + ? WHERE BatchID = ?", birdsLoss, batchID)
 		if err != nil {
 			handleError(w, http.StatusInternalServerError, "Failed to restore batch population", err)
@@ -2678,6 +2823,14 @@ func deleteEvent(w http.ResponseWriter, r *http.Request) {
 		}
 
 	case "cost":
+		var batchID int
+		if err := tx.QueryRowContext(ctx, "SELECT BatchID FROM cm_production_cost WHERE CostID = ?", eventID).Scan(&batchID); err != nil {
+			handleError(w, http.StatusNotFound, "Cost record not found", err)
+			return
+		}
+		if !requireBatchAction(ctx, w, tx, batchID, "cost") {
+			return
+		}
 		_, err := tx.ExecContext(ctx, "DELETE FROM cm_production_cost WHERE CostID = ?", eventID)
 		if err != nil {
 			handleError(w, http.StatusInternalServerError, "Failed to delete cost record", err)
@@ -2716,6 +2869,10 @@ func createDirectCost(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := withTimeout(r.Context())
 	defer cancel()
 
+	if !requireBatchAction(ctx, w, db, batchID, "cost") {
+		return
+	}
+
 	query := "INSERT INTO cm_production_cost (BatchID, Date, CostType, Amount, Description) VALUES (?, ?, ?, ?, ?)"
 	res, err := db.ExecContext(ctx, query, payload.BatchID, payload.Date, payload.CostType, payload.Amount, payload.Description)
 	if err != nil {
@@ -2744,6 +2901,15 @@ func updateDirectCost(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := withTimeout(r.Context())
 	defer cancel()
 
+	var batchID int
+	if err := db.QueryRowContext(ctx, "SELECT BatchID FROM cm_production_cost WHERE CostID = ?", costID).Scan(&batchID); err != nil {
+		handleError(w, http.StatusNotFound, "Cost record not found", err)
+		return
+	}
+	if !requireBatchAction(ctx, w, db, batchID, "cost") {
+		return
+	}
+
 	query := `
 		UPDATE cm_production_cost 
 		SET Date = ?, CostType = ?, Description = ?, Amount = ? 
@@ -2830,11 +2996,16 @@ func createHarvest(w http.ResponseWriter, r *http.Request) {
 	defer tx.Rollback()
 
 	var currentChicken int
-	checkQuery := "SELECT CurrentChicken FROM cm_batches WHERE BatchID = ? FOR UPDATE"
-	if err := tx.QueryRowContext(ctx, checkQuery, payload.BatchID).Scan(&currentChicken); err != nil {
+	var status string
+	checkQuery := "SELECT CurrentChicken, Status FROM cm_batches WHERE BatchID = ? FOR UPDATE"
+	if err := tx.QueryRowContext(ctx, checkQuery, payload.BatchID).Scan(&currentChicken, &status); err != nil {
 		handleError(w, http.StatusNotFound, "Batch not found", err)
 		return
 	}
+	if !batchActionAllowed(status, "harvest") {
+		handleError(w, http.StatusConflict, "Cannot harvest a batch that is "+status+".", nil)
+		return
+	}
 	if payload.QuantityHarvested > currentChicken {
 		handleError(w, http.StatusBadRequest, "Not enough chickens in the batch to harvest.", nil)
 		return
@@ -2848,7 +3019,12 @@ func createHarvest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if newPopulation <= 0 {
-		if _, err := tx.ExecContext(ctx, "UPDATE cm_batches SET Status = 'Sold' WHERE BatchID = ?", payload.BatchID); err != nil {
+		if err := transitionBatchStatus(ctx, tx, payload.BatchID, status, BatchSold, requestUsername(r), "All birds harvested"); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to update batch status", err)
+			return
+		}
+	} else if status == BatchActive {
+		if err := transitionBatchStatus(ctx, tx, payload.BatchID, status, BatchHarvesting, requestUsername(r), "First harvest recorded"); err != nil {
 			handleError(w, http.StatusInternalServerError, "Failed to update batch status", err)
 			return
 		}
@@ -3129,6 +3305,9 @@ func deleteHarvestProduct(w http.ResponseWriter, r *http.Request) {
 		handleError(w, http.StatusBadRequest, "Cannot delete a harvest that has already been sold.", nil)
 		return
 	}
+	if !requireBatchAction(ctx, w, tx, batchID, "harvest") {
+		return
+	}
 
 	if _, err := tx.ExecContext(ctx, "DELETE FROM cm_harvest_products WHERE HarvestProductID = ?", harvestProductID); err != nil {
 		handleError(w, http.StatusInternalServerError, "Failed to delete harvest product", err)
@@ -3187,6 +3366,17 @@ func updateHarvestProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A sold batch may still correct weights or dates as long as the bird count is unchanged
+	var status string
+	if err := tx.QueryRowContext(ctx, "SELECT Status FROM cm_batches WHERE BatchID = ? FOR UPDATE", batchID).Scan(&status); err != nil {
+		handleError(w, http.StatusNotFound, "Batch not found", err)
+		return
+	}
+	if !batchActionAllowed(status, "harvest") && !(status == BatchSold && payload.QuantityHarvested == oldQtyHarvested) {
+		handleError(w, http.StatusConflict, "Cannot edit harvests of a batch that is "+status+".", nil)
+		return
+	}
+
 	updateProductQuery := `
 		UPDATE cm_harvest_products 
 		SET ProductType = ?, QuantityHarvested = ?, WeightHarvestedKg = ?, QuantityRemaining = ?, WeightRemainingKg = ?
@@ -3279,6 +3469,37 @@ func createBatch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	status := BatchActive
+	if payload.Status == BatchPlanned {
+		status = BatchPlanned
+	} else if payload.Status != "" && payload.Status != BatchActive {
+		handleError(w, http.StatusBadRequest, "New batches must be Active or Planned.", nil)
+		return
+	}
+
+	// the grow-out length fills in the harvest date, or is derived from it
+	start, err := time.Parse("2006-01-02", payload.StartDate)
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid StartDate, expected YYYY-MM-DD", err)
+		return
+	}
+	if payload.ExpectedHarvestDate == "" {
+		if payload.GrowOutDays <= 0 {
+			payload.GrowOutDays = defaultGrowOutDays
+		}
+		payload.ExpectedHarvestDate = start.AddDate(0, 0, payload.GrowOutDays).Format("2006-01-02")
+	} else if payload.GrowOutDays <= 0 {
+		if harvest, err := time.Parse("2006-01-02", payload.ExpectedHarvestDate); err == nil && harvest.After(start) {
+			payload.GrowOutDays = int(harvest.Sub(start).Hours() / 24)
+		} else {
+			payload.GrowOutDays = defaultGrowOutDays
+		}
+	}
+	downtime := defaultDowntimeDays
+	if payload.DowntimeDays != nil && *payload.DowntimeDays >= 0 {
+		downtime = *payload.DowntimeDays
+	}
+
 	ctx, cancel := withTimeout(r.Context())
 	defer cancel()
 
@@ -3292,7 +3513,7 @@ func createBatch(w http.ResponseWriter, r *http.Request) {
 	batchQuery := `
 		INSERT INTO cm_batches 
 		(BatchName, StartDate, ExpectedHarvestDate, TotalChicken, CurrentChicken, Status, Notes) 
-		VALUES (?, ?, ?, ?, ?, 'Active', ?)`
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
 
 	res, err := tx.ExecContext(ctx, batchQuery,
 		payload.BatchName,
@@ -3300,6 +3521,7 @@ func createBatch(w http.ResponseWriter, r *http.Request) {
 		payload.ExpectedHarvestDate,
 		payload.TotalChicken,
 		payload.TotalChicken,
+		status,
 		payload.Notes,
 	)
 	if err != nil {
@@ -3308,6 +3530,25 @@ func createBatch(w http.ResponseWriter, r *http.Request) {
 	}
 	newBatchID, _ := res.LastInsertId()
 
+	historyQuery := "INSERT INTO cm_batch_status_history (BatchID, FromStatus, ToStatus, ChangedBy, Reason) VALUES (?, NULL, ?, ?, 'Batch created')"
+	if _, err := tx.ExecContext(ctx, historyQuery, newBatchID, status, requestUsername(r)); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to record batch status", err)
+		return
+	}
+
+	if status == BatchPlanned || payload.CageNum != nil {
+		if err := saveBatchPlan(ctx, tx, newBatchID, payload.CageNum, payload.GrowOutDays, downtime, requestUsername(r)); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to save batch plan", err)
+			return
+		}
+	}
+	if status == BatchActive {
+		if err := linkPlannedCage(ctx, tx, int(newBatchID)); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to place batch in cage", err)
+			return
+		}
+	}
+
 	if payload.ChickCost > 0 {
 		costDescription := fmt.Sprintf("Initial purchase of %d chicks.", payload.TotalChicken)
 		costQuery := `
@@ -3343,17 +3584,50 @@ func updateBatch(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := withTimeout(r.Context())
 	defer cancel()
 
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var current string
+	if err := tx.QueryRowContext(ctx, "SELECT Status FROM cm_batches WHERE BatchID = ? FOR UPDATE", batchID).Scan(&current); err != nil {
+		handleError(w, http.StatusNotFound, "Batch not found", err)
+		return
+	}
+
+	// Status changes go through the lifecycle rules; an empty status leaves it as is
+	if payload.Status != "" && payload.Status != current {
+		if !canTransitionBatch(current, payload.Status) {
+			handleError(w, http.StatusConflict, fmt.Sprintf("Cannot change batch status from %s to %s.", current, payload.Status), nil)
+			return
+		}
+	}
+
 	query := `
 		UPDATE cm_batches 
-		SET BatchName = ?, ExpectedHarvestDate = ?, Notes = ?, Status = ?
+		SET BatchName = ?, ExpectedHarvestDate = ?, Notes = ?
 		WHERE BatchID = ?`
 
-	_, err = db.ExecContext(ctx, query, payload.BatchName, payload.ExpectedHarvestDate, payload.Notes, payload.Status, batchID)
+	_, err = tx.ExecContext(ctx, query, payload.BatchName, payload.ExpectedHarvestDate, payload.Notes, batchID)
 	if err != nil {
 		handleError(w, http.StatusInternalServerError, "Failed to update batch", err)
 		return
 	}
 
+	if payload.Status != "" && payload.Status != current {
+		if err := transitionBatchStatus(ctx, tx, batchID, current, payload.Status, requestUsername(r), "Edited batch"); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to change batch status", err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to commit transaction", err)
+		return
+	}
+
 	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
 }
 
@@ -3558,103 +3832,142 @@ func getBatchReport(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := withTimeout(r.Context())
 	defer cancel()
 
-	var report BatchReportData
-	var initialBirdCount, totalMortality, birdsHarvestedCount int
-	var totalRevenue, totalWeightHarvested, totalFeedConsumed float64
-	var chickPurchaseCost, feedUsageCost, dynamicCostsTotal float64
-
-	var batchName, startDateStr, status string
-	err := db.QueryRowContext(ctx, "SELECT BatchName, StartDate, Status, COALESCE(TotalChicken, 0) FROM cm_batches WHERE BatchID = ?", batchID).Scan(&batchName, &startDateStr, &status, &initialBirdCount)
+	report, err := loadBatchReport(ctx, batchID)
 	if err != nil {
 		handleError(w, http.StatusInternalServerError, "Failed to fetch batch details", err)
 		return
 	}
-	report.BatchName = batchName
-	startDate, _ := time.Parse("2006-01-02", startDateStr)
 
-	if status == "Sold" {
-		var lastHarvestDateStr sql.NullString
-		db.QueryRowContext(ctx, "SELECT MAX(HarvestDate) FROM cm_harvest WHERE BatchID = ?", batchID).Scan(&lastHarvestDateStr)
-		if lastHarvestDateStr.Valid {
-			lastHarvestDate, _ := time.Parse("2006-01-02", lastHarvestDateStr.String)
-			report.DurationDays = int(lastHarvestDate.Sub(startDate).Hours() / 24)
-		}
-	} else {
-		report.DurationDays = int(time.Since(startDate).Hours() / 24)
+	respondJSON(w, http.StatusOK, report)
+}
+
+// batchFigures holds the raw totals of one batch that its report is derived from
+type batchFigures struct {
+	Name            string
+	Status          string
+	StartDate       string
+	LastHarvest     sql.NullString
+	InitialBirds    int
+	Mortality       int
+	BirdsHarvested  int
+	WeightHarvested float64
+	FeedConsumed    float64
+	Revenue         float64
+	ChickCost       float64
+	FeedCost        float64
+	OtherCosts      []FinancialBreakdownItem // one "- CostType" line per direct cost type, amounts negative
+	Overhead        float64
+}
+
+// buildBatchReport computes the report figures for a single batch; shared by the
+// single batch report and the snapshot taken on close.
+func buildBatchReport(ctx context.Context, q queryer, batchID string) (BatchReportData, error) {
+	var f batchFigures
+	err := q.QueryRowContext(ctx, "SELECT BatchName, StartDate, Status, COALESCE(TotalChicken, 0) FROM cm_batches WHERE BatchID = ?", batchID).Scan(&f.Name, &f.StartDate, &f.Status, &f.InitialBirds)
+	if err != nil {
+		return BatchReportData{}, err
 	}
-	report.OperationalAnalytics.AverageHarvestAge = report.DurationDays
 
-	db.QueryRowContext(ctx, "SELECT COALESCE(SUM(BirdsLoss), 0) FROM cm_mortality WHERE BatchID = ?", batchID).Scan(&totalMortality)
-	db.QueryRowContext(ctx, "SELECT COALESCE(SUM(QuantityHarvested), 0) FROM cm_harvest_products WHERE HarvestID IN (SELECT HarvestID FROM cm_harvest WHERE BatchID = ?)", batchID).Scan(&birdsHarvestedCount)
-	db.QueryRowContext(ctx, "SELECT COALESCE(SUM(WeightHarvestedKg), 0) FROM cm_harvest_products WHERE HarvestID IN (SELECT HarvestID FROM cm_harvest WHERE BatchID = ?)", batchID).Scan(&totalWeightHarvested)
-	db.QueryRowContext(ctx, "SELECT COALESCE(SUM(iu.QuantityUsed), 0) FROM cm_inventory_usage iu JOIN cm_items i ON iu.ItemID = i.ItemID WHERE iu.BatchID = ? AND i.Category = 'Feed'", batchID).Scan(&totalFeedConsumed)
-	db.QueryRowContext(ctx, "SELECT COALESCE(SUM(TotalAmount), 0) FROM cm_sales_orders WHERE SaleID IN (SELECT SaleID FROM cm_sales_details WHERE HarvestProductID IN (SELECT HarvestProductID FROM cm_harvest_products WHERE HarvestID IN (SELECT HarvestID FROM cm_harvest WHERE BatchID = ?)))", batchID).Scan(&totalRevenue)
-	db.QueryRowContext(ctx, "SELECT COALESCE(SUM(Amount), 0) FROM cm_production_cost WHERE BatchID = ? AND CostType = 'Chick Purchase'", batchID).Scan(&chickPurchaseCost)
+	if f.Status == BatchSold || f.Status == BatchClosed {
+		q.QueryRowContext(ctx, "SELECT MAX(HarvestDate) FROM cm_harvest WHERE BatchID = ?", batchID).Scan(&f.LastHarvest)
+	}
+	q.QueryRowContext(ctx, "SELECT COALESCE(SUM(BirdsLoss), 0) FROM cm_mortality WHERE BatchID = ?", batchID).Scan(&f.Mortality)
+	q.QueryRowContext(ctx, "SELECT COALESCE(SUM(QuantityHarvested), 0) FROM cm_harvest_products WHERE HarvestID IN (SELECT HarvestID FROM cm_harvest WHERE BatchID = ?)", batchID).Scan(&f.BirdsHarvested)
+	q.QueryRowContext(ctx, "SELECT COALESCE(SUM(WeightHarvestedKg), 0) FROM cm_harvest_products WHERE HarvestID IN (SELECT HarvestID FROM cm_harvest WHERE BatchID = ?)", batchID).Scan(&f.WeightHarvested)
+	q.QueryRowContext(ctx, "SELECT COALESCE(SUM(iu.QuantityUsed), 0) FROM cm_inventory_usage iu JOIN cm_items i ON iu.ItemID = i.ItemID WHERE iu.BatchID = ? AND i.Category = 'Feed'", batchID).Scan(&f.FeedConsumed)
+	q.QueryRowContext(ctx, "SELECT COALESCE(SUM(TotalAmount), 0) FROM cm_sales_orders WHERE SaleID IN (SELECT SaleID FROM cm_sales_details WHERE HarvestProductID IN (SELECT HarvestProductID FROM cm_harvest_products WHERE HarvestID IN (SELECT HarvestID FROM cm_harvest WHERE BatchID = ?)))", batchID).Scan(&f.Revenue)
+	q.QueryRowContext(ctx, "SELECT COALESCE(SUM(Amount), 0) FROM cm_production_cost WHERE BatchID = ? AND CostType = 'Chick Purchase'", batchID).Scan(&f.ChickCost)
 
 	feedCostQuery := `SELECT COALESCE(SUM(iud.QuantityDrawn / NULLIF(ip.QuantityPurchased, 0) * ip.UnitCost), 0) FROM cm_inventory_usage iu JOIN cm_inventory_usage_details iud ON iu.UsageID = iud.UsageID JOIN cm_inventory_purchases ip ON iud.PurchaseID = ip.PurchaseID WHERE iu.BatchID = ?`
-	db.QueryRowContext(ctx, feedCostQuery, batchID).Scan(&feedUsageCost)
+	q.QueryRowContext(ctx, feedCostQuery, batchID).Scan(&f.FeedCost)
 
-	var dynamicCosts []FinancialBreakdownItem
 	dynamicCostQuery := `SELECT CostType, COALESCE(SUM(Amount), 0) as TotalAmount FROM cm_production_cost WHERE BatchID = ? AND CostType != 'Chick Purchase' GROUP BY CostType`
-	rows, _ := db.QueryContext(ctx, dynamicCostQuery, batchID)
+	rows, err := q.QueryContext(ctx, dynamicCostQuery, batchID)
+	if err != nil {
+		return BatchReportData{}, err
+	}
 	defer rows.Close()
 	for rows.Next() {
-		var item FinancialBreakdownItem
 		var costType string
 		var amount float64
 		rows.Scan(&costType, &amount)
-		item.Category = "- " + costType
-		item.Amount = -amount
-		dynamicCosts = append(dynamicCosts, item)
-		dynamicCostsTotal += amount
+		f.OtherCosts = append(f.OtherCosts, FinancialBreakdownItem{Category: "- " + costType, Amount: -amount})
 	}
-	totalCost := chickPurchaseCost + feedUsageCost + dynamicCostsTotal
+	f.Overhead = batchAllocatedOverhead(ctx, q, batchID)
 
-	finalBirdCount := initialBirdCount - totalMortality
-	report.OperationalAnalytics.InitialBirdCount = initialBirdCount
-	report.OperationalAnalytics.FinalBirdCount = finalBirdCount
-	if initialBirdCount > 0 {
-		report.OperationalAnalytics.MortalityRate = (float64(totalMortality) / float64(initialBirdCount)) * 100
+	return deriveBatchReport(f), nil
+}
+
+// deriveBatchReport turns a batch's raw totals into its report. Every place that
+// reports on a live batch goes through here so the figures always agree.
+func deriveBatchReport(f batchFigures) BatchReportData {
+	var report BatchReportData
+	report.BatchName = f.Name
+	startDate, _ := time.Parse("2006-01-02", f.StartDate)
+
+	if f.Status == BatchSold || f.Status == BatchClosed {
+		if f.LastHarvest.Valid {
+			lastHarvestDate, _ := time.Parse("2006-01-02", f.LastHarvest.String)
+			report.DurationDays = int(lastHarvestDate.Sub(startDate).Hours() / 24)
+		}
+	} else {
+		report.DurationDays = int(time.Since(startDate).Hours() / 24)
 	}
-	if birdsHarvestedCount > 0 {
-		report.OperationalAnalytics.AverageHarvestWeight = totalWeightHarvested / float64(birdsHarvestedCount)
+	report.OperationalAnalytics.AverageHarvestAge = report.DurationDays
+
+	var dynamicCostsTotal float64
+	for _, item := range f.OtherCosts {
+		dynamicCostsTotal -= item.Amount
+	}
+	totalCost := f.ChickCost + f.FeedCost + dynamicCostsTotal + f.Overhead
+
+	report.OperationalAnalytics.InitialBirdCount = f.InitialBirds
+	report.OperationalAnalytics.FinalBirdCount = f.InitialBirds - f.Mortality
+	if f.InitialBirds > 0 {
+		report.OperationalAnalytics.MortalityRate = (float64(f.Mortality) / float64(f.InitialBirds)) * 100
+	}
+	if f.BirdsHarvested > 0 {
+		report.OperationalAnalytics.AverageHarvestWeight = f.WeightHarvested / float64(f.BirdsHarvested)
 	}
-	report.OperationalAnalytics.TotalFeedConsumed = totalFeedConsumed
-	report.OperationalAnalytics.TotalWeightHarvested = totalWeightHarvested
-	report.ExecutiveSummary.NetProfit = totalRevenue - totalCost
+	report.OperationalAnalytics.TotalFeedConsumed = f.FeedConsumed
+	report.OperationalAnalytics.TotalWeightHarvested = f.WeightHarvested
+	report.ExecutiveSummary.NetProfit = f.Revenue - totalCost
 	if totalCost > 0 {
 		report.ExecutiveSummary.ROI = (report.ExecutiveSummary.NetProfit / totalCost) * 100
 	}
-	if totalWeightHarvested > 0 {
-		report.ExecutiveSummary.CostPerKg = totalCost / totalWeightHarvested
-		if totalFeedConsumed > 0 {
-			report.ExecutiveSummary.FeedConversionRatio = totalFeedConsumed / totalWeightHarvested
+	if f.WeightHarvested > 0 {
+		report.ExecutiveSummary.CostPerKg = totalCost / f.WeightHarvested
+		if f.FeedConsumed > 0 {
+			report.ExecutiveSummary.FeedConversionRatio = f.FeedConsumed / f.WeightHarvested
 		}
 	}
-	if initialBirdCount > 0 {
-		report.ExecutiveSummary.HarvestRecovery = (float64(birdsHarvestedCount) / float64(initialBirdCount)) * 100
+	if f.InitialBirds > 0 {
+		report.ExecutiveSummary.HarvestRecovery = (float64(f.BirdsHarvested) / float64(f.InitialBirds)) * 100
 	}
 
-	if initialBirdCount > 0 {
+	if f.InitialBirds > 0 {
 		var breakdown []FinancialBreakdownItem
-		perBirdDivisor := float64(initialBirdCount)
-		breakdown = append(breakdown, FinancialBreakdownItem{"Total Revenue", totalRevenue, 0, totalRevenue / perBirdDivisor})
+		perBirdDivisor := float64(f.InitialBirds)
+		breakdown = append(breakdown, FinancialBreakdownItem{"Total Revenue", f.Revenue, 0, f.Revenue / perBirdDivisor})
 		breakdown = append(breakdown, FinancialBreakdownItem{"Total Costs", -totalCost, 100, -totalCost / perBirdDivisor})
-		if feedUsageCost > 0 {
-			breakdown = append(breakdown, FinancialBreakdownItem{"- Feed Cost", -feedUsageCost, (feedUsageCost / totalCost) * 100, -feedUsageCost / perBirdDivisor})
+		if f.FeedCost > 0 {
+			breakdown = append(breakdown, FinancialBreakdownItem{"- Feed Cost", -f.FeedCost, (f.FeedCost / totalCost) * 100, -f.FeedCost / perBirdDivisor})
 		}
-		for _, item := range dynamicCosts {
+		for _, item := range f.OtherCosts {
 			item.Percentage = ((-item.Amount) / totalCost) * 100
 			item.PerBird = item.Amount / perBirdDivisor
 			breakdown = append(breakdown, item)
 		}
-		if chickPurchaseCost > 0 {
-			breakdown = append(breakdown, FinancialBreakdownItem{"- Chick Purchase", -chickPurchaseCost, (chickPurchaseCost / totalCost) * 100, -chickPurchaseCost / perBirdDivisor})
+		if f.ChickCost > 0 {
+			breakdown = append(breakdown, FinancialBreakdownItem{"- Chick Purchase", -f.ChickCost, (f.ChickCost / totalCost) * 100, -f.ChickCost / perBirdDivisor})
+		}
+		if f.Overhead > 0 {
+			breakdown = append(breakdown, FinancialBreakdownItem{"- Allocated Overhead", -f.Overhead, (f.Overhead / totalCost) * 100, -f.Overhead / perBirdDivisor})
 		}
 		report.FinancialBreakdown = breakdown
 	}
 
-	respondJSON(w, http.StatusOK, report)
+	return report
 }
 
 func getBatchTransactions(w http.ResponseWriter, r *http.Request) {
@@ -3709,10 +4022,24 @@ func getBatchTransactions(w http.ResponseWriter, r *http.Request) {
 		WHERE h.BatchID = ?
 		GROUP BY so.SaleID, DATE(so.SaleDate), c.Name
 
+		UNION ALL
+
+		-- 4. Get farm overheads allocated to this batch
+		SELECT
+			ar.PeriodTo AS Date,
+			'Cost' AS Type,
+			CONCAT('Allocated Overhead: ', o.CostType) AS Description,
+			-SUM(a.Amount) AS Amount
+		FROM cm_overhead_allocations a
+		JOIN cm_overhead_allocation_runs ar ON a.RunID = ar.RunID
+		JOIN cm_farm_overheads o ON a.OverheadID = o.OverheadID
+		WHERE a.BatchID = ? AND ar.Status = 'Posted'
+		GROUP BY ar.RunID, ar.PeriodTo, o.CostType
+
 		ORDER BY Date DESC;
 	`
 
-	rows, err := db.QueryContext(ctx, query, batchID, batchID, batchID)
+	rows, err := db.QueryContext(ctx, query, batchID, batchID, batchID, batchID)
 	if err != nil {
 		handleError(w, http.StatusInternalServerError, "Failed to fetch batch transactions", err)
 		return
@@ -3751,7 +4078,7 @@ func getDashboardData(w http.ResponseWriter, r *http.Request) {
 	var data DashboardData
 
 	// --- 1. At a Glance Metrics (No changes) ---
-	db.QueryRowContext(ctx, `SELECT COALESCE(COUNT(BatchID), 0), COALESCE(SUM(CurrentChicken), 0) FROM cm_batches WHERE Status = 'Active'`).Scan(&data.AtAGlance.ActiveBatchCount, &data.AtAGlance.CurrentPopulation)
+	db.QueryRowContext(ctx, `SELECT COALESCE(COUNT(BatchID), 0), COALESCE(SUM(CurrentChicken), 0) FROM cm_batches WHERE Status IN ('Active', 'Harvesting')`).Scan(&data.AtAGlance.ActiveBatchCount, &data.AtAGlance.CurrentPopulation)
 	db.QueryRowContext(ctx, `SELECT COALESCE(SUM(TotalChicken), 0) FROM cm_batches`).Scan(&data.AtAGlance.TotalBirds)
 	db.QueryRowContext(ctx, `SELECT COALESCE(SUM(TotalAmount), 0) FROM cm_sales_orders WHERE SaleDate >= CURDATE() - INTERVAL 30 DAY AND IsActive = 1`).Scan(&data.AtAGlance.MonthlyRevenue)
 	db.QueryRowContext(ctx, `SELECT COALESCE(SUM(QuantityRemaining), 0) FROM cm_harvest_products WHERE ProductType IN ('Live', 'Dressed') AND IsActive = 1`).Scan(&data.AtAGlance.SellableInventory)
@@ -3763,7 +4090,7 @@ func getDashboardData(w http.ResponseWriter, r *http.Request) {
 		Population               int
 	}
 	var activeBatchList []activeBatchInfo
-	rows, _ := db.QueryContext(ctx, `SELECT BatchID, BatchName, StartDate, ExpectedHarvestDate, CurrentChicken FROM cm_batches WHERE Status = 'Active' ORDER BY StartDate ASC`)
+	rows, _ := db.QueryContext(ctx, `SELECT BatchID, BatchName, StartDate, ExpectedHarvestDate, CurrentChicken FROM cm_batches WHERE Status IN ('Active', 'Harvesting') ORDER BY StartDate ASC`)
 	defer rows.Close()
 	for rows.Next() {
 		var b activeBatchInfo
@@ -3864,9 +4191,9 @@ func getDashboardData(w http.ResponseWriter, r *http.Request) {
 		data.Charts.RevenueTimeline = append(data.Charts.RevenueTimeline, RevenueDataPoint{Date: day, Revenue: revenueMap[day]})
 	}
 	var feedCost, chickCost, otherCost float64
-	db.QueryRowContext(ctx, `SELECT COALESCE(SUM(iud.QuantityDrawn / NULLIF(ip.QuantityPurchased, 0) * ip.UnitCost), 0) FROM cm_inventory_usage_details iud JOIN cm_inventory_usage iu ON iud.UsageID = iu.UsageID JOIN cm_inventory_purchases ip ON iud.PurchaseID = ip.PurchaseID WHERE iu.BatchID IN (SELECT BatchID FROM cm_batches WHERE Status = 'Active')`).Scan(&feedCost)
-	db.QueryRowContext(ctx, `SELECT COALESCE(SUM(Amount), 0) FROM cm_production_cost WHERE CostType = 'Chick Purchase' AND BatchID IN (SELECT BatchID FROM cm_batches WHERE Status = 'Active')`).Scan(&chickCost)
-	db.QueryRowContext(ctx, `SELECT COALESCE(SUM(Amount), 0) FROM cm_production_cost WHERE CostType != 'Chick Purchase' AND BatchID IN (SELECT BatchID FROM cm_batches WHERE Status = 'Active')`).Scan(&otherCost)
+	db.QueryRowContext(ctx, `SELECT COALESCE(SUM(iud.QuantityDrawn / NULLIF(ip.QuantityPurchased, 0) * ip.UnitCost), 0) FROM cm_inventory_usage_details iud JOIN cm_inventory_usage iu ON iud.UsageID = iu.UsageID JOIN cm_inventory_purchases ip ON iud.PurchaseID = ip.PurchaseID WHERE iu.BatchID IN (SELECT BatchID FROM cm_batches WHERE Status IN ('Active', 'Harvesting'))`).Scan(&feedCost)
+	db.QueryRowContext(ctx, `SELECT COALESCE(SUM(Amount), 0) FROM cm_production_cost WHERE CostType = 'Chick Purchase' AND BatchID IN (SELECT BatchID FROM cm_batches WHERE Status IN ('Active', 'Harvesting'))`).Scan(&chickCost)
+	db.QueryRowContext(ctx, `SELECT COALESCE(SUM(Amount), 0) FROM cm_production_cost WHERE CostType != 'Chick Purchase' AND BatchID IN (SELECT BatchID FROM cm_batches WHERE Status IN ('Active', 'Harvesting'))`).Scan(&otherCost)
 	data.Charts.CostBreakdown = append(data.Charts.CostBreakdown, CostBreakdownPoint{Name: "Feed Cost", Value: feedCost}, CostBreakdownPoint{Name: "Chick Purchase", Value: chickCost}, CostBreakdownPoint{Name: "Other Costs", Value: otherCost})
 
 	// --- 5. Financial Forecast Calculation (No changes) ---
@@ -3910,6 +4237,14 @@ func getDashboardData(w http.ResponseWriter, r *http.Request) {
 	if data.Charts.CostBreakdown == nil {
 		data.Charts.CostBreakdown = make([]CostBreakdownPoint, 0)
 	}
+	// environmental and device alerts come first, then the stock alerts above; if
+	// only this query fails the rest of the dashboard is still returned
+	envAlerts, err := openAlertsForDashboard(ctx)
+	if err != nil {
+		log.Printf("[ERROR] Failed to fetch alerts for dashboard: %v", err)
+	}
+	data.Alerts = append(envAlerts, data.Alerts...)
+
 	if data.Alerts == nil {
 		data.Alerts = make([]Alert, 0)
 	}
@@ -3924,7 +4259,8 @@ func getDashboardData(w http.ResponseWriter, r *http.Request) {
 	IoT Data Handling
 =========================== */
 
-// handleGatewayWS upgrades gateway connection at /ws/gateway?id=gw-1234
+// handleGatewayWS authenticates and upgrades a gateway connection at /ws/gateway?id=gw-1234
+// (see gateway_auth.go for the credentials it expects)
 func handleGatewayWS(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("id")
 	if id == "" {
@@ -3932,103 +4268,88 @@ func handleGatewayWS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	ctx, cancel := withTimeout(r.Context())
+	hw, err := authenticateGateway(ctx, r, id)
+	cancel()
 	if err != nil {
-		log.Println("upgrade:", err)
+		log.Printf("Gateway %s rejected: %v", id, err)
+		http.Error(w, err.Error(), gatewayAuthStatus(err))
 		return
 	}
 
-	gw := &Gateway{ID: id, Conn: conn}
-	gatewayMu.Lock()
-	gateways[id] = gw
-	gatewayMu.Unlock()
-	log.Printf("Gateway connected: %s", id)
-
-	defer func() {
-		conn.Close()
-		gatewayMu.Lock()
-		delete(gateways, id)
-		gatewayMu.Unlock()
-		log.Printf("Gateway disconnected: %s", id)
-	}()
-
-	for {
-		_, msg, err := conn.ReadMessage()
-		if err != nil {
-			log.Printf("Read error from %s: %v", id, err)
-			break
-		}
-		log.Printf("[%s] %s", id, string(msg))
-		// TODO: insert telemetry into MySQL if needed
-	}
-}
-
-// getGateways lists all connected gateways (for React polling)
-func getGateways(w http.ResponseWriter, r *http.Request) {
-	type gatewayInfo struct {
-		ID      string `json:"id"`
-		Status  string `json:"status"`
-		Claimed bool   `json:"claimed"`
-	}
 	gatewayMu.RLock()
-	var list []gatewayInfo
-	for id := range gateways {
-		list = append(list, gatewayInfo{
-			ID:      id,
-			Status:  "online",
-			Claimed: claimed[id],
-		})
-	}
+	existing, live := gateways[id]
 	gatewayMu.RUnlock()
-	json.NewEncoder(w).Encode(list)
-}
-
-// claimGateway handles POST /api/gateways/{id}/claim
-func claimGateway(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	claimed[id] = true
-	json.NewEncoder(w).Encode(map[string]any{
-		"success": true,
-		"message": "Gateway claimed",
-	})
-}
-
-// sendCommand posts JSON command down to the gateway WebSocket
-func sendCommand(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-
-	var cmd map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
-		http.Error(w, "invalid JSON", http.StatusBadRequest)
+	if live && existing.HardwareID != hw {
+		log.Printf("Gateway %s rejected: %v", id, errGatewayDuplicate)
+		http.Error(w, errGatewayDuplicate.Error(), gatewayAuthStatus(errGatewayDuplicate))
 		return
 	}
 
-	gatewayMu.RLock()
-	gw, ok := gateways[id]
-	gatewayMu.RUnlock()
-	if !ok {
-		http.Error(w, "gateway not connected", http.StatusNotFound)
+	conn, err := gatewayUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("upgrade:", err)
 		return
 	}
 
-	if err := gw.Conn.WriteJSON(cmd); err != nil {
-		log.Printf("WriteJSON to %s failed: %v", id, err)
-		http.Error(w, "failed to send command", http.StatusInternalServerError)
+	gw := newGateway(id, hw, conn)
+	configureGatewayConn(gw)
+	go gw.writePump()
+
+	if !attachGateway(gw, r.RemoteAddr) {
 		return
 	}
+	var readErr error
+	defer func() { detachGateway(gw, readErr) }()
 
-	json.NewEncoder(w).Encode(map[string]string{
-		"success": "true",
-		"message": "Command sent",
-	})
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			log.Printf("Read error from %s: %v", id, err)
+			readErr = err
+			break
+		}
+		conn.SetReadDeadline(time.Now().Add(gatewayPongTimeout))
+		handleGatewayFrame(gw, msg)
+	}
 }
 
 // RegisterGatewayRoutes mounts the endpoints
 func RegisterGatewayRoutes(r chi.Router) {
 	r.HandleFunc("/ws/gateway", handleGatewayWS)
+	r.HandleFunc("/ws/live", handleLiveWS)
 	r.Get("/iot/gateways", getGateways)
+	r.Post("/iot/gateways", requireAdmin(provisionGateway))
+	r.Post("/iot/gateways/{id}/rotate-secret", requireAdmin(rotateGatewaySecret))
+	r.Post("/iot/gateways/{id}/revoke", requireAdmin(revokeGateway))
+	r.Get("/iot/gateways/{id}/connections", getGatewayConnections)
 	r.Post("/iot/gateways/{id}/claim", claimGateway)
 	r.Post("/iot/gateways/{id}/command", sendCommand)
+	r.Get("/iot/commands", getGatewayCommands)
+	r.Get("/iot/commands/{id}", getGatewayCommand)
+
+	// direct-IP devices on the farm LAN, reached only through the backend
+	r.Get("/iot/manageDevices", getManagedDevices)
+	r.Post("/iot/manageDevices", registerDevice)
+	r.Put("/iot/manageDevices/{id}", updateDevice)
+	r.Delete("/iot/manageDevices/{id}", deleteDevice)
+	r.Get("/iot/devices/{id}/telemetry", getDeviceTelemetry)
+	r.Post("/iot/devices/{id}/relays", setDeviceRelays)
+	r.Post("/iot/devices/{id}/mode", setDeviceMode)
+	r.Post("/iot/devices/{id}/rotate-servo", rotateDeviceServo)
+
+	r.Get("/iot/sensors", getSensors)
+	r.Put("/iot/sensors/{gatewayId}/{deviceId}", updateSensor)
+	r.Delete("/iot/sensors/{gatewayId}/{deviceId}", deleteSensor)
+
+	// firmware OTA; the download is authenticated with gateway credentials
+	r.Get("/iot/firmware", getFirmware)
+	r.Post("/iot/firmware", requireAdmin(uploadFirmware))
+	r.Delete("/iot/firmware/{id}", requireAdmin(deleteFirmware))
+	r.Get("/iot/firmware/{id}/download", downloadFirmware)
+	r.Post("/iot/firmware/rollout", requireAdmin(createFirmwareRollout))
+	r.Get("/iot/firmware/rollouts", getFirmwareRollouts)
+	r.Put("/iot/gateways/{id}/firmware-target", requireAdmin(setGatewayFirmwareTarget))
 }
 
 /* ===========================
@@ -4052,6 +4373,26 @@ func buildRouter() http.Handler {
 		// --- Standalone routes ---
 		r.Get("/dashboard", getDashboardData)
 		r.Post("/dht22-data", handleDhtData)
+		r.Get("/telemetry", getTelemetry)
+
+		// for environmental alerts
+		r.Get("/alert-rules", getAlertRules)
+		r.Post("/alert-rules", createAlertRule)
+		r.Put("/alert-rules/{id}", updateAlertRule)
+		r.Delete("/alert-rules/{id}", deleteAlertRule)
+		r.Get("/alerts", getAlerts)
+		r.Post("/alerts/{id}/acknowledge", acknowledgeAlert)
+		r.Post("/alerts/{id}/resolve", resolveAlertHandler)
+
+		// for alert notifications
+		r.Get("/notifications/subscriptions", getNotificationSubscriptions)
+		r.Post("/notifications/subscriptions", requireAdmin(createNotificationSubscription))
+		r.Put("/notifications/subscriptions/{id}", requireAdmin(updateNotificationSubscription))
+		r.Delete("/notifications/subscriptions/{id}", requireAdmin(deleteNotificationSubscription))
+		r.Get("/notifications/deliveries", getNotificationDeliveries)
+		r.Post("/notifications/test", requireAdmin(sendTestNotification))
+		r.Get("/notifications/sms-stub", getStubSMS)
+		r.Post("/notifications/sms-stub", receiveStubSMS)
 		r.Post("/login", loginHandler)
 		r.Post("/register", registerHandler)
 		r.Get("/categories", getCategories)
@@ -4112,10 +4453,56 @@ func buildRouter() http.Handler {
 			r.Post("/costs", createDirectCost)
 			r.Get("/harvest-products", getHarvestedProducts)
 			r.Get("/transactions", getBatchTransactions)
+			r.Post("/status", changeBatchStatus)
+			r.Get("/status-history", getBatchStatusHistory)
+			r.Put("/plan", updateBatchPlan)
+			r.Get("/cages", getBatchCages)
+			r.Post("/cages", assignBatchCage)
+			r.Delete("/cages/{cageId}", removeBatchCage)
+			r.Get("/readings", getBatchReadings)
+			r.Get("/consumption", getBatchConsumption)
 			r.Put("/", updateBatch)
 			r.Delete("/", deleteBatch)
 		})
 
+		// for houses and cages
+		r.Get("/cages", getCages)
+		r.Post("/cages", createCage)
+		r.Get("/cages/{id}", getCage)
+		r.Put("/cages/{id}", updateCage)
+		r.Delete("/cages/{id}", deleteCage)
+		r.Post("/cages/{id}/devices", assignCageDevice)
+		r.Delete("/cages/{id}/devices/{assignmentId}", unassignCageDevice)
+		r.Put("/cages/{id}/mode", setCageMode)
+
+		// metered water and feed
+		r.Get("/consumption/water-meters", getWaterMeters)
+		r.Post("/consumption/water-meters", createWaterMeter)
+		r.Put("/consumption/water-meters/{id}", updateWaterMeter)
+		r.Delete("/consumption/water-meters/{id}", deleteWaterMeter)
+		r.Get("/consumption/feed-drafts", getFeedUsageDrafts)
+		r.Post("/consumption/feed-drafts/{id}/confirm", confirmFeedUsageDraft)
+		r.Post("/consumption/feed-drafts/{id}/dismiss", dismissFeedUsageDraft)
+
+		// Automation schedules
+		r.Get("/automation/schedules", getSchedules)
+		r.Post("/automation/schedules", createSchedule)
+		r.Put("/automation/schedules/{id}", updateSchedule)
+		r.Delete("/automation/schedules/{id}", deleteSchedule)
+		r.Get("/automation/runs", getAutomationRuns)
+
+		// Closed-loop control rules
+		r.Get("/control-rules", getControlRules)
+		r.Post("/control-rules", createControlRule)
+		r.Post("/control-rules/simulate", simulateDraftControlRule)
+		r.Put("/control-rules/{id}", updateControlRule)
+		r.Delete("/control-rules/{id}", deleteControlRule)
+		r.Get("/control-rules/{id}/actions", getControlActions)
+		r.Get("/control-rules/{id}/simulate", simulateSavedControlRule)
+
+		// for batch planning
+		r.Get("/planning/calendar", getCapacityCalendar)
+
 		// for record daily events
 		r.Post("/mortality", createMortalityRecord)
 		r.Post("/health-checks", createHealthCheck)
@@ -4141,6 +4528,38 @@ func buildRouter() http.Handler {
 
 		//for reports tab
 		r.Get("/reports/batch/{id}", getBatchReport)
+		r.Get("/reports/batches/compare", compareBatchReports)
+		r.Get("/reports/pnl", getProfitAndLoss)
+
+		// for staff chores and labor tracking
+		r.Route("/tasks", func(r chi.Router) {
+			r.Get("/", getTasks)
+			r.Post("/", createTask)
+			r.Get("/missed", getMissedTasks)
+			r.Post("/generate", generateTasks)
+			r.Post("/{id}/complete", completeTask)
+			r.Get("/templates", getTaskTemplates)
+			r.Post("/templates", createTaskTemplate)
+			r.Put("/templates/{id}", updateTaskTemplate)
+			r.Delete("/templates/{id}", deleteTaskTemplate)
+		})
+		r.Get("/labor-rates", getLaborRates)
+		r.Put("/labor-rates", upsertLaborRate)
+
+		// for farm overheads not tied to a batch
+		r.Route("/overheads", func(r chi.Router) {
+			r.Get("/", getFarmOverheads)
+			r.Post("/", createFarmOverhead)
+			r.Put("/{id}", updateFarmOverhead)
+			r.Delete("/{id}", deleteFarmOverhead)
+			r.Get("/rules", getAllocationRules)
+			r.Put("/rules", upsertAllocationRule)
+			r.Delete("/rules/{id}", deleteAllocationRule)
+			r.Get("/allocations", getAllocationRuns)
+			r.Post("/allocations", runOverheadAllocation)
+			r.Get("/allocations/{id}", getAllocationRunDetails)
+			r.Delete("/allocations/{id}", reverseAllocationRun)
+		})
 
 		//IoT device management
 		r.Group(func(r chi.Router) {
@@ -4153,12 +4572,21 @@ func buildRouter() http.Handler {
 
 func main() {
 	initDB()
+	ensureSchema()
+	initNotifiers()
+
+	// Before anything can issue a new command
+	startCtx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	if err := timeOutStaleCommands(startCtx); err != nil {
+		log.Printf("[ERROR] Failed to time out stale gateway commands: %v", err)
+	}
+	cancel()
 
 	server := &http.Server{
 		Addr:         "0.0.0.0:8080",
 		Handler:      buildRouter(),
 		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		WriteTimeout: serverWriteTimeout,
 		IdleTimeout:  60 * time.Second,
 	}
 
@@ -4174,19 +4602,19 @@ func main() {
 		}
 	}()
 
-	// Example background ticker (kept from your original)
-	go func(ctx context.Context) {
-		t := time.NewTicker(5 * time.Second)
-		defer t.Stop()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case tm := <-t.C:
-				fmt.Println("tick at", tm.Format(time.RFC3339))
-			}
-		}
-	}(ctx)
+	// Background jobs: telemetry rollups and retention, notification retries and
+	// escalation, gateway liveness, sensor health, automation schedules, daily
+	// tasks, direct device polling, firmware rollouts, and the MQTT bridge when
+	// MQTT_BROKER is set
+	go runTelemetryJobs(ctx)
+	go runNotificationJobs(ctx)
+	go runGatewayMonitor(ctx)
+	go runAutomation(ctx)
+	go runTaskScheduler(ctx)
+	go runSensorMonitor(ctx)
+	go runDevicePoller(ctx)
+	go runFirmwareRollouts(ctx)
+	go runMQTTBridge(ctx)
 
 	// Block until signal
 	<-ctx.Done()
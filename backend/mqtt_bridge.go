@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* ===========================
+    MQTT Bridge
+=========================== */
+
+// Sensor nodes that speak MQTT publish to a local broker (MQTT_BROKER, e.g.
+// "localhost:1883"; the bridge is off when it is unset) and the backend
+// subscribes as a client:
+//
+//	farm/{gateway}/{cage}/telemetry   {"device":"esp32-a","temperature":29.5,"humidity":61,"gas":120}
+//	farm/{gateway}/{cage}/event       {"device":"esp-feed-1","event":"feeder_dispensed","detail":{"grams":500}}
+//	farm/{gateway}/{cage}/ack         {"commandId":"9f2c...","ok":true}
+//	farm/{gateway}/hello              {"firmware":"1.2.0","devices":[...]}
+//	farm/{gateway}/heartbeat          {"uptime":3600}
+//
+// The frames are the WebSocket frames without "type" (the topic says it) and the
+// cage comes from the topic; a telemetry or event without "device" is filed as
+// "{gateway}-{cage}". Every message is signed with the gateway's secret, since
+// the broker's own login does not say which gateway a client is:
+//
+//	{"hw":"24:6f:28:aa:bb:cc","ts":1718000000,"sig":"<hex>","msg":{...the frame...}}
+//	sig = hex(hmac-sha256(secret, topic + "\n" + hw + "\n" + ts + "\n" + msg))
+//
+// where msg is the frame's bytes exactly as they appear in the payload. As on
+// /ws/gateway, signatures older than gatewayAuthWindow or seen before are
+// refused and "hw" is bound to the credentials on first use. Commands go out on farm/{gateway}/{cage}/cmd (or
+// farm/{gateway}/cmd when the device's cage is unknown) and everything else the
+// server says - pairing codes, "claimed", errors - on farm/{gateway}/notify.
+// Those are signed the same way, with the gateway's own "hw", so a node can
+// tell the server's messages from anything else published on its topics.
+//
+// Each gateway seen on MQTT becomes a regular *Gateway whose outbound queue is
+// published instead of written to a socket, so provisioning, claiming,
+// persistence, alerts, control rules and command acks are shared with
+// /ws/gateway. The bridge only accepts gateways that are provisioned and not
+// revoked, and treats a gateway silent for MQTT_IDLE_SECONDS as disconnected.
+// One gateway uses one transport at a time.
+const (
+	mqttKeepAlive       = 30 * time.Second
+	defaultMQTTIdleSecs = 120
+	mqttMaxBackoff      = time.Minute
+)
+
+// mqttEnvelope is the signed wrapper around every frame a node publishes
+type mqttEnvelope struct {
+	HW  string          `json:"hw"`
+	TS  int64           `json:"ts"`
+	Sig string          `json:"sig"`
+	Msg json.RawMessage `json:"msg"`
+}
+
+var mqttTopicKinds = map[string]bool{"telemetry": true, "event": true, "ack": true, "hello": true, "heartbeat": true}
+
+type mqttBridgeState struct {
+	mu          sync.Mutex
+	client      *mqttClient // nil while the broker is unreachable
+	addr        string
+	prefix      string
+	deviceCages map[string]int       // gatewayID|device -> cage, for routing commands
+	refused     map[string]time.Time // gateways whose messages are dropped, to log them once a minute
+}
+
+var mqttBridge = &mqttBridgeState{
+	deviceCages: make(map[string]int),
+	refused:     make(map[string]time.Time),
+}
+
+// runMQTTBridge keeps a broker connection up until ctx is cancelled
+func runMQTTBridge(ctx context.Context) {
+	addr := strings.TrimPrefix(os.Getenv("MQTT_BROKER"), "tcp://")
+	if addr == "" {
+		return
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "1883")
+	}
+	prefix := strings.Trim(os.Getenv("MQTT_TOPIC_PREFIX"), "/")
+	if prefix == "" {
+		prefix = "farm"
+	}
+	clientID := os.Getenv("MQTT_CLIENT_ID")
+	if clientID == "" {
+		clientID = "pms-backend"
+	}
+	opts := mqttOptions{
+		ClientID:  clientID,
+		Username:  os.Getenv("MQTT_USERNAME"),
+		Password:  os.Getenv("MQTT_PASSWORD"),
+		KeepAlive: mqttKeepAlive,
+	}
+	idle := time.Duration(getEnvInt("MQTT_IDLE_SECONDS", defaultMQTTIdleSecs)) * time.Second
+	if idle < mqttKeepAlive {
+		idle = mqttKeepAlive
+	}
+
+	mqttBridge.mu.Lock()
+	mqttBridge.addr, mqttBridge.prefix = addr, prefix
+	mqttBridge.mu.Unlock()
+
+	go sweepIdleMQTTGateways(ctx, idle)
+
+	backoff := time.Second
+	for ctx.Err() == nil {
+		client, err := dialMQTT(ctx, addr, opts)
+		if err == nil {
+			err = client.Subscribe(prefix+"/+/+/telemetry", prefix+"/+/+/event", prefix+"/+/+/ack",
+				prefix+"/+/hello", prefix+"/+/heartbeat")
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("[ERROR] MQTT broker %s: %v (retrying in %s)", addr, err, backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > mqttMaxBackoff {
+				backoff = mqttMaxBackoff
+			}
+			continue
+		}
+
+		backoff = time.Second
+		log.Printf("MQTT bridge connected to %s (topics %s/...)", addr, prefix)
+		mqttBridge.mu.Lock()
+		mqttBridge.client = client
+		mqttBridge.mu.Unlock()
+
+		err = client.Run(ctx, handleMQTTMessage)
+
+		mqttBridge.mu.Lock()
+		mqttBridge.client = nil
+		mqttBridge.mu.Unlock()
+		client.Close()
+		closeMQTTGateways("MQTT broker connection lost")
+		if ctx.Err() == nil {
+			log.Printf("[ERROR] MQTT bridge disconnected: %v", err)
+		}
+	}
+}
+
+// handleMQTTMessage turns a message into a gateway frame and feeds it through handleGatewayFrame
+func handleMQTTMessage(msg mqttMessage) {
+	parts := strings.Split(msg.Topic, "/")
+	var gatewayID, kind string
+	var cage *int
+	switch len(parts) {
+	case 3:
+		gatewayID, kind = parts[1], parts[2]
+	case 4:
+		gatewayID, kind = parts[1], parts[3]
+		n, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return
+		}
+		cage = &n
+	default:
+		return
+	}
+	if !mqttTopicKinds[kind] || gatewayID == "" {
+		return
+	}
+
+	gw, body := mqttGateway(gatewayID, msg)
+	if gw == nil {
+		return
+	}
+
+	var frame map[string]interface{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &frame); err != nil {
+			gw.writeJSON(gatewayReply{Type: "error", Error: "invalid JSON on " + msg.Topic})
+			return
+		}
+	}
+	if frame == nil {
+		frame = map[string]interface{}{}
+	}
+	frame["type"] = kind
+	if cage != nil {
+		frame["cage"] = *cage
+		if kind == "telemetry" || kind == "event" {
+			device, _ := frame["device"].(string)
+			if device == "" {
+				device = fmt.Sprintf("%s-%d", gatewayID, *cage)
+				frame["device"] = device
+			}
+			mqttBridge.mu.Lock()
+			mqttBridge.deviceCages[gatewayID+"|"+device] = *cage
+			mqttBridge.mu.Unlock()
+		}
+	}
+	raw, err := json.Marshal(frame)
+	if err != nil {
+		return
+	}
+	handleGatewayFrame(gw, raw)
+}
+
+func mqttSignature(secret, topic, hw string, ts int64, msg []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(topic + "\n" + hw + "\n" + strconv.FormatInt(ts, 10) + "\n"))
+	mac.Write(msg)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyMQTTEnvelope checks the signature and freshness of a message from gateway id
+func verifyMQTTEnvelope(secret, id, topic string, env mqttEnvelope, now time.Time) error {
+	if d := now.Sub(time.Unix(env.TS, 0)); d > gatewayAuthWindow || d < -gatewayAuthWindow {
+		return errGatewayReplay
+	}
+	want := mqttSignature(secret, topic, env.HW, env.TS, env.Msg)
+	if !hmac.Equal([]byte(strings.ToLower(env.Sig)), []byte(want)) {
+		return errGatewayBadAuth
+	}
+	if !rememberNonce(id, want, now) {
+		return errGatewayReplay
+	}
+	return nil
+}
+
+// mqttGateway verifies a message and returns the live MQTT gateway that sent it
+// along with the frame inside, attaching the gateway on its first message. It
+// returns a nil gateway for messages and gateways the bridge refuses.
+func mqttGateway(id string, msg mqttMessage) (*Gateway, []byte) {
+	var env mqttEnvelope
+	if err := json.Unmarshal(msg.Payload, &env); err != nil || env.Sig == "" || env.HW == "" || len(env.HW) > 64 {
+		refuseMQTTGateway(id, "unsigned message on "+msg.Topic)
+		return nil, nil
+	}
+
+	gatewayMu.RLock()
+	gw, live := gateways[id]
+	gatewayMu.RUnlock()
+	if live {
+		if !gw.MQTT {
+			refuseMQTTGateway(id, "connected over WebSocket")
+			return nil, nil
+		}
+		if err := verifyMQTTEnvelope(gw.mqttSecret, id, msg.Topic, env, time.Now()); err != nil {
+			refuseMQTTGateway(id, err.Error())
+			return nil, nil
+		}
+		if env.HW != gw.HardwareID {
+			refuseMQTTGateway(id, errGatewayHardware.Error())
+			return nil, nil
+		}
+		return gw, env.Msg
+	}
+
+	ctx, cancel := withTimeout(context.Background())
+	defer cancel()
+	var secret, revokedAt, boundHW *string
+	err := db.QueryRowContext(ctx, "SELECT Secret, RevokedAt, HardwareID FROM cm_gateways WHERE GatewayID = ?", id).Scan(&secret, &revokedAt, &boundHW)
+	switch {
+	case errors.Is(err, sql.ErrNoRows), err == nil && (secret == nil || *secret == ""):
+		refuseMQTTGateway(id, errGatewayUnknown.Error())
+		return nil, nil
+	case err != nil:
+		log.Printf("[ERROR] MQTT gateway %s lookup: %v", id, err)
+		return nil, nil
+	case revokedAt != nil:
+		refuseMQTTGateway(id, errGatewayRevoked.Error())
+		return nil, nil
+	}
+	if err := verifyMQTTEnvelope(*secret, id, msg.Topic, env, time.Now()); err != nil {
+		refuseMQTTGateway(id, err.Error())
+		return nil, nil
+	}
+	if err := bindGatewayHardware(ctx, id, env.HW, boundHW); err != nil {
+		if errors.Is(err, errGatewayHardware) {
+			refuseMQTTGateway(id, err.Error())
+		} else {
+			log.Printf("[ERROR] MQTT gateway %s hardware binding: %v", id, err)
+		}
+		return nil, nil
+	}
+
+	gw = newGateway(id, env.HW, nil)
+	gw.MQTT, gw.mqttSecret = true, *secret
+	go mqttPump(gw)
+	mqttBridge.mu.Lock()
+	addr := mqttBridge.addr
+	mqttBridge.mu.Unlock()
+	if !attachGateway(gw, "mqtt://"+addr) {
+		return nil, nil
+	}
+	return gw, env.Msg
+}
+
+func refuseMQTTGateway(id, reason string) {
+	mqttBridge.mu.Lock()
+	defer mqttBridge.mu.Unlock()
+	if last, ok := mqttBridge.refused[id]; ok && time.Since(last) < time.Minute {
+		return
+	}
+	mqttBridge.refused[id] = time.Now()
+	log.Printf("MQTT messages from gateway %s dropped: %s", id, reason)
+}
+
+// mqttPump publishes what the server queues for an MQTT gateway; it plays the
+// part of writePump and of the read loop's cleanup
+func mqttPump(gw *Gateway) {
+	for {
+		select {
+		case msg := <-gw.send:
+			if err := publishToGateway(gw, msg); err != nil {
+				log.Printf("[WARN] MQTT publish to %s failed: %v", gw.ID, err)
+			}
+		case <-gw.closed:
+			detachGateway(gw, nil)
+			return
+		}
+	}
+}
+
+// publishToGateway signs msg with the gateway's secret and publishes it on the
+// gateway's cmd or notify topic
+func publishToGateway(gw *Gateway, msg []byte) error {
+	gatewayID := gw.ID
+	var head struct {
+		Type   string `json:"type"`
+		Device string `json:"device"`
+	}
+	json.Unmarshal(msg, &head)
+
+	mqttBridge.mu.Lock()
+	client, prefix := mqttBridge.client, mqttBridge.prefix
+	cage, known := mqttBridge.deviceCages[gatewayID+"|"+head.Device]
+	mqttBridge.mu.Unlock()
+	if client == nil {
+		return errors.New("broker not connected")
+	}
+
+	topic := prefix + "/" + gatewayID + "/notify"
+	if head.Type == "command" {
+		if !known && head.Device != "" {
+			ctx, cancel := withTimeout(context.Background())
+			var c *int
+			err := db.QueryRowContext(ctx, "SELECT CageNum FROM cm_gateway_devices WHERE GatewayID = ? AND DeviceID = ?", gatewayID, head.Device).Scan(&c)
+			cancel()
+			if err == nil && c != nil {
+				cage, known = *c, true
+			}
+		}
+		topic = prefix + "/" + gatewayID + "/cmd"
+		if known {
+			topic = fmt.Sprintf("%s/%s/%d/cmd", prefix, gatewayID, cage)
+		}
+	}
+
+	env := mqttEnvelope{HW: gw.HardwareID, TS: time.Now().Unix(), Msg: msg}
+	env.Sig = mqttSignature(gw.mqttSecret, topic, env.HW, env.TS, msg)
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return client.Publish(topic, payload, 1)
+}
+
+// sweepIdleMQTTGateways disconnects MQTT gateways that stopped publishing;
+// unlike a socket there is nothing else that would notice
+func sweepIdleMQTTGateways(ctx context.Context, idle time.Duration) {
+	t := time.NewTicker(idle / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			gatewayMu.RLock()
+			for _, gw := range gateways {
+				if gw.MQTT && now.Sub(time.Unix(atomic.LoadInt64(&gw.LastSeen), 0)) > idle {
+					gw.closeWithReason(fmt.Sprintf("no MQTT messages for %s", idle))
+				}
+			}
+			gatewayMu.RUnlock()
+		}
+	}
+}
+
+func closeMQTTGateways(reason string) {
+	gatewayMu.RLock()
+	defer gatewayMu.RUnlock()
+	for _, gw := range gateways {
+		if gw.MQTT {
+			gw.closeWithReason(reason)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestPublishToGatewayIsSigned(t *testing.T) {
+	c, broker := connectTestClient(t, mqttOptions{ClientID: "pms", KeepAlive: time.Minute})
+	runTestClient(c, func(mqttMessage) {})
+
+	mqttBridge.mu.Lock()
+	origClient, origPrefix := mqttBridge.client, mqttBridge.prefix
+	mqttBridge.client, mqttBridge.prefix = c, "farm"
+	mqttBridge.mu.Unlock()
+	defer func() {
+		mqttBridge.mu.Lock()
+		mqttBridge.client, mqttBridge.prefix = origClient, origPrefix
+		mqttBridge.mu.Unlock()
+	}()
+
+	gw := newGateway("gw-sign", "24:6f:28:aa:bb:cc", nil)
+	gw.MQTT, gw.mqttSecret = true, "s3cret"
+	frame := []byte(`{"type":"claimed"}`)
+	go publishToGateway(gw, frame)
+
+	header, body := readTestPacket(t, broker, mqttPublish)
+	msg, _, _, err := parseMQTTPublish(header, body)
+	if err != nil || msg.Topic != "farm/gw-sign/notify" {
+		t.Fatalf("parse: %+v %v", msg, err)
+	}
+	var env mqttEnvelope
+	if err := json.Unmarshal(msg.Payload, &env); err != nil {
+		t.Fatalf("payload is not an envelope: %v", err)
+	}
+	if string(env.Msg) != string(frame) || env.HW != gw.HardwareID {
+		t.Fatalf("envelope %+v does not carry the frame and the gateway's hw", env)
+	}
+	if err := verifyMQTTEnvelope("s3cret", gw.ID, msg.Topic, env, time.Now()); err != nil {
+		t.Fatalf("signature does not verify: %v", err)
+	}
+	if err := verifyMQTTEnvelope("other", "gw-other", msg.Topic, env, time.Now()); err == nil {
+		t.Fatal("signature verified with the wrong secret")
+	}
+}
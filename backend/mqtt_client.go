@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+/* ===========================
+    MQTT 3.1.1 Client
+=========================== */
+
+// Just enough of MQTT 3.1.1 for the bridge: CONNECT with optional credentials,
+// SUBSCRIBE, PUBLISH at QoS 0/1 in both directions (incoming QoS 1 is PUBACKed),
+// and keepalive pings. Outgoing QoS 1 publishes are resent with DUP set until
+// the broker PUBACKs them, up to mqttMaxResends times, and every SUBACK must
+// answer a pending SUBSCRIBE within mqttAckTimeout. Received messages are handled
+// in order by one worker behind a queue of mqttQueueSize, so slow handling never
+// holds up acks and pings; when the queue is full new messages are dropped. No
+// persistence, no QoS 2, no automatic reconnect; the bridge reconnects with a
+// clean session and subscribes again.
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+	mqttMaxPacket   = 256 * 1024
+	mqttDialTimeout = 10 * time.Second
+	mqttAckTimeout  = 10 * time.Second
+	mqttMaxResends  = 3
+	mqttQueueSize   = 1024
+)
+
+var connackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+type mqttMessage struct {
+	Topic   string
+	Payload []byte
+}
+
+type mqttClient struct {
+	conn       net.Conn
+	r          *bufio.Reader
+	keepAlive  time.Duration
+	ackTimeout time.Duration // how long a PUBACK or SUBACK may take
+
+	writeMu sync.Mutex
+
+	// idMu guards the packet IDs and everything waiting for an acknowledgement
+	idMu     sync.Mutex
+	nextID   uint16
+	inflight map[uint16]*mqttInflight // QoS 1 publishes waiting for PUBACK
+	subs     map[uint16]*mqttInflight // subscriptions waiting for SUBACK
+	failure  error                    // why the connection was closed from our side
+}
+
+// mqttInflight is a sent packet that still has to be acknowledged
+type mqttInflight struct {
+	header  byte
+	body    []byte
+	filters []string // SUBSCRIBE only
+	sentAt  time.Time
+	resends int
+}
+
+type mqttOptions struct {
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+}
+
+// dialMQTT connects to addr ("host:port") and completes the CONNECT/CONNACK handshake
+func dialMQTT(ctx context.Context, addr string, opts mqttOptions) (*mqttClient, error) {
+	d := net.Dialer{Timeout: mqttDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return connectMQTT(conn, opts)
+}
+
+// connectMQTT runs the CONNECT/CONNACK handshake on an open connection
+func connectMQTT(conn net.Conn, opts mqttOptions) (*mqttClient, error) {
+	c := newMQTTClient(conn, opts.KeepAlive)
+
+	// variable header: protocol name, level 4, flags, keepalive
+	var flags byte = 0x02 // clean session
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, 0)
+	body = binary.BigEndian.AppendUint16(body, uint16(opts.KeepAlive/time.Second))
+	body = appendMQTTString(body, opts.ClientID)
+	if opts.Username != "" {
+		flags |= 0x80
+		body = appendMQTTString(body, opts.Username)
+		if opts.Password != "" {
+			flags |= 0x40
+			body = appendMQTTString(body, opts.Password)
+		}
+	}
+	body[7] = flags
+
+	conn.SetDeadline(time.Now().Add(mqttDialTimeout))
+	if err := c.writePacket(mqttConnect<<4, body); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	typ, payload, err := c.readPacket()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("waiting for CONNACK: %w", err)
+	}
+	if typ>>4 != mqttConnack || len(payload) != 2 {
+		conn.Close()
+		return nil, errors.New("broker did not answer with CONNACK")
+	}
+	if code := payload[1]; code != 0 {
+		conn.Close()
+		if msg, ok := connackErrors[code]; ok {
+			return nil, fmt.Errorf("broker refused connection: %s", msg)
+		}
+		return nil, fmt.Errorf("broker refused connection: code %d", code)
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func (c *mqttClient) Close() error {
+	c.writeMu.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.conn.Write([]byte{mqttDisconnect << 4, 0})
+	c.writeMu.Unlock()
+	return c.conn.Close()
+}
+
+func newMQTTClient(conn net.Conn, keepAlive time.Duration) *mqttClient {
+	return &mqttClient{
+		conn:       conn,
+		r:          bufio.NewReader(conn),
+		keepAlive:  keepAlive,
+		ackTimeout: mqttAckTimeout,
+		inflight:   make(map[uint16]*mqttInflight),
+		subs:       make(map[uint16]*mqttInflight),
+	}
+}
+
+// track assigns a packet ID not used by another unacknowledged packet, writes
+// it into p.body at idAt and registers p under it
+func (c *mqttClient) track(into map[uint16]*mqttInflight, p *mqttInflight, idAt int) uint16 {
+	c.idMu.Lock()
+	defer c.idMu.Unlock()
+	for {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		if c.inflight[c.nextID] == nil && c.subs[c.nextID] == nil {
+			break
+		}
+	}
+	binary.BigEndian.PutUint16(p.body[idAt:], c.nextID)
+	p.sentAt = time.Now()
+	into[c.nextID] = p
+	return c.nextID
+}
+
+// Subscribe asks for the topic filters at QoS 1; Run matches the SUBACK to it
+func (c *mqttClient) Subscribe(filters ...string) error {
+	body := []byte{0, 0}
+	for _, f := range filters {
+		body = appendMQTTString(body, f)
+		body = append(body, 1)
+	}
+	p := &mqttInflight{header: mqttSubscribe<<4 | 0x02, body: body, filters: filters}
+	c.track(c.subs, p, 0)
+	return c.writePacket(p.header, p.body)
+}
+
+// Publish sends at QoS 0 or 1 without waiting for the PUBACK; Run resends
+// unacknowledged QoS 1 publishes. Commands have their own acknowledgement and
+// retry on top of this.
+func (c *mqttClient) Publish(topic string, payload []byte, qos byte) error {
+	body := appendMQTTString(nil, topic)
+	header := byte(mqttPublish << 4)
+	if qos == 0 {
+		return c.writePacket(header, append(body, payload...))
+	}
+	header |= 1 << 1
+	idAt := len(body)
+	body = append(append(body, 0, 0), payload...)
+	p := &mqttInflight{header: header, body: body}
+	c.track(c.inflight, p, idAt)
+	return c.writePacket(p.header, p.body)
+}
+
+// resend retransmits publishes the broker has not acknowledged in time, and
+// gives up on the connection if a subscription is not acknowledged
+func (c *mqttClient) resend(now time.Time) error {
+	var due []*mqttInflight
+	c.idMu.Lock()
+	for id, p := range c.subs {
+		if now.Sub(p.sentAt) >= c.ackTimeout {
+			c.idMu.Unlock()
+			return fmt.Errorf("no SUBACK for packet %d within %s", id, c.ackTimeout)
+		}
+	}
+	for id, p := range c.inflight {
+		if now.Sub(p.sentAt) < c.ackTimeout {
+			continue
+		}
+		if p.resends >= mqttMaxResends {
+			delete(c.inflight, id)
+			log.Printf("[WARN] MQTT publish %d not acknowledged after %d resends, dropped", id, p.resends)
+			continue
+		}
+		p.resends++
+		p.sentAt = now
+		due = append(due, p)
+	}
+	c.idMu.Unlock()
+
+	for _, p := range due {
+		if err := c.writePacket(p.header|0x08, p.body); err != nil { // DUP
+			return err
+		}
+	}
+	return nil
+}
+
+// suback checks a SUBACK against the subscription it answers
+func (c *mqttClient) suback(body []byte) error {
+	if len(body) < 3 {
+		return errors.New("short SUBACK")
+	}
+	id := binary.BigEndian.Uint16(body)
+	c.idMu.Lock()
+	p := c.subs[id]
+	delete(c.subs, id)
+	c.idMu.Unlock()
+	if p == nil {
+		return fmt.Errorf("SUBACK for unknown packet %d", id)
+	}
+	codes := body[2:]
+	if len(codes) != len(p.filters) {
+		return fmt.Errorf("SUBACK has %d return codes for %d filters", len(codes), len(p.filters))
+	}
+	for i, code := range codes {
+		if code == 0x80 {
+			return fmt.Errorf("broker refused the subscription to %s", p.filters[i])
+		}
+	}
+	return nil
+}
+
+func (c *mqttClient) puback(body []byte) error {
+	if len(body) != 2 {
+		return errors.New("malformed PUBACK")
+	}
+	c.idMu.Lock()
+	delete(c.inflight, binary.BigEndian.Uint16(body))
+	c.idMu.Unlock()
+	return nil
+}
+
+// fail closes the connection from our side; Run reports err instead of the read error
+func (c *mqttClient) fail(err error) {
+	c.idMu.Lock()
+	if c.failure == nil {
+		c.failure = err
+	}
+	c.idMu.Unlock()
+	c.conn.Close()
+}
+
+// Run reads packets until the connection fails or ctx ends, queueing each
+// PUBLISH for handle, and keeps the connection alive with PINGREQs. Messages
+// still queued when Run returns are handled afterwards.
+func (c *mqttClient) Run(ctx context.Context, handle func(mqttMessage)) error {
+	queue := make(chan mqttMessage, mqttQueueSize)
+	defer close(queue)
+	go func() {
+		for msg := range queue {
+			handle(msg)
+		}
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ping := time.NewTicker(c.keepAlive / 2)
+		defer ping.Stop()
+		retry := time.NewTicker(c.ackTimeout / 2)
+		defer retry.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				c.conn.Close()
+				return
+			case <-ping.C:
+				if err := c.writePacket(mqttPingreq<<4, nil); err != nil {
+					c.conn.Close()
+					return
+				}
+			case now := <-retry.C:
+				if err := c.resend(now); err != nil {
+					c.fail(err)
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		// the broker answers our pings, so silence for 1.5 keepalives means the link is gone
+		c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		typ, body, err := c.readPacket()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			c.idMu.Lock()
+			failure := c.failure
+			c.idMu.Unlock()
+			if failure != nil {
+				return failure
+			}
+			return err
+		}
+		switch typ >> 4 {
+		case mqttPublish:
+			msg, id, qos, err := parseMQTTPublish(typ, body)
+			if err != nil {
+				return err
+			}
+			if qos == 1 {
+				if err := c.writePacket(mqttPuback<<4, binary.BigEndian.AppendUint16(nil, id)); err != nil {
+					return err
+				}
+			}
+			select {
+			case queue <- msg:
+			default:
+				log.Printf("[WARN] MQTT message on %s dropped: handler queue full", msg.Topic)
+			}
+		case mqttSuback:
+			if err := c.suback(body); err != nil {
+				return err
+			}
+		case mqttPuback:
+			if err := c.puback(body); err != nil {
+				return err
+			}
+		case mqttPingresp:
+		default:
+			return fmt.Errorf("unexpected MQTT packet type %d", typ>>4)
+		}
+	}
+}
+
+func parseMQTTPublish(header byte, body []byte) (mqttMessage, uint16, byte, error) {
+	var msg mqttMessage
+	if len(body) < 2 {
+		return msg, 0, 0, errors.New("short PUBLISH")
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return msg, 0, 0, errors.New("short PUBLISH topic")
+	}
+	msg.Topic = string(body[2 : 2+n])
+	rest := body[2+n:]
+	qos := (header >> 1) & 0x03
+	var id uint16
+	if qos > 0 {
+		if len(rest) < 2 {
+			return msg, 0, 0, errors.New("PUBLISH without packet id")
+		}
+		id = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	if qos > 1 {
+		return msg, 0, 0, errors.New("QoS 2 is not supported")
+	}
+	msg.Payload = rest
+	return msg, id, qos, nil
+}
+
+func (c *mqttClient) writePacket(header byte, body []byte) error {
+	pkt := []byte{header}
+	pkt = appendMQTTLength(pkt, len(body))
+	pkt = append(pkt, body...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(gatewayWriteTimeout))
+	_, err := c.conn.Write(pkt)
+	return err
+}
+
+func (c *mqttClient) readPacket() (byte, []byte, error) {
+	header, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, mult := 0, 1
+	for i := 0; ; i++ {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * mult
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("malformed MQTT remaining length")
+		}
+		mult *= 128
+	}
+	if length > mqttMaxPacket {
+		return 0, nil, fmt.Errorf("MQTT packet of %d bytes is too large", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func appendMQTTLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The broker side of these tests is a second mqttClient on the other end of a
+// net.Pipe, used only for its packet framing.
+
+func connectTestClient(t *testing.T, opts mqttOptions) (*mqttClient, *mqttClient) {
+	t.Helper()
+	cli, srv := net.Pipe()
+	t.Cleanup(func() {
+		cli.Close()
+		srv.Close()
+	})
+	broker := newMQTTClient(srv, time.Minute)
+
+	type result struct {
+		c   *mqttClient
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := connectMQTT(cli, opts)
+		done <- result{c, err}
+	}()
+
+	typ, _, err := broker.readPacket()
+	if err != nil || typ>>4 != mqttConnect {
+		t.Fatalf("expected CONNECT, got type %d, err %v", typ>>4, err)
+	}
+	if err := broker.writePacket(mqttConnack<<4, []byte{0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("connect: %v", r.err)
+	}
+	return r.c, broker
+}
+
+func runTestClient(c *mqttClient, handle func(mqttMessage)) <-chan error {
+	errc := make(chan error, 1)
+	go func() { errc <- c.Run(context.Background(), handle) }()
+	return errc
+}
+
+func readTestPacket(t *testing.T, broker *mqttClient, wantType byte) (byte, []byte) {
+	t.Helper()
+	broker.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	typ, body, err := broker.readPacket()
+	if err != nil {
+		t.Fatalf("reading packet type %d: %v", wantType, err)
+	}
+	if typ>>4 != wantType {
+		t.Fatalf("got packet type %d, want %d", typ>>4, wantType)
+	}
+	return typ, body
+}
+
+func TestMQTTConnectSendsCredentials(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+	broker := newMQTTClient(srv, time.Minute)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := connectMQTT(cli, mqttOptions{ClientID: "pms", Username: "bridge", Password: "pw", KeepAlive: 30 * time.Second})
+		done <- err
+	}()
+
+	typ, body, err := broker.readPacket()
+	if err != nil || typ != mqttConnect<<4 {
+		t.Fatalf("expected CONNECT, got %#x, err %v", typ, err)
+	}
+	want := appendMQTTString(nil, "MQTT")
+	want = append(want, 4, 0xc2, 0, 30)
+	want = appendMQTTString(want, "pms")
+	want = appendMQTTString(want, "bridge")
+	want = appendMQTTString(want, "pw")
+	if !bytes.Equal(body, want) {
+		t.Fatalf("CONNECT body\n got %x\nwant %x", body, want)
+	}
+
+	broker.writePacket(mqttConnack<<4, []byte{0, 5})
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "not authorized") {
+		t.Fatalf("expected a not authorized error, got %v", err)
+	}
+}
+
+func TestMQTTSubackMatchesSubscribe(t *testing.T) {
+	cases := []struct {
+		name    string
+		idDelta uint16 // added to the SUBSCRIBE's packet id
+		codes   []byte
+		wantErr string
+	}{
+		{"accepted", 0, []byte{1, 1}, ""},
+		{"unknown id", 1, []byte{1, 1}, "unknown packet"},
+		{"refused", 0, []byte{1, 0x80}, "refused the subscription to b/+"},
+		{"short", 0, []byte{1}, "1 return codes for 2 filters"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, broker := connectTestClient(t, mqttOptions{ClientID: "pms", KeepAlive: time.Minute})
+			got := make(chan mqttMessage, 1)
+			errc := runTestClient(c, func(m mqttMessage) { got <- m })
+
+			go c.Subscribe("a/#", "b/+")
+			_, body := readTestPacket(t, broker, mqttSubscribe)
+			id := binary.BigEndian.Uint16(body)
+			broker.writePacket(mqttSuback<<4, append(binary.BigEndian.AppendUint16(nil, id+tc.idDelta), tc.codes...))
+
+			if tc.wantErr != "" {
+				select {
+				case err := <-errc:
+					if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+						t.Fatalf("Run returned %v, want %q", err, tc.wantErr)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatal("Run did not fail")
+				}
+				return
+			}
+
+			// the client keeps reading after a good SUBACK
+			broker.writePacket(mqttPublish<<4, append(appendMQTTString(nil, "a/x"), "hi"...))
+			select {
+			case m := <-got:
+				if m.Topic != "a/x" || string(m.Payload) != "hi" {
+					t.Fatalf("unexpected message %+v", m)
+				}
+			case err := <-errc:
+				t.Fatalf("Run failed: %v", err)
+			case <-time.After(2 * time.Second):
+				t.Fatal("message not delivered")
+			}
+			c.idMu.Lock()
+			pending := len(c.subs)
+			c.idMu.Unlock()
+			if pending != 0 {
+				t.Fatalf("%d subscriptions still pending", pending)
+			}
+		})
+	}
+}
+
+func TestMQTTSubscribeWithoutSubackFails(t *testing.T) {
+	c, broker := connectTestClient(t, mqttOptions{ClientID: "pms", KeepAlive: time.Minute})
+	c.ackTimeout = 40 * time.Millisecond
+	errc := runTestClient(c, func(mqttMessage) {})
+
+	go c.Subscribe("a/#")
+	readTestPacket(t, broker, mqttSubscribe)
+	go func() {
+		for {
+			if _, _, err := broker.readPacket(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		if err == nil || !strings.Contains(err.Error(), "no SUBACK") {
+			t.Fatalf("Run returned %v, want a SUBACK timeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not give up on the subscription")
+	}
+}
+
+func TestMQTTPublishIsResentUntilAcked(t *testing.T) {
+	c, broker := connectTestClient(t, mqttOptions{ClientID: "pms", KeepAlive: time.Minute})
+	c.ackTimeout = 40 * time.Millisecond
+	runTestClient(c, func(mqttMessage) {})
+
+	go c.Publish("farm/gw-1/cmd", []byte(`{"type":"command"}`), 1)
+	first, body := readTestPacket(t, broker, mqttPublish)
+	if first&0x08 != 0 || (first>>1)&0x03 != 1 {
+		t.Fatalf("first PUBLISH header %#x, want QoS 1 without DUP", first)
+	}
+	msg, id, _, err := parseMQTTPublish(first, body)
+	if err != nil || msg.Topic != "farm/gw-1/cmd" {
+		t.Fatalf("parse: %+v %v", msg, err)
+	}
+
+	again, body2 := readTestPacket(t, broker, mqttPublish)
+	if again&0x08 == 0 {
+		t.Fatalf("resent PUBLISH header %#x has no DUP flag", again)
+	}
+	if !bytes.Equal(body, body2) {
+		t.Fatal("resent PUBLISH differs from the original")
+	}
+
+	broker.writePacket(mqttPuback<<4, binary.BigEndian.AppendUint16(nil, id))
+	broker.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := broker.readPacket(); err == nil {
+		t.Fatal("PUBLISH resent after its PUBACK")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("unexpected read error %v", err)
+	}
+}
+
+func TestMQTTPublishGivesUpAfterMaxResends(t *testing.T) {
+	c, broker := connectTestClient(t, mqttOptions{ClientID: "pms", KeepAlive: time.Minute})
+	c.ackTimeout = 20 * time.Millisecond
+	runTestClient(c, func(mqttMessage) {})
+
+	go c.Publish("farm/gw-1/notify", []byte(`{}`), 1)
+	for i := 0; i <= mqttMaxResends; i++ {
+		readTestPacket(t, broker, mqttPublish)
+	}
+	broker.conn.SetReadDeadline(time.Now().Add(150 * time.Millisecond))
+	if _, _, err := broker.readPacket(); err == nil {
+		t.Fatalf("PUBLISH sent more than %d times", mqttMaxResends+1)
+	}
+	c.idMu.Lock()
+	n := len(c.inflight)
+	c.idMu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d publishes still in flight", n)
+	}
+}
+
+func TestMQTTIncomingQoS1IsAcked(t *testing.T) {
+	c, broker := connectTestClient(t, mqttOptions{ClientID: "pms", KeepAlive: time.Minute})
+	got := make(chan mqttMessage, 1)
+	runTestClient(c, func(m mqttMessage) { got <- m })
+
+	body := appendMQTTString(nil, "farm/gw-1/heartbeat")
+	body = binary.BigEndian.AppendUint16(body, 7)
+	body = append(body, `{"uptime":5}`...)
+	go broker.writePacket(mqttPublish<<4|0x02, body)
+
+	_, ack := readTestPacket(t, broker, mqttPuback)
+	if binary.BigEndian.Uint16(ack) != 7 {
+		t.Fatalf("PUBACK for packet %d, want 7", binary.BigEndian.Uint16(ack))
+	}
+	m := <-got
+	if m.Topic != "farm/gw-1/heartbeat" || string(m.Payload) != `{"uptime":5}` {
+		t.Fatalf("unexpected message %+v", m)
+	}
+}
+
+func TestMQTTPacketIDsSkipInflight(t *testing.T) {
+	c := newMQTTClient(nil, time.Minute)
+	c.nextID = 0xfffe
+	c.inflight[1] = &mqttInflight{}
+	p := &mqttInflight{body: []byte{0, 0}}
+	if id := c.track(c.subs, p, 0); id != 0xffff {
+		t.Fatalf("got id %d, want 65535", id)
+	}
+	p = &mqttInflight{body: []byte{0, 0}}
+	if id := c.track(c.subs, p, 0); id != 2 {
+		t.Fatalf("got id %d after wrap, want 2 (0 is invalid, 1 in flight)", id)
+	}
+	if binary.BigEndian.Uint16(p.body) != 2 {
+		t.Fatal("packet id not written into the body")
+	}
+}
+
+func TestMQTTRemainingLength(t *testing.T) {
+	for _, n := range []int{0, 1, 127, 128, 16383, 16384, 200000} {
+		pkt := appendMQTTLength([]byte{mqttPingresp << 4}, n)
+		pkt = append(pkt, make([]byte, n)...)
+		c := &mqttClient{r: bufio.NewReader(bytes.NewReader(pkt))}
+		typ, body, err := c.readPacket()
+		if err != nil || typ != mqttPingresp<<4 || len(body) != n {
+			t.Fatalf("length %d: type %#x, %d bytes, err %v", n, typ, len(body), err)
+		}
+	}
+
+	tooLarge := appendMQTTLength([]byte{mqttPublish << 4}, mqttMaxPacket+1)
+	c := &mqttClient{r: bufio.NewReader(bytes.NewReader(tooLarge))}
+	if _, _, err := c.readPacket(); err == nil {
+		t.Fatal("oversized packet accepted")
+	}
+
+	malformed := []byte{mqttPublish << 4, 0xff, 0xff, 0xff, 0xff, 0x01}
+	c = &mqttClient{r: bufio.NewReader(bytes.NewReader(malformed))}
+	if _, _, err := c.readPacket(); err == nil {
+		t.Fatal("five-byte remaining length accepted")
+	}
+}
+
+func TestMQTTParsePublishRejectsQoS2(t *testing.T) {
+	body := appendMQTTString(nil, "t")
+	body = binary.BigEndian.AppendUint16(body, 1)
+	if _, _, _, err := parseMQTTPublish(mqttPublish<<4|0x04, body); err == nil {
+		t.Fatal("QoS 2 PUBLISH accepted")
+	}
+	if _, _, _, err := parseMQTTPublish(mqttPublish<<4, []byte{0, 5, 'a'}); err == nil {
+		t.Fatal("truncated topic accepted")
+	}
+}
+
+func TestMQTTSlowHandlerDoesNotBlockAcks(t *testing.T) {
+	c, broker := connectTestClient(t, mqttOptions{ClientID: "pms", KeepAlive: time.Minute})
+	release := make(chan struct{})
+	defer close(release)
+	runTestClient(c, func(mqttMessage) { <-release })
+
+	for id := uint16(1); id <= 2; id++ {
+		body := appendMQTTString(nil, "farm/gw-1/heartbeat")
+		body = binary.BigEndian.AppendUint16(body, id)
+		go broker.writePacket(mqttPublish<<4|0x02, body)
+		_, ack := readTestPacket(t, broker, mqttPuback)
+		if got := binary.BigEndian.Uint16(ack); got != id {
+			t.Fatalf("PUBACK for packet %d, want %d", got, id)
+		}
+	}
+}
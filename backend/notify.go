@@ -0,0 +1,796 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+/* ===========================
+    Notification Channels
+=========================== */
+
+type Notification struct {
+	AlertID  int64  `json:"alertId"`
+	Type     string `json:"type"`
+	Severity string `json:"severity"`
+	Subject  string `json:"subject"`
+	Body     string `json:"body"`
+}
+
+// Notifier delivers a notification to one destination (email address, URL, phone number)
+type Notifier interface {
+	Send(ctx context.Context, destination string, n Notification) error
+}
+
+// SMTPNotifier sends plain text email through the server in SMTP_HOST/SMTP_PORT
+type SMTPNotifier struct {
+	Host, Port, Username, Password, From string
+}
+
+func (s SMTPNotifier) Send(ctx context.Context, destination string, n Notification) error {
+	if s.Host == "" {
+		return errors.New("SMTP is not configured")
+	}
+	msg := "From: " + headerValue(s.From) + "\r\n" +
+		"To: " + headerValue(destination) + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("UTF-8", headerValue(n.Subject)) + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n\r\n" +
+		n.Body + "\r\n"
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(s.Host+":"+s.Port, auth, s.From, []string{destination}, []byte(msg)) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// headerValue folds line breaks into spaces so alert text cannot add its own mail headers
+func headerValue(v string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(v)
+}
+
+// WebhookNotifier posts the notification as JSON to the destination URL
+type WebhookNotifier struct {
+	Client *http.Client
+}
+
+func (wh WebhookNotifier) Send(ctx context.Context, destination string, n Notification) error {
+	body, _ := json.Marshal(n)
+	return postJSON(ctx, wh.Client, destination, body)
+}
+
+// blockedWebhookIP reports the addresses a webhook must never reach: the server
+// itself and link-local ranges such as cloud metadata endpoints
+func blockedWebhookIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// validWebhookURL accepts http and https URLs whose host does not resolve to a
+// blocked address
+func validWebhookURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("webhook destination must be an http or https URL")
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("cannot resolve webhook host %s", u.Hostname())
+	}
+	for _, a := range addrs {
+		if blockedWebhookIP(a.IP) {
+			return fmt.Errorf("webhook host %s resolves to a loopback or link-local address", u.Hostname())
+		}
+	}
+	return nil
+}
+
+// newWebhookClient checks every address at dial time as well, so neither a host
+// that resolves differently later nor a redirect reaches a blocked address
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || blockedWebhookIP(ip) {
+				return fmt.Errorf("webhook address %s is not allowed", host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
+}
+
+// SMSGateway is the adapter for whichever SMS provider the farm uses
+type SMSGateway interface {
+	SendSMS(ctx context.Context, phone, message string) error
+}
+
+// HTTPSMSGateway posts {"to", "message"} to a provider URL with an optional API key
+type HTTPSMSGateway struct {
+	URL    string
+	APIKey string
+	Client *http.Client
+}
+
+func (g HTTPSMSGateway) SendSMS(ctx context.Context, phone, message string) error {
+	body, _ := json.Marshal(map[string]string{"to": phone, "message": message})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if g.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+g.APIKey)
+	}
+	resp, err := g.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("SMS gateway returned %s", resp.Status)
+	}
+	return nil
+}
+
+// SMSNotifier has no Gateway when SMS_GATEWAY_URL is not set; every send then fails
+type SMSNotifier struct {
+	Gateway SMSGateway
+}
+
+func (s SMSNotifier) Send(ctx context.Context, destination string, n Notification) error {
+	if s.Gateway == nil {
+		return errors.New("SMS is not configured, set SMS_GATEWAY_URL")
+	}
+	text := n.Subject
+	if runes := []rune(text); len(runes) > 160 {
+		text = string(runes[:160])
+	}
+	return s.Gateway.SendSMS(ctx, destination, text)
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// In-process stand-in for an SMS provider, reachable over HTTP so SMS_GATEWAY_URL
+// can be pointed at it while testing
+type StubSMS struct {
+	To      string `json:"to"`
+	Message string `json:"message"`
+	At      string `json:"at"`
+}
+
+var (
+	smsStubMu  sync.Mutex
+	smsStubLog []StubSMS
+)
+
+const smsStubKeep = 100
+
+var notifiers = map[string]Notifier{}
+
+// initNotifiers builds the channels from env. Channels that are not configured stay
+// registered so their deliveries are logged as Failed instead of vanishing.
+func initNotifiers() {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	smtpPort := os.Getenv("SMTP_PORT")
+	if smtpPort == "" {
+		smtpPort = "587"
+	}
+	notifiers["email"] = SMTPNotifier{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     smtpPort,
+		Username: os.Getenv("SMTP_USER"),
+		Password: os.Getenv("SMTP_PASS"),
+		From:     os.Getenv("SMTP_FROM"),
+	}
+	notifiers["webhook"] = WebhookNotifier{Client: newWebhookClient()}
+
+	if smsURL := os.Getenv("SMS_GATEWAY_URL"); smsURL != "" {
+		notifiers["sms"] = SMSNotifier{Gateway: HTTPSMSGateway{URL: smsURL, APIKey: os.Getenv("SMS_GATEWAY_KEY"), Client: client}}
+	} else {
+		log.Printf("[WARN] SMS_GATEWAY_URL is not set, SMS notifications will fail")
+		notifiers["sms"] = SMSNotifier{}
+	}
+}
+
+/* ===========================
+    Models for Subscriptions
+=========================== */
+
+type NotificationSubscription struct {
+	SubscriptionID   int     `json:"SubscriptionID"`
+	Username         string  `json:"Username"`
+	Channel          string  `json:"Channel"`     // email, webhook or sms
+	Destination      string  `json:"Destination"` // empty uses the user's email or phone number
+	AlertTypes       string  `json:"AlertTypes"`  // comma separated, "*" for all
+	MinSeverity      string  `json:"MinSeverity"`
+	QuietStart       *string `json:"QuietStart"` // "22:00"
+	QuietEnd         *string `json:"QuietEnd"`   // "06:00"
+	EscalateAfterMin *int    `json:"EscalateAfterMin"`
+	IsActive         bool    `json:"IsActive"`
+}
+
+type NotificationDelivery struct {
+	DeliveryID     int64   `json:"DeliveryID"`
+	AlertID        int64   `json:"AlertID"`
+	SubscriptionID int     `json:"SubscriptionID"`
+	Username       string  `json:"Username"`
+	Channel        string  `json:"Channel"`
+	Destination    string  `json:"Destination"`
+	Status         string  `json:"Status"` // Sent, Failed, Deferred
+	Error          *string `json:"Error"`
+	CreatedAt      string  `json:"CreatedAt"`
+}
+
+var severityRank = map[string]int{"info": 0, "warning": 1, "critical": 2}
+
+const (
+	notificationJobInterval = time.Minute
+	maxDeliveryAttempts     = 3
+	// A dispatch that crashed mid-way gives up its claim on the alert after this long
+	notifyClaimTimeout = 2 * time.Minute
+)
+
+/* ===========================
+    Notification Dispatch
+=========================== */
+
+func (s NotificationSubscription) matches(alertType, severity string) bool {
+	if severityRank[severity] < severityRank[s.MinSeverity] {
+		return false
+	}
+	if s.AlertTypes == "" || s.AlertTypes == "*" {
+		return true
+	}
+	for _, t := range strings.Split(s.AlertTypes, ",") {
+		t = strings.TrimSpace(t)
+		if t == alertType || (strings.HasSuffix(t, "*") && strings.HasPrefix(alertType, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// inQuietHours handles windows that wrap past midnight, e.g. 22:00-06:00
+func (s NotificationSubscription) inQuietHours(now time.Time) bool {
+	if s.QuietStart == nil || s.QuietEnd == nil {
+		return false
+	}
+	start, err1 := time.Parse("15:04", *s.QuietStart)
+	end, err2 := time.Parse("15:04", *s.QuietEnd)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	from, to := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+func loadSubscriptions(ctx context.Context, activeOnly bool) ([]NotificationSubscription, error) {
+	query := `
+		SELECT s.SubscriptionID, s.Username, s.Channel,
+			CASE WHEN s.Destination <> '' THEN s.Destination
+				WHEN s.Channel = 'email' THEN COALESCE(u.email, '')
+				WHEN s.Channel = 'sms' THEN COALESCE(u.phone_number, '')
+				ELSE '' END,
+			s.AlertTypes, s.MinSeverity, TIME_FORMAT(s.QuietStart, '%H:%i'), TIME_FORMAT(s.QuietEnd, '%H:%i'),
+			s.EscalateAfterMin, s.IsActive
+		FROM cm_notification_subscriptions s
+		LEFT JOIN cm_users u ON u.username = s.Username`
+	if activeOnly {
+		query += " WHERE s.IsActive = 1"
+	}
+	query += " ORDER BY s.Username, s.SubscriptionID"
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := []NotificationSubscription{}
+	for rows.Next() {
+		var s NotificationSubscription
+		if err := rows.Scan(&s.SubscriptionID, &s.Username, &s.Channel, &s.Destination, &s.AlertTypes, &s.MinSeverity,
+			&s.QuietStart, &s.QuietEnd, &s.EscalateAfterMin, &s.IsActive); err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
+func logDelivery(ctx context.Context, alertID int64, s NotificationSubscription, status string, sendErr error) {
+	var errText *string
+	if sendErr != nil {
+		e := sendErr.Error()
+		errText = &e
+	}
+	query := `
+		INSERT INTO cm_notification_deliveries (AlertID, SubscriptionID, Channel, Destination, Status, Error)
+		VALUES (?, ?, ?, ?, ?, ?)`
+	if _, err := db.ExecContext(ctx, query, alertID, s.SubscriptionID, s.Channel, s.Destination, status, errText); err != nil {
+		log.Printf("[ERROR] Failed to log notification delivery: %v", err)
+	}
+}
+
+// deliverAlert sends an alert to every subscription that wants it and has not
+// received it yet. Escalation subscriptions only fire once the alert has stayed
+// unacknowledged for their delay; quiet hours hold back everything but critical alerts.
+func deliverAlert(ctx context.Context, a AlertRecord, subs []NotificationSubscription, now time.Time) {
+	raisedAt, _ := time.ParseInLocation(sqlDateTime, a.RaisedAt, time.Local)
+	n := Notification{
+		AlertID:  a.AlertID,
+		Type:     a.Type,
+		Severity: a.Severity,
+		Subject:  fmt.Sprintf("[%s] %s", strings.ToUpper(a.Severity), a.Message),
+		Body:     fmt.Sprintf("%s\n\nType: %s\nRaised: %s\nStatus: %s", a.Message, a.Type, a.RaisedAt, a.Status),
+	}
+
+	for _, s := range subs {
+		if !s.matches(a.Type, a.Severity) {
+			continue
+		}
+		if s.EscalateAfterMin != nil {
+			if a.Status != AlertOpen || now.Sub(raisedAt) < time.Duration(*s.EscalateAfterMin)*time.Minute {
+				continue
+			}
+		}
+
+		var sent, failed, deferred int
+		countQuery := `
+			SELECT COALESCE(SUM(Status = 'Sent'), 0), COALESCE(SUM(Status = 'Failed'), 0), COALESCE(SUM(Status = 'Deferred'), 0)
+			FROM cm_notification_deliveries WHERE AlertID = ? AND SubscriptionID = ?`
+		if err := db.QueryRowContext(ctx, countQuery, a.AlertID, s.SubscriptionID).Scan(&sent, &failed, &deferred); err != nil {
+			log.Printf("[ERROR] Failed to check notification deliveries: %v", err)
+			continue
+		}
+		if sent > 0 || failed >= maxDeliveryAttempts {
+			continue
+		}
+
+		if a.Severity != "critical" && s.inQuietHours(now) {
+			if deferred == 0 {
+				logDelivery(ctx, a.AlertID, s, "Deferred", nil)
+			}
+			continue
+		}
+
+		notifier, ok := notifiers[s.Channel]
+		if !ok || s.Destination == "" {
+			logDelivery(ctx, a.AlertID, s, "Failed", fmt.Errorf("no %s destination for %s", s.Channel, s.Username))
+			continue
+		}
+		sendCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		err := notifier.Send(sendCtx, s.Destination, n)
+		cancel()
+		if err != nil {
+			logDelivery(ctx, a.AlertID, s, "Failed", err)
+			continue
+		}
+		logDelivery(ctx, a.AlertID, s, "Sent", nil)
+	}
+}
+
+// loadUnresolvedAlerts returns alerts still needing attention, newest first
+func loadUnresolvedAlerts(ctx context.Context, alertID int64) ([]AlertRecord, error) {
+	query := `
+		SELECT AlertID, Type, Severity, Message, Status, RaisedAt
+		FROM cm_alerts
+		WHERE Status <> 'Resolved'`
+	var args []interface{}
+	if alertID > 0 {
+		query += " AND AlertID = ?"
+		args = append(args, alertID)
+	}
+	query += " ORDER BY AlertID DESC"
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var alerts []AlertRecord
+	for rows.Next() {
+		var a AlertRecord
+		if err := rows.Scan(&a.AlertID, &a.Type, &a.Severity, &a.Message, &a.Status, &a.RaisedAt); err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts, rows.Err()
+}
+
+// claimAlertNotification marks the alert as being notified. Only one dispatch (the one
+// right after the alert was raised or a periodic sweep) can hold the claim at a time,
+// so two of them never send the same alert to the same subscription.
+func claimAlertNotification(ctx context.Context, alertID int64) (bool, error) {
+	query := `
+		UPDATE cm_alerts SET NotifyClaimedAt = NOW()
+		WHERE AlertID = ? AND (NotifyClaimedAt IS NULL OR NotifyClaimedAt < NOW() - INTERVAL ? SECOND)`
+	res, err := db.ExecContext(ctx, query, alertID, int(notifyClaimTimeout.Seconds()))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func releaseAlertNotification(alertID int64) {
+	ctx, cancel := withTimeout(context.Background())
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "UPDATE cm_alerts SET NotifyClaimedAt = NULL WHERE AlertID = ?", alertID); err != nil {
+		log.Printf("[ERROR] Failed to release notification claim on alert %d: %v", alertID, err)
+	}
+}
+
+// dispatchNotifications delivers one alert (alertID > 0) or sweeps every unresolved one
+func dispatchNotifications(ctx context.Context, alertID int64) {
+	subs, err := loadSubscriptions(ctx, true)
+	if err != nil {
+		log.Printf("[ERROR] Failed to load notification subscriptions: %v", err)
+		return
+	}
+	if len(subs) == 0 {
+		return
+	}
+	alerts, err := loadUnresolvedAlerts(ctx, alertID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to load alerts for notification: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, a := range alerts {
+		claimed, err := claimAlertNotification(ctx, a.AlertID)
+		if err != nil {
+			log.Printf("[ERROR] Failed to claim alert %d for notification: %v", a.AlertID, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		deliverAlert(ctx, a, subs, now)
+		releaseAlertNotification(a.AlertID)
+	}
+}
+
+// notifyAlertAsync is called right after an alert is raised so the ingest path never waits on SMTP
+func notifyAlertAsync(alertID int64) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		dispatchNotifications(ctx, alertID)
+	}()
+}
+
+// runNotificationJobs retries failed and deferred deliveries and fires escalations
+func runNotificationJobs(ctx context.Context) {
+	t := time.NewTicker(notificationJobInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			jobCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+			dispatchNotifications(jobCtx, 0)
+			cancel()
+		}
+	}
+}
+
+/* ===========================
+    Notification Handlers
+=========================== */
+
+func getNotificationSubscriptions(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	subs, err := loadSubscriptions(ctx, false)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch subscriptions", err)
+		return
+	}
+	if user := r.URL.Query().Get("username"); user != "" {
+		filtered := []NotificationSubscription{}
+		for _, s := range subs {
+			if s.Username == user {
+				filtered = append(filtered, s)
+			}
+		}
+		subs = filtered
+	}
+	respondJSON(w, http.StatusOK, subs)
+}
+
+func validateSubscription(ctx context.Context, w http.ResponseWriter, s *NotificationSubscription) bool {
+	if _, ok := notifiers[s.Channel]; !ok {
+		handleError(w, http.StatusBadRequest, "Channel must be email, webhook or sms", nil)
+		return false
+	}
+	if s.Channel == "webhook" {
+		if err := validWebhookURL(ctx, s.Destination); err != nil {
+			handleError(w, http.StatusBadRequest, err.Error(), nil)
+			return false
+		}
+	}
+	if s.MinSeverity == "" {
+		s.MinSeverity = "warning"
+	}
+	if _, ok := severityRank[s.MinSeverity]; !ok {
+		handleError(w, http.StatusBadRequest, "MinSeverity must be info, warning or critical", nil)
+		return false
+	}
+	if s.AlertTypes == "" {
+		s.AlertTypes = "*"
+	}
+	if (s.QuietStart == nil) != (s.QuietEnd == nil) {
+		handleError(w, http.StatusBadRequest, "QuietStart and QuietEnd must be set together", nil)
+		return false
+	}
+	for _, v := range []*string{s.QuietStart, s.QuietEnd} {
+		if v != nil {
+			if _, err := time.Parse("15:04", *v); err != nil {
+				handleError(w, http.StatusBadRequest, "Quiet hours must be HH:MM", err)
+				return false
+			}
+		}
+	}
+	if s.EscalateAfterMin != nil && *s.EscalateAfterMin <= 0 {
+		handleError(w, http.StatusBadRequest, "EscalateAfterMin must be greater than zero", nil)
+		return false
+	}
+	exists, err := userExists(ctx, s.Username)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to check user", err)
+		return false
+	}
+	if !exists {
+		handleError(w, http.StatusBadRequest, "Unknown user", nil)
+		return false
+	}
+	return true
+}
+
+func createNotificationSubscription(w http.ResponseWriter, r *http.Request) {
+	sub := NotificationSubscription{IsActive: true}
+	if !decodeJSONBody(w, r, &sub) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	if !validateSubscription(ctx, w, &sub) {
+		return
+	}
+
+	query := `
+		INSERT INTO cm_notification_subscriptions
+		(Username, Channel, Destination, AlertTypes, MinSeverity, QuietStart, QuietEnd, EscalateAfterMin, IsActive)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	res, err := db.ExecContext(ctx, query, sub.Username, sub.Channel, sub.Destination, sub.AlertTypes, sub.MinSeverity,
+		sub.QuietStart, sub.QuietEnd, sub.EscalateAfterMin, sub.IsActive)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to create subscription", err)
+		return
+	}
+	lastID, _ := res.LastInsertId()
+	respondJSON(w, http.StatusCreated, map[string]interface{}{"success": true, "insertedId": lastID})
+}
+
+func updateNotificationSubscription(w http.ResponseWriter, r *http.Request) {
+	subID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid subscription ID", err)
+		return
+	}
+
+	sub := NotificationSubscription{IsActive: true}
+	if !decodeJSONBody(w, r, &sub) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	if !validateSubscription(ctx, w, &sub) {
+		return
+	}
+
+	query := `
+		UPDATE cm_notification_subscriptions
+		SET Username = ?, Channel = ?, Destination = ?, AlertTypes = ?, MinSeverity = ?,
+			QuietStart = ?, QuietEnd = ?, EscalateAfterMin = ?, IsActive = ?
+		WHERE SubscriptionID = ?`
+	res, err := db.ExecContext(ctx, query, sub.Username, sub.Channel, sub.Destination, sub.AlertTypes, sub.MinSeverity,
+		sub.QuietStart, sub.QuietEnd, sub.EscalateAfterMin, sub.IsActive, subID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to update subscription", err)
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		handleError(w, http.StatusNotFound, "Subscription not found or no changes made", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+func deleteNotificationSubscription(w http.ResponseWriter, r *http.Request) {
+	subID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid subscription ID", err)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, "DELETE FROM cm_notification_subscriptions WHERE SubscriptionID = ?", subID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to delete subscription", err)
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		handleError(w, http.StatusNotFound, "Subscription not found", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// GET /api/notifications/deliveries?alert=12
+func getNotificationDeliveries(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := `
+		SELECT d.DeliveryID, d.AlertID, d.SubscriptionID, COALESCE(s.Username, ''), d.Channel, d.Destination, d.Status, d.Error, d.CreatedAt
+		FROM cm_notification_deliveries d
+		LEFT JOIN cm_notification_subscriptions s ON s.SubscriptionID = d.SubscriptionID`
+	var args []interface{}
+	if alert := r.URL.Query().Get("alert"); alert != "" {
+		query += " WHERE d.AlertID = ?"
+		args = append(args, alert)
+	}
+	query += " ORDER BY d.DeliveryID DESC LIMIT 200"
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch deliveries", err)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []NotificationDelivery{}
+	for rows.Next() {
+		var d NotificationDelivery
+		if err := rows.Scan(&d.DeliveryID, &d.AlertID, &d.SubscriptionID, &d.Username, &d.Channel, &d.Destination, &d.Status, &d.Error, &d.CreatedAt); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan delivery", err)
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+	respondJSON(w, http.StatusOK, deliveries)
+}
+
+// POST /api/notifications/test - sends a test message to a saved subscription. Only
+// destinations already configured on a subscription can be reached this way.
+func sendTestNotification(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		SubscriptionID int `json:"SubscriptionID"`
+	}
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+
+	subs, err := loadSubscriptions(ctx, false)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch subscriptions", err)
+		return
+	}
+	var sub *NotificationSubscription
+	for i := range subs {
+		if subs[i].SubscriptionID == payload.SubscriptionID {
+			sub = &subs[i]
+			break
+		}
+	}
+	if sub == nil {
+		handleError(w, http.StatusNotFound, "Subscription not found", nil)
+		return
+	}
+	notifier, ok := notifiers[sub.Channel]
+	if !ok || sub.Destination == "" {
+		handleError(w, http.StatusBadRequest, "Subscription has no "+sub.Channel+" destination", nil)
+		return
+	}
+
+	n := Notification{Type: "test", Severity: "info", Subject: "Chickmate test notification", Body: "Notifications are set up correctly."}
+	if err := notifier.Send(ctx, sub.Destination, n); err != nil {
+		handleError(w, http.StatusBadGateway, "Failed to send test notification", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// POST /api/notifications/sms-stub - accepts messages like an SMS provider would
+func receiveStubSMS(w http.ResponseWriter, r *http.Request) {
+	var msg StubSMS
+	if !decodeJSONBody(w, r, &msg) {
+		return
+	}
+	msg.At = time.Now().Format(time.RFC3339)
+	log.Printf("[SMS stub] to %s: %s", msg.To, msg.Message)
+
+	smsStubMu.Lock()
+	smsStubLog = append(smsStubLog, msg)
+	if len(smsStubLog) > smsStubKeep {
+		smsStubLog = smsStubLog[len(smsStubLog)-smsStubKeep:]
+	}
+	smsStubMu.Unlock()
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// GET /api/notifications/sms-stub - messages received by the stub, newest last
+func getStubSMS(w http.ResponseWriter, r *http.Request) {
+	smsStubMu.Lock()
+	out := make([]StubSMS, len(smsStubLog))
+	copy(out, smsStubLog)
+	smsStubMu.Unlock()
+	respondJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInQuietHours(t *testing.T) {
+	str := func(s string) *string { return &s }
+	cases := []struct {
+		name       string
+		start, end *string
+		clock      string
+		want       bool
+	}{
+		{"no window", nil, nil, "23:00", false},
+		{"inside a daytime window", str("12:00"), str("14:00"), "13:15", true},
+		{"start is inclusive", str("12:00"), str("14:00"), "12:00", true},
+		{"end is exclusive", str("12:00"), str("14:00"), "14:00", false},
+		{"before a daytime window", str("12:00"), str("14:00"), "11:59", false},
+		{"late evening in an overnight window", str("22:00"), str("06:00"), "23:30", true},
+		{"early morning in an overnight window", str("22:00"), str("06:00"), "05:59", true},
+		{"after an overnight window", str("22:00"), str("06:00"), "06:00", false},
+		{"midday outside an overnight window", str("22:00"), str("06:00"), "12:00", false},
+		{"empty window", str("08:00"), str("08:00"), "08:00", false},
+		{"unparsable window", str("10pm"), str("06:00"), "23:00", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			clock, _ := time.Parse("15:04", tc.clock)
+			now := time.Date(2026, 3, 1, clock.Hour(), clock.Minute(), 0, 0, time.Local)
+			s := NotificationSubscription{QuietStart: tc.start, QuietEnd: tc.end}
+			if got := s.inQuietHours(now); got != tc.want {
+				t.Fatalf("inQuietHours(%s) = %v, want %v", tc.clock, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidWebhookURL(t *testing.T) {
+	cases := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://203.0.113.10/hooks/farm", true},
+		{"http://192.168.1.20:8080/alert", true},
+		{"ftp://203.0.113.10/x", false},
+		{"/relative/path", false},
+		{"http://127.0.0.1/admin", false},
+		{"http://[::1]:8080/", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://0.0.0.0/", false},
+		{"http://[fe80::1]/", false},
+	}
+	for _, tc := range cases {
+		err := validWebhookURL(context.Background(), tc.url)
+		if (err == nil) != tc.ok {
+			t.Errorf("validWebhookURL(%q) = %v, want ok=%v", tc.url, err, tc.ok)
+		}
+	}
+}
+
+type recordingSMS struct{ text string }
+
+func (g *recordingSMS) SendSMS(_ context.Context, _ string, message string) error {
+	g.text = message
+	return nil
+}
+
+func TestSMSTruncatesByRune(t *testing.T) {
+	g := &recordingSMS{}
+	subject := strings.Repeat("é", 200)
+	if err := (SMSNotifier{Gateway: g}).Send(context.Background(), "+100", Notification{Subject: subject}); err != nil {
+		t.Fatal(err)
+	}
+	if got := []rune(g.text); len(got) != 160 || string(got) != strings.Repeat("é", 160) {
+		t.Fatalf("got %d runes, valid prefix %v", len(got), string(got) == strings.Repeat("é", 160))
+	}
+}
@@ -0,0 +1,785 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+/* ===========================
+    Models for Farm Overheads
+=========================== */
+
+type FarmOverhead struct {
+	OverheadID  int     `json:"OverheadID"`
+	Date        string  `json:"Date"`
+	CostType    string  `json:"CostType"`
+	Description string  `json:"Description"`
+	Amount      float64 `json:"Amount"`
+	Allocated   bool    `json:"Allocated"`
+}
+
+type FarmOverheadPayload struct {
+	Date        string  `json:"Date"`
+	CostType    string  `json:"CostType"`
+	Description string  `json:"Description"`
+	Amount      float64 `json:"Amount"`
+}
+
+// Allocation rule per cost type; the rule with CostType "*" is the default
+type AllocationRule struct {
+	RuleID   int    `json:"RuleID"`
+	CostType string `json:"CostType"`
+	Method   string `json:"Method"` // "bird_days", "head_count", "equal"
+}
+
+type AllocationRunPayload struct {
+	From   string `json:"From"`
+	To     string `json:"To"`
+	DryRun bool   `json:"DryRun"`
+}
+
+type AllocationRun struct {
+	RunID          int     `json:"RunID"`
+	PeriodFrom     string  `json:"PeriodFrom"`
+	PeriodTo       string  `json:"PeriodTo"`
+	TotalAllocated float64 `json:"TotalAllocated"`
+	Status         string  `json:"Status"`
+	CreatedAt      string  `json:"CreatedAt"`
+}
+
+type OverheadAllocation struct {
+	OverheadID int     `json:"OverheadID"`
+	CostType   string  `json:"CostType"`
+	BatchID    int     `json:"BatchID"`
+	BatchName  string  `json:"BatchName"`
+	Method     string  `json:"Method"`
+	Basis      float64 `json:"Basis"`
+	Amount     float64 `json:"Amount"`
+}
+
+const defaultAllocationMethod = "bird_days"
+
+var validAllocationMethods = map[string]bool{"bird_days": true, "head_count": true, "equal": true}
+
+/* ===========================
+    Overhead Handlers
+=========================== */
+
+// GET /api/overheads?from=2025-01-01&to=2025-01-31
+func getFarmOverheads(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := `
+		SELECT o.OverheadID, o.Date, o.CostType, o.Description, o.Amount,
+			EXISTS (
+				SELECT 1 FROM cm_overhead_allocations a
+				JOIN cm_overhead_allocation_runs ar ON a.RunID = ar.RunID
+				WHERE a.OverheadID = o.OverheadID AND ar.Status = 'Posted'
+			) AS Allocated
+		FROM cm_farm_overheads o
+		WHERE o.IsActive = 1`
+
+	var args []interface{}
+	if from := r.URL.Query().Get("from"); from != "" {
+		query += " AND o.Date >= ?"
+		args = append(args, from)
+	}
+	if to := r.URL.Query().Get("to"); to != "" {
+		query += " AND o.Date <= ?"
+		args = append(args, to)
+	}
+	query += " ORDER BY o.Date DESC, o.OverheadID DESC"
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch overheads", err)
+		return
+	}
+	defer rows.Close()
+
+	overheads := []FarmOverhead{}
+	for rows.Next() {
+		var o FarmOverhead
+		if err := rows.Scan(&o.OverheadID, &o.Date, &o.CostType, &o.Description, &o.Amount, &o.Allocated); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan overhead", err)
+			return
+		}
+		overheads = append(overheads, o)
+	}
+	respondJSON(w, http.StatusOK, overheads)
+}
+
+func validateOverheadPayload(w http.ResponseWriter, p FarmOverheadPayload) bool {
+	if _, err := time.Parse("2006-01-02", p.Date); err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid Date, expected YYYY-MM-DD", err)
+		return false
+	}
+	if p.CostType == "" {
+		handleError(w, http.StatusBadRequest, "CostType is required", nil)
+		return false
+	}
+	if p.Amount <= 0 {
+		handleError(w, http.StatusBadRequest, "Amount must be greater than zero", nil)
+		return false
+	}
+	return true
+}
+
+func createFarmOverhead(w http.ResponseWriter, r *http.Request) {
+	var payload FarmOverheadPayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if !validateOverheadPayload(w, payload) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := "INSERT INTO cm_farm_overheads (Date, CostType, Description, Amount) VALUES (?, ?, ?, ?)"
+	res, err := db.ExecContext(ctx, query, payload.Date, payload.CostType, payload.Description, payload.Amount)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to insert overhead", err)
+		return
+	}
+	lastID, _ := res.LastInsertId()
+	respondJSON(w, http.StatusCreated, map[string]interface{}{"success": true, "insertedId": lastID})
+}
+
+// isOverheadAllocated reports whether the overhead is part of a posted allocation run
+func isOverheadAllocated(ctx context.Context, overheadID int) (bool, error) {
+	var count int
+	query := `
+		SELECT COUNT(*) FROM cm_overhead_allocations a
+		JOIN cm_overhead_allocation_runs ar ON a.RunID = ar.RunID
+		WHERE a.OverheadID = ? AND ar.Status = 'Posted'`
+	err := db.QueryRowContext(ctx, query, overheadID).Scan(&count)
+	return count > 0, err
+}
+
+func updateFarmOverhead(w http.ResponseWriter, r *http.Request) {
+	overheadID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid overhead ID", err)
+		return
+	}
+
+	var payload FarmOverheadPayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if !validateOverheadPayload(w, payload) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	allocated, err := isOverheadAllocated(ctx, overheadID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to check overhead allocation", err)
+		return
+	}
+	if allocated {
+		handleError(w, http.StatusConflict, "Overhead has already been allocated. Reverse the allocation run first.", nil)
+		return
+	}
+
+	query := "UPDATE cm_farm_overheads SET Date = ?, CostType = ?, Description = ?, Amount = ? WHERE OverheadID = ? AND IsActive = 1"
+	res, err := db.ExecContext(ctx, query, payload.Date, payload.CostType, payload.Description, payload.Amount, overheadID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to update overhead", err)
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		handleError(w, http.StatusNotFound, "Overhead not found or no changes made", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+func deleteFarmOverhead(w http.ResponseWriter, r *http.Request) {
+	overheadID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid overhead ID", err)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	allocated, err := isOverheadAllocated(ctx, overheadID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to check overhead allocation", err)
+		return
+	}
+	if allocated {
+		handleError(w, http.StatusConflict, "Overhead has already been allocated. Reverse the allocation run first.", nil)
+		return
+	}
+
+	res, err := db.ExecContext(ctx, "UPDATE cm_farm_overheads SET IsActive = 0 WHERE OverheadID = ?", overheadID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to delete overhead", err)
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		handleError(w, http.StatusNotFound, "Overhead not found", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+/* ===========================
+    Allocation Rules
+=========================== */
+
+func getAllocationRules(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT RuleID, CostType, Method FROM cm_overhead_allocation_rules ORDER BY CostType")
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch allocation rules", err)
+		return
+	}
+	defer rows.Close()
+
+	rules := []AllocationRule{}
+	for rows.Next() {
+		var rule AllocationRule
+		if err := rows.Scan(&rule.RuleID, &rule.CostType, &rule.Method); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan allocation rule", err)
+			return
+		}
+		rules = append(rules, rule)
+	}
+	respondJSON(w, http.StatusOK, rules)
+}
+
+// PUT /api/overheads/rules creates or replaces the rule for a cost type
+func upsertAllocationRule(w http.ResponseWriter, r *http.Request) {
+	var payload AllocationRule
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if payload.CostType == "" {
+		handleError(w, http.StatusBadRequest, "CostType is required. Use * for the default rule.", nil)
+		return
+	}
+	if !validAllocationMethods[payload.Method] {
+		handleError(w, http.StatusBadRequest, "Invalid Method. Use bird_days, head_count or equal.", nil)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := `
+		INSERT INTO cm_overhead_allocation_rules (CostType, Method) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE Method = VALUES(Method)`
+	if _, err := db.ExecContext(ctx, query, payload.CostType, payload.Method); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to save allocation rule", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+func deleteAllocationRule(w http.ResponseWriter, r *http.Request) {
+	ruleID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid rule ID", err)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, "DELETE FROM cm_overhead_allocation_rules WHERE RuleID = ?", ruleID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to delete allocation rule", err)
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		handleError(w, http.StatusNotFound, "Allocation rule not found", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+/* ===========================
+    Allocation Runs
+=========================== */
+
+type allocationBatch struct {
+	ID        int
+	Name      string
+	HeadCount int
+	BirdDays  float64
+}
+
+// batchBirdDays counts the birds alive on each day of [from, to], using the
+// batch start, mortality records and harvests to track the population.
+func batchBirdDays(ctx context.Context, batchID int, startDate time.Time, totalChicken int, from, to time.Time) (float64, error) {
+	// Population changes keyed by date, birds removed on that day
+	removals := make(map[string]int)
+
+	rows, err := db.QueryContext(ctx, "SELECT Date, BirdsLoss FROM cm_mortality WHERE BatchID = ?", batchID)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var date string
+		var loss int
+		if err := rows.Scan(&date, &loss); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		removals[date[:10]] += loss
+	}
+	rows.Close()
+
+	harvestQuery := `
+		SELECT h.HarvestDate, COALESCE(SUM(hp.QuantityHarvested), 0)
+		FROM cm_harvest h
+		JOIN cm_harvest_products hp ON hp.HarvestID = h.HarvestID
+		WHERE h.BatchID = ? AND hp.ProductType IN ('Live', 'Dressed')
+		GROUP BY h.HarvestID, h.HarvestDate`
+	rows, err = db.QueryContext(ctx, harvestQuery, batchID)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var date string
+		var qty int
+		if err := rows.Scan(&date, &qty); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		removals[date[:10]] += qty
+	}
+	rows.Close()
+
+	population := totalChicken
+	var birdDays float64
+	for day := startDate; !day.After(to); day = day.AddDate(0, 0, 1) {
+		population -= removals[day.Format("2006-01-02")]
+		if population <= 0 {
+			break
+		}
+		if !day.Before(from) {
+			birdDays += float64(population)
+		}
+	}
+	return birdDays, nil
+}
+
+// activeBatchesInPeriod returns every batch that had birds on the farm at some point
+// in [from, to]. Closed batches are left out: their report is final.
+func activeBatchesInPeriod(ctx context.Context, from, to time.Time) ([]allocationBatch, error) {
+	query := `
+		SELECT b.BatchID, b.BatchName, b.StartDate, b.TotalChicken
+		FROM cm_batches b
+		WHERE b.StartDate <= ? AND b.Status NOT IN ('Planned', 'Cancelled', 'Closed')
+		AND (
+			b.CurrentChicken > 0
+			OR (SELECT MAX(h.HarvestDate) FROM cm_harvest h WHERE h.BatchID = b.BatchID) >= ?
+		)
+		ORDER BY b.StartDate ASC`
+	rows, err := db.QueryContext(ctx, query, to.Format("2006-01-02"), from.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+
+	type batchRow struct {
+		ID, Total int
+		Name      string
+		Start     string
+	}
+	var list []batchRow
+	for rows.Next() {
+		var b batchRow
+		if err := rows.Scan(&b.ID, &b.Name, &b.Start, &b.Total); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		list = append(list, b)
+	}
+	rows.Close()
+
+	var batches []allocationBatch
+	for _, b := range list {
+		start, err := time.Parse("2006-01-02", b.Start)
+		if err != nil {
+			return nil, err
+		}
+		birdDays, err := batchBirdDays(ctx, b.ID, start, b.Total, from, to)
+		if err != nil {
+			return nil, err
+		}
+		if birdDays == 0 {
+			continue
+		}
+		batches = append(batches, allocationBatch{ID: b.ID, Name: b.Name, HeadCount: b.Total, BirdDays: birdDays})
+	}
+	return batches, nil
+}
+
+// allocationRuleMethods loads the configured method per cost type; "*" is the fallback
+func allocationRuleMethods(ctx context.Context) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT CostType, Method FROM cm_overhead_allocation_rules")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	methods := make(map[string]string)
+	for rows.Next() {
+		var costType, method string
+		if err := rows.Scan(&costType, &method); err != nil {
+			return nil, err
+		}
+		methods[costType] = method
+	}
+	return methods, rows.Err()
+}
+
+// splitOverhead distributes amount across batches by the method's basis, rounding to
+// cents and giving any rounding remainder to the last batch so the total is exact.
+func splitOverhead(overhead FarmOverhead, method string, batches []allocationBatch) []OverheadAllocation {
+	var totalBasis float64
+	basis := make([]float64, len(batches))
+	for i, b := range batches {
+		switch method {
+		case "head_count":
+			basis[i] = float64(b.HeadCount)
+		case "equal":
+			basis[i] = 1
+		default:
+			basis[i] = b.BirdDays
+		}
+		totalBasis += basis[i]
+	}
+	if totalBasis == 0 {
+		return nil
+	}
+
+	var allocations []OverheadAllocation
+	var allocated float64
+	for i, b := range batches {
+		amount := math.Round(overhead.Amount*basis[i]/totalBasis*100) / 100
+		if i == len(batches)-1 {
+			amount = math.Round((overhead.Amount-allocated)*100) / 100
+		}
+		allocated += amount
+		allocations = append(allocations, OverheadAllocation{
+			OverheadID: overhead.OverheadID,
+			CostType:   overhead.CostType,
+			BatchID:    b.ID,
+			BatchName:  b.Name,
+			Method:     method,
+			Basis:      basis[i],
+			Amount:     amount,
+		})
+	}
+	return allocations
+}
+
+// POST /api/overheads/allocations distributes unallocated overheads in the period
+// across the batches active in that period. DryRun returns the preview only.
+func runOverheadAllocation(w http.ResponseWriter, r *http.Request) {
+	var payload AllocationRunPayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	from, err := time.Parse("2006-01-02", payload.From)
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid From date, expected YYYY-MM-DD", err)
+		return
+	}
+	to, err := time.Parse("2006-01-02", payload.To)
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid To date, expected YYYY-MM-DD", err)
+		return
+	}
+	if to.Before(from) {
+		handleError(w, http.StatusBadRequest, "To date must not be before From date", nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 3*defaultQueryTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+
+	// The overhead rows stay locked until commit, so a concurrent run waits and then
+	// finds them already allocated instead of posting them a second time
+	overheadQuery := `
+		SELECT o.OverheadID, o.Date, o.CostType, o.Description, o.Amount
+		FROM cm_farm_overheads o
+		WHERE o.IsActive = 1 AND o.Date BETWEEN ? AND ?
+		AND NOT EXISTS (
+			SELECT 1 FROM cm_overhead_allocations a
+			JOIN cm_overhead_allocation_runs ar ON a.RunID = ar.RunID
+			WHERE a.OverheadID = o.OverheadID AND ar.Status = 'Posted'
+		)
+		ORDER BY o.Date ASC`
+	if !payload.DryRun {
+		overheadQuery += " FOR UPDATE"
+	}
+	rows, err := tx.QueryContext(ctx, overheadQuery, payload.From, payload.To)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch unallocated overheads", err)
+		return
+	}
+	var overheads []FarmOverhead
+	for rows.Next() {
+		var o FarmOverhead
+		if err := rows.Scan(&o.OverheadID, &o.Date, &o.CostType, &o.Description, &o.Amount); err != nil {
+			rows.Close()
+			handleError(w, http.StatusInternalServerError, "Failed to scan overhead", err)
+			return
+		}
+		overheads = append(overheads, o)
+	}
+	rows.Close()
+
+	if len(overheads) == 0 {
+		handleError(w, http.StatusBadRequest, "No unallocated overheads in this period", nil)
+		return
+	}
+
+	batches, err := activeBatchesInPeriod(ctx, from, to)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to determine active batches", err)
+		return
+	}
+	if len(batches) == 0 {
+		handleError(w, http.StatusBadRequest, "No batches were active in this period", nil)
+		return
+	}
+
+	methods, err := allocationRuleMethods(ctx)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to load allocation rules", err)
+		return
+	}
+
+	allocations := []OverheadAllocation{}
+	var total float64
+	for _, o := range overheads {
+		method, ok := methods[o.CostType]
+		if !ok {
+			if method, ok = methods["*"]; !ok {
+				method = defaultAllocationMethod
+			}
+		}
+		for _, a := range splitOverhead(o, method, batches) {
+			allocations = append(allocations, a)
+			total += a.Amount
+		}
+	}
+	total = math.Round(total*100) / 100
+
+	if payload.DryRun {
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"success":        true,
+			"dryRun":         true,
+			"totalAllocated": total,
+			"allocations":    allocations,
+		})
+		return
+	}
+
+	res, err := tx.ExecContext(ctx, "INSERT INTO cm_overhead_allocation_runs (PeriodFrom, PeriodTo, TotalAllocated) VALUES (?, ?, ?)", payload.From, payload.To, total)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to create allocation run", err)
+		return
+	}
+	runID, _ := res.LastInsertId()
+
+	insertQuery := "INSERT INTO cm_overhead_allocations (RunID, OverheadID, BatchID, Method, Basis, Amount) VALUES (?, ?, ?, ?, ?, ?)"
+	for _, a := range allocations {
+		if _, err := tx.ExecContext(ctx, insertQuery, runID, a.OverheadID, a.BatchID, a.Method, a.Basis, a.Amount); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to insert allocation", err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to commit transaction", err)
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"success":        true,
+		"runId":          runID,
+		"totalAllocated": total,
+		"allocations":    allocations,
+	})
+}
+
+func getAllocationRuns(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT RunID, PeriodFrom, PeriodTo, TotalAllocated, Status, CreatedAt FROM cm_overhead_allocation_runs ORDER BY RunID DESC")
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch allocation runs", err)
+		return
+	}
+	defer rows.Close()
+
+	runs := []AllocationRun{}
+	for rows.Next() {
+		var run AllocationRun
+		if err := rows.Scan(&run.RunID, &run.PeriodFrom, &run.PeriodTo, &run.TotalAllocated, &run.Status, &run.CreatedAt); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan allocation run", err)
+			return
+		}
+		runs = append(runs, run)
+	}
+	respondJSON(w, http.StatusOK, runs)
+}
+
+func getAllocationRunDetails(w http.ResponseWriter, r *http.Request) {
+	runID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid run ID", err)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	var run AllocationRun
+	err = db.QueryRowContext(ctx, "SELECT RunID, PeriodFrom, PeriodTo, TotalAllocated, Status, CreatedAt FROM cm_overhead_allocation_runs WHERE RunID = ?", runID).
+		Scan(&run.RunID, &run.PeriodFrom, &run.PeriodTo, &run.TotalAllocated, &run.Status, &run.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		handleError(w, http.StatusNotFound, "Allocation run not found", nil)
+		return
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch allocation run", err)
+		return
+	}
+
+	query := `
+		SELECT a.OverheadID, o.CostType, a.BatchID, b.BatchName, a.Method, a.Basis, a.Amount
+		FROM cm_overhead_allocations a
+		JOIN cm_farm_overheads o ON a.OverheadID = o.OverheadID
+		JOIN cm_batches b ON a.BatchID = b.BatchID
+		WHERE a.RunID = ?
+		ORDER BY a.OverheadID, a.BatchID`
+	rows, err := db.QueryContext(ctx, query, runID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch allocations", err)
+		return
+	}
+	defer rows.Close()
+
+	allocations := []OverheadAllocation{}
+	for rows.Next() {
+		var a OverheadAllocation
+		if err := rows.Scan(&a.OverheadID, &a.CostType, &a.BatchID, &a.BatchName, &a.Method, &a.Basis, &a.Amount); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan allocation", err)
+			return
+		}
+		allocations = append(allocations, a)
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"run": run, "allocations": allocations})
+}
+
+// DELETE /api/overheads/allocations/{id} reverses a run so its overheads can be allocated again
+func reverseAllocationRun(w http.ResponseWriter, r *http.Request) {
+	runID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid run ID", err)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRowContext(ctx, "SELECT Status FROM cm_overhead_allocation_runs WHERE RunID = ? FOR UPDATE", runID).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && status != "Posted") {
+		handleError(w, http.StatusNotFound, "Posted allocation run not found", nil)
+		return
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch allocation run", err)
+		return
+	}
+
+	// reversing would change the costs of batches whose report is already final
+	var closed []string
+	rows, err := tx.QueryContext(ctx, `
+		SELECT DISTINCT b.BatchName
+		FROM cm_overhead_allocations a
+		JOIN cm_batches b ON b.BatchID = a.BatchID
+		WHERE a.RunID = ? AND b.Status = ?
+		ORDER BY b.BatchName`, runID, BatchClosed)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to check allocated batches", err)
+		return
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			handleError(w, http.StatusInternalServerError, "Failed to check allocated batches", err)
+			return
+		}
+		closed = append(closed, name)
+	}
+	rows.Close()
+	if len(closed) > 0 {
+		handleError(w, http.StatusConflict, "Run allocated to batches that have since closed: "+strings.Join(closed, ", "), nil)
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE cm_overhead_allocation_runs SET Status = 'Reversed' WHERE RunID = ?", runID); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to reverse allocation run", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to commit transaction", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// batchAllocatedOverhead sums the overhead posted to a batch by allocation runs
+func batchAllocatedOverhead(ctx context.Context, q queryer, batchID string) float64 {
+	var amount float64
+	query := `
+		SELECT COALESCE(SUM(a.Amount), 0)
+		FROM cm_overhead_allocations a
+		JOIN cm_overhead_allocation_runs ar ON a.RunID = ar.RunID
+		WHERE a.BatchID = ? AND ar.Status = 'Posted'`
+	q.QueryRowContext(ctx, query, batchID).Scan(&amount)
+	return amount
+}
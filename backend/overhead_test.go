@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSplitOverhead(t *testing.T) {
+	batches := []allocationBatch{
+		{ID: 1, Name: "A", HeadCount: 1000, BirdDays: 30000},
+		{ID: 2, Name: "B", HeadCount: 500, BirdDays: 5000},
+		{ID: 3, Name: "C", HeadCount: 1500, BirdDays: 0},
+	}
+	cases := []struct {
+		method string
+		amount float64
+		want   []float64
+	}{
+		{"bird_days", 700, []float64{600, 100, 0}},
+		{"head_count", 300, []float64{100, 50, 150}},
+		{"equal", 100, []float64{33.33, 33.33, 33.34}},
+		{"equal", 0.02, []float64{0.01, 0.01, 0}},
+	}
+	for _, tc := range cases {
+		got := splitOverhead(FarmOverhead{OverheadID: 7, CostType: "Electricity", Amount: tc.amount}, tc.method, batches)
+		if len(got) != len(tc.want) {
+			t.Fatalf("%s %.2f: %d allocations, want %d", tc.method, tc.amount, len(got), len(tc.want))
+		}
+		var total float64
+		for i, a := range got {
+			if a.Amount != tc.want[i] || a.BatchID != batches[i].ID || a.Method != tc.method || a.OverheadID != 7 {
+				t.Errorf("%s %.2f: allocation %d = %+v, want %.2f to batch %d", tc.method, tc.amount, i, a, tc.want[i], batches[i].ID)
+			}
+			total += a.Amount
+		}
+		if math.Abs(total-tc.amount) > 1e-9 {
+			t.Errorf("%s %.2f: allocations add up to %v", tc.method, tc.amount, total)
+		}
+	}
+
+	if got := splitOverhead(FarmOverhead{Amount: 100}, "bird_days", []allocationBatch{{ID: 1}}); got != nil {
+		t.Fatalf("no basis should allocate nothing, got %+v", got)
+	}
+	if got := splitOverhead(FarmOverhead{Amount: 100}, "equal", nil); got != nil {
+		t.Fatalf("no batches should allocate nothing, got %+v", got)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/* ===========================
+    Live Event Stream (browser)
+=========================== */
+
+// LiveEvent is what browsers receive on /api/ws/live. Topic is "cage:<num>",
+// "gateway:<id>" or "farm" for events not tied to either.
+type LiveEvent struct {
+	Type  string      `json:"type"` // reading, gateway, command, alert
+	Topic string      `json:"topic"`
+	At    time.Time   `json:"at"`
+	Data  interface{} `json:"data"`
+}
+
+// Messages browsers may send to change what they receive
+type liveClientMessage struct {
+	Action string   `json:"action"` // subscribe, unsubscribe
+	Topics []string `json:"topics"`
+}
+
+type liveClient struct {
+	conn   *websocket.Conn
+	send   chan []byte
+	mu     sync.Mutex
+	topics map[string]bool // liveTopicAll for everything, empty for nothing
+}
+
+// liveTopicAll subscribes a browser to every topic. It has to be asked for explicitly;
+// a client that unsubscribes from its last topic stops receiving events.
+const liveTopicAll = "*"
+
+const (
+	liveSendBuffer   = 64
+	liveWriteTimeout = 10 * time.Second
+	livePongTimeout  = 60 * time.Second
+	livePingInterval = 25 * time.Second
+)
+
+var (
+	liveMu      sync.RWMutex
+	liveClients = make(map[*liveClient]bool)
+)
+
+func cageTopic(cageNum int) string  { return "cage:" + strconv.Itoa(cageNum) }
+func gatewayTopic(id string) string { return "gateway:" + id }
+
+func (c *liveClient) wants(topic string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.topics[liveTopicAll] || c.topics[topic]
+}
+
+// checkLiveOrigin admits browser pages served from FRONTEND_ORIGIN (comma separated,
+// e.g. http://localhost:5173), or from the API's own host when it is not set.
+// Clients that send no Origin are not browsers and are let through.
+func checkLiveOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if allowed := os.Getenv("FRONTEND_ORIGIN"); allowed != "" {
+		for _, o := range strings.Split(allowed, ",") {
+			if strings.EqualFold(strings.TrimRight(strings.TrimSpace(o), "/"), origin) {
+				return true
+			}
+		}
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// publishLive fans an event out to every subscribed browser. A client whose buffer
+// is full is too slow to keep up and gets disconnected rather than blocking ingest.
+func publishLive(eventType, topic string, data interface{}) {
+	msg, err := json.Marshal(LiveEvent{Type: eventType, Topic: topic, At: time.Now(), Data: data})
+	if err != nil {
+		log.Printf("[ERROR] Failed to encode live event: %v", err)
+		return
+	}
+
+	liveMu.RLock()
+	var slow []*liveClient
+	for c := range liveClients {
+		if !c.wants(topic) {
+			continue
+		}
+		select {
+		case c.send <- msg:
+		default:
+			slow = append(slow, c)
+		}
+	}
+	liveMu.RUnlock()
+
+	for _, c := range slow {
+		removeLiveClient(c)
+	}
+}
+
+func removeLiveClient(c *liveClient) {
+	liveMu.Lock()
+	if liveClients[c] {
+		delete(liveClients, c)
+		close(c.send)
+	}
+	liveMu.Unlock()
+}
+
+// handleLiveWS upgrades a browser connection at /api/ws/live?topics=cage:1,gateway:gw-1
+// (or ?topics=* for everything)
+func handleLiveWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("upgrade:", err)
+		return
+	}
+
+	c := &liveClient{conn: conn, send: make(chan []byte, liveSendBuffer), topics: map[string]bool{}}
+	for _, t := range strings.Split(r.URL.Query().Get("topics"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			c.topics[t] = true
+		}
+	}
+
+	liveMu.Lock()
+	liveClients[c] = true
+	liveMu.Unlock()
+
+	go c.writePump()
+	c.readPump()
+}
+
+// readPump handles subscribe/unsubscribe messages and notices when the browser goes away
+func (c *liveClient) readPump() {
+	defer func() {
+		removeLiveClient(c)
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(4096)
+	c.conn.SetReadDeadline(time.Now().Add(livePongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(livePongTimeout))
+	})
+
+	for {
+		var msg liveClientMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		c.mu.Lock()
+		for _, t := range msg.Topics {
+			switch msg.Action {
+			case "subscribe":
+				c.topics[t] = true
+			case "unsubscribe":
+				delete(c.topics, t)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// writePump is the only goroutine writing to the connection
+func (c *liveClient) writePump() {
+	ping := time.NewTicker(livePingInterval)
+	defer func() {
+		ping.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-ping.C:
+			c.conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
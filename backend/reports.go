@@ -0,0 +1,599 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ===========================
+    Models for Reports
+=========================== */
+
+// for comparing several batches side by side in the reports tab
+type BatchComparisonEntry struct {
+	BatchID              int                  `json:"batchId"`
+	BatchName            string               `json:"batchName"`
+	StartDate            string               `json:"startDate"`
+	Status               string               `json:"status"`
+	DurationDays         int                  `json:"durationDays"`
+	ExecutiveSummary     ExecutiveSummary     `json:"executiveSummary"`
+	OperationalAnalytics OperationalAnalytics `json:"operationalAnalytics"`
+	// Difference from the farm average, keyed by metric name
+	Deltas map[string]float64 `json:"deltas"`
+}
+
+type MetricExtreme struct {
+	BatchID   int     `json:"batchId"`
+	BatchName string  `json:"batchName"`
+	Value     float64 `json:"value"`
+}
+
+type MetricComparison struct {
+	Metric           string         `json:"metric"`
+	HigherIsBetter   bool           `json:"higherIsBetter"`
+	FarmAverage      float64        `json:"farmAverage"`
+	SelectionAverage float64        `json:"selectionAverage"`
+	Best             *MetricExtreme `json:"best"`
+	Worst            *MetricExtreme `json:"worst"`
+}
+
+type BatchComparisonReport struct {
+	Batches []BatchComparisonEntry `json:"batches"`
+	Metrics []MetricComparison     `json:"metrics"`
+	// Number of completed batches the farm averages were computed from; only batches
+	// started within REPORT_BENCHMARK_MONTHS are included
+	FarmBatchCount int `json:"farmBatchCount"`
+}
+
+// comparisonMetric describes one number pulled out of a batch report for comparison
+type comparisonMetric struct {
+	Name           string
+	HigherIsBetter bool
+	Value          func(BatchReportData) float64
+}
+
+var comparisonMetrics = []comparisonMetric{
+	{"netProfit", true, func(r BatchReportData) float64 { return r.ExecutiveSummary.NetProfit }},
+	{"roi", true, func(r BatchReportData) float64 { return r.ExecutiveSummary.ROI }},
+	{"feedConversionRatio", false, func(r BatchReportData) float64 { return r.ExecutiveSummary.FeedConversionRatio }},
+	{"harvestRecovery", true, func(r BatchReportData) float64 { return r.ExecutiveSummary.HarvestRecovery }},
+	{"costPerKg", false, func(r BatchReportData) float64 { return r.ExecutiveSummary.CostPerKg }},
+	{"mortalityRate", false, func(r BatchReportData) float64 { return r.OperationalAnalytics.MortalityRate }},
+	{"averageHarvestAge", false, func(r BatchReportData) float64 { return float64(r.OperationalAnalytics.AverageHarvestAge) }},
+	{"averageHarvestWeight", true, func(r BatchReportData) float64 { return r.OperationalAnalytics.AverageHarvestWeight }},
+	{"totalFeedConsumed", false, func(r BatchReportData) float64 { return r.OperationalAnalytics.TotalFeedConsumed }},
+	{"totalWeightHarvested", true, func(r BatchReportData) float64 { return r.OperationalAnalytics.TotalWeightHarvested }},
+}
+
+// for the farm-wide profit and loss statement
+type PnLLine struct {
+	Category string  `json:"category"`
+	Amount   float64 `json:"amount"`
+}
+
+type PnLStatement struct {
+	From                  string    `json:"from"`
+	To                    string    `json:"to"`
+	Revenue               float64   `json:"revenue"`
+	CostOfProduction      []PnLLine `json:"costOfProduction"`
+	TotalCostOfProduction float64   `json:"totalCostOfProduction"`
+	GrossProfit           float64   `json:"grossProfit"`
+	GrossMargin           float64   `json:"grossMargin"` // percentage of revenue
+	Overheads             []PnLLine `json:"overheads"`
+	TotalOverheads        float64   `json:"totalOverheads"`
+	NetProfit             float64   `json:"netProfit"`
+	NetMargin             float64   `json:"netMargin"` // percentage of revenue
+}
+
+type PnLChange struct {
+	Amount  float64  `json:"amount"`
+	Percent *float64 `json:"percent"` // nil when the previous period was zero
+}
+
+type PnLComparison struct {
+	Revenue               PnLChange `json:"revenue"`
+	TotalCostOfProduction PnLChange `json:"totalCostOfProduction"`
+	GrossProfit           PnLChange `json:"grossProfit"`
+	TotalOverheads        PnLChange `json:"totalOverheads"`
+	NetProfit             PnLChange `json:"netProfit"`
+}
+
+type PnLReport struct {
+	Period     string        `json:"period"`
+	Current    PnLStatement  `json:"current"`
+	Previous   PnLStatement  `json:"previous"`
+	Comparison PnLComparison `json:"comparison"`
+}
+
+/* ===========================
+    Report Handlers
+=========================== */
+
+// Comparisons are capped so one request cannot fan out over the whole farm history
+const (
+	maxComparedBatches     = 20
+	defaultBenchmarkMonths = 24
+	comparisonDateLayout   = "2006-01-02"
+)
+
+type comparedBatch struct {
+	ID        int
+	Name      string
+	StartDate string
+	Status    string
+	Report    BatchReportData
+}
+
+// comparedBatchQuery aggregates the figures buildBatchReport collects for many batches
+// at once; each derived table is grouped by batch so the whole set costs a single query.
+// Closed batches carry their snapshot, which is reported instead of the live figures.
+const comparedBatchQuery = `
+	SELECT b.BatchID, b.BatchName, b.StartDate, b.Status, COALESCE(b.TotalChicken, 0),
+		COALESCE(m.Loss, 0), COALESCE(hp.Birds, 0), COALESCE(hp.Weight, 0), hp.LastHarvest,
+		COALESCE(fq.Quantity, 0), COALESCE(fc.Cost, 0), COALESCE(s.Revenue, 0),
+		COALESCE(c.Cost, 0), COALESCE(o.Amount, 0), snap.ReportJSON
+	FROM cm_batches b
+	LEFT JOIN cm_batch_report_snapshots snap ON snap.BatchID = b.BatchID AND b.Status = 'Closed'
+	LEFT JOIN (
+		SELECT BatchID, SUM(BirdsLoss) AS Loss FROM cm_mortality GROUP BY BatchID
+	) m ON m.BatchID = b.BatchID
+	LEFT JOIN (
+		SELECT h.BatchID, SUM(p.QuantityHarvested) AS Birds, SUM(p.WeightHarvestedKg) AS Weight, MAX(h.HarvestDate) AS LastHarvest
+		FROM cm_harvest h LEFT JOIN cm_harvest_products p ON p.HarvestID = h.HarvestID
+		GROUP BY h.BatchID
+	) hp ON hp.BatchID = b.BatchID
+	LEFT JOIN (
+		SELECT iu.BatchID, SUM(iu.QuantityUsed) AS Quantity
+		FROM cm_inventory_usage iu JOIN cm_items i ON iu.ItemID = i.ItemID
+		WHERE i.Category = 'Feed'
+		GROUP BY iu.BatchID
+	) fq ON fq.BatchID = b.BatchID
+	LEFT JOIN (
+		SELECT iu.BatchID, SUM(iud.QuantityDrawn / NULLIF(ip.QuantityPurchased, 0) * ip.UnitCost) AS Cost
+		FROM cm_inventory_usage iu
+		JOIN cm_inventory_usage_details iud ON iu.UsageID = iud.UsageID
+		JOIN cm_inventory_purchases ip ON iud.PurchaseID = ip.PurchaseID
+		GROUP BY iu.BatchID
+	) fc ON fc.BatchID = b.BatchID
+	LEFT JOIN (
+		SELECT x.BatchID, SUM(so.TotalAmount) AS Revenue
+		FROM (
+			SELECT DISTINCT h.BatchID, sd.SaleID
+			FROM cm_sales_details sd
+			JOIN cm_harvest_products p ON sd.HarvestProductID = p.HarvestProductID
+			JOIN cm_harvest h ON p.HarvestID = h.HarvestID
+		) x JOIN cm_sales_orders so ON so.SaleID = x.SaleID
+		GROUP BY x.BatchID
+	) s ON s.BatchID = b.BatchID
+	LEFT JOIN (
+		SELECT BatchID, SUM(Amount) AS Cost FROM cm_production_cost WHERE CostType = 'Chick Purchase' GROUP BY BatchID
+	) c ON c.BatchID = b.BatchID
+	LEFT JOIN (
+		SELECT a.BatchID, SUM(a.Amount) AS Amount
+		FROM cm_overhead_allocations a JOIN cm_overhead_allocation_runs ar ON a.RunID = ar.RunID
+		WHERE ar.Status = 'Posted'
+		GROUP BY a.BatchID
+	) o ON o.BatchID = b.BatchID`
+
+// loadComparedBatches runs comparedBatchQuery with the given filter. Closed batches
+// report their snapshot; the rest go through deriveBatchReport like a single batch
+// report does. A limit of 0 returns every matching batch.
+func loadComparedBatches(ctx context.Context, limit int, where string, args ...any) ([]comparedBatch, error) {
+	query := comparedBatchQuery + "\n\tWHERE " + where + "\n\tORDER BY b.StartDate ASC, b.BatchID ASC"
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []comparedBatch
+	live := make(map[int]*batchFigures)
+	for rows.Next() {
+		var b comparedBatch
+		var f batchFigures
+		var snapshot sql.NullString
+		if err := rows.Scan(&b.ID, &b.Name, &b.StartDate, &b.Status, &f.InitialBirds,
+			&f.Mortality, &f.BirdsHarvested, &f.WeightHarvested, &f.LastHarvest,
+			&f.FeedConsumed, &f.FeedCost, &f.Revenue, &f.ChickCost, &f.Overhead, &snapshot); err != nil {
+			return nil, err
+		}
+		if snapshot.Valid {
+			if err := json.Unmarshal([]byte(snapshot.String), &b.Report); err != nil {
+				return nil, fmt.Errorf("batch %d snapshot: %w", b.ID, err)
+			}
+		} else {
+			f.Name, f.StartDate, f.Status = b.Name, b.StartDate, b.Status
+			live[len(list)] = &f
+		}
+		list = append(list, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(live) == 0 {
+		return list, nil
+	}
+
+	// The other direct costs are itemised per type, so they come in a second query
+	placeholders := make([]string, 0, len(live))
+	costArgs := make([]any, 0, len(live))
+	byID := make(map[int]*batchFigures, len(live))
+	for i, f := range live {
+		placeholders = append(placeholders, "?")
+		costArgs = append(costArgs, list[i].ID)
+		byID[list[i].ID] = f
+	}
+	costQuery := `SELECT BatchID, CostType, COALESCE(SUM(Amount), 0) FROM cm_production_cost
+		WHERE CostType != 'Chick Purchase' AND BatchID IN (` + strings.Join(placeholders, ", ") + `)
+		GROUP BY BatchID, CostType`
+	costRows, err := db.QueryContext(ctx, costQuery, costArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer costRows.Close()
+	for costRows.Next() {
+		var batchID int
+		var costType string
+		var amount float64
+		if err := costRows.Scan(&batchID, &costType, &amount); err != nil {
+			return nil, err
+		}
+		f := byID[batchID]
+		f.OtherCosts = append(f.OtherCosts, FinancialBreakdownItem{Category: "- " + costType, Amount: -amount})
+	}
+	if err := costRows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, f := range live {
+		list[i].Report = deriveBatchReport(*f)
+	}
+	return list, nil
+}
+
+// GET /api/reports/batches/compare?ids=1,2,3 or ?from=2025-01-01&to=2025-06-30
+func compareBatchReports(w http.ResponseWriter, r *http.Request) {
+	idsParam := r.URL.Query().Get("ids")
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	var selected []comparedBatch
+	var err error
+	switch {
+	case idsParam != "":
+		parts := strings.Split(idsParam, ",")
+		if len(parts) > maxComparedBatches {
+			handleError(w, http.StatusBadRequest, fmt.Sprintf("At most %d batches can be compared at once", maxComparedBatches), nil)
+			return
+		}
+		placeholders := make([]string, len(parts))
+		args := make([]any, len(parts))
+		for i, part := range parts {
+			id, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil {
+				handleError(w, http.StatusBadRequest, "Invalid batch ID in ids", err)
+				return
+			}
+			placeholders[i] = "?"
+			args[i] = id
+		}
+		selected, err = loadComparedBatches(ctx, 0, "b.BatchID IN ("+strings.Join(placeholders, ", ")+")", args...)
+	case from != "" && to != "":
+		if _, err := time.Parse(comparisonDateLayout, from); err != nil {
+			handleError(w, http.StatusBadRequest, "Invalid from date, expected YYYY-MM-DD", err)
+			return
+		}
+		if _, err := time.Parse(comparisonDateLayout, to); err != nil {
+			handleError(w, http.StatusBadRequest, "Invalid to date, expected YYYY-MM-DD", err)
+			return
+		}
+		// One extra row tells us the range holds more batches than we compare
+		selected, err = loadComparedBatches(ctx, maxComparedBatches+1, "b.StartDate BETWEEN ? AND ?", from, to)
+		if err == nil && len(selected) > maxComparedBatches {
+			handleError(w, http.StatusBadRequest, fmt.Sprintf("More than %d batches started in that range, narrow it or pass ids", maxComparedBatches), nil)
+			return
+		}
+	default:
+		handleError(w, http.StatusBadRequest, "Provide either ids or a from/to date range", nil)
+		return
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to build batch reports", err)
+		return
+	}
+
+	if len(selected) == 0 {
+		respondJSON(w, http.StatusOK, BatchComparisonReport{Batches: []BatchComparisonEntry{}, Metrics: []MetricComparison{}})
+		return
+	}
+
+	// Farm averages are benchmarked against the batches completed in the recent past
+	months := getEnvInt("REPORT_BENCHMARK_MONTHS", defaultBenchmarkMonths)
+	since := time.Now().AddDate(0, -months, 0).Format(comparisonDateLayout)
+	farm, err := loadComparedBatches(ctx, 0, "b.Status IN ('Sold', 'Closed') AND b.StartDate >= ?", since)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to build farm averages", err)
+		return
+	}
+
+	report := BatchComparisonReport{FarmBatchCount: len(farm)}
+	farmAverages := make(map[string]float64)
+
+	for _, m := range comparisonMetrics {
+		mc := MetricComparison{Metric: m.Name, HigherIsBetter: m.HigherIsBetter}
+
+		if len(farm) > 0 {
+			var sum float64
+			for _, b := range farm {
+				sum += m.Value(b.Report)
+			}
+			mc.FarmAverage = sum / float64(len(farm))
+		}
+
+		var sum float64
+		for _, b := range selected {
+			v := m.Value(b.Report)
+			sum += v
+			if mc.Best == nil || (m.HigherIsBetter && v > mc.Best.Value) || (!m.HigherIsBetter && v < mc.Best.Value) {
+				mc.Best = &MetricExtreme{BatchID: b.ID, BatchName: b.Name, Value: v}
+			}
+			if mc.Worst == nil || (m.HigherIsBetter && v < mc.Worst.Value) || (!m.HigherIsBetter && v > mc.Worst.Value) {
+				mc.Worst = &MetricExtreme{BatchID: b.ID, BatchName: b.Name, Value: v}
+			}
+		}
+		mc.SelectionAverage = sum / float64(len(selected))
+
+		// Fall back to the selection when the farm has no completed batches yet
+		if len(farm) > 0 {
+			farmAverages[m.Name] = mc.FarmAverage
+		} else {
+			farmAverages[m.Name] = mc.SelectionAverage
+		}
+		report.Metrics = append(report.Metrics, mc)
+	}
+
+	for _, b := range selected {
+		entry := BatchComparisonEntry{
+			BatchID:              b.ID,
+			BatchName:            b.Name,
+			StartDate:            b.StartDate,
+			Status:               b.Status,
+			DurationDays:         b.Report.DurationDays,
+			ExecutiveSummary:     b.Report.ExecutiveSummary,
+			OperationalAnalytics: b.Report.OperationalAnalytics,
+			Deltas:               make(map[string]float64),
+		}
+		for _, m := range comparisonMetrics {
+			entry.Deltas[m.Name] = m.Value(b.Report) - farmAverages[m.Name]
+		}
+		report.Batches = append(report.Batches, entry)
+	}
+
+	respondJSON(w, http.StatusOK, report)
+}
+
+// periodRange resolves a named period around the anchor date into an inclusive date range.
+// For "custom" the caller supplies from/to directly.
+func periodRange(period string, anchor time.Time) (time.Time, time.Time, error) {
+	switch period {
+	case "month":
+		from := time.Date(anchor.Year(), anchor.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return from, from.AddDate(0, 1, -1), nil
+	case "quarter":
+		firstMonth := time.Month((int(anchor.Month())-1)/3*3 + 1)
+		from := time.Date(anchor.Year(), firstMonth, 1, 0, 0, 0, 0, time.UTC)
+		return from, from.AddDate(0, 3, -1), nil
+	case "year":
+		from := time.Date(anchor.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+		return from, from.AddDate(1, 0, -1), nil
+	default:
+		return time.Time{}, time.Time{}, fmt.Errorf("unknown period %q", period)
+	}
+}
+
+// previousPeriodRange returns the range immediately before [from, to] with the same length.
+// Named periods step back by whole calendar units so month-end dates stay aligned.
+func previousPeriodRange(period string, from, to time.Time) (time.Time, time.Time) {
+	switch period {
+	case "month", "quarter", "year":
+		prevFrom, prevTo, _ := periodRange(period, from.AddDate(0, 0, -1))
+		return prevFrom, prevTo
+	}
+	days := int(to.Sub(from).Hours()/24) + 1
+	prevTo := from.AddDate(0, 0, -1)
+	return prevTo.AddDate(0, 0, -(days - 1)), prevTo
+}
+
+// buildPnLStatement aggregates revenue and costs for every batch in the date range
+func buildPnLStatement(ctx context.Context, from, to time.Time) (PnLStatement, error) {
+	st := PnLStatement{
+		From:             from.Format("2006-01-02"),
+		To:               to.Format("2006-01-02"),
+		CostOfProduction: []PnLLine{},
+		Overheads:        []PnLLine{},
+	}
+
+	revenueQuery := `SELECT COALESCE(SUM(TotalAmount), 0) FROM cm_sales_orders WHERE DATE(SaleDate) BETWEEN ? AND ? AND IsActive = 1`
+	if err := db.QueryRowContext(ctx, revenueQuery, st.From, st.To).Scan(&st.Revenue); err != nil {
+		return st, err
+	}
+
+	// Inventory consumed in the period (feed, medicine, vitamins), valued at purchase cost
+	usageQuery := `
+		SELECT i.Category, COALESCE(SUM(iud.QuantityDrawn / NULLIF(ip.QuantityPurchased, 0) * ip.UnitCost), 0)
+		FROM cm_inventory_usage iu
+		JOIN cm_items i ON iu.ItemID = i.ItemID
+		JOIN cm_inventory_usage_details iud ON iu.UsageID = iud.UsageID
+		JOIN cm_inventory_purchases ip ON iud.PurchaseID = ip.PurchaseID
+		WHERE DATE(iu.Date) BETWEEN ? AND ?
+		GROUP BY i.Category
+		ORDER BY i.Category`
+	rows, err := db.QueryContext(ctx, usageQuery, st.From, st.To)
+	if err != nil {
+		return st, err
+	}
+	for rows.Next() {
+		var line PnLLine
+		var category string
+		if err := rows.Scan(&category, &line.Amount); err != nil {
+			rows.Close()
+			return st, err
+		}
+		line.Category = category + " Consumed"
+		st.CostOfProduction = append(st.CostOfProduction, line)
+		st.TotalCostOfProduction += line.Amount
+	}
+	rows.Close()
+
+	// Direct batch costs such as chick purchases, grouped by cost type
+	costQuery := `
+		SELECT CostType, COALESCE(SUM(Amount), 0)
+		FROM cm_production_cost
+		WHERE DATE(Date) BETWEEN ? AND ?
+		GROUP BY CostType
+		ORDER BY CostType`
+	rows, err = db.QueryContext(ctx, costQuery, st.From, st.To)
+	if err != nil {
+		return st, err
+	}
+	for rows.Next() {
+		var line PnLLine
+		if err := rows.Scan(&line.Category, &line.Amount); err != nil {
+			rows.Close()
+			return st, err
+		}
+		st.CostOfProduction = append(st.CostOfProduction, line)
+		st.TotalCostOfProduction += line.Amount
+	}
+	rows.Close()
+
+	// Farm-level overheads are reported below gross profit. Allocations to batches are
+	// not added here again, they only redistribute these same entries.
+	overheadQuery := `
+		SELECT CostType, COALESCE(SUM(Amount), 0)
+		FROM cm_farm_overheads
+		WHERE IsActive = 1 AND Date BETWEEN ? AND ?
+		GROUP BY CostType
+		ORDER BY CostType`
+	rows, err = db.QueryContext(ctx, overheadQuery, st.From, st.To)
+	if err != nil {
+		return st, err
+	}
+	for rows.Next() {
+		var line PnLLine
+		if err := rows.Scan(&line.Category, &line.Amount); err != nil {
+			rows.Close()
+			return st, err
+		}
+		st.Overheads = append(st.Overheads, line)
+		st.TotalOverheads += line.Amount
+	}
+	rows.Close()
+
+	st.GrossProfit = st.Revenue - st.TotalCostOfProduction
+	st.NetProfit = st.GrossProfit - st.TotalOverheads
+	if st.Revenue > 0 {
+		st.GrossMargin = (st.GrossProfit / st.Revenue) * 100
+		st.NetMargin = (st.NetProfit / st.Revenue) * 100
+	}
+	return st, nil
+}
+
+func pnlChange(current, previous float64) PnLChange {
+	c := PnLChange{Amount: current - previous}
+	if previous != 0 {
+		pct := (current - previous) / absFloat(previous) * 100
+		c.Percent = &pct
+	}
+	return c
+}
+
+func absFloat(v float64) float64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// GET /api/reports/pnl?period=month|quarter|year&date=2025-06-15 or ?period=custom&from=...&to=...
+func getProfitAndLoss(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	period := q.Get("period")
+	if period == "" {
+		period = "month"
+	}
+
+	var from, to time.Time
+	var err error
+	if period == "custom" {
+		from, err = time.Parse("2006-01-02", q.Get("from"))
+		if err != nil {
+			handleError(w, http.StatusBadRequest, "Invalid from date, expected YYYY-MM-DD", err)
+			return
+		}
+		to, err = time.Parse("2006-01-02", q.Get("to"))
+		if err != nil {
+			handleError(w, http.StatusBadRequest, "Invalid to date, expected YYYY-MM-DD", err)
+			return
+		}
+		if to.Before(from) {
+			handleError(w, http.StatusBadRequest, "to date must not be before from date", nil)
+			return
+		}
+	} else {
+		anchor := time.Now()
+		if d := q.Get("date"); d != "" {
+			anchor, err = time.Parse("2006-01-02", d)
+			if err != nil {
+				handleError(w, http.StatusBadRequest, "Invalid date, expected YYYY-MM-DD", err)
+				return
+			}
+		}
+		from, to, err = periodRange(period, anchor)
+		if err != nil {
+			handleError(w, http.StatusBadRequest, "Invalid period. Use month, quarter, year or custom.", err)
+			return
+		}
+	}
+	prevFrom, prevTo := previousPeriodRange(period, from, to)
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	current, err := buildPnLStatement(ctx, from, to)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to build profit and loss statement", err)
+		return
+	}
+	previous, err := buildPnLStatement(ctx, prevFrom, prevTo)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to build previous period statement", err)
+		return
+	}
+
+	report := PnLReport{
+		Period:   period,
+		Current:  current,
+		Previous: previous,
+		Comparison: PnLComparison{
+			Revenue:               pnlChange(current.Revenue, previous.Revenue),
+			TotalCostOfProduction: pnlChange(current.TotalCostOfProduction, previous.TotalCostOfProduction),
+			GrossProfit:           pnlChange(current.GrossProfit, previous.GrossProfit),
+			TotalOverheads:        pnlChange(current.TotalOverheads, previous.TotalOverheads),
+			NetProfit:             pnlChange(current.NetProfit, previous.NetProfit),
+		},
+	}
+	respondJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,759 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+/* ===========================
+    Schema
+=========================== */
+
+// Tables added on top of the original cm_* schema. Every statement must be
+// safe to run on each start, so only CREATE ... IF NOT EXISTS belongs here.
+var schemaStatements = []string{
+	// farm-level overheads that are not tied to a batch
+	`CREATE TABLE IF NOT EXISTS cm_farm_overheads (
+		OverheadID  INT AUTO_INCREMENT PRIMARY KEY,
+		Date        DATE NOT NULL,
+		CostType    VARCHAR(64) NOT NULL,
+		Description VARCHAR(255) NOT NULL DEFAULT '',
+		Amount      DECIMAL(12,2) NOT NULL,
+		IsActive    TINYINT(1) NOT NULL DEFAULT 1,
+		CreatedAt   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_overheads_date (Date)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_overhead_allocation_rules (
+		RuleID   INT AUTO_INCREMENT PRIMARY KEY,
+		CostType VARCHAR(64) NOT NULL,
+		Method   ENUM('bird_days','head_count','equal') NOT NULL DEFAULT 'bird_days',
+		UNIQUE KEY uq_allocation_rule_cost_type (CostType)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_overhead_allocation_runs (
+		RunID          INT AUTO_INCREMENT PRIMARY KEY,
+		PeriodFrom     DATE NOT NULL,
+		PeriodTo       DATE NOT NULL,
+		TotalAllocated DECIMAL(12,2) NOT NULL DEFAULT 0,
+		Status         ENUM('Posted','Reversed') NOT NULL DEFAULT 'Posted',
+		CreatedAt      DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_overhead_allocations (
+		AllocationID INT AUTO_INCREMENT PRIMARY KEY,
+		RunID        INT NOT NULL,
+		OverheadID   INT NOT NULL,
+		BatchID      INT NOT NULL,
+		Method       VARCHAR(16) NOT NULL,
+		Basis        DECIMAL(14,2) NOT NULL,
+		Amount       DECIMAL(12,2) NOT NULL,
+		INDEX idx_allocations_batch (BatchID),
+		INDEX idx_allocations_run (RunID),
+		INDEX idx_allocations_overhead (OverheadID)
+	)`,
+
+	// staff chores and labor tracking
+	`CREATE TABLE IF NOT EXISTS cm_task_templates (
+		TemplateID     INT AUTO_INCREMENT PRIMARY KEY,
+		Title          VARCHAR(128) NOT NULL,
+		TaskType       VARCHAR(32) NOT NULL,
+		BatchID        INT NULL,
+		CageNum        INT NULL,
+		AssignedTo     VARCHAR(64) NULL,
+		DueTime        TIME NULL,
+		EstimatedHours DECIMAL(5,2) NOT NULL DEFAULT 0,
+		StartDate      DATE NOT NULL,
+		IsActive       TINYINT(1) NOT NULL DEFAULT 1
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_tasks (
+		TaskID      INT AUTO_INCREMENT PRIMARY KEY,
+		TemplateID  INT NULL,
+		Title       VARCHAR(128) NOT NULL,
+		TaskType    VARCHAR(32) NOT NULL,
+		BatchID     INT NULL,
+		CageNum     INT NULL,
+		AssignedTo  VARCHAR(64) NULL,
+		DueDate     DATE NOT NULL,
+		DueTime     TIME NULL,
+		Status      ENUM('Pending','Completed','Skipped') NOT NULL DEFAULT 'Pending',
+		CompletedAt DATETIME NULL,
+		CompletedBy VARCHAR(64) NULL,
+		HoursWorked DECIMAL(5,2) NOT NULL DEFAULT 0,
+		Notes       TEXT NULL,
+		CostID      INT NULL,
+		UNIQUE KEY uq_task_template_day (TemplateID, DueDate),
+		INDEX idx_tasks_due (DueDate, Status)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_labor_rates (
+		Username   VARCHAR(64) PRIMARY KEY,
+		HourlyRate DECIMAL(10,2) NOT NULL
+	)`,
+
+	// batch lifecycle
+	`CREATE TABLE IF NOT EXISTS cm_batch_status_history (
+		HistoryID  INT AUTO_INCREMENT PRIMARY KEY,
+		BatchID    INT NOT NULL,
+		FromStatus VARCHAR(16) NULL,
+		ToStatus   VARCHAR(16) NOT NULL,
+		ChangedBy  VARCHAR(64) NOT NULL,
+		ChangedAt  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		Reason     VARCHAR(255) NOT NULL DEFAULT '',
+		INDEX idx_status_history_batch (BatchID)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_batch_report_snapshots (
+		BatchID    INT PRIMARY KEY,
+		ReportJSON LONGTEXT NOT NULL,
+		ClosedBy   VARCHAR(64) NOT NULL,
+		ClosedAt   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+
+	// batch planning
+	`CREATE TABLE IF NOT EXISTS cm_batch_plans (
+		BatchID      INT PRIMARY KEY,
+		CageNum      INT NULL,
+		GrowOutDays  INT NOT NULL,
+		DowntimeDays INT NOT NULL DEFAULT 14,
+		PlannedBy    VARCHAR(64) NOT NULL,
+		CreatedAt    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_batch_plans_cage (CageNum)
+	)`,
+
+	// houses/cages registry and batch placement
+	`CREATE TABLE IF NOT EXISTS cm_cages (
+		CageID      INT AUTO_INCREMENT PRIMARY KEY,
+		CageNum     INT NOT NULL,
+		Name        VARCHAR(64) NOT NULL,
+		House       VARCHAR(64) NOT NULL DEFAULT '',
+		Capacity    INT NOT NULL DEFAULT 0,
+		AreaM2      DECIMAL(8,2) NOT NULL DEFAULT 0,
+		Equipment   TEXT NOT NULL,
+		ControlMode VARCHAR(8) NOT NULL DEFAULT 'auto',
+		Notes       TEXT NULL,
+		IsActive    TINYINT(1) NOT NULL DEFAULT 1,
+		UNIQUE KEY uq_cages_num (CageNum)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_cage_devices (
+		AssignmentID INT AUTO_INCREMENT PRIMARY KEY,
+		CageID       INT NOT NULL,
+		DeviceType   ENUM('sensor','gateway') NOT NULL,
+		DeviceRef    VARCHAR(64) NOT NULL,
+		Label        VARCHAR(64) NOT NULL DEFAULT '',
+		UNIQUE KEY uq_cage_devices_ref (DeviceType, DeviceRef)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_batch_cages (
+		BatchID  INT NOT NULL,
+		CageID   INT NOT NULL,
+		FromDate DATE NOT NULL,
+		ToDate   DATE NULL,
+		Birds    INT NULL,
+		PRIMARY KEY (BatchID, CageID, FromDate),
+		INDEX idx_batch_cages_cage (CageID, FromDate)
+	)`,
+
+	// telemetry rollups of cm_temperature
+	`CREATE TABLE IF NOT EXISTS cm_telemetry_hourly (
+		CageNum     INT NOT NULL,
+		Metric      VARCHAR(32) NOT NULL,
+		BucketStart DATETIME NOT NULL,
+		MinValue    DOUBLE NOT NULL,
+		AvgValue    DOUBLE NOT NULL,
+		MaxValue    DOUBLE NOT NULL,
+		Samples     INT NOT NULL,
+		PRIMARY KEY (CageNum, Metric, BucketStart),
+		INDEX idx_telemetry_hourly_start (BucketStart)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_telemetry_daily (
+		CageNum    INT NOT NULL,
+		Metric     VARCHAR(32) NOT NULL,
+		BucketDate DATE NOT NULL,
+		MinValue   DOUBLE NOT NULL,
+		AvgValue   DOUBLE NOT NULL,
+		MaxValue   DOUBLE NOT NULL,
+		Samples    INT NOT NULL,
+		PRIMARY KEY (CageNum, Metric, BucketDate)
+	)`,
+
+	// environmental alert rules and raised alerts
+	`CREATE TABLE IF NOT EXISTS cm_alert_rules (
+		RuleID         INT AUTO_INCREMENT PRIMARY KEY,
+		Name           VARCHAR(128) NOT NULL,
+		Metric         VARCHAR(32) NOT NULL,
+		CageNum        INT NULL,
+		Severity       VARCHAR(16) NOT NULL DEFAULT 'warning',
+		Bands          TEXT NOT NULL,
+		Hysteresis     DOUBLE NOT NULL DEFAULT 0,
+		MinDurationSec INT NOT NULL DEFAULT 0,
+		IsActive       TINYINT(1) NOT NULL DEFAULT 1
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_alerts (
+		AlertID         BIGINT AUTO_INCREMENT PRIMARY KEY,
+		RuleID          INT NULL,
+		Type            VARCHAR(64) NOT NULL,
+		Severity        VARCHAR(16) NOT NULL,
+		CageNum         INT NULL,
+		BatchID         INT NULL,
+		Source          VARCHAR(160) NULL,
+		Metric          VARCHAR(32) NULL,
+		Value           DOUBLE NULL,
+		Threshold       DOUBLE NULL,
+		Message         VARCHAR(512) NOT NULL,
+		Status          ENUM('Open','Acknowledged','Resolved') NOT NULL DEFAULT 'Open',
+		RaisedAt        DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		AcknowledgedBy  VARCHAR(64) NULL,
+		AcknowledgedAt  DATETIME NULL,
+		ResolvedBy      VARCHAR(64) NULL,
+		ResolvedAt      DATETIME NULL,
+		NotifyClaimedAt DATETIME NULL,
+		INDEX idx_alerts_status (Status, RaisedAt),
+		INDEX idx_alerts_rule_cage (RuleID, CageNum, Status)
+	)`,
+
+	// alert notifications
+	`CREATE TABLE IF NOT EXISTS cm_notification_subscriptions (
+		SubscriptionID   INT AUTO_INCREMENT PRIMARY KEY,
+		Username         VARCHAR(64) NOT NULL,
+		Channel          VARCHAR(16) NOT NULL,
+		Destination      VARCHAR(255) NOT NULL DEFAULT '',
+		AlertTypes       VARCHAR(255) NOT NULL DEFAULT '*',
+		MinSeverity      VARCHAR(16) NOT NULL DEFAULT 'warning',
+		QuietStart       TIME NULL,
+		QuietEnd         TIME NULL,
+		EscalateAfterMin INT NULL,
+		IsActive         TINYINT(1) NOT NULL DEFAULT 1
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_notification_deliveries (
+		DeliveryID     BIGINT AUTO_INCREMENT PRIMARY KEY,
+		AlertID        BIGINT NOT NULL,
+		SubscriptionID INT NOT NULL,
+		Channel        VARCHAR(16) NOT NULL,
+		Destination    VARCHAR(255) NOT NULL,
+		Status         ENUM('Sent','Failed','Deferred') NOT NULL,
+		Error          VARCHAR(512) NULL,
+		CreatedAt      DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_deliveries_alert (AlertID, SubscriptionID)
+	)`,
+
+	// gateway registry, devices, telemetry frames and events
+	`CREATE TABLE IF NOT EXISTS cm_gateways (
+		GatewayID        VARCHAR(64) PRIMARY KEY,
+		Name             VARCHAR(100) NULL,
+		OwnerFarm        VARCHAR(100) NULL,
+		ClaimedAt        DATETIME NULL,
+		ClaimedBy        VARCHAR(100) NULL,
+		Firmware         VARCHAR(50) NULL,
+		TargetFirmware   VARCHAR(32) NULL,
+		LastSeen         DATETIME NULL,
+		PairingCodeHash  CHAR(64) NULL,
+		PairingExpiresAt DATETIME NULL,
+		PairingAttempts  INT NOT NULL DEFAULT 0,
+		Secret           CHAR(64) NULL,
+		HardwareID       VARCHAR(64) NULL,
+		RevokedAt        DATETIME NULL,
+		CreatedAt        DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_gateway_connections (
+		ID             BIGINT AUTO_INCREMENT PRIMARY KEY,
+		GatewayID      VARCHAR(64) NOT NULL,
+		HardwareID     VARCHAR(64) NULL,
+		RemoteAddr     VARCHAR(64) NOT NULL,
+		ConnectedAt    DATETIME NOT NULL,
+		DisconnectedAt DATETIME NULL,
+		Reason         VARCHAR(255) NULL,
+		INDEX idx_gateway_connections_gateway (GatewayID, ConnectedAt)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_gateway_devices (
+		GatewayID VARCHAR(64) NOT NULL,
+		DeviceID  VARCHAR(64) NOT NULL,
+		Kind      VARCHAR(32) NOT NULL DEFAULT '',
+		CageNum   INT NULL,
+		LastSeen  DATETIME NOT NULL,
+		PRIMARY KEY (GatewayID, DeviceID)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_gateway_telemetry (
+		ID         BIGINT AUTO_INCREMENT PRIMARY KEY,
+		GatewayID  VARCHAR(64) NOT NULL,
+		DeviceID   VARCHAR(64) NOT NULL,
+		CageNum    INT NULL,
+		Water1     INT NULL,
+		Water2     INT NULL,
+		Water3     INT NULL,
+		Relay1     TINYINT NULL,
+		Relay2     TINYINT NULL,
+		Relay3     TINYINT NULL,
+		ReceivedAt DATETIME NOT NULL,
+		INDEX idx_gateway_telemetry_device (GatewayID, DeviceID, ReceivedAt),
+		INDEX idx_gateway_telemetry_time (ReceivedAt)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_gateway_events (
+		ID         BIGINT AUTO_INCREMENT PRIMARY KEY,
+		GatewayID  VARCHAR(64) NOT NULL,
+		DeviceID   VARCHAR(64) NOT NULL,
+		Event      VARCHAR(64) NOT NULL,
+		Detail     TEXT NOT NULL,
+		ReceivedAt DATETIME NOT NULL,
+		INDEX idx_gateway_events_gateway (GatewayID, ReceivedAt)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_gateway_commands (
+		CommandID   VARCHAR(32) PRIMARY KEY,
+		GatewayID   VARCHAR(64) NOT NULL,
+		Payload     TEXT NOT NULL,
+		IssuedBy    VARCHAR(100) NOT NULL,
+		Status      VARCHAR(20) NOT NULL DEFAULT 'Pending',
+		Attempts    INT NOT NULL DEFAULT 0,
+		MaxAttempts INT NOT NULL DEFAULT 1,
+		Result      TEXT NULL,
+		Error       VARCHAR(255) NULL,
+		CreatedAt   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		CompletedAt DATETIME NULL,
+		INDEX idx_gateway_commands_gateway (GatewayID, CreatedAt)
+	)`,
+	// automation schedules and their execution log
+	`CREATE TABLE IF NOT EXISTS cm_automation_schedules (
+		ScheduleID INT AUTO_INCREMENT PRIMARY KEY,
+		Name       VARCHAR(100) NOT NULL,
+		Kind       VARCHAR(16) NOT NULL,
+		CageNum    INT NULL,
+		GatewayID  VARCHAR(64) NOT NULL,
+		DeviceID   VARCHAR(64) NOT NULL,
+		Relay      TINYINT NOT NULL,
+		StartTime  TIME NOT NULL,
+		EndTime    TIME NOT NULL,
+		Recurrence VARCHAR(8) NOT NULL,
+		DaysOfWeek TEXT NOT NULL,
+		Dates      TEXT NOT NULL,
+		StartDate  DATE NULL,
+		EndDate    DATE NULL,
+		IsActive   TINYINT(1) NOT NULL DEFAULT 1,
+		CreatedBy  VARCHAR(100) NOT NULL,
+		CreatedAt  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_automation_runs (
+		RunID        BIGINT AUTO_INCREMENT PRIMARY KEY,
+		ScheduleID   INT NOT NULL,
+		Action       VARCHAR(8) NOT NULL,
+		ScheduledFor DATETIME NOT NULL,
+		ExecutedAt   DATETIME NULL,
+		Status       VARCHAR(16) NOT NULL,
+		CommandID    VARCHAR(32) NULL,
+		Detail       VARCHAR(255) NULL,
+		UNIQUE KEY uq_automation_run (ScheduleID, Action, ScheduledFor)
+	)`,
+	// closed-loop control rules and the switches they made
+	`CREATE TABLE IF NOT EXISTS cm_control_rules (
+		RuleID        INT AUTO_INCREMENT PRIMARY KEY,
+		Name          VARCHAR(100) NOT NULL,
+		CageNum       INT NOT NULL,
+		Metric        VARCHAR(32) NOT NULL,
+		Operator      CHAR(1) NOT NULL,
+		OnThreshold   DOUBLE NOT NULL,
+		OffThreshold  DOUBLE NOT NULL,
+		ForSeconds    INT NOT NULL DEFAULT 0,
+		MinOnSeconds  INT NOT NULL DEFAULT 0,
+		MinOffSeconds INT NOT NULL DEFAULT 0,
+		GatewayID     VARCHAR(64) NOT NULL,
+		DeviceID      VARCHAR(64) NOT NULL,
+		Relay         TINYINT NOT NULL,
+		IsActive      TINYINT(1) NOT NULL DEFAULT 1,
+		INDEX idx_control_rules_cage (CageNum, IsActive)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_control_rule_actions (
+		ActionID  BIGINT AUTO_INCREMENT PRIMARY KEY,
+		RuleID    INT NOT NULL,
+		Action    VARCHAR(8) NOT NULL,
+		Value     DOUBLE NOT NULL,
+		At        DATETIME NOT NULL,
+		Status    VARCHAR(16) NOT NULL,
+		CommandID VARCHAR(32) NULL,
+		Detail    VARCHAR(255) NULL,
+		INDEX idx_control_actions_rule (RuleID, ActionID)
+	)`,
+	// direct-IP devices polled and proxied by the backend
+	`CREATE TABLE IF NOT EXISTS cm_devices (
+		DeviceID         INT AUTO_INCREMENT PRIMARY KEY,
+		IPAddress        VARCHAR(64) NOT NULL UNIQUE,
+		DeviceType       VARCHAR(20) NOT NULL,
+		Name             VARCHAR(100) NOT NULL DEFAULT '',
+		CageNum          INT NULL,
+		IsActive         TINYINT(1) NOT NULL DEFAULT 1,
+		GramsPerDispense DECIMAL(8,2) NULL,
+		LastPolledAt     DATETIME NULL,
+		LastError        VARCHAR(255) NULL,
+		CreatedAt        DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+
+	// metered water and feed per batch, cage and day
+	`CREATE TABLE IF NOT EXISTS cm_water_meters (
+		MeterID       INT AUTO_INCREMENT PRIMARY KEY,
+		GatewayID     VARCHAR(64) NOT NULL,
+		DeviceID      VARCHAR(64) NOT NULL,
+		Channel       TINYINT NOT NULL,
+		CageNum       INT NULL,
+		LitersPerUnit DECIMAL(10,4) NOT NULL,
+		MinDropUnits  INT NOT NULL DEFAULT 2,
+		IsActive      TINYINT(1) NOT NULL DEFAULT 1,
+		CreatedAt     DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_water_meters_channel (GatewayID, DeviceID, Channel)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_water_meter_days (
+		MeterID     INT NOT NULL,
+		CageNum     INT NOT NULL,
+		Date        DATE NOT NULL,
+		WaterLiters DECIMAL(12,3) NOT NULL DEFAULT 0,
+		PRIMARY KEY (MeterID, CageNum, Date),
+		INDEX idx_water_meter_days_date (Date)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_batch_consumption (
+		BatchID     INT NOT NULL,
+		CageNum     INT NOT NULL,
+		Date        DATE NOT NULL,
+		WaterLiters DECIMAL(12,3) NOT NULL DEFAULT 0,
+		FeedKg      DECIMAL(12,3) NOT NULL DEFAULT 0,
+		Dispenses   INT NOT NULL DEFAULT 0,
+		UpdatedAt   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		PRIMARY KEY (BatchID, CageNum, Date),
+		INDEX idx_batch_consumption_date (Date)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_feed_usage_drafts (
+		DraftID    INT AUTO_INCREMENT PRIMARY KEY,
+		BatchID    INT NOT NULL,
+		Date       DATE NOT NULL,
+		QuantityKg DECIMAL(12,3) NOT NULL,
+		Status     VARCHAR(12) NOT NULL DEFAULT 'pending',
+		UsageID    INT NULL,
+		ReviewedBy VARCHAR(100) NULL,
+		ReviewedAt DATETIME NULL,
+		CreatedAt  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_feed_usage_drafts_day (BatchID, Date)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_sensors (
+		GatewayID      VARCHAR(64) NOT NULL,
+		DeviceID       VARCHAR(64) NOT NULL,
+		Name           VARCHAR(100) NULL,
+		CageNum        INT NULL,
+		TempOffset     DOUBLE NOT NULL DEFAULT 0,
+		TempScale      DOUBLE NOT NULL DEFAULT 1,
+		HumidityOffset DOUBLE NOT NULL DEFAULT 0,
+		HumidityScale  DOUBLE NOT NULL DEFAULT 1,
+		GasCurve       TEXT NULL,
+		Health         VARCHAR(16) NOT NULL DEFAULT 'ok',
+		HealthDetail   VARCHAR(255) NULL,
+		HealthSince    DATETIME NULL,
+		LastReadingAt  DATETIME NULL,
+		IsActive       TINYINT(1) NOT NULL DEFAULT 1,
+		PRIMARY KEY (GatewayID, DeviceID),
+		INDEX idx_sensors_cage (CageNum),
+		INDEX idx_sensors_health (IsActive, Health, LastReadingAt)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_firmware (
+		FirmwareID INT AUTO_INCREMENT PRIMARY KEY,
+		Version    VARCHAR(32) NOT NULL UNIQUE,
+		Sha256     CHAR(64) NOT NULL,
+		Signature  VARCHAR(128) NULL,
+		SizeBytes  BIGINT NOT NULL,
+		FilePath   VARCHAR(255) NOT NULL,
+		Notes      VARCHAR(255) NULL,
+		UploadedBy VARCHAR(100) NOT NULL,
+		UploadedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		IsActive   TINYINT(1) NOT NULL DEFAULT 1
+	)`,
+	`CREATE TABLE IF NOT EXISTS cm_firmware_rollouts (
+		RolloutID   BIGINT AUTO_INCREMENT PRIMARY KEY,
+		GatewayID   VARCHAR(64) NOT NULL,
+		FirmwareID  INT NOT NULL,
+		Version     VARCHAR(32) NOT NULL,
+		FromVersion VARCHAR(50) NULL,
+		Status      VARCHAR(16) NOT NULL DEFAULT 'Pending',
+		Progress    TINYINT NULL,
+		CommandID   VARCHAR(32) NULL,
+		Detail      VARCHAR(255) NULL,
+		CreatedBy   VARCHAR(100) NOT NULL,
+		CreatedAt   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UpdatedAt   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		FinishedAt  DATETIME NULL,
+		INDEX idx_firmware_rollouts_gateway (GatewayID, Status),
+		INDEX idx_firmware_rollouts_status (Status, UpdatedAt)
+	)`,
+}
+
+// Changes to existing tables that cannot be written as IF NOT EXISTS statements.
+// Each one checks INFORMATION_SCHEMA first so it only runs once.
+var schemaMigrations = []func(ctx context.Context) error{
+	widenBatchStatus,
+	addTemperatureBatchID,
+	addTemperatureTimeIndex,
+	addGatewayCredentials,
+	addAlertSource,
+	addCageControlMode,
+	addDeviceDispenseGrams,
+	widenAlertSource,
+	addTemperatureCalibration,
+	addGatewayTargetFirmware,
+	addAlertNotifyClaim,
+	addWaterMeterMinDrop,
+	addFirmwareSignature,
+	keyDirectHistoryByDeviceID,
+}
+
+// widenBatchStatus turns cm_batches.Status from the original Active/Sold enum into a
+// plain string so the full lifecycle (Planned, Harvesting, Closed, ...) can be stored
+func widenBatchStatus(ctx context.Context) error {
+	var dataType string
+	query := `
+		SELECT DATA_TYPE FROM INFORMATION_SCHEMA.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'cm_batches' AND COLUMN_NAME = 'Status'`
+	if err := db.QueryRowContext(ctx, query).Scan(&dataType); err != nil {
+		return err
+	}
+	if dataType != "enum" {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "ALTER TABLE cm_batches MODIFY Status VARCHAR(16) NOT NULL DEFAULT 'Active'")
+	return err
+}
+
+// addTemperatureBatchID stores which batch was in the cage when a reading arrived
+func addTemperatureBatchID(ctx context.Context) error {
+	var count int
+	query := `
+		SELECT COUNT(*) FROM INFORMATION_SCHEMA.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'cm_temperature' AND COLUMN_NAME = 'BatchID'`
+	if err := db.QueryRowContext(ctx, query).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "ALTER TABLE cm_temperature ADD COLUMN BatchID INT NULL, ADD INDEX idx_temperature_batch (BatchID)")
+	return err
+}
+
+// addTemperatureTimeIndex supports range queries now that cm_temperature keeps full history
+func addTemperatureTimeIndex(ctx context.Context) error {
+	var count int
+	query := `
+		SELECT COUNT(*) FROM INFORMATION_SCHEMA.STATISTICS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'cm_temperature' AND INDEX_NAME = 'idx_temperature_cage_time'`
+	if err := db.QueryRowContext(ctx, query).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "ALTER TABLE cm_temperature ADD INDEX idx_temperature_cage_time (temp_cage_num, created_at)")
+	return err
+}
+
+// addGatewayCredentials adds the per-gateway secret and revocation to registries
+// created before gateways had to authenticate
+func addGatewayCredentials(ctx context.Context) error {
+	var count int
+	query := `
+		SELECT COUNT(*) FROM INFORMATION_SCHEMA.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'cm_gateways' AND COLUMN_NAME = 'Secret'`
+	if err := db.QueryRowContext(ctx, query).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "ALTER TABLE cm_gateways ADD COLUMN Secret CHAR(64) NULL, ADD COLUMN HardwareID VARCHAR(64) NULL, ADD COLUMN RevokedAt DATETIME NULL")
+	return err
+}
+
+// addAlertSource lets gateway and sensor alerts say which device raised them
+func addAlertSource(ctx context.Context) error {
+	var count int
+	query := `
+		SELECT COUNT(*) FROM INFORMATION_SCHEMA.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'cm_alerts' AND COLUMN_NAME = 'Source'`
+	if err := db.QueryRowContext(ctx, query).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "ALTER TABLE cm_alerts ADD COLUMN Source VARCHAR(160) NULL AFTER BatchID")
+	return err
+}
+
+// addCageControlMode adds the manual/auto flag the automation scheduler respects
+func addCageControlMode(ctx context.Context) error {
+	var count int
+	query := `
+		SELECT COUNT(*) FROM INFORMATION_SCHEMA.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'cm_cages' AND COLUMN_NAME = 'ControlMode'`
+	if err := db.QueryRowContext(ctx, query).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "ALTER TABLE cm_cages ADD COLUMN ControlMode VARCHAR(8) NOT NULL DEFAULT 'auto' AFTER Equipment")
+	return err
+}
+
+// addDeviceDispenseGrams lets direct feeders report how much one rotation dispenses
+func addDeviceDispenseGrams(ctx context.Context) error {
+	var count int
+	query := `
+		SELECT COUNT(*) FROM INFORMATION_SCHEMA.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'cm_devices' AND COLUMN_NAME = 'GramsPerDispense'`
+	if err := db.QueryRowContext(ctx, query).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "ALTER TABLE cm_devices ADD COLUMN GramsPerDispense DECIMAL(8,2) NULL AFTER IsActive")
+	return err
+}
+
+// widenAlertSource makes room for sensor sources ("gateway/device")
+func widenAlertSource(ctx context.Context) error {
+	var length int
+	query := `
+		SELECT CHARACTER_MAXIMUM_LENGTH FROM INFORMATION_SCHEMA.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'cm_alerts' AND COLUMN_NAME = 'Source'`
+	if err := db.QueryRowContext(ctx, query).Scan(&length); err != nil {
+		return err
+	}
+	if length >= 160 {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "ALTER TABLE cm_alerts MODIFY Source VARCHAR(160) NULL")
+	return err
+}
+
+// addTemperatureCalibration keeps the raw sensor values next to the calibrated
+// ones, the estimated NH3 ppm, which sensor sent the reading and whether it was
+// faulty at the time
+func addTemperatureCalibration(ctx context.Context) error {
+	var count int
+	query := `
+		SELECT COUNT(*) FROM INFORMATION_SCHEMA.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'cm_temperature' AND COLUMN_NAME = 'SensorID'`
+	if err := db.QueryRowContext(ctx, query).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, `ALTER TABLE cm_temperature
+		ADD COLUMN SensorID VARCHAR(160) NULL,
+		ADD COLUMN RawTemperature DOUBLE NULL,
+		ADD COLUMN RawHumidity DOUBLE NULL,
+		ADD COLUMN GasPpm DOUBLE NULL,
+		ADD COLUMN SensorFault VARCHAR(16) NULL`)
+	return err
+}
+
+// ensureSchema creates any missing tables and applies migrations; called once after initDB
+func ensureSchema() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, stmt := range schemaStatements {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			log.Fatalf("Failed to apply schema: %v\n%s", err, stmt)
+		}
+	}
+	for _, migrate := range schemaMigrations {
+		if err := migrate(ctx); err != nil {
+			log.Fatalf("Failed to migrate schema: %v", err)
+		}
+	}
+	fmt.Println("Schema is up to date.")
+}
+
+// addGatewayTargetFirmware stores the firmware version each gateway should run
+func addGatewayTargetFirmware(ctx context.Context) error {
+	var count int
+	query := `
+		SELECT COUNT(*) FROM INFORMATION_SCHEMA.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'cm_gateways' AND COLUMN_NAME = 'TargetFirmware'`
+	if err := db.QueryRowContext(ctx, query).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "ALTER TABLE cm_gateways ADD COLUMN TargetFirmware VARCHAR(32) NULL AFTER Firmware")
+	return err
+}
+
+// addAlertNotifyClaim lets one notification dispatch at a time claim an alert
+func addAlertNotifyClaim(ctx context.Context) error {
+	var count int
+	query := `
+		SELECT COUNT(*) FROM INFORMATION_SCHEMA.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'cm_alerts' AND COLUMN_NAME = 'NotifyClaimedAt'`
+	if err := db.QueryRowContext(ctx, query).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "ALTER TABLE cm_alerts ADD COLUMN NotifyClaimedAt DATETIME NULL AFTER ResolvedAt")
+	return err
+}
+
+// addWaterMeterMinDrop adds the deadband below which level changes are noise
+func addWaterMeterMinDrop(ctx context.Context) error {
+	var count int
+	query := `
+		SELECT COUNT(*) FROM INFORMATION_SCHEMA.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'cm_water_meters' AND COLUMN_NAME = 'MinDropUnits'`
+	if err := db.QueryRowContext(ctx, query).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "ALTER TABLE cm_water_meters ADD COLUMN MinDropUnits INT NOT NULL DEFAULT 2 AFTER LitersPerUnit")
+	return err
+}
+
+// addFirmwareSignature stores the release signature of each firmware image
+func addFirmwareSignature(ctx context.Context) error {
+	var count int
+	query := `
+		SELECT COUNT(*) FROM INFORMATION_SCHEMA.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'cm_firmware' AND COLUMN_NAME = 'Signature'`
+	if err := db.QueryRowContext(ctx, query).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "ALTER TABLE cm_firmware ADD COLUMN Signature VARCHAR(128) NULL AFTER Sha256")
+	return err
+}
+
+// keyDirectHistoryByDeviceID refiles direct-device history stored under the
+// device IP onto its registry ID, which survives a DHCP address change
+func keyDirectHistoryByDeviceID(ctx context.Context) error {
+	var pending bool
+	query := `
+		SELECT EXISTS (SELECT 1 FROM cm_sensors s JOIN cm_devices d ON s.GatewayID = 'direct' AND s.DeviceID = d.IPAddress)
+			OR EXISTS (SELECT 1 FROM cm_gateway_telemetry t JOIN cm_devices d ON t.GatewayID = 'direct' AND t.DeviceID = d.IPAddress)
+			OR EXISTS (SELECT 1 FROM cm_gateway_events e JOIN cm_devices d ON e.GatewayID = 'direct' AND e.DeviceID = d.IPAddress)`
+	if err := db.QueryRowContext(ctx, query).Scan(&pending); err != nil {
+		return err
+	}
+	if !pending {
+		return nil
+	}
+	updates := []string{
+		"UPDATE cm_sensors s JOIN cm_devices d ON s.GatewayID = 'direct' AND s.DeviceID = d.IPAddress SET s.DeviceID = d.DeviceID",
+		"UPDATE cm_gateway_telemetry t JOIN cm_devices d ON t.GatewayID = 'direct' AND t.DeviceID = d.IPAddress SET t.DeviceID = d.DeviceID",
+		"UPDATE cm_gateway_events e JOIN cm_devices d ON e.GatewayID = 'direct' AND e.DeviceID = d.IPAddress SET e.DeviceID = d.DeviceID",
+		"UPDATE cm_water_meters m JOIN cm_devices d ON m.GatewayID = 'direct' AND m.DeviceID = d.IPAddress SET m.DeviceID = d.DeviceID",
+		"UPDATE cm_temperature t JOIN cm_devices d ON t.SensorID = CONCAT('direct/', d.IPAddress) SET t.SensorID = CONCAT('direct/', d.DeviceID)",
+	}
+	for _, q := range updates {
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
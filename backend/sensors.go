@@ -0,0 +1,559 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+/* ===========================
+    Sensor Calibration & Health
+=========================== */
+
+// Every environment sensor is identified by the gateway it reports through and its
+// device ID. Gateway devices use their own IDs, direct-IP boards are filed under
+// "direct" with their registry ID, and /api/dht22-data posts under "dht22" with the
+// sensor_id they send (or "cage-N"). A sensor is registered on its first reading
+// and can be calibrated afterwards, or configured before it ever reports:
+//
+//	{"TempOffset":-0.8,"TempScale":1,"HumidityOffset":3,"HumidityScale":1,
+//	 "GasCurve":[{"Raw":0,"Ppm":0},{"Raw":200,"Ppm":10},{"Raw":600,"Ppm":50}]}
+//
+// Calibrated temperature and humidity are what cm_temperature, alerts and control
+// rules see; the raw values are kept beside them. GasCurve maps the raw gas value
+// to estimated ppm NH3 (metric "nh3"), interpolating linearly between points.
+//
+// Health: a sensor whose temperature and humidity do not change for
+// SENSOR_STUCK_MINUTES is "stuck", one that reports values outside the DHT22
+// range or jumps by more than SENSOR_MAX_TEMP_JUMP / SENSOR_MAX_HUMIDITY_JUMP
+// is "spike" until it has sent sensorRecoveryReadings clean readings, and one
+// silent for SENSOR_MISSING_MINUTES is "missing" (unless its gateway is offline,
+// which has its own alert). Each problem raises a warning alert that resolves
+// when the sensor recovers, and readings from an unhealthy sensor are stored
+// (flagged in SensorFault) but not fed to control rules.
+const (
+	SensorOK      = "ok"
+	SensorStuck   = "stuck"
+	SensorSpike   = "spike"
+	SensorMissing = "missing"
+
+	dhtSensorGateway        = "dht22"
+	sensorAlertPrefix       = "sensor_"
+	defaultSensorStuckMins  = 30
+	defaultSensorMissing    = 15
+	defaultMaxTempJump      = 5
+	defaultMaxHumidityJump  = 20
+	minStuckReadings        = 5
+	sensorRecoveryReadings  = 10
+	sensorJumpWindow        = 10 * time.Minute
+	sensorMonitorInterval   = time.Minute
+	sensorMinTemperature    = -40.0
+	sensorMaxTemperature    = 80.0
+	maxGasCurvePoints       = 20
+	sensorHealthDetailLimit = 255
+)
+
+type GasCurvePoint struct {
+	Raw float64 `json:"Raw"`
+	Ppm float64 `json:"Ppm"`
+}
+
+type Sensor struct {
+	GatewayID      string          `json:"GatewayID"`
+	DeviceID       string          `json:"DeviceID"`
+	Name           *string         `json:"Name"`
+	CageNum        *int            `json:"CageNum"`
+	TempOffset     float64         `json:"TempOffset"`
+	TempScale      float64         `json:"TempScale"`
+	HumidityOffset float64         `json:"HumidityOffset"`
+	HumidityScale  float64         `json:"HumidityScale"`
+	GasCurve       []GasCurvePoint `json:"GasCurve"`
+	Health         string          `json:"Health"`
+	HealthDetail   *string         `json:"HealthDetail"`
+	HealthSince    *string         `json:"HealthSince"`
+	LastReadingAt  *string         `json:"LastReadingAt"`
+	IsActive       bool            `json:"IsActive"`
+}
+
+type SensorPayload struct {
+	Name           *string         `json:"Name"`
+	CageNum        *int            `json:"CageNum"`
+	TempOffset     float64         `json:"TempOffset"`
+	TempScale      *float64        `json:"TempScale"`
+	HumidityOffset float64         `json:"HumidityOffset"`
+	HumidityScale  *float64        `json:"HumidityScale"`
+	GasCurve       []GasCurvePoint `json:"GasCurve"`
+}
+
+// sensorReading is one reading after calibration
+type sensorReading struct {
+	RawTemperature float64
+	RawHumidity    float64
+	RawGas         float64
+	Temperature    float64
+	Humidity       float64
+	GasPpm         *float64
+}
+
+// sensorTrack is what health detection remembers between readings
+type sensorTrack struct {
+	lastRaw    [2]float64 // temperature, humidity as reported
+	sameSince  time.Time
+	sameCount  int
+	prev       [2]float64 // previous calibrated reading, clean or not
+	lastGood   [2]float64
+	lastGoodAt time.Time
+	cleanRun   int
+}
+
+var (
+	sensorMu     sync.Mutex
+	sensorTracks = make(map[string]*sensorTrack) // sensorKey -> history
+)
+
+func sensorKey(gatewayID, deviceID string) string {
+	return gatewayID + "/" + deviceID
+}
+
+// apply turns a raw reading into a calibrated one
+func (s Sensor) apply(temperature, humidity, gas float64) sensorReading {
+	rd := sensorReading{
+		RawTemperature: temperature,
+		RawHumidity:    humidity,
+		RawGas:         gas,
+		Temperature:    math.Round((temperature*s.TempScale+s.TempOffset)*100) / 100,
+		Humidity:       math.Round((humidity*s.HumidityScale+s.HumidityOffset)*100) / 100,
+	}
+	if len(s.GasCurve) > 0 {
+		ppm := math.Round(gasPpm(s.GasCurve, gas)*100) / 100
+		rd.GasPpm = &ppm
+	}
+	return rd
+}
+
+// gasPpm interpolates the curve; outside it the nearest point applies
+func gasPpm(curve []GasCurvePoint, raw float64) float64 {
+	if raw <= curve[0].Raw {
+		return curve[0].Ppm
+	}
+	for i := 1; i < len(curve); i++ {
+		a, b := curve[i-1], curve[i]
+		if raw > b.Raw {
+			continue
+		}
+		return a.Ppm + (b.Ppm-a.Ppm)*(raw-a.Raw)/(b.Raw-a.Raw)
+	}
+	return curve[len(curve)-1].Ppm
+}
+
+const sensorColumns = `
+	SELECT GatewayID, DeviceID, Name, CageNum, TempOffset, TempScale, HumidityOffset, HumidityScale, GasCurve,
+		Health, HealthDetail, HealthSince, LastReadingAt, IsActive
+	FROM cm_sensors`
+
+func scanSensor(scan func(dest ...interface{}) error) (Sensor, error) {
+	var s Sensor
+	var curve *string
+	err := scan(&s.GatewayID, &s.DeviceID, &s.Name, &s.CageNum, &s.TempOffset, &s.TempScale, &s.HumidityOffset, &s.HumidityScale,
+		&curve, &s.Health, &s.HealthDetail, &s.HealthSince, &s.LastReadingAt, &s.IsActive)
+	if err != nil {
+		return s, err
+	}
+	s.GasCurve = []GasCurvePoint{}
+	if curve != nil && *curve != "" {
+		if err := json.Unmarshal([]byte(*curve), &s.GasCurve); err != nil {
+			return s, fmt.Errorf("sensor %s has an invalid gas curve: %w", sensorKey(s.GatewayID, s.DeviceID), err)
+		}
+	}
+	return s, nil
+}
+
+func loadSensor(ctx context.Context, gatewayID, deviceID string) (Sensor, error) {
+	return scanSensor(db.QueryRowContext(ctx, sensorColumns+" WHERE GatewayID = ? AND DeviceID = ?", gatewayID, deviceID).Scan)
+}
+
+// touchSensor registers the sensor on its first reading, records the reading
+// time and cage, and returns its calibration and health
+func touchSensor(ctx context.Context, gatewayID, deviceID string, cageNum int, at time.Time) (Sensor, error) {
+	query := `
+		INSERT INTO cm_sensors (GatewayID, DeviceID, CageNum, LastReadingAt)
+		VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE CageNum = VALUES(CageNum), LastReadingAt = VALUES(LastReadingAt)`
+	if _, err := db.ExecContext(ctx, query, gatewayID, deviceID, cageNum, at.Format(sqlDateTime)); err != nil {
+		return Sensor{}, err
+	}
+	return loadSensor(ctx, gatewayID, deviceID)
+}
+
+// checkSensorReading runs health detection on a calibrated reading and returns
+// the health the sensor is in afterwards, with a detail for non-ok states
+func checkSensorReading(s Sensor, rd sensorReading, at time.Time) (string, string) {
+	stuckAfter := time.Duration(getEnvInt("SENSOR_STUCK_MINUTES", defaultSensorStuckMins)) * time.Minute
+	maxTempJump := float64(getEnvInt("SENSOR_MAX_TEMP_JUMP", defaultMaxTempJump))
+	maxHumJump := float64(getEnvInt("SENSOR_MAX_HUMIDITY_JUMP", defaultMaxHumidityJump))
+
+	sensorMu.Lock()
+	defer sensorMu.Unlock()
+	key := sensorKey(s.GatewayID, s.DeviceID)
+	h, ok := sensorTracks[key]
+	if !ok {
+		h = &sensorTrack{sameSince: at}
+		// a restart should not forget a spike that is still being sat out
+		if s.Health != SensorSpike {
+			h.cleanRun = sensorRecoveryReadings
+		}
+		sensorTracks[key] = h
+	}
+	current := [2]float64{rd.Temperature, rd.Humidity}
+	raw := [2]float64{rd.RawTemperature, rd.RawHumidity}
+	defer func() { h.prev = current }()
+
+	// out of range, or a jump away from both the last clean reading and the
+	// previous one (a real step change is confirmed by the reading after it)
+	spike := ""
+	switch {
+	case rd.Temperature < sensorMinTemperature || rd.Temperature > sensorMaxTemperature:
+		spike = fmt.Sprintf("temperature %.1f is outside %.0f..%.0f", rd.Temperature, sensorMinTemperature, sensorMaxTemperature)
+	case rd.Humidity < 0 || rd.Humidity > 100:
+		spike = fmt.Sprintf("humidity %.1f is outside 0..100", rd.Humidity)
+	case rd.RawGas < 0:
+		spike = fmt.Sprintf("gas value %.1f is negative", rd.RawGas)
+	case !h.lastGoodAt.IsZero() && at.Sub(h.lastGoodAt) <= sensorJumpWindow:
+		if math.Abs(rd.Temperature-h.lastGood[0]) > maxTempJump && math.Abs(rd.Temperature-h.prev[0]) > maxTempJump {
+			spike = fmt.Sprintf("temperature jumped from %.1f to %.1f", h.lastGood[0], rd.Temperature)
+		} else if math.Abs(rd.Humidity-h.lastGood[1]) > maxHumJump && math.Abs(rd.Humidity-h.prev[1]) > maxHumJump {
+			spike = fmt.Sprintf("humidity jumped from %.1f to %.1f", h.lastGood[1], rd.Humidity)
+		}
+	}
+	if spike != "" {
+		h.cleanRun = 0
+		return SensorSpike, spike
+	}
+	h.lastGood, h.lastGoodAt = current, at
+
+	if ok && raw == h.lastRaw {
+		h.sameCount++
+	} else {
+		h.lastRaw, h.sameSince, h.sameCount = raw, at, 1
+	}
+	if h.sameCount >= minStuckReadings && at.Sub(h.sameSince) >= stuckAfter {
+		return SensorStuck, fmt.Sprintf("temperature %.1f and humidity %.1f unchanged since %s",
+			rd.RawTemperature, rd.RawHumidity, h.sameSince.Format(sqlDateTime))
+	}
+
+	if h.cleanRun < sensorRecoveryReadings {
+		h.cleanRun++
+		if h.cleanRun < sensorRecoveryReadings {
+			return SensorSpike, fmt.Sprintf("recovering, %d of %d clean readings", h.cleanRun, sensorRecoveryReadings)
+		}
+	}
+	return SensorOK, ""
+}
+
+func openSensorAlert(ctx context.Context, key string) (int64, error) {
+	var alertID int64
+	query := "SELECT AlertID FROM cm_alerts WHERE Type LIKE 'sensor\\_%' AND Source = ? AND Status <> 'Resolved' ORDER BY AlertID DESC LIMIT 1"
+	err := db.QueryRowContext(ctx, query, key).Scan(&alertID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return alertID, err
+}
+
+// setSensorHealth stores a health change and swaps the sensor's alert: the old
+// problem's alert is resolved and a new one raised unless the sensor is ok again.
+// A detail change within the same state is only stored.
+func setSensorHealth(ctx context.Context, s Sensor, health, detail string) error {
+	if len(detail) > sensorHealthDetailLimit {
+		detail = detail[:sensorHealthDetailLimit]
+	}
+	if health == s.Health {
+		if health != SensorOK {
+			_, err := db.ExecContext(ctx, "UPDATE cm_sensors SET HealthDetail = ? WHERE GatewayID = ? AND DeviceID = ?", detail, s.GatewayID, s.DeviceID)
+			return err
+		}
+		return nil
+	}
+
+	query := "UPDATE cm_sensors SET Health = ?, HealthDetail = NULLIF(?, ''), HealthSince = NOW() WHERE GatewayID = ? AND DeviceID = ?"
+	if _, err := db.ExecContext(ctx, query, health, detail, s.GatewayID, s.DeviceID); err != nil {
+		return err
+	}
+	key := sensorKey(s.GatewayID, s.DeviceID)
+	publishLive("sensor", alertTopic(s.CageNum), map[string]interface{}{"sensor": key, "cageNum": s.CageNum, "health": health, "detail": detail})
+
+	alertID, err := openSensorAlert(ctx, key)
+	if err != nil {
+		return err
+	}
+	if alertID != 0 {
+		if _, err := resolveAlert(ctx, alertID, "system"); err != nil {
+			return err
+		}
+	}
+	if health == SensorOK {
+		return nil
+	}
+
+	name := key
+	if s.Name != nil && *s.Name != "" {
+		name = *s.Name
+	}
+	where := ""
+	if s.CageNum != nil {
+		where = fmt.Sprintf(" in cage %d", *s.CageNum)
+	}
+	_, err = raiseAlert(ctx, AlertRecord{
+		Type:     sensorAlertPrefix + health,
+		Severity: "warning",
+		CageNum:  s.CageNum,
+		Source:   &key,
+		Message:  fmt.Sprintf("Sensor %s%s is %s: %s", name, where, health, detail),
+	})
+	return err
+}
+
+// observeSensorReading registers, calibrates and health-checks a reading. The
+// returned fault is the sensor's health when it is not ok.
+func observeSensorReading(ctx context.Context, gatewayID, deviceID string, cageNum int, temperature, humidity, gas float64, at time.Time) (sensorReading, string, error) {
+	s, err := touchSensor(ctx, gatewayID, deviceID, cageNum, at)
+	if err != nil {
+		return sensorReading{}, "", fmt.Errorf("register sensor: %w", err)
+	}
+	rd := s.apply(temperature, humidity, gas)
+	if !s.IsActive {
+		return rd, "", nil
+	}
+	health, detail := checkSensorReading(s, rd, at)
+	if err := setSensorHealth(ctx, s, health, detail); err != nil {
+		log.Printf("[ERROR] Failed to update health of sensor %s: %v", sensorKey(gatewayID, deviceID), err)
+	}
+	if health == SensorOK {
+		return rd, "", nil
+	}
+	return rd, health, nil
+}
+
+// checkMissingSensors marks active sensors that stopped reporting. Sensors behind
+// a gateway that is not connected are left to the gateway's offline alert.
+func checkMissingSensors(ctx context.Context, now time.Time) error {
+	missingAfter := time.Duration(getEnvInt("SENSOR_MISSING_MINUTES", defaultSensorMissing)) * time.Minute
+	rows, err := db.QueryContext(ctx, sensorColumns+" WHERE IsActive = 1 AND Health <> ? AND LastReadingAt < ?",
+		SensorMissing, now.Add(-missingAfter).Format(sqlDateTime))
+	if err != nil {
+		return err
+	}
+	var missing []Sensor
+	for rows.Next() {
+		s, err := scanSensor(rows.Scan)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if s.GatewayID != dhtSensorGateway && s.GatewayID != directDeviceGateway {
+			gatewayMu.RLock()
+			_, connected := gateways[s.GatewayID]
+			gatewayMu.RUnlock()
+			if !connected {
+				continue
+			}
+		}
+		missing = append(missing, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, s := range missing {
+		sensorMu.Lock()
+		delete(sensorTracks, sensorKey(s.GatewayID, s.DeviceID))
+		sensorMu.Unlock()
+		if err := setSensorHealth(ctx, s, SensorMissing, "no reading since "+*s.LastReadingAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runSensorMonitor(ctx context.Context) {
+	t := time.NewTicker(sensorMonitorInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			jobCtx, cancel := context.WithTimeout(ctx, time.Minute)
+			if err := checkMissingSensors(jobCtx, now); err != nil {
+				log.Printf("[ERROR] Sensor monitor: %v", err)
+			}
+			cancel()
+		}
+	}
+}
+
+/* ===========================
+    Sensor Handlers
+=========================== */
+
+// GET /api/iot/sensors?cage=2&health=stuck
+func getSensors(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := sensorColumns + " WHERE IsActive = 1"
+	var args []interface{}
+	if c := r.URL.Query().Get("cage"); c != "" {
+		cageNum, err := strconv.Atoi(c)
+		if err != nil {
+			handleError(w, http.StatusBadRequest, "Invalid cage", err)
+			return
+		}
+		query += " AND CageNum = ?"
+		args = append(args, cageNum)
+	}
+	if h := r.URL.Query().Get("health"); h != "" {
+		query += " AND Health = ?"
+		args = append(args, h)
+	}
+	query += " ORDER BY CageNum, GatewayID, DeviceID"
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch sensors", err)
+		return
+	}
+	defer rows.Close()
+
+	list := []Sensor{}
+	for rows.Next() {
+		s, err := scanSensor(rows.Scan)
+		if err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan sensor", err)
+			return
+		}
+		list = append(list, s)
+	}
+	respondJSON(w, http.StatusOK, list)
+}
+
+func validateSensorPayload(w http.ResponseWriter, p *SensorPayload) bool {
+	if p.TempScale == nil {
+		one := 1.0
+		p.TempScale = &one
+	}
+	if p.HumidityScale == nil {
+		one := 1.0
+		p.HumidityScale = &one
+	}
+	if *p.TempScale <= 0 || *p.HumidityScale <= 0 {
+		handleError(w, http.StatusBadRequest, "TempScale and HumidityScale must be positive", nil)
+		return false
+	}
+	if p.Name != nil {
+		name := strings.TrimSpace(*p.Name)
+		p.Name = &name
+	}
+	if len(p.GasCurve) == 1 || len(p.GasCurve) > maxGasCurvePoints {
+		handleError(w, http.StatusBadRequest, fmt.Sprintf("GasCurve needs 2 to %d points", maxGasCurvePoints), nil)
+		return false
+	}
+	for i, pt := range p.GasCurve {
+		if pt.Ppm < 0 {
+			handleError(w, http.StatusBadRequest, "GasCurve Ppm cannot be negative", nil)
+			return false
+		}
+		if i > 0 && pt.Raw <= p.GasCurve[i-1].Raw {
+			handleError(w, http.StatusBadRequest, "GasCurve Raw values must increase", nil)
+			return false
+		}
+	}
+	return true
+}
+
+// PUT /api/iot/sensors/{gatewayId}/{deviceId} sets the calibration, registering
+// the sensor if it has not reported yet
+func updateSensor(w http.ResponseWriter, r *http.Request) {
+	gatewayID, deviceID := chi.URLParam(r, "gatewayId"), chi.URLParam(r, "deviceId")
+	if gatewayID == "" || deviceID == "" || len(gatewayID) > 64 || len(deviceID) > 64 {
+		handleError(w, http.StatusBadRequest, "Invalid sensor ID", nil)
+		return
+	}
+	var p SensorPayload
+	if !decodeJSONBody(w, r, &p) {
+		return
+	}
+	if !validateSensorPayload(w, &p) {
+		return
+	}
+
+	var curve *string
+	if len(p.GasCurve) > 0 {
+		b, _ := json.Marshal(p.GasCurve)
+		s := string(b)
+		curve = &s
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := `
+		INSERT INTO cm_sensors (GatewayID, DeviceID, Name, CageNum, TempOffset, TempScale, HumidityOffset, HumidityScale, GasCurve)
+		VALUES (?, ?, NULLIF(?, ''), ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE Name = VALUES(Name), CageNum = COALESCE(VALUES(CageNum), CageNum),
+			TempOffset = VALUES(TempOffset), TempScale = VALUES(TempScale),
+			HumidityOffset = VALUES(HumidityOffset), HumidityScale = VALUES(HumidityScale),
+			GasCurve = VALUES(GasCurve), IsActive = 1`
+	if _, err := db.ExecContext(ctx, query, gatewayID, deviceID, p.Name, p.CageNum, p.TempOffset, *p.TempScale,
+		p.HumidityOffset, *p.HumidityScale, curve); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to save sensor calibration", err)
+		return
+	}
+	s, err := loadSensor(ctx, gatewayID, deviceID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to load sensor", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, s)
+}
+
+// DELETE /api/iot/sensors/{gatewayId}/{deviceId} retires a sensor: it is no
+// longer health checked and its open alert is resolved. Its readings are still
+// stored with its calibration; saving the calibration again reactivates it.
+func deleteSensor(w http.ResponseWriter, r *http.Request) {
+	gatewayID, deviceID := chi.URLParam(r, "gatewayId"), chi.URLParam(r, "deviceId")
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := "UPDATE cm_sensors SET IsActive = 0, Health = ?, HealthDetail = NULL, HealthSince = NOW() WHERE GatewayID = ? AND DeviceID = ? AND IsActive = 1"
+	res, err := db.ExecContext(ctx, query, SensorOK, gatewayID, deviceID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to retire sensor", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		handleError(w, http.StatusNotFound, "Sensor not found or no changes made", nil)
+		return
+	}
+	key := sensorKey(gatewayID, deviceID)
+	if alertID, err := openSensorAlert(ctx, key); err == nil && alertID != 0 {
+		resolveAlert(ctx, alertID, requestUsername(r))
+	}
+	sensorMu.Lock()
+	delete(sensorTracks, key)
+	sensorMu.Unlock()
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGasPpm(t *testing.T) {
+	curve := []GasCurvePoint{{Raw: 100, Ppm: 0}, {Raw: 200, Ppm: 10}, {Raw: 600, Ppm: 50}}
+	cases := []struct {
+		raw  float64
+		want float64
+	}{
+		{0, 0},     // below the curve: first point
+		{100, 0},   // on a point
+		{150, 5},   // first segment
+		{200, 10},  // joint of two segments
+		{400, 30},  // second segment
+		{600, 50},  // last point
+		{9000, 50}, // above the curve: last point
+	}
+	for _, tc := range cases {
+		if got := gasPpm(curve, tc.raw); got != tc.want {
+			t.Errorf("gasPpm(%v) = %v, want %v", tc.raw, got, tc.want)
+		}
+	}
+}
+
+func TestSensorApply(t *testing.T) {
+	s := Sensor{TempOffset: -0.8, TempScale: 1, HumidityOffset: 3, HumidityScale: 0.9}
+	rd := s.apply(30.123, 60, 250)
+	if rd.Temperature != 29.32 || rd.Humidity != 57 {
+		t.Fatalf("calibrated to %v C / %v %%, want 29.32 / 57", rd.Temperature, rd.Humidity)
+	}
+	if rd.RawTemperature != 30.123 || rd.RawHumidity != 60 || rd.RawGas != 250 {
+		t.Fatalf("raw values not kept: %+v", rd)
+	}
+	if rd.GasPpm != nil {
+		t.Fatalf("no gas curve should give no ppm, got %v", *rd.GasPpm)
+	}
+
+	s.GasCurve = []GasCurvePoint{{Raw: 0, Ppm: 0}, {Raw: 300, Ppm: 10}}
+	rd = s.apply(30, 60, 100)
+	if rd.GasPpm == nil || *rd.GasPpm != 3.33 {
+		t.Fatalf("gas ppm %v, want 3.33", rd.GasPpm)
+	}
+}
+
+func TestValidateSensorPayload(t *testing.T) {
+	zero := 0.0
+	cases := []struct {
+		name string
+		p    SensorPayload
+		ok   bool
+	}{
+		{"defaults", SensorPayload{}, true},
+		{"zero scale", SensorPayload{TempScale: &zero}, false},
+		{"one point", SensorPayload{GasCurve: []GasCurvePoint{{Raw: 0, Ppm: 0}}}, false},
+		{"increasing", SensorPayload{GasCurve: []GasCurvePoint{{Raw: 0, Ppm: 0}, {Raw: 10, Ppm: 5}}}, true},
+		{"repeated raw", SensorPayload{GasCurve: []GasCurvePoint{{Raw: 10, Ppm: 0}, {Raw: 10, Ppm: 5}}}, false},
+		{"negative ppm", SensorPayload{GasCurve: []GasCurvePoint{{Raw: 0, Ppm: -1}, {Raw: 10, Ppm: 5}}}, false},
+		{"too many points", SensorPayload{GasCurve: make([]GasCurvePoint, maxGasCurvePoints+1)}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			p := tc.p
+			if ok := validateSensorPayload(w, &p); ok != tc.ok {
+				t.Fatalf("valid = %v, want %v (%s)", ok, tc.ok, w.Body.String())
+			}
+			if !tc.ok && w.Code != http.StatusBadRequest {
+				t.Fatalf("status %d, want 400", w.Code)
+			}
+			if tc.ok && (p.TempScale == nil || p.HumidityScale == nil) {
+				t.Fatal("scales not defaulted")
+			}
+		})
+	}
+}
@@ -0,0 +1,700 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+/* ===========================
+    Models for Staff Tasks
+=========================== */
+
+// Recurring daily chore; one task is generated from it for every day
+type TaskTemplate struct {
+	TemplateID     int     `json:"TemplateID"`
+	Title          string  `json:"Title"`
+	TaskType       string  `json:"TaskType"` // "Feeding", "Cleaning", "Vaccination", ...
+	BatchID        *int    `json:"BatchID"`
+	CageNum        *int    `json:"CageNum"`
+	AssignedTo     *string `json:"AssignedTo"` // cm_users.username
+	DueTime        *string `json:"DueTime"`    // HH:MM:SS
+	EstimatedHours float64 `json:"EstimatedHours"`
+	StartDate      string  `json:"StartDate"`
+	IsActive       bool    `json:"IsActive"`
+}
+
+type TaskTemplatePayload struct {
+	Title          string  `json:"Title"`
+	TaskType       string  `json:"TaskType"`
+	BatchID        *int    `json:"BatchID"`
+	CageNum        *int    `json:"CageNum"`
+	AssignedTo     *string `json:"AssignedTo"`
+	DueTime        *string `json:"DueTime"`
+	EstimatedHours float64 `json:"EstimatedHours"`
+	StartDate      string  `json:"StartDate"`
+}
+
+type Task struct {
+	TaskID      int     `json:"TaskID"`
+	TemplateID  *int    `json:"TemplateID"`
+	Title       string  `json:"Title"`
+	TaskType    string  `json:"TaskType"`
+	BatchID     *int    `json:"BatchID"`
+	CageNum     *int    `json:"CageNum"`
+	AssignedTo  *string `json:"AssignedTo"`
+	DueDate     string  `json:"DueDate"`
+	DueTime     *string `json:"DueTime"`
+	Status      string  `json:"Status"`
+	CompletedAt *string `json:"CompletedAt"`
+	CompletedBy *string `json:"CompletedBy"`
+	HoursWorked float64 `json:"HoursWorked"`
+	Notes       *string `json:"Notes"`
+	CostID      *int    `json:"CostID"`
+}
+
+type TaskPayload struct {
+	Title      string  `json:"Title"`
+	TaskType   string  `json:"TaskType"`
+	BatchID    *int    `json:"BatchID"`
+	CageNum    *int    `json:"CageNum"`
+	AssignedTo *string `json:"AssignedTo"`
+	DueDate    string  `json:"DueDate"`
+	DueTime    *string `json:"DueTime"`
+}
+
+type TaskCompletionPayload struct {
+	CompletedBy string  `json:"CompletedBy"`
+	HoursWorked float64 `json:"HoursWorked"`
+	Notes       string  `json:"Notes"`
+	Skipped     bool    `json:"Skipped"`
+}
+
+type LaborRate struct {
+	Username   string  `json:"Username"`
+	HourlyRate float64 `json:"HourlyRate"`
+}
+
+type TaskGeneratePayload struct {
+	From string `json:"From"`
+	To   string `json:"To"`
+}
+
+type MissedTasksDay struct {
+	Date  string `json:"date"`
+	Tasks []Task `json:"tasks"`
+}
+
+// Longest range the missed-tasks report covers or a manual generation backfills
+const maxTaskReportDays = 92
+
+// How often the scheduler makes sure today's recurring tasks exist
+const (
+	taskGenerateInterval    = time.Hour
+	defaultTaskBackfillDays = 7
+)
+
+const taskColumns = `TaskID, TemplateID, Title, TaskType, BatchID, CageNum, AssignedTo, DueDate, DueTime,
+	Status, CompletedAt, CompletedBy, HoursWorked, Notes, CostID`
+
+func scanTask(rows *sql.Rows) (Task, error) {
+	var t Task
+	err := rows.Scan(&t.TaskID, &t.TemplateID, &t.Title, &t.TaskType, &t.BatchID, &t.CageNum, &t.AssignedTo,
+		&t.DueDate, &t.DueTime, &t.Status, &t.CompletedAt, &t.CompletedBy, &t.HoursWorked, &t.Notes, &t.CostID)
+	return t, err
+}
+
+/* ===========================
+    Task Helpers
+=========================== */
+
+// userExists checks the username against cm_users
+func userExists(ctx context.Context, username string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM cm_users WHERE username = ?", username).Scan(&count)
+	return count > 0, err
+}
+
+// generateDailyTasks creates the day's task from every active template that has started.
+// Templates tied to a batch only produce tasks while the batch is Active or Harvesting.
+// The unique (TemplateID, DueDate) key makes this safe to call repeatedly.
+func generateDailyTasks(ctx context.Context, day time.Time) error {
+	query := `
+		INSERT IGNORE INTO cm_tasks (TemplateID, Title, TaskType, BatchID, CageNum, AssignedTo, DueDate, DueTime)
+		SELECT t.TemplateID, t.Title, t.TaskType, t.BatchID, t.CageNum, t.AssignedTo, ?, t.DueTime
+		FROM cm_task_templates t
+		LEFT JOIN cm_batches b ON t.BatchID = b.BatchID
+		WHERE t.IsActive = 1 AND t.StartDate <= ?
+		AND (t.BatchID IS NULL OR b.Status IN (?, ?))`
+	d := day.Format("2006-01-02")
+	_, err := db.ExecContext(ctx, query, d, d, BatchActive, BatchHarvesting)
+	return err
+}
+
+// generatePendingTasks generates every day from the one after the last generated
+// task up to today, so days the server was down still get their tasks and show up
+// as missed. It looks back at most TASK_BACKFILL_DAYS.
+func generatePendingTasks(ctx context.Context, now time.Time) error {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	from := today
+	var last sql.NullString
+	if err := db.QueryRowContext(ctx, "SELECT MAX(DueDate) FROM cm_tasks WHERE TemplateID IS NOT NULL").Scan(&last); err != nil {
+		return err
+	}
+	if last.Valid {
+		if d, err := time.Parse("2006-01-02", last.String); err == nil && d.Before(today) {
+			from = d.AddDate(0, 0, 1)
+		}
+	}
+	if earliest := today.AddDate(0, 0, -getEnvInt("TASK_BACKFILL_DAYS", defaultTaskBackfillDays)); from.Before(earliest) {
+		from = earliest
+	}
+	for day := from; !day.After(today); day = day.AddDate(0, 0, 1) {
+		if err := generateDailyTasks(ctx, day); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runTaskScheduler generates recurring tasks at startup and then every
+// taskGenerateInterval, so reading the task list never has to write to it
+func runTaskScheduler(ctx context.Context) {
+	t := time.NewTicker(taskGenerateInterval)
+	defer t.Stop()
+	for {
+		jobCtx, cancel := withTimeout(ctx)
+		if err := generatePendingTasks(jobCtx, time.Now()); err != nil {
+			log.Printf("[ERROR] Task generation: %v", err)
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func validateTaskTemplate(ctx context.Context, w http.ResponseWriter, p TaskTemplatePayload) bool {
+	if p.Title == "" || p.TaskType == "" {
+		handleError(w, http.StatusBadRequest, "Title and TaskType are required", nil)
+		return false
+	}
+	if _, err := time.Parse("2006-01-02", p.StartDate); err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid StartDate, expected YYYY-MM-DD", err)
+		return false
+	}
+	if p.DueTime != nil {
+		if _, err := time.Parse("15:04:05", *p.DueTime); err != nil {
+			handleError(w, http.StatusBadRequest, "Invalid DueTime, expected HH:MM:SS", err)
+			return false
+		}
+	}
+	if p.EstimatedHours < 0 {
+		handleError(w, http.StatusBadRequest, "EstimatedHours cannot be negative", nil)
+		return false
+	}
+	if p.BatchID != nil {
+		var count int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM cm_batches WHERE BatchID = ?", *p.BatchID).Scan(&count); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to look up batch", err)
+			return false
+		}
+		if count == 0 {
+			handleError(w, http.StatusBadRequest, "Batch not found", nil)
+			return false
+		}
+	}
+	if p.AssignedTo != nil && *p.AssignedTo != "" {
+		ok, err := userExists(ctx, *p.AssignedTo)
+		if err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to look up user", err)
+			return false
+		}
+		if !ok {
+			handleError(w, http.StatusBadRequest, "Assigned user not found", nil)
+			return false
+		}
+	}
+	return true
+}
+
+/* ===========================
+    Task Template Handlers
+=========================== */
+
+func getTaskTemplates(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := `
+		SELECT TemplateID, Title, TaskType, BatchID, CageNum, AssignedTo, DueTime, EstimatedHours, StartDate, IsActive
+		FROM cm_task_templates
+		ORDER BY IsActive DESC, DueTime ASC, Title ASC`
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch task templates", err)
+		return
+	}
+	defer rows.Close()
+
+	templates := []TaskTemplate{}
+	for rows.Next() {
+		var t TaskTemplate
+		if err := rows.Scan(&t.TemplateID, &t.Title, &t.TaskType, &t.BatchID, &t.CageNum, &t.AssignedTo, &t.DueTime, &t.EstimatedHours, &t.StartDate, &t.IsActive); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan task template", err)
+			return
+		}
+		templates = append(templates, t)
+	}
+	respondJSON(w, http.StatusOK, templates)
+}
+
+func createTaskTemplate(w http.ResponseWriter, r *http.Request) {
+	var payload TaskTemplatePayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	if !validateTaskTemplate(ctx, w, payload) {
+		return
+	}
+
+	query := `
+		INSERT INTO cm_task_templates (Title, TaskType, BatchID, CageNum, AssignedTo, DueTime, EstimatedHours, StartDate)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	res, err := db.ExecContext(ctx, query, payload.Title, payload.TaskType, payload.BatchID, payload.CageNum,
+		payload.AssignedTo, payload.DueTime, payload.EstimatedHours, payload.StartDate)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to create task template", err)
+		return
+	}
+	lastID, _ := res.LastInsertId()
+
+	// A template starting today should not wait for the next scheduler pass
+	if err := generateDailyTasks(ctx, time.Now()); err != nil {
+		log.Printf("[ERROR] Task generation after template %d was created: %v", lastID, err)
+	}
+	respondJSON(w, http.StatusCreated, map[string]interface{}{"success": true, "insertedId": lastID})
+}
+
+func updateTaskTemplate(w http.ResponseWriter, r *http.Request) {
+	templateID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid template ID", err)
+		return
+	}
+
+	var payload TaskTemplatePayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	if !validateTaskTemplate(ctx, w, payload) {
+		return
+	}
+
+	// Only future occurrences pick up the change; generated tasks keep their history
+	query := `
+		UPDATE cm_task_templates
+		SET Title = ?, TaskType = ?, BatchID = ?, CageNum = ?, AssignedTo = ?, DueTime = ?, EstimatedHours = ?, StartDate = ?
+		WHERE TemplateID = ?`
+	res, err := db.ExecContext(ctx, query, payload.Title, payload.TaskType, payload.BatchID, payload.CageNum,
+		payload.AssignedTo, payload.DueTime, payload.EstimatedHours, payload.StartDate, templateID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to update task template", err)
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		handleError(w, http.StatusNotFound, "Task template not found or no changes made", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+func deleteTaskTemplate(w http.ResponseWriter, r *http.Request) {
+	templateID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid template ID", err)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, "UPDATE cm_task_templates SET IsActive = 0 WHERE TemplateID = ?", templateID)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to deactivate task template", err)
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		handleError(w, http.StatusNotFound, "Task template not found", nil)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+/* ===========================
+    Task Handlers
+=========================== */
+
+// GET /api/tasks?date=2025-06-01&assignedTo=juan&batchId=3
+func getTasks(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	day := time.Now()
+	if d := r.URL.Query().Get("date"); d != "" {
+		parsed, err := time.Parse("2006-01-02", d)
+		if err != nil {
+			handleError(w, http.StatusBadRequest, "Invalid date, expected YYYY-MM-DD", err)
+			return
+		}
+		day = parsed
+	}
+
+	query := "SELECT " + taskColumns + " FROM cm_tasks WHERE DueDate = ?"
+	args := []interface{}{day.Format("2006-01-02")}
+	if assignedTo := r.URL.Query().Get("assignedTo"); assignedTo != "" {
+		query += " AND AssignedTo = ?"
+		args = append(args, assignedTo)
+	}
+	if batchID := r.URL.Query().Get("batchId"); batchID != "" {
+		query += " AND BatchID = ?"
+		args = append(args, batchID)
+	}
+	query += " ORDER BY DueTime IS NULL, DueTime ASC, TaskID ASC"
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch tasks", err)
+		return
+	}
+	defer rows.Close()
+
+	tasks := []Task{}
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan task", err)
+			return
+		}
+		tasks = append(tasks, t)
+	}
+	respondJSON(w, http.StatusOK, tasks)
+}
+
+// POST /api/tasks creates a one-off task outside of any template
+func createTask(w http.ResponseWriter, r *http.Request) {
+	var payload TaskPayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	if !validateTaskTemplate(ctx, w, TaskTemplatePayload{
+		Title: payload.Title, TaskType: payload.TaskType, BatchID: payload.BatchID, AssignedTo: payload.AssignedTo,
+		DueTime: payload.DueTime, StartDate: payload.DueDate,
+	}) {
+		return
+	}
+
+	query := `
+		INSERT INTO cm_tasks (Title, TaskType, BatchID, CageNum, AssignedTo, DueDate, DueTime)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+	res, err := db.ExecContext(ctx, query, payload.Title, payload.TaskType, payload.BatchID, payload.CageNum,
+		payload.AssignedTo, payload.DueDate, payload.DueTime)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to create task", err)
+		return
+	}
+	lastID, _ := res.LastInsertId()
+	respondJSON(w, http.StatusCreated, map[string]interface{}{"success": true, "insertedId": lastID})
+}
+
+// POST /api/tasks/{id}/complete marks the task done (or skipped) and, for batch tasks
+// with hours worked, posts the labor cost to the batch at the worker's hourly rate.
+func completeTask(w http.ResponseWriter, r *http.Request) {
+	taskID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid task ID", err)
+		return
+	}
+
+	var payload TaskCompletionPayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if payload.CompletedBy == "" {
+		handleError(w, http.StatusBadRequest, "CompletedBy is required", nil)
+		return
+	}
+	if payload.HoursWorked < 0 {
+		handleError(w, http.StatusBadRequest, "HoursWorked cannot be negative", nil)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	ok, err := userExists(ctx, payload.CompletedBy)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to look up user", err)
+		return
+	}
+	if !ok {
+		handleError(w, http.StatusBadRequest, "User not found", nil)
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var status, title, taskType, dueDate string
+	var batchID *int
+	err = tx.QueryRowContext(ctx, "SELECT Status, Title, TaskType, BatchID, DueDate FROM cm_tasks WHERE TaskID = ? FOR UPDATE", taskID).
+		Scan(&status, &title, &taskType, &batchID, &dueDate)
+	if errors.Is(err, sql.ErrNoRows) {
+		handleError(w, http.StatusNotFound, "Task not found", nil)
+		return
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch task", err)
+		return
+	}
+	if status != "Pending" {
+		handleError(w, http.StatusConflict, "Task has already been "+status+".", nil)
+		return
+	}
+
+	newStatus := "Completed"
+	if payload.Skipped {
+		newStatus = "Skipped"
+		payload.HoursWorked = 0
+	}
+
+	var costID *int64
+	var laborCost float64
+	if batchID != nil && payload.HoursWorked > 0 {
+		var rate float64
+		err := tx.QueryRowContext(ctx, "SELECT HourlyRate FROM cm_labor_rates WHERE Username = ?", payload.CompletedBy).Scan(&rate)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			handleError(w, http.StatusInternalServerError, "Failed to fetch labor rate", err)
+			return
+		}
+		laborCost = math.Round(rate*payload.HoursWorked*100) / 100
+		if laborCost > 0 {
+			if !requireBatchAction(ctx, w, tx, *batchID, "cost") {
+				return
+			}
+			description := fmt.Sprintf("%s: %s (%.2f h by %s)", taskType, title, payload.HoursWorked, payload.CompletedBy)
+			costQuery := "INSERT INTO cm_production_cost (BatchID, Date, CostType, Amount, Description) VALUES (?, ?, 'Labor', ?, ?)"
+			res, err := tx.ExecContext(ctx, costQuery, *batchID, dueDate, laborCost, description)
+			if err != nil {
+				handleError(w, http.StatusInternalServerError, "Failed to post labor cost", err)
+				return
+			}
+			id, _ := res.LastInsertId()
+			costID = &id
+		}
+	}
+
+	updateQuery := `
+		UPDATE cm_tasks
+		SET Status = ?, CompletedAt = NOW(), CompletedBy = ?, HoursWorked = ?, Notes = ?, CostID = ?
+		WHERE TaskID = ?`
+	if _, err := tx.ExecContext(ctx, updateQuery, newStatus, payload.CompletedBy, payload.HoursWorked, payload.Notes, costID, taskID); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to update task", err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to commit transaction", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true, "status": newStatus, "laborCost": laborCost})
+}
+
+// POST /api/tasks/generate backfills recurring tasks for days the scheduler did not
+// run, e.g. while the server was down. Days already generated are left as they are.
+func generateTasks(w http.ResponseWriter, r *http.Request) {
+	var payload TaskGeneratePayload
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	from, err := time.Parse("2006-01-02", payload.From)
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid From date, expected YYYY-MM-DD", err)
+		return
+	}
+	to, err := time.Parse("2006-01-02", payload.To)
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid To date, expected YYYY-MM-DD", err)
+		return
+	}
+	if to.Before(from) {
+		handleError(w, http.StatusBadRequest, "To date must not be before From date", nil)
+		return
+	}
+	if int(to.Sub(from).Hours()/24) > maxTaskReportDays {
+		handleError(w, http.StatusBadRequest, fmt.Sprintf("Range cannot exceed %d days", maxTaskReportDays), nil)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	days := 0
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		if err := generateDailyTasks(ctx, day); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to generate daily tasks", err)
+			return
+		}
+		days++
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true, "days": days})
+}
+
+// GET /api/tasks/missed?from=2025-06-01&to=2025-06-07 lists pending tasks whose day
+// (or due time, for today) has passed, grouped by day.
+func getMissedTasks(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	from, to := today.AddDate(0, 0, -7), today
+	var err error
+	if f := r.URL.Query().Get("from"); f != "" {
+		if from, err = time.Parse("2006-01-02", f); err != nil {
+			handleError(w, http.StatusBadRequest, "Invalid from date, expected YYYY-MM-DD", err)
+			return
+		}
+	}
+	if t := r.URL.Query().Get("to"); t != "" {
+		if to, err = time.Parse("2006-01-02", t); err != nil {
+			handleError(w, http.StatusBadRequest, "Invalid to date, expected YYYY-MM-DD", err)
+			return
+		}
+	}
+	if to.After(today) {
+		to = today
+	}
+	if to.Before(from) {
+		handleError(w, http.StatusBadRequest, "to date must not be before from date", nil)
+		return
+	}
+	if int(to.Sub(from).Hours()/24) > maxTaskReportDays {
+		handleError(w, http.StatusBadRequest, fmt.Sprintf("Range cannot exceed %d days", maxTaskReportDays), nil)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	query := "SELECT " + taskColumns + ` FROM cm_tasks
+		WHERE Status = 'Pending' AND DueDate BETWEEN ? AND ?
+		AND (DueDate < CURDATE() OR (DueTime IS NOT NULL AND DueTime < CURTIME()))
+		ORDER BY DueDate DESC, DueTime ASC`
+	rows, err := db.QueryContext(ctx, query, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch missed tasks", err)
+		return
+	}
+	defer rows.Close()
+
+	days := []MissedTasksDay{}
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan task", err)
+			return
+		}
+		date := t.DueDate[:10]
+		if len(days) == 0 || days[len(days)-1].Date != date {
+			days = append(days, MissedTasksDay{Date: date})
+		}
+		days[len(days)-1].Tasks = append(days[len(days)-1].Tasks, t)
+	}
+	respondJSON(w, http.StatusOK, days)
+}
+
+/* ===========================
+    Labor Rates
+=========================== */
+
+func getLaborRates(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT Username, HourlyRate FROM cm_labor_rates ORDER BY Username")
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch labor rates", err)
+		return
+	}
+	defer rows.Close()
+
+	rates := []LaborRate{}
+	for rows.Next() {
+		var lr LaborRate
+		if err := rows.Scan(&lr.Username, &lr.HourlyRate); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan labor rate", err)
+			return
+		}
+		rates = append(rates, lr)
+	}
+	respondJSON(w, http.StatusOK, rates)
+}
+
+func upsertLaborRate(w http.ResponseWriter, r *http.Request) {
+	var payload LaborRate
+	if !decodeJSONBody(w, r, &payload) {
+		return
+	}
+	if payload.HourlyRate < 0 {
+		handleError(w, http.StatusBadRequest, "HourlyRate cannot be negative", nil)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	ok, err := userExists(ctx, payload.Username)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to look up user", err)
+		return
+	}
+	if !ok {
+		handleError(w, http.StatusBadRequest, "User not found", nil)
+		return
+	}
+
+	query := `
+		INSERT INTO cm_labor_rates (Username, HourlyRate) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE HourlyRate = VALUES(HourlyRate)`
+	if _, err := db.ExecContext(ctx, query, payload.Username, payload.HourlyRate); err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to save labor rate", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ===========================
+    Telemetry History
+=========================== */
+
+// Raw readings live in cm_temperature; each metric maps to one of its columns.
+// nh3 is only set for sensors with a gas curve (see sensors.go).
+var telemetryMetrics = map[string]string{
+	"temperature": "temp_temperature",
+	"humidity":    "temp_humidity",
+	"gas":         "gas_sensor",
+	"nh3":         "GasPpm",
+}
+
+type TelemetryPoint struct {
+	At      string  `json:"At"`
+	Min     float64 `json:"Min"`
+	Avg     float64 `json:"Avg"`
+	Max     float64 `json:"Max"`
+	Samples int     `json:"Samples"`
+}
+
+type TelemetrySeries struct {
+	CageNum    int              `json:"CageNum"`
+	Metric     string           `json:"Metric"`
+	Resolution string           `json:"Resolution"`
+	From       string           `json:"From"`
+	To         string           `json:"To"`
+	Points     []TelemetryPoint `json:"Points"`
+}
+
+const (
+	telemetryJobInterval    = 5 * time.Minute
+	defaultRawRetentionDays = 30
+	defaultHourlyRetention  = 365
+	telemetryPurgeChunk     = 5000
+	sqlDateTime             = "2006-01-02 15:04:05"
+)
+
+/* ===========================
+    Ingest
+=========================== */
+
+// ingestEnvironmentReading stores a temperature/humidity/gas reading from a sensor,
+// calibrated and health checked, attributes it to the batch living in the cage,
+// streams it and, unless it is faulty, evaluates alert and control rules.
+// /api/dht22-data, gateway telemetry frames and polled direct devices all go
+// through here. at is when the reading was taken, the frame timestamp for
+// gateway telemetry.
+func ingestEnvironmentReading(ctx context.Context, gatewayID, deviceID string, cageNum int, temperature, humidity, gas float64, at time.Time) (int64, error) {
+	batchID, err := batchInCage(ctx, db, cageNum, at)
+	if err != nil {
+		return 0, fmt.Errorf("look up batch for cage: %w", err)
+	}
+	rd, fault, err := observeSensorReading(ctx, gatewayID, deviceID, cageNum, temperature, humidity, gas, at)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt := `
+		INSERT INTO cm_temperature (temp_temperature, temp_humidity, gas_sensor, temp_cage_num, BatchID,
+			SensorID, RawTemperature, RawHumidity, GasPpm, SensorFault, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?)`
+	res, err := db.ExecContext(ctx, stmt, rd.Temperature, rd.Humidity, gas, cageNum, batchID,
+		sensorKey(gatewayID, deviceID), rd.RawTemperature, rd.RawHumidity, rd.GasPpm, fault, at.Format(sqlDateTime))
+	if err != nil {
+		return 0, err
+	}
+	id, _ := res.LastInsertId()
+
+	publishLive("reading", cageTopic(cageNum), map[string]interface{}{
+		"id":             id,
+		"cageNum":        cageNum,
+		"batchId":        batchID,
+		"sensor":         sensorKey(gatewayID, deviceID),
+		"temperature":    rd.Temperature,
+		"humidity":       rd.Humidity,
+		"gas":            gas,
+		"nh3":            rd.GasPpm,
+		"rawTemperature": rd.RawTemperature,
+		"rawHumidity":    rd.RawHumidity,
+		"sensorFault":    fault,
+	})
+
+	values := map[string]float64{
+		"temperature": rd.Temperature,
+		"humidity":    rd.Humidity,
+		"gas":         gas,
+	}
+	if rd.GasPpm != nil {
+		values["nh3"] = *rd.GasPpm
+	}
+	// /api/dht22-data takes unauthenticated posts, so those readings may raise
+	// alerts but never switch relays
+	evaluateReadingRules(ctx, cageNum, batchID, values, fault, gatewayID != dhtSensorGateway, at)
+	return id, nil
+}
+
+// The rule evaluators, swapped out by tests
+var (
+	alertRuleEvaluator   = evaluateAlertRules
+	controlRuleEvaluator = evaluateControlRules
+)
+
+// evaluateReadingRules feeds a stored reading to the alert and control rules.
+// Readings sensor health flagged as faulty feed neither: a spike or a stuck
+// sensor must not raise threshold alerts or switch relays. Control rules only
+// see readings from authenticated sources.
+func evaluateReadingRules(ctx context.Context, cageNum int, batchID *int, values map[string]float64, fault string, control bool, at time.Time) {
+	if fault != "" {
+		return
+	}
+	alertRuleEvaluator(ctx, cageNum, batchID, values)
+	if control {
+		controlRuleEvaluator(ctx, cageNum, values, at)
+	}
+}
+
+/* ===========================
+    Rollup Job
+=========================== */
+
+// rollupTelemetry recomputes hourly buckets from raw readings since the given
+// time, then the daily buckets touched by them. Buckets are overwritten, so
+// running over the same window twice is harmless.
+func rollupTelemetry(ctx context.Context, since time.Time) error {
+	hourStart := since.Truncate(time.Hour).Format(sqlDateTime)
+	for metric, column := range telemetryMetrics {
+		hourly := fmt.Sprintf(`
+			INSERT INTO cm_telemetry_hourly (CageNum, Metric, BucketStart, MinValue, AvgValue, MaxValue, Samples)
+			SELECT temp_cage_num, ?, DATE_FORMAT(created_at, '%%Y-%%m-%%d %%H:00:00'),
+				MIN(%[1]s), AVG(%[1]s), MAX(%[1]s), COUNT(*)
+			FROM cm_temperature
+			WHERE created_at >= ? AND %[1]s IS NOT NULL AND SensorFault IS NULL
+			GROUP BY temp_cage_num, DATE_FORMAT(created_at, '%%Y-%%m-%%d %%H:00:00')
+			ON DUPLICATE KEY UPDATE MinValue = VALUES(MinValue), AvgValue = VALUES(AvgValue),
+				MaxValue = VALUES(MaxValue), Samples = VALUES(Samples)`, column)
+		if _, err := db.ExecContext(ctx, hourly, metric, hourStart); err != nil {
+			return fmt.Errorf("hourly rollup of %s: %w", metric, err)
+		}
+	}
+
+	// daily buckets are built from the hourly ones, weighting each hour by its sample count
+	daily := `
+		INSERT INTO cm_telemetry_daily (CageNum, Metric, BucketDate, MinValue, AvgValue, MaxValue, Samples)
+		SELECT CageNum, Metric, DATE(BucketStart), MIN(MinValue), SUM(AvgValue * Samples) / SUM(Samples), MAX(MaxValue), SUM(Samples)
+		FROM cm_telemetry_hourly
+		WHERE BucketStart >= ?
+		GROUP BY CageNum, Metric, DATE(BucketStart)
+		ON DUPLICATE KEY UPDATE MinValue = VALUES(MinValue), AvgValue = VALUES(AvgValue),
+			MaxValue = VALUES(MaxValue), Samples = VALUES(Samples)`
+	dayStart := since.Format("2006-01-02")
+	if _, err := db.ExecContext(ctx, daily, dayStart); err != nil {
+		return fmt.Errorf("daily rollup: %w", err)
+	}
+	return nil
+}
+
+// purgeTelemetry drops raw readings (sensor and gateway) and hourly buckets past their retention, in
+// chunks so the table is never locked for long
+func purgeTelemetry(ctx context.Context, rawDays, hourlyDays int) error {
+	for {
+		res, err := db.ExecContext(ctx, "DELETE FROM cm_temperature WHERE created_at < NOW() - INTERVAL ? DAY LIMIT ?", rawDays, telemetryPurgeChunk)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n < telemetryPurgeChunk {
+			break
+		}
+	}
+	for {
+		res, err := db.ExecContext(ctx, "DELETE FROM cm_gateway_telemetry WHERE ReceivedAt < NOW() - INTERVAL ? DAY LIMIT ?", rawDays, telemetryPurgeChunk)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n < telemetryPurgeChunk {
+			break
+		}
+	}
+	_, err := db.ExecContext(ctx, "DELETE FROM cm_telemetry_hourly WHERE BucketStart < NOW() - INTERVAL ? DAY", hourlyDays)
+	return err
+}
+
+// runTelemetryJobs rolls up and purges telemetry until ctx is cancelled. The first
+// pass covers all retained raw data so buckets missed while the server was down are filled.
+func runTelemetryJobs(ctx context.Context) {
+	rawDays := getEnvInt("TELEMETRY_RETENTION_DAYS", defaultRawRetentionDays)
+	hourlyDays := getEnvInt("TELEMETRY_HOURLY_RETENTION_DAYS", defaultHourlyRetention)
+	if rawDays < 1 {
+		rawDays = 1
+	}
+	if hourlyDays < rawDays {
+		hourlyDays = rawDays
+	}
+
+	since := time.Now().AddDate(0, 0, -rawDays)
+	run := func() {
+		jobCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+		defer cancel()
+
+		started := time.Now()
+		if err := rollupTelemetry(jobCtx, since); err != nil {
+			log.Printf("[ERROR] Telemetry rollup failed: %v", err)
+			return
+		}
+		// metered water and feed are rebuilt per whole day; the oldest retained
+		// day is only partly there and is left as it was
+		from := since
+		if oldest := started.AddDate(0, 0, 1-rawDays); from.Before(oldest) {
+			from = oldest
+		}
+		if err := rollupConsumption(jobCtx, from); err != nil {
+			log.Printf("[ERROR] Consumption rollup failed: %v", err)
+		}
+		// the previous hour is recomputed each pass so late readings are included
+		since = started.Add(-time.Hour)
+
+		if err := purgeTelemetry(jobCtx, rawDays, hourlyDays); err != nil {
+			log.Printf("[ERROR] Telemetry purge failed: %v", err)
+		}
+	}
+
+	run()
+	t := time.NewTicker(telemetryJobInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			run()
+		}
+	}
+}
+
+/* ===========================
+    Telemetry Handler
+=========================== */
+
+// parseTelemetryRange accepts a relative range like "24h", "7d" or "2w", or an
+// explicit from/to pair of dates or datetimes
+func parseTelemetryRange(r *http.Request, now time.Time) (time.Time, time.Time, error) {
+	q := r.URL.Query()
+	if from := q.Get("from"); from != "" {
+		start, err := parseTelemetryTime(from)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		end := now
+		if to := q.Get("to"); to != "" {
+			if end, err = parseTelemetryTime(to); err != nil {
+				return time.Time{}, time.Time{}, err
+			}
+			if len(to) == len("2006-01-02") {
+				end = end.AddDate(0, 0, 1)
+			}
+		}
+		return start, end, nil
+	}
+
+	rng := q.Get("range")
+	if rng == "" {
+		rng = "24h"
+	}
+	if len(rng) < 2 {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid range %q", rng)
+	}
+	n, err := strconv.Atoi(rng[:len(rng)-1])
+	if err != nil || n <= 0 {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid range %q", rng)
+	}
+	switch rng[len(rng)-1] {
+	case 'h':
+		return now.Add(-time.Duration(n) * time.Hour), now, nil
+	case 'd':
+		return now.AddDate(0, 0, -n), now, nil
+	case 'w':
+		return now.AddDate(0, 0, -7*n), now, nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("invalid range %q", rng)
+}
+
+func parseTelemetryTime(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation(sqlDateTime, s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
+
+// GET /api/telemetry?cage=1&metric=temperature&range=7d&resolution=auto
+// resolution is raw, hourly, daily or auto (picked from the length of the range)
+// Raw mode returns the latest `limit` readings (default 100, at most 1000) and leaves
+// out readings flagged as sensor faults unless includeFaults=true.
+func getTelemetry(w http.ResponseWriter, r *http.Request) {
+	cageNum, err := strconv.Atoi(r.URL.Query().Get("cage"))
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid cage number", err)
+		return
+	}
+	metric := strings.ToLower(r.URL.Query().Get("metric"))
+	if metric == "" {
+		metric = "temperature"
+	}
+	column, ok := telemetryMetrics[metric]
+	if !ok {
+		handleError(w, http.StatusBadRequest, "Unknown metric; use temperature, humidity, gas or nh3", nil)
+		return
+	}
+
+	from, to, err := parseTelemetryRange(r, time.Now())
+	if err != nil || !to.After(from) {
+		handleError(w, http.StatusBadRequest, "Invalid range", err)
+		return
+	}
+
+	resolution := r.URL.Query().Get("resolution")
+	span := to.Sub(from)
+	rawCutoff := time.Now().AddDate(0, 0, -getEnvInt("TELEMETRY_RETENTION_DAYS", defaultRawRetentionDays))
+	switch resolution {
+	case "", "auto":
+		switch {
+		case span <= 48*time.Hour && from.After(rawCutoff):
+			resolution = "raw"
+		case span <= 60*24*time.Hour:
+			resolution = "hourly"
+		default:
+			resolution = "daily"
+		}
+	case "raw", "hourly", "daily":
+	default:
+		handleError(w, http.StatusBadRequest, "Invalid resolution; use raw, hourly, daily or auto", nil)
+		return
+	}
+
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+	faultFilter := " AND SensorFault IS NULL"
+	if r.URL.Query().Get("includeFaults") == "true" {
+		faultFilter = ""
+	}
+
+	var query string
+	args := []interface{}{cageNum}
+	switch resolution {
+	case "raw":
+		// newest readings first so the limit keeps the latest ones, then back in time order
+		query = fmt.Sprintf(`
+			SELECT created_at, v, v, v, 1 FROM (
+				SELECT created_at, %[1]s AS v
+				FROM cm_temperature
+				WHERE temp_cage_num = ? AND created_at >= ? AND created_at < ? AND %[1]s IS NOT NULL%[2]s
+				ORDER BY created_at DESC
+				LIMIT ?
+			) latest
+			ORDER BY created_at`, column, faultFilter)
+	case "hourly":
+		query = `
+			SELECT BucketStart, MinValue, AvgValue, MaxValue, Samples
+			FROM cm_telemetry_hourly
+			WHERE CageNum = ? AND Metric = ? AND BucketStart >= ? AND BucketStart < ?
+			ORDER BY BucketStart`
+		args = append(args, metric)
+	case "daily":
+		query = `
+			SELECT BucketDate, MinValue, AvgValue, MaxValue, Samples
+			FROM cm_telemetry_daily
+			WHERE CageNum = ? AND Metric = ? AND BucketDate >= DATE(?) AND BucketDate < ?
+			ORDER BY BucketDate`
+		args = append(args, metric)
+	}
+
+	ctx, cancel := withTimeout(r.Context())
+	defer cancel()
+
+	args = append(args, from.Format(sqlDateTime), to.Format(sqlDateTime))
+	if resolution == "raw" {
+		args = append(args, limit)
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to fetch telemetry", err)
+		return
+	}
+	defer rows.Close()
+
+	series := TelemetrySeries{
+		CageNum:    cageNum,
+		Metric:     metric,
+		Resolution: resolution,
+		From:       from.Format(sqlDateTime),
+		To:         to.Format(sqlDateTime),
+		Points:     []TelemetryPoint{},
+	}
+	for rows.Next() {
+		var p TelemetryPoint
+		if err := rows.Scan(&p.At, &p.Min, &p.Avg, &p.Max, &p.Samples); err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to scan telemetry", err)
+			return
+		}
+		series.Points = append(series.Points, p)
+	}
+	respondJSON(w, http.StatusOK, series)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFaultedReadingSkipsRules(t *testing.T) {
+	origAlert, origControl := alertRuleEvaluator, controlRuleEvaluator
+	defer func() { alertRuleEvaluator, controlRuleEvaluator = origAlert, origControl }()
+
+	cases := []struct {
+		name        string
+		reading     sensorReading
+		wantAlerted bool
+	}{
+		{"in range", sensorReading{Temperature: 31, Humidity: 60, RawTemperature: 31, RawHumidity: 60}, true},
+		{"too hot", sensorReading{Temperature: 95, Humidity: 60, RawTemperature: 95, RawHumidity: 60}, false},
+		{"humidity over 100", sensorReading{Temperature: 30, Humidity: 130, RawTemperature: 30, RawHumidity: 130}, false},
+		{"negative gas", sensorReading{Temperature: 30, Humidity: 60, RawGas: -5, RawTemperature: 30, RawHumidity: 60}, false},
+	}
+	for i, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			alerted, controlled := false, false
+			alertRuleEvaluator = func(context.Context, int, *int, map[string]float64) { alerted = true }
+			controlRuleEvaluator = func(context.Context, int, map[string]float64, time.Time) { controlled = true }
+
+			// a sensor with a clean history, so only the reading itself decides its health
+			s := Sensor{GatewayID: "test", DeviceID: tc.name, Health: SensorOK}
+			sensorMu.Lock()
+			delete(sensorTracks, sensorKey(s.GatewayID, s.DeviceID))
+			sensorMu.Unlock()
+			at := time.Date(2026, 1, 1, 12, i, 0, 0, time.Local)
+			health, _ := checkSensorReading(s, tc.reading, at)
+			fault := ""
+			if health != SensorOK {
+				fault = health
+			}
+
+			values := map[string]float64{"temperature": tc.reading.Temperature, "humidity": tc.reading.Humidity}
+			evaluateReadingRules(context.Background(), 1, nil, values, fault, true, at)
+			if alerted != tc.wantAlerted || controlled != tc.wantAlerted {
+				t.Fatalf("health %q: alert rules run %v, control rules run %v, want %v", health, alerted, controlled, tc.wantAlerted)
+			}
+		})
+	}
+}
+
+func TestUnauthenticatedReadingSkipsControlRules(t *testing.T) {
+	origAlert, origControl := alertRuleEvaluator, controlRuleEvaluator
+	defer func() { alertRuleEvaluator, controlRuleEvaluator = origAlert, origControl }()
+
+	alerted, controlled := false, false
+	alertRuleEvaluator = func(context.Context, int, *int, map[string]float64) { alerted = true }
+	controlRuleEvaluator = func(context.Context, int, map[string]float64, time.Time) { controlled = true }
+
+	evaluateReadingRules(context.Background(), 1, nil, map[string]float64{"temperature": 40}, "", false, time.Now())
+	if !alerted || controlled {
+		t.Fatalf("alert rules run %v, control rules run %v; want alerts only", alerted, controlled)
+	}
+}
@@ -20,6 +20,9 @@ interface BatchVitals {
   ageInDays: number;
   currentPopulation: number;
   totalMortality: number;
+  waterLiters: number;
+  feedKg: number;
+  waterToFeedRatio: number | null;
 }
 
 interface BatchEvent {
@@ -211,6 +214,39 @@ const Monitoring: React.FC<MonitoringProps> = ({ batch, onDataChange }) => {
               className="block w-full rounded-md border-gray-300 bg-gray-50"
             />
           </div>
+          <div>
+            <label className="block text-sm font-medium text-gray-700 mb-1">
+              Water Intake (metered)
+            </label>
+            <input
+              type="text"
+              readOnly
+              value={vitals ? `${vitals.waterLiters} L` : "N/A"}
+              className="block w-full rounded-md border-gray-300 bg-gray-50"
+            />
+          </div>
+          <div>
+            <label className="block text-sm font-medium text-gray-700 mb-1">
+              Feed Dispensed (metered)
+            </label>
+            <input
+              type="text"
+              readOnly
+              value={vitals ? `${vitals.feedKg} kg` : "N/A"}
+              className="block w-full rounded-md border-gray-300 bg-gray-50"
+            />
+          </div>
+          <div>
+            <label className="block text-sm font-medium text-gray-700 mb-1">
+              Water : Feed
+            </label>
+            <input
+              type="text"
+              readOnly
+              value={vitals?.waterToFeedRatio != null ? `${vitals.waterToFeedRatio} L/kg` : "N/A"}
+              className="block w-full rounded-md border-gray-300 bg-gray-50"
+            />
+          </div>
         </div>
       </div>
 
@@ -1,29 +1,179 @@
-import React, { useState } from "react";
+import React, { useEffect, useState } from "react";
+import axios from "axios";
 import { FaLightbulb, FaPills } from "react-icons/fa";
 import Light_Form from "./Auto_Forms/Light_Form";
 import Medicine_Form from "./Auto_Forms/Medicine_Form";
 
-const Automation_Form: React.FC<{ onClose: () => void }> = ({ onClose }) => {
+export interface CageOption {
+  CageID: number;
+  CageNum: number;
+  Name: string;
+  ControlMode: string;
+}
+
+interface GatewayOption {
+  id: string;
+  name?: string;
+  claimed?: boolean;
+  revoked?: boolean;
+}
+
+interface AutomationFormProps {
+  onClose: () => void;
+  cages?: CageOption[];
+}
+
+const serverHost = import.meta.env.VITE_APP_SERVERHOST?.replace(/\/+$/, "") || "";
+
+const pad = (n: number) => String(n).padStart(2, "0");
+const toHHMM = (d: Date) => `${pad(d.getHours())}:${pad(d.getMinutes())}`;
+const toISODate = (d: Date) => `${d.getFullYear()}-${pad(d.getMonth() + 1)}-${pad(d.getDate())}`;
+
+const Automation_Form: React.FC<AutomationFormProps> = ({ onClose, cages = [] }) => {
   const [showLightForm, setShowLightForm] = useState(false);
   const [showMedicineForm, setShowMedicineForm] = useState(false);
+  const [gateways, setGateways] = useState<GatewayOption[]>([]);
+  const [gatewayId, setGatewayId] = useState("");
+  const [deviceId, setDeviceId] = useState("");
+  const [relay, setRelay] = useState(1);
+  const [cageNum, setCageNum] = useState<number | null>(null);
+  const [saving, setSaving] = useState(false);
+  const [error, setError] = useState("");
+
+  useEffect(() => {
+    let cancelled = false;
+    axios
+      .get<GatewayOption[]>(`${serverHost}/api/iot/gateways`)
+      .then(({ data }) => {
+        if (cancelled) return;
+        const usable = (Array.isArray(data) ? data : []).filter((g) => g.claimed && !g.revoked);
+        setGateways(usable);
+        if (usable.length > 0) setGatewayId((cur) => cur || usable[0].id);
+      })
+      .catch((e: any) => {
+        if (!cancelled) setError(e?.response?.data?.error || e?.message || "Failed to load gateways");
+      });
+    return () => {
+      cancelled = true;
+    };
+  }, []);
+
+  const targetReady = gatewayId !== "" && deviceId.trim() !== "";
+
+  // Both forms end up as one schedule on the selected gateway relay
+  const saveSchedule = async (schedule: Record<string, unknown>) => {
+    if (!targetReady) {
+      setError("Choose a gateway and device first");
+      return;
+    }
+    setSaving(true);
+    setError("");
+    try {
+      await axios.post(`${serverHost}/api/automation/schedules`, {
+        ...schedule,
+        CageNum: cageNum,
+        GatewayID: gatewayId,
+        DeviceID: deviceId.trim(),
+        Relay: relay,
+        IsActive: true,
+      });
+      onClose();
+    } catch (e: any) {
+      setError(e?.response?.data?.error || e?.message || "Failed to save schedule");
+    } finally {
+      setSaving(false);
+    }
+  };
 
   const handleLightSave = (startTime: string, endTime: string) => {
-    console.log('Light schedule saved:', { startTime, endTime });
-    // Here you can add the logic to save the schedule
+    saveSchedule({
+      Name: `Lights ${startTime}-${endTime}`,
+      Kind: "light",
+      StartTime: startTime,
+      EndTime: endTime,
+      Recurrence: "daily",
+    });
   };
 
-  const handleMedicineSave = (dates: Date[]) => {
-    console.log('Medicine schedule saved for dates:', dates);
-    // Here you can add the logic to save the medicine schedule
+  const handleMedicineSave = (schedule: { date: Date; startTime: Date; endTime: Date }[]) => {
     setShowMedicineForm(false);
+    if (schedule.length === 0) return;
+    saveSchedule({
+      Name: `Medication (${schedule.length} day${schedule.length === 1 ? "" : "s"})`,
+      Kind: "medication",
+      StartTime: toHHMM(schedule[0].startTime),
+      EndTime: toHHMM(schedule[0].endTime),
+      Recurrence: "dates",
+      Dates: schedule.map((s) => toISODate(s.date)),
+    });
   };
 
   return (
     <div className="p-6">
+      <div className="grid grid-cols-1 gap-3 mb-6 text-sm">
+        <label className="flex flex-col">
+          <span className="font-medium text-gray-700 mb-1">Gateway</span>
+          <select
+            value={gatewayId}
+            onChange={(e) => setGatewayId(e.target.value)}
+            className="border border-gray-300 rounded-md px-2 py-1.5"
+          >
+            {gateways.length === 0 && <option value="">No claimed gateways</option>}
+            {gateways.map((g) => (
+              <option key={g.id} value={g.id}>
+                {g.name || g.id}
+              </option>
+            ))}
+          </select>
+        </label>
+        <div className="grid grid-cols-2 gap-3">
+          <label className="flex flex-col">
+            <span className="font-medium text-gray-700 mb-1">Device ID</span>
+            <input
+              value={deviceId}
+              onChange={(e) => setDeviceId(e.target.value)}
+              placeholder="e.g. relay-board-1"
+              className="border border-gray-300 rounded-md px-2 py-1.5"
+            />
+          </label>
+          <label className="flex flex-col">
+            <span className="font-medium text-gray-700 mb-1">Relay</span>
+            <select
+              value={relay}
+              onChange={(e) => setRelay(Number(e.target.value))}
+              className="border border-gray-300 rounded-md px-2 py-1.5"
+            >
+              {[1, 2, 3].map((n) => (
+                <option key={n} value={n}>
+                  Relay {n}
+                </option>
+              ))}
+            </select>
+          </label>
+        </div>
+        <label className="flex flex-col">
+          <span className="font-medium text-gray-700 mb-1">Cage</span>
+          <select
+            value={cageNum ?? ""}
+            onChange={(e) => setCageNum(e.target.value === "" ? null : Number(e.target.value))}
+            className="border border-gray-300 rounded-md px-2 py-1.5"
+          >
+            <option value="">All cages</option>
+            {cages.map((c) => (
+              <option key={c.CageID} value={c.CageNum}>
+                {c.Name || `Cage ${c.CageNum}`}
+              </option>
+            ))}
+          </select>
+        </label>
+        {error && <p className="text-red-600">{error}</p>}
+      </div>
+
       <div className="grid grid-cols-1 md:grid-cols-2 gap-6">
         <button
           onClick={() => setShowLightForm(true)}
-          className="flex flex-col items-center justify-center p-6 rounded-lg shadow-md transition-all duration-300 bg-white hover:bg-green-50 border border-gray-200"
+          disabled={!targetReady || saving}
+          className="flex flex-col items-center justify-center p-6 rounded-lg shadow-md transition-all duration-300 bg-white hover:bg-green-50 border border-gray-200 disabled:opacity-50 disabled:cursor-not-allowed"
         >
           <FaLightbulb className="text-4xl text-green-600 mb-2" />
           <span className="text-lg font-medium text-gray-800">Light</span>
@@ -31,7 +181,8 @@ const Automation_Form: React.FC<{ onClose: () => void }> = ({ onClose }) => {
 
         <button
           onClick={() => setShowMedicineForm(true)}
-          className="flex flex-col items-center justify-center p-6 rounded-lg shadow-md transition-all duration-300 bg-white hover:bg-green-50 border border-gray-200"
+          disabled={!targetReady || saving}
+          className="flex flex-col items-center justify-center p-6 rounded-lg shadow-md transition-all duration-300 bg-white hover:bg-green-50 border border-gray-200 disabled:opacity-50 disabled:cursor-not-allowed"
         >
           <FaPills className="text-4xl text-green-600 mb-2" />
           <span className="text-lg font-medium text-gray-800">Medicine</span>
@@ -68,13 +68,17 @@ const AddDevice: React.FC<AddDeviceProps> = ({ isOpen, onClose, onAddDevice }) =
 
   const handleClaim = async (gateway: Gateway) => {
     if (claimingId || gateway.claimed) return;  // Prevent multiple claims
+    // The gateway shows a one-time pairing code on its display / serial console
+    const code = window.prompt(`Enter the pairing code shown on ${gateway.name || gateway.id}`);
+    if (!code) return;
     setClaimingId(gateway.id);
     setError("");
     try {
-      await axios.post(`${serverHost}/api/iot/gateways/${gateway.id}/claim`);
+      await axios.post(`${serverHost}/api/iot/gateways/${gateway.id}/claim`, { code: code.trim() });
       onAddDevice(gateway.id, "gateway");
     } catch (e: any) {
       setError(
+        e?.response?.data?.error ||
         e?.response?.data?.message ||
         e?.message ||
         "Failed to claim gateway"
@@ -24,6 +24,7 @@ const Environmental: React.FC = () => {
       <ToggleManualAutoMode 
         isAuto={isAutoMode} 
         onToggle={setIsAutoMode}
+        onModeLoaded={setIsAutoMode}
         className="fixed top-4 right-4 z-50"
       />
       
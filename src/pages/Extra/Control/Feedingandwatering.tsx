@@ -13,10 +13,14 @@ const Feedingandwatering: React.FC = () => {
   const [waterState, setWaterState] = useState<string>("Empty");
   const [isAutoMode, setIsAutoMode] = useState<boolean>(true);
   const [activeTab, setActiveTab] = useState<string>("Control");
-  const [wateringIp, setWateringIp] = useState<string>("");
-  const [feedingIp, setFeedingIp] = useState<string>("");
-  const [medicineIp, setMedicineIp] = useState<string>("");
+  const [wateringId, setWateringId] = useState<number | null>(null);
+  const [feedingId, setFeedingId] = useState<number | null>(null);
+  const [medicineId, setMedicineId] = useState<number | null>(null);
   const serverHost = import.meta.env.VITE_APP_SERVERHOST;
+  // devices are reached through the backend proxy, never directly on the LAN;
+  // null until the device is registered, callers skip the request then
+  const deviceUrl = (id: number | null, path: string) =>
+    id === null ? null : `${serverHost}/api/iot/devices/${id}/${path}`;
 
 
   // Map tab names to components
@@ -26,26 +30,22 @@ const Feedingandwatering: React.FC = () => {
   };
 
   React.useEffect(() => {
-    axios.get(`http://${wateringIp}/telemetry`)
-      .then(response => {
-        const data = response.data;
-        setRelayState({
-          relay1: data.relay1,
-          relay2: data.relay2,
-          relay3: data.relay3
-        });
-      })
-      .catch(error => {
-        console.error("Error fetching telemetry data:", error);
-      });
-
     axios.get(`${serverHost}/api/iot/manageDevices`)
       .then(response => {
         const devices = response.data;
-        devices.forEach((device: { deviceType: string; ipAddress: string }) => {
-          if (device.deviceType === "Watering") setWateringIp(device.ipAddress);
-          else if (device.deviceType === "Feeding") setFeedingIp(device.ipAddress);
-          else if (device.deviceType === "Medicine") setMedicineIp(device.ipAddress);
+        devices.forEach((device: { id: number; deviceType: string; telemetry?: { relay1: number; relay2: number; relay3: number } }) => {
+          if (device.deviceType === "Watering") {
+            setWateringId(device.id);
+            if (device.telemetry) {
+              setRelayState({
+                relay1: device.telemetry.relay1,
+                relay2: device.telemetry.relay2,
+                relay3: device.telemetry.relay3
+              });
+            }
+          }
+          else if (device.deviceType === "Feeding") setFeedingId(device.id);
+          else if (device.deviceType === "Medicine") setMedicineId(device.id);
         });
       })
       .catch(error => {
@@ -65,37 +65,26 @@ const Feedingandwatering: React.FC = () => {
   };
   
   const postModeChange = (mode: string) => {
-    Promise.all([
-      axios.post(`http://${wateringIp}/set-relays`, {
-        relay1: 0,
-        relay2: 0,
-        relay3: 0,
-        mode: mode,
-      }),
-      axios.post(`http://${medicineIp}/set-relays`, {
-        relay1: 0,
-        relay2: 0,
-        relay3: 0,
-        mode: mode,
-      }),
-      axios.post(`http://${feedingIp}/mode`, { mode: mode })
-    ])
-      .then(([wateringResponse, medicineResponse, feedingRespons]) => {
-        console.log("Watering response:", wateringResponse.data);
-        console.log("Medicine response:", medicineResponse.data);
-        console.log("Feeding response:", feedingRespons.data);
-      })
+    const relaysOff = { relay1: 0, relay2: 0, relay3: 0, mode: mode };
+    const requests: [string | null, object][] = [
+      [deviceUrl(wateringId, "relays"), relaysOff],
+      [deviceUrl(medicineId, "relays"), relaysOff],
+      [deviceUrl(feedingId, "mode"), { mode: mode }],
+    ];
+    Promise.all(requests.filter(([url]) => url !== null).map(([url, body]) => axios.post(url!, body)))
       .catch((error) => console.error("Error changing mode:", error));
   };
 
   
   // Rotate servo for feed buttons
   const handleFeedRotate = async (relay: number) => {
+    const url = deviceUrl(feedingId, "rotate-servo");
+    if (!url) return;
     try {
       const { data } = await axios.post(
-        `http://${feedingIp}/rotate-servo`,
+        url,
         { relay },
-        { headers: { "Content-Type": "application/json" }, timeout: 3000 }
+        { headers: { "Content-Type": "application/json" }, timeout: 6000 }
       );
       console.log("Relay triggered:", data); // { success: true, relay: n }
     } catch (err: any) {
@@ -107,23 +96,25 @@ const Feedingandwatering: React.FC = () => {
 
 
   const handleWaterToggle = (relayNum: number) => {
-    if (isAutoMode) return;
+    const url = deviceUrl(wateringId, "relays");
+    if (isAutoMode || !url) return;
     const newState = { ...relayState };
     newState[`relay${relayNum}` as keyof typeof newState] =
       relayState[`relay${relayNum}` as keyof typeof newState] ? 0 : 1;
     setRelayState(newState);
-    axios.post(`http://${wateringIp}/set-relays`, newState)
+    axios.post(url, newState)
       .then(response => console.log("Watering successful:", response.data))
       .catch(error => console.error("Error watering:", error));
   };
 
   const handleMedecine = (relayNum: number) => {
-    if (isAutoMode) return;
+    const url = deviceUrl(medicineId, "relays");
+    if (isAutoMode || !url) return;
     const newState = { ...medRelayState };
     newState[`relay_med${relayNum}` as keyof typeof newState] =
       medRelayState[`relay_med${relayNum}` as keyof typeof newState] ? 0 : 1;
     setMedRelayState(newState);
-    axios.post(`http://${medicineIp}/set-relays`, newState)
+    axios.post(url, newState)
       .then(response => console.log("Medicine relay toggled:", response.data))
       .catch(error => console.error("Error toggling medicine relay:", error));
   };
@@ -133,6 +124,7 @@ const Feedingandwatering: React.FC = () => {
       <ToggleManualAutoMode
         isAuto={isAutoMode}
         onToggle={handleToggleMode}
+        onModeLoaded={setIsAutoMode}
         className="absolute right-4 top-4"
       />
 
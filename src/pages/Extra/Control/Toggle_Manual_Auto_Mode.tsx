@@ -1,13 +1,16 @@
 import React, { useState, useEffect } from 'react';
 import { Calendar, Plus } from 'lucide-react';
-import Automation_Form from './Automation/Automation_Form';
+import Automation_Form, { CageOption } from './Automation/Automation_Form';
 import Add_Device from './Device_Forms/Add_Device';
-import { a } from 'framer-motion/client';
 import axios from 'axios';
 
+const serverHost = import.meta.env.VITE_APP_SERVERHOST?.replace(/\/+$/, '') || '';
+
 interface ToggleManualAutoModeProps {
   isAuto: boolean;
   onToggle: (isAuto: boolean) => void;
+  // Called once with the mode stored on the cages, without switching anything
+  onModeLoaded?: (isAuto: boolean) => void;
   label?: string;
   className?: string;
   disabled?: boolean;
@@ -16,6 +19,7 @@ interface ToggleManualAutoModeProps {
 const ToggleManualAutoMode: React.FC<ToggleManualAutoModeProps> = ({
   isAuto: externalIsAuto,
   onToggle,
+  onModeLoaded,
   label = 'Control Mode',
   className = '',
   disabled = false
@@ -23,16 +27,53 @@ const ToggleManualAutoMode: React.FC<ToggleManualAutoModeProps> = ({
   const [isAuto, setIsAuto] = useState(externalIsAuto);
   const [showSchedule, setShowSchedule] = useState(false);
   const [showAddDevice, setShowAddDevice] = useState(false);
+  const [cages, setCages] = useState<CageOption[]>([]);
+  const [saving, setSaving] = useState(false);
+  const [error, setError] = useState('');
   // Sync with external state
   useEffect(() => {
     setIsAuto(externalIsAuto);
   }, [externalIsAuto]);
 
-  const handleToggle = () => {
-    if (!disabled) {
-      const newMode = !isAuto;
+  // The farm is shown as auto only when every cage is in auto mode
+  useEffect(() => {
+    let cancelled = false;
+    axios
+      .get<CageOption[]>(`${serverHost}/api/cages`)
+      .then(({ data }) => {
+        if (cancelled) return;
+        const list = Array.isArray(data) ? data : [];
+        setCages(list);
+        const auto = list.length > 0 && list.every((c) => c.ControlMode === 'auto');
+        setIsAuto(auto);
+        onModeLoaded?.(auto);
+      })
+      .catch((e: any) => {
+        if (!cancelled) setError(e?.response?.data?.error || e?.message || 'Failed to load cages');
+      });
+    return () => {
+      cancelled = true;
+    };
+    // eslint-disable-next-line react-hooks/exhaustive-deps
+  }, []);
+
+  const handleToggle = async () => {
+    if (disabled || saving) return;
+    const newMode = !isAuto;
+    const mode = newMode ? 'auto' : 'manual';
+    setSaving(true);
+    setError('');
+    try {
+      await Promise.all(
+        cages.map((c) => axios.put(`${serverHost}/api/cages/${c.CageID}/mode`, { mode }))
+      );
+      setCages((prev) => prev.map((c) => ({ ...c, ControlMode: mode })));
       setIsAuto(newMode);
       onToggle(newMode);
+    } catch (e: any) {
+      setError(e?.response?.data?.error || e?.message || 'Failed to change control mode');
+    } finally {
+      setSaving(false);
     }
   };
 
@@ -52,10 +93,9 @@ const ToggleManualAutoMode: React.FC<ToggleManualAutoModeProps> = ({
     setShowAddDevice(false);
   };
 
-  // Store added device info to backend
-  const handleAddDevice = (ipAddress: string, deviceType: string) => {
-    console.log('Adding device:', { ipAddress, deviceType });
-   
+  // Claiming in Add_Device already registered the gateway, just close the modal
+  const handleAddDevice = () => {
+    setShowAddDevice(false);
   };
 
   return (
@@ -77,7 +117,7 @@ const ToggleManualAutoMode: React.FC<ToggleManualAutoModeProps> = ({
               } ${disabled ? 'opacity-50 cursor-not-allowed' : ''}`}
               onClick={handleToggle}
               aria-pressed={isAuto}
-              disabled={disabled}
+              disabled={disabled || saving}
             >
               <span
                 className={`inline-block h-5 w-5 transform rounded-full bg-white transition-transform ${
@@ -86,6 +126,7 @@ const ToggleManualAutoMode: React.FC<ToggleManualAutoModeProps> = ({
               />
             </button>
           </div>
+          {error && <span className="text-xs text-red-600">{error}</span>}
           
           <div className="flex space-x-2">
             <button
@@ -153,7 +194,7 @@ const ToggleManualAutoMode: React.FC<ToggleManualAutoModeProps> = ({
               </button>
             </div>
             <div className="p-4">
-              <Automation_Form onClose={handleCloseSchedule} />
+              <Automation_Form onClose={handleCloseSchedule} cages={cages} />
             </div>
           </div>
         </div>